@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"sort"
 
 	"strings"
 
+	"torpedobot/multibot"
+
 	common "github.com/tb0hdan/torpedo_common"
 	"github.com/tb0hdan/torpedo_registry"
 )
@@ -13,20 +16,36 @@ func HelpProcessMessage(api *torpedo_registry.BotAPI, channel interface{}, incom
 	var message string
 	_, command, _ := common.GetRequestedFeature(incoming_message)
 	if command == "" {
-		idx := 0
-		message = "Available commands: "
+		commands := make([]string, 0)
 		for command := range torpedo_registry.Config.GetHandlers() {
-			if idx == 0 {
-				message += fmt.Sprintf("`%s%s`", api.CommandPrefix, command)
-			} else {
-				message += fmt.Sprintf(", `%s%s`", api.CommandPrefix, command)
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+		aliases := multibot.CommandAliases()
+		message = "Available commands: "
+		for idx, command := range commands {
+			if idx > 0 {
+				message += ", "
+			}
+			message += fmt.Sprintf("`%s%s`", api.CommandPrefix, command)
+			// aliases are listed along with their command
+			if len(aliases[command]) > 0 {
+				names := make([]string, 0, len(aliases[command]))
+				for _, alias := range aliases[command] {
+					names = append(names, fmt.Sprintf("`%s%s`", api.CommandPrefix, alias))
+				}
+				message += fmt.Sprintf(" (%s)", strings.Join(names, ", "))
 			}
-			idx += 1
 		}
+	} else if words := strings.Fields(command); multibot.GetCommand(strings.TrimLeft(words[0], api.CommandPrefix)) != nil {
+		// declared command, print real usage
+		cmd := multibot.GetCommand(strings.TrimLeft(words[0], api.CommandPrefix))
+		message = cmd.Usage(api.CommandPrefix, append([]string{cmd.Name}, words[1:]...)...)
 	} else {
 		message = "No help available yet"
+		name := multibot.ResolveAlias(strings.TrimLeft(command, api.CommandPrefix))
 		for help := range torpedo_registry.Config.GetHelp() {
-			if strings.TrimLeft(command, api.CommandPrefix) == help {
+			if name == help {
 				message = api.Bot.GetHelp()[help]
 				break
 			}
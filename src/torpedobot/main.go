@@ -27,14 +27,26 @@ func main() {
 
 	// Help handlers
 	help_msg := "Get help using this command"
-	torpedo_registry.Config.RegisterHelpAndHandler("?", help_msg, HelpProcessMessage)
-	torpedo_registry.Config.RegisterHelpAndHandler("h", help_msg, HelpProcessMessage)
 	torpedo_registry.Config.RegisterHelpAndHandler("help", help_msg, HelpProcessMessage)
+	multibot.RegisterAlias("?", "help")
+	multibot.RegisterAlias("h", "help")
 	torpedo_registry.Config.RegisterHelpAndHandler("stats", "Just system stats, nothing interesting", StatsProcessMessage)
 	torpedo_registry.Config.RegisterHelpAndHandler("chatinfo", "Chat/DM information", ChatInfoProcessMessage)
 
 	bot := multibot.New()
 	bot.SetBuildInfo(BUILD, BUILD_DATE, GO_VERSION, VERSION, ProjectURL)
+	multibot.RegisterCommand(bot.AliasCommand())
+	multibot.RegisterCommand(bot.BlacklistCommand())
+	for _, command := range bot.ACLCommands() {
+		multibot.RegisterCommand(command)
+	}
+	multibot.RegisterCommand(bot.BridgeCommand())
+	for _, command := range bot.SchedulerCommands() {
+		multibot.RegisterCommand(command)
+	}
+	for _, command := range bot.HistoryCommands() {
+		multibot.RegisterCommand(command)
+	}
 	// bot cfg
 	// plugins/protocols
 	torpedo_registry.Config.RegisterParser("slack", bot.ConfigureSlackBot, bot.ParseSlackBot)
@@ -47,13 +59,34 @@ func main() {
 	torpedo_registry.Config.RegisterParser("matrix", bot.ConfigureMatrixBot, bot.ParseMatrixBot)
 	torpedo_registry.Config.RegisterParser("facebook", bot.ConfigureFacebookBot, bot.ParseFacebookBot)
 	torpedo_registry.Config.RegisterParser("irc", bot.ConfigureIRCBot, bot.ParseIRCBot)
+	torpedo_registry.Config.RegisterParser("console", bot.ConfigureConsoleBot, bot.ParseConsoleBot)
+	torpedo_registry.Config.RegisterParser("webhook", bot.ConfigureWebhook, bot.ParseWebhook)
+
+	// transports
+	bot.RegisterProtocol("slack", bot.NewSlackProtocol)
+	bot.RegisterProtocol("telegram", bot.NewTelegramProtocol)
+	bot.RegisterProtocol("jabber", bot.NewJabberProtocol)
+	bot.RegisterProtocol("skype", bot.NewSkypeProtocol)
+	bot.RegisterProtocol("teams", bot.NewTeamsProtocol)
+	bot.RegisterProtocol("kik", bot.NewKikProtocol)
+	bot.RegisterProtocol("line", bot.NewLineProtocol)
+	bot.RegisterProtocol("matrix", bot.NewMatrixProtocol)
+	bot.RegisterProtocol("facebook", bot.NewFacebookProtocol)
+	bot.RegisterProtocol("irc", bot.NewIRCProtocol)
+	bot.RegisterProtocol("console", bot.NewConsoleProtocol)
 
 	// internals
 	torpedo_registry.Config.RegisterParser("debug", bot.ConfigureDebug, bot.ParseDebug)
+	torpedo_registry.Config.RegisterParser("config", bot.ConfigureConfigFile, bot.ParseConfigFile)
+	torpedo_registry.Config.RegisterParser("prefix", bot.ConfigureCommandPrefix, bot.ParseCommandPrefix)
+	torpedo_registry.Config.RegisterParser("admins", bot.ConfigureAdmins, bot.ParseAdmins)
 	torpedo_registry.Config.RegisterParser("apiaddr", bot.ConfigureHTTPAPI, bot.ParseHTTPAPI)
 	torpedo_registry.Config.RegisterParser("mongodb", bot.ConfigureMongoDBPlugin, bot.ParseMongoDBPlugin)
+	torpedo_registry.Config.RegisterParser("store", bot.ConfigureStore, bot.ParseStore)
 	torpedo_registry.Config.RegisterParser("trpe", bot.ConfigureTRPE, bot.ParseTRPE)
 	torpedo_registry.Config.RegisterParser("list_handlers", bot.ConfigureListPlugins, bot.ParseListPlugins)
+	torpedo_registry.Config.RegisterParser("shutdown", bot.ConfigureShutdown, bot.ParseShutdown)
+	torpedo_registry.Config.RegisterParser("attachments", bot.ConfigureAttachments, bot.ParseAttachments)
 
 	bot.RunPreParsers()
 	flag.Parse()
@@ -64,21 +97,34 @@ func main() {
 		logger := cu.NewLog("torpedo-bot")
 		logger.Println(torpedo_registry.Config.GetConfig())
 	}
-	bot.RunBotsCSV(bot.RunSlackBot, torpedo_registry.Config.GetConfig()["slackapikey"], "!")
-	bot.RunBotsCSV(bot.RunTelegramBot, torpedo_registry.Config.GetConfig()["telegramapikey"], "/")
-	bot.RunBotsCSV(bot.RunJabberBot, torpedo_registry.Config.GetConfig()["jabberapikey"], "!")
-	bot.RunBotsCSV(bot.RunSkypeBot, torpedo_registry.Config.GetConfig()["skypeapikey"], "!")
-	bot.RunBotsCSV(bot.RunTeamsBot, torpedo_registry.Config.GetConfig()["teamsapikey"], "!")
-	bot.RunBotsCSV(bot.RunKikBot, torpedo_registry.Config.GetConfig()["kikapikey"], "!")
-	bot.RunBotsCSV(bot.RunLineBot, torpedo_registry.Config.GetConfig()["lineapikey"], "!")
-	bot.RunBotsCSV(bot.RunMatrixBot, torpedo_registry.Config.GetConfig()["matrixapikey"], "!")
-	bot.RunBotsCSV(bot.RunFacebookBot, torpedo_registry.Config.GetConfig()["facebookapikey"], "!")
-	bot.RunBotsCSV(bot.RunIRCBot, torpedo_registry.Config.GetConfig()["ircapikey"], "!")
+	if err := bot.OpenStore(); err != nil {
+		cu := &common.Utils{}
+		cu.NewLog("torpedo-bot").Fatalf("Could not open storage: %+v\n", err)
+	}
+	if torpedo_registry.Config.GetConfig()["configfile"] != "" {
+		if err := bot.ReloadConfig(); err != nil {
+			cu := &common.Utils{}
+			cu.NewLog("torpedo-bot").Fatalf("Could not load config: %+v\n", err)
+		}
+	}
+	bot.RunBotsCSV("slack", torpedo_registry.Config.GetConfig()["slackapikey"])
+	bot.RunBotsCSV("telegram", torpedo_registry.Config.GetConfig()["telegramapikey"])
+	bot.RunBotsCSV("jabber", torpedo_registry.Config.GetConfig()["jabberapikey"])
+	bot.RunBotsCSV("skype", torpedo_registry.Config.GetConfig()["skypeapikey"])
+	bot.RunBotsCSV("teams", torpedo_registry.Config.GetConfig()["teamsapikey"])
+	bot.RunBotsCSV("kik", torpedo_registry.Config.GetConfig()["kikapikey"])
+	bot.RunBotsCSV("line", torpedo_registry.Config.GetConfig()["lineapikey"])
+	bot.RunBotsCSV("matrix", torpedo_registry.Config.GetConfig()["matrixapikey"])
+	bot.RunBotsCSV("facebook", torpedo_registry.Config.GetConfig()["facebookapikey"])
+	bot.RunBotsCSV("irc", torpedo_registry.Config.GetConfig()["ircapikey"])
+	if torpedo_registry.Config.GetConfig()["console"] == "yes" {
+		bot.RunBotsCSV("console", "console")
+	}
 
 	// start plugin coroutines (if any) after connecting to accounts
 	bot.RunCoroutines()
 	// start HTTP API Server
 	bot.RunHTTPAPI()
 	// start eternal loop
-	bot.RunLoop()
+	os.Exit(bot.RunLoop())
 }
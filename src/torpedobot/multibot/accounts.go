@@ -0,0 +1,246 @@
+package multibot
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// BotAccount - registered account along with protocol name and running protocol instance
+type BotAccount struct {
+	ID       int
+	Protocol string
+	Account  *torpedo_registry.Account
+	// Prefixes - command prefixes, first one is also set as Account.CommandPrefix
+	Prefixes []string
+	// Rooms - rooms to join on connect in addition to stored ones
+	Rooms []string
+	// Plugins - per-account plugin settings
+	Plugins map[string]map[string]string
+	// configured - account comes from config file and is managed by ReloadConfig
+	configured bool
+	removed    bool
+	proto      Protocol
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// AddAccount - register account in bot and torpedo_registry
+func (tb *TorpedoBot) AddAccount(protocol string, account *torpedo_registry.Account) (ba *BotAccount) {
+	torpedo_registry.Accounts.AppendAccounts(account)
+	tb.accountsLock.Lock()
+	defer tb.accountsLock.Unlock()
+	ba = &BotAccount{ID: tb.nextAccountID, Protocol: protocol, Account: account, Prefixes: []string{account.CommandPrefix}}
+	ba.ctx, ba.cancel = context.WithCancel(tb.ctx)
+	tb.nextAccountID += 1
+	tb.botAccounts = append(tb.botAccounts, ba)
+	tb.updateStats(func(stats *BotStats) { stats.TotalAccounts += 1 })
+	return
+}
+
+// GetAccounts - list registered accounts
+func (tb *TorpedoBot) GetAccounts() (accounts []*BotAccount) {
+	tb.accountsLock.RLock()
+	defer tb.accountsLock.RUnlock()
+	accounts = make([]*BotAccount, len(tb.botAccounts))
+	copy(accounts, tb.botAccounts)
+	return
+}
+
+func (tb *TorpedoBot) GetAccount(id int) (ba *BotAccount, err error) {
+	tb.accountsLock.RLock()
+	defer tb.accountsLock.RUnlock()
+	for _, item := range tb.botAccounts {
+		if item.ID == id {
+			ba = item
+			return
+		}
+	}
+	err = fmt.Errorf("no such account: %d", id)
+	return
+}
+
+func (tb *TorpedoBot) findAccount(account *torpedo_registry.Account) *BotAccount {
+	for _, ba := range tb.botAccounts {
+		if ba.Account == account {
+			return ba
+		}
+	}
+	return nil
+}
+
+// RemoveAccount - disconnect account, it's forgotten once its supervisor exits
+func (tb *TorpedoBot) RemoveAccount(id int) (err error) {
+	ba, err := tb.GetAccount(id)
+	if err != nil {
+		return
+	}
+	tb.accountsLock.Lock()
+	ba.removed = true
+	tb.accountsLock.Unlock()
+	ba.cancel()
+	return
+}
+
+// forgetAccount - drop removed account from account list
+func (tb *TorpedoBot) forgetAccount(account *torpedo_registry.Account) {
+	tb.accountsLock.Lock()
+	defer tb.accountsLock.Unlock()
+	for idx, ba := range tb.botAccounts {
+		if ba.Account == account && ba.removed {
+			tb.botAccounts = append(tb.botAccounts[:idx], tb.botAccounts[idx+1:]...)
+			tb.updateStats(func(stats *BotStats) { stats.TotalAccounts -= 1 })
+			return
+		}
+	}
+}
+
+// accountContext - context cancelled when account is removed or bot is shutting down
+func (tb *TorpedoBot) accountContext(account *torpedo_registry.Account) context.Context {
+	tb.accountsLock.RLock()
+	defer tb.accountsLock.RUnlock()
+	if ba := tb.findAccount(account); ba != nil {
+		return ba.ctx
+	}
+	return tb.ctx
+}
+
+// AccountRooms - rooms configured for account followed by stored rooms, key is protocol specific (server, JID)
+func (tb *TorpedoBot) AccountRooms(account *torpedo_registry.Account, protocol, key string) (rooms []string) {
+	seen := make(map[string]bool)
+	tb.accountsLock.RLock()
+	if ba := tb.findAccount(account); ba != nil {
+		for _, room := range ba.Rooms {
+			if !seen[room] {
+				seen[room] = true
+				rooms = append(rooms, room)
+			}
+		}
+	}
+	tb.accountsLock.RUnlock()
+	for _, room := range tb.GetRooms(protocol, key) {
+		if !seen[room] {
+			seen[room] = true
+			rooms = append(rooms, room)
+		}
+	}
+	return
+}
+
+// SetAccountPrefixes - replace account command prefixes, empty ones are ignored
+func (tb *TorpedoBot) SetAccountPrefixes(account *torpedo_registry.Account, prefixes []string) {
+	valid := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix != "" {
+			valid = append(valid, prefix)
+		}
+	}
+	if len(valid) == 0 {
+		return
+	}
+	tb.accountsLock.Lock()
+	defer tb.accountsLock.Unlock()
+	if ba := tb.findAccount(account); ba != nil {
+		ba.Prefixes = valid
+		account.CommandPrefix = valid[0]
+	}
+}
+
+func (tb *TorpedoBot) AccountPrefixes(account *torpedo_registry.Account) (prefixes []string) {
+	tb.accountsLock.RLock()
+	defer tb.accountsLock.RUnlock()
+	if ba := tb.findAccount(account); ba != nil {
+		prefixes = append(prefixes, ba.Prefixes...)
+	}
+	return
+}
+
+// PluginSettings - per-account plugin settings from config file, nil if none
+func (tb *TorpedoBot) PluginSettings(account *torpedo_registry.Account, plugin string) (settings map[string]string) {
+	tb.accountsLock.RLock()
+	defer tb.accountsLock.RUnlock()
+	if ba := tb.findAccount(account); ba != nil && ba.Plugins != nil {
+		settings = ba.Plugins[plugin]
+	}
+	return
+}
+
+// AccountProtocol - protocol name account was registered with
+func (tb *TorpedoBot) AccountProtocol(account *torpedo_registry.Account) (protocol string) {
+	tb.accountsLock.RLock()
+	defer tb.accountsLock.RUnlock()
+	if ba := tb.findAccount(account); ba != nil {
+		protocol = ba.Protocol
+	}
+	return
+}
+
+// setAccountProtocol - remember protocol instance serving account, nil when disconnected
+func (tb *TorpedoBot) setAccountProtocol(account *torpedo_registry.Account, proto Protocol) {
+	tb.accountsLock.Lock()
+	defer tb.accountsLock.Unlock()
+	for _, ba := range tb.botAccounts {
+		if ba.Account == account {
+			ba.proto = proto
+		}
+	}
+}
+
+// connectedAccount - connected account of protocol, account with given ID if it is still there
+func (tb *TorpedoBot) connectedAccount(protocol string, id int) (proto Protocol, account *torpedo_registry.Account) {
+	tb.accountsLock.RLock()
+	defer tb.accountsLock.RUnlock()
+	for _, ba := range tb.botAccounts {
+		if ba.Protocol != protocol || ba.removed || ba.proto == nil {
+			continue
+		}
+		if proto == nil || ba.ID == id {
+			proto, account = ba.proto, ba.Account
+		}
+		if ba.ID == id {
+			break
+		}
+	}
+	return
+}
+
+// connectedAccountByKey - connected account of protocol by WebhookAccountID
+func (tb *TorpedoBot) connectedAccountByKey(protocol, key string) (proto Protocol, account *torpedo_registry.Account) {
+	tb.accountsLock.RLock()
+	defer tb.accountsLock.RUnlock()
+	for _, ba := range tb.botAccounts {
+		if ba.Protocol == protocol && !ba.removed && ba.proto != nil && WebhookAccountID(ba.Account) == key {
+			return ba.proto, ba.Account
+		}
+	}
+	return
+}
+
+// SendMessage - post unsolicited message to channel using account's current connection, returns platform message ID
+func (tb *TorpedoBot) SendMessage(id int, channel interface{}, message string) (message_id string, err error) {
+	ba, err := tb.GetAccount(id)
+	if err != nil {
+		return
+	}
+	tb.accountsLock.RLock()
+	proto := ba.proto
+	tb.accountsLock.RUnlock()
+	if proto == nil {
+		err = fmt.Errorf("account %d is not connected", id)
+		return
+	}
+	// protocols expect channel type they produce themselves, don't let bad input kill the bot
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s could not send to `%v`: %v", ba.Protocol, channel, r)
+		}
+	}()
+	botApi, err := tb.NewOutboundAPI(proto, ba.Account)
+	if err != nil {
+		err = fmt.Errorf("%s can't send messages on its own: %+v", ba.Protocol, err)
+		return
+	}
+	message_id, err = botApi.Send(&Message{Channel: channel, Text: message})
+	return
+}
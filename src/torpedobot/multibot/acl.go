@@ -0,0 +1,433 @@
+package multibot
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	common "github.com/tb0hdan/torpedo_common"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// Role - user permissions level, roles compare by privileges: banned < user < admin < owner
+type Role int
+
+const (
+	RoleBanned Role = iota - 1
+	// RoleUser - default role, zero value
+	RoleUser
+	RoleAdmin
+	RoleOwner
+)
+
+var roleNames = map[Role]string{
+	RoleBanned: "banned",
+	RoleUser:   "user",
+	RoleAdmin:  "admin",
+	RoleOwner:  "owner",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole - role by name
+func ParseRole(name string) (role Role, err error) {
+	for role, role_name := range roleNames {
+		if strings.EqualFold(name, role_name) {
+			return role, nil
+		}
+	}
+	err = fmt.Errorf("Unknown role `%s`, valid roles are banned, user, admin and owner", name)
+	return
+}
+
+func (r *Role) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var name string
+	if err = unmarshal(&name); err != nil {
+		return
+	}
+	*r, err = ParseRole(name)
+	return
+}
+
+// ACLConfig - `acl` section of config file
+type ACLConfig struct {
+	// Owners, Admins, Banned - user IDs, `protocol:ID` or just `ID` for any protocol
+	Owners []string `yaml:"owners"`
+	Admins []string `yaml:"admins"`
+	Banned []string `yaml:"banned"`
+	// Commands - role required to run command or subcommand (`alias add`), overrides plugin defaults
+	Commands map[string]Role `yaml:"commands"`
+	// Rules - checked in order before command roles, first matching rule wins
+	Rules []ACLRule `yaml:"rules"`
+}
+
+// ACLRule - allow or deny command in channel
+type ACLRule struct {
+	// Action - allow or deny
+	Action string `yaml:"action"`
+	// Command - command name or `command subcommand`, any command if empty or `*`
+	Command string `yaml:"command"`
+	// Channel - `protocol:channel` (see ChannelKey), any channel if empty or `*`
+	Channel string `yaml:"channel"`
+	// Role - rule applies to users with this role and below, admin if unset. Owners are never affected.
+	Role *Role `yaml:"role"`
+}
+
+// Validate - check rule action
+func (rule *ACLRule) Validate() error {
+	if rule.Action != "allow" && rule.Action != "deny" {
+		return fmt.Errorf("acl rule action should be allow or deny, got `%s`", rule.Action)
+	}
+	return nil
+}
+
+func (rule *ACLRule) matches(command, channel string, role Role) bool {
+	max_role := RoleAdmin
+	if rule.Role != nil {
+		max_role = *rule.Role
+	}
+	if role > max_role {
+		return false
+	}
+	if rule.Channel != "" && rule.Channel != "*" && rule.Channel != channel {
+		return false
+	}
+	return rule.Command == "" || rule.Command == "*" || rule.Command == command || strings.HasPrefix(command, rule.Command+" ")
+}
+
+var (
+	// commandRoles - roles required by plugins, see RequireRole
+	commandRoles     = make(map[string]Role)
+	commandRolesLock sync.RWMutex
+
+	Owners *string
+	Admins *string
+)
+
+// RequireRole - only users with this role or higher may run command, e.g. RequireRole("blacklist", RoleAdmin).
+// Subcommands are set as `command subcommand`. Config file `acl.commands` take precedence.
+func RequireRole(command string, role Role) {
+	commandRolesLock.Lock()
+	defer commandRolesLock.Unlock()
+	commandRoles[strings.ToLower(command)] = role
+}
+
+func (tb *TorpedoBot) ConfigureAdmins(cfg *torpedo_registry.ConfigStruct) {
+	Owners = flag.String("owners", "", "Comma separated list of bot owner IDs (protocol:ID or ID), owners can grant admin role")
+	Admins = flag.String("admins", "", "Comma separated list of admin IDs (protocol:ID or ID)")
+}
+
+func (tb *TorpedoBot) ParseAdmins(cfg *torpedo_registry.ConfigStruct) {
+	cfg.SetConfig("owners", *Owners)
+	if cfg.GetConfig()["owners"] == "" {
+		cfg.SetConfig("owners", common.GetStripEnv("TORPEDO_OWNERS"))
+	}
+	cfg.SetConfig("admins", *Admins)
+	if cfg.GetConfig()["admins"] == "" {
+		cfg.SetConfig("admins", common.GetStripEnv("TORPEDO_ADMINS"))
+	}
+}
+
+func (tb *TorpedoBot) setACL(acl ACLConfig) {
+	tb.aclLock.Lock()
+	defer tb.aclLock.Unlock()
+	tb.acl = acl
+}
+
+// UserKey - user identifier for roles
+func UserKey(protocol, user string) string {
+	return protocol + ":" + user
+}
+
+func userListed(list []string, protocol, user string) bool {
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == user || item == UserKey(protocol, user) {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredRole - role set with flags or config file, these can't be changed with `grant`
+func (tb *TorpedoBot) configuredRole(protocol, user string) (role Role, ok bool) {
+	cfg := torpedo_registry.Config.GetConfig()
+	tb.aclLock.Lock()
+	acl := tb.acl
+	tb.aclLock.Unlock()
+	switch {
+	case userListed(strings.Split(cfg["owners"], ","), protocol, user) || userListed(acl.Owners, protocol, user):
+		return RoleOwner, true
+	case userListed(acl.Banned, protocol, user):
+		return RoleBanned, true
+	case userListed(strings.Split(cfg["admins"], ","), protocol, user) || userListed(acl.Admins, protocol, user):
+		return RoleAdmin, true
+	}
+	return
+}
+
+// storedRoles - roles granted at runtime, loaded from storage on first use. Call with aclLock held.
+func (tb *TorpedoBot) storedRoles() map[string]Role {
+	if tb.roles != nil {
+		return tb.roles
+	}
+	tb.roles = make(map[string]Role)
+	if tb.Store == nil {
+		return tb.roles
+	}
+	stored, err := tb.Store.GetRoles()
+	if err != nil {
+		tb.logger.Printf("Could not get roles: %+v\n", err)
+	}
+	for user, name := range stored {
+		role, err := ParseRole(name)
+		if err != nil {
+			tb.logger.Printf("Skipping role of %s: %+v\n", user, err)
+			continue
+		}
+		tb.roles[user] = role
+	}
+	return tb.roles
+}
+
+// GetUserRole - role of user on protocol
+func (tb *TorpedoBot) GetUserRole(protocol, user string) Role {
+	if role, ok := tb.configuredRole(protocol, user); ok {
+		return role
+	}
+	tb.aclLock.Lock()
+	defer tb.aclLock.Unlock()
+	if role, ok := tb.storedRoles()[UserKey(protocol, user)]; ok {
+		return role
+	}
+	return RoleUser
+}
+
+// SetUserRole - grant role to user, RoleUser removes granted role
+func (tb *TorpedoBot) SetUserRole(protocol, user string, role Role) (err error) {
+	if _, ok := tb.configuredRole(protocol, user); ok {
+		return fmt.Errorf("Role of `%s` is set in config", user)
+	}
+	key := UserKey(protocol, user)
+	tb.aclLock.Lock()
+	defer tb.aclLock.Unlock()
+	roles := tb.storedRoles()
+	if tb.Store != nil {
+		if role == RoleUser {
+			err = tb.Store.RemoveRole(key)
+		} else {
+			err = tb.Store.SetRole(key, role.String())
+		}
+		if err != nil {
+			return
+		}
+	}
+	if role == RoleUser {
+		delete(roles, key)
+	} else {
+		roles[key] = role
+	}
+	return
+}
+
+// AdminIDs - admins and owners of protocol, for notifications
+func (tb *TorpedoBot) AdminIDs(protocol string) (ids []string) {
+	cfg := torpedo_registry.Config.GetConfig()
+	tb.aclLock.Lock()
+	lists := [][]string{strings.Split(cfg["owners"], ","), strings.Split(cfg["admins"], ","), tb.acl.Owners, tb.acl.Admins}
+	candidates := make(map[string]bool)
+	for key, role := range tb.storedRoles() {
+		if role >= RoleAdmin && strings.HasPrefix(key, protocol+":") {
+			candidates[strings.TrimPrefix(key, protocol+":")] = true
+		}
+	}
+	tb.aclLock.Unlock()
+	for _, list := range lists {
+		for _, item := range list {
+			item = strings.TrimSpace(item)
+			if idx := strings.Index(item, ":"); idx > 0 && tb.HasProtocol(item[:idx]) {
+				if item[:idx] != protocol {
+					continue
+				}
+				item = item[idx+1:]
+			}
+			if item != "" {
+				candidates[item] = true
+			}
+		}
+	}
+	for id := range candidates {
+		// banned in config
+		if tb.GetUserRole(protocol, id) >= RoleAdmin {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return
+}
+
+// UserRole - role of message sender, roles above user are not applied if protocol can't verify sender
+func (tb *TorpedoBot) UserRole(api *TorpedoBotAPI) Role {
+	if api.UserProfile == nil || api.UserProfile.ID == "" {
+		return RoleUser
+	}
+	role := tb.GetUserRole(api.ProtocolName, api.UserProfile.ID)
+	if verifier, ok := api.Protocol.(SenderVerifier); ok && role > RoleUser && !verifier.VerifiedSenders() {
+		tb.logger.Printf("%s sender IDs are not verified, %s role of %s is not applied\n", api.ProtocolName, role, api.UserProfile.ID)
+		return RoleUser
+	}
+	return role
+}
+
+// IsAdmin - message sender is admin or owner
+func (tb *TorpedoBot) IsAdmin(api *TorpedoBotAPI) bool {
+	return tb.UserRole(api) >= RoleAdmin
+}
+
+// CommandRole - role required to run command, `command subcommand` for subcommands
+func (tb *TorpedoBot) CommandRole(command string) Role {
+	command = strings.ToLower(command)
+	tb.aclLock.Lock()
+	role, ok := tb.acl.Commands[command]
+	tb.aclLock.Unlock()
+	if ok {
+		return role
+	}
+	commandRolesLock.RLock()
+	defer commandRolesLock.RUnlock()
+	return commandRoles[command]
+}
+
+// CommandAllowed - sender may run command in channel: owners always can, banned users never can,
+// otherwise first matching config rule decides, then command role
+func (tb *TorpedoBot) CommandAllowed(api *TorpedoBotAPI, channel interface{}, command string) bool {
+	role := tb.UserRole(api)
+	switch role {
+	case RoleOwner:
+		return true
+	case RoleBanned:
+		return false
+	}
+	command = strings.ToLower(command)
+	channel_key := ChannelKey(api, channel)
+	tb.aclLock.Lock()
+	rules := tb.acl.Rules
+	tb.aclLock.Unlock()
+	for _, rule := range rules {
+		if rule.matches(command, channel_key, role) {
+			return rule.Action == "allow"
+		}
+	}
+	return role >= tb.CommandRole(command)
+}
+
+// denyCommand - reply to user that is not allowed to run command, banned users are ignored
+func (tb *TorpedoBot) denyCommand(api *TorpedoBotAPI, channel interface{}, command string) {
+	tb.logger.Printf("%s user %+v is not allowed to run %s\n", api.ProtocolName, api.UserProfile, command)
+	if tb.UserRole(api) == RoleBanned {
+		return
+	}
+	api.PostMessage(channel, fmt.Sprintf("You are not allowed to run `%s%s`", api.CommandPrefix, command))
+}
+
+// parseUser - `ID` on current protocol or `protocol:ID`, Slack style `<@ID>` mentions are accepted
+func (tb *TorpedoBot) parseUser(api *TorpedoBotAPI, user string) (protocol, id string) {
+	protocol, id = api.ProtocolName, user
+	if strings.HasPrefix(id, "<@") && strings.HasSuffix(id, ">") {
+		id = strings.TrimSuffix(strings.TrimPrefix(id, "<@"), ">")
+	}
+	if idx := strings.Index(id, ":"); idx > 0 && (tb.HasProtocol(id[:idx]) || id[:idx] == api.ProtocolName) {
+		protocol, id = id[:idx], id[idx+1:]
+	}
+	return
+}
+
+// changeRole - sender may only change roles of users below own role to roles below own role, owners may grant admin
+func (tb *TorpedoBot) changeRole(api *TorpedoBotAPI, user string, role Role) (message string, err error) {
+	protocol, id := tb.parseUser(api, user)
+	sender_role := tb.UserRole(api)
+	if current := tb.GetUserRole(protocol, id); current >= sender_role || role >= sender_role {
+		err = fmt.Errorf("You can't change role of `%s` to %s", id, role)
+		return
+	}
+	if err = tb.SetUserRole(protocol, id, role); err != nil {
+		return
+	}
+	message = fmt.Sprintf("`%s` on %s is %s now", id, protocol, role)
+	return
+}
+
+// ACLCommands - `grant`, `revoke` and `whois` commands
+func (tb *TorpedoBot) ACLCommands() []*Command {
+	reply := func(handler func(api *TorpedoBotAPI, cmd *ParsedCommand) (string, error)) CommandHandler {
+		return func(botapi *torpedo_registry.BotAPI, channel interface{}, cmd *ParsedCommand) {
+			api := botapi.API.(*TorpedoBotAPI)
+			message, err := handler(api, cmd)
+			if err != nil {
+				message = err.Error()
+			}
+			api.PostMessage(channel, message)
+		}
+	}
+	roles := make([]string, 0, len(roleNames))
+	for _, name := range roleNames {
+		roles = append(roles, name)
+	}
+	sort.Strings(roles)
+	return []*Command{
+		{
+			Name: "grant",
+			Help: "Grant role to user, e.g. `grant U024BE7LH admin` or `grant irc:irc.libera.chat:alice banned` (IRC services account)",
+			Role: RoleAdmin,
+			Args: []ArgSpec{
+				{Name: "user", Help: "User ID, `protocol:ID` for other protocols", Required: true},
+				{Name: "role", Help: "Role", Type: ArgEnum, Choices: roles, Required: true},
+			},
+			Handler: reply(func(api *TorpedoBotAPI, cmd *ParsedCommand) (string, error) {
+				role, _ := ParseRole(cmd.String("role"))
+				return tb.changeRole(api, cmd.String("user"), role)
+			}),
+		},
+		{
+			Name: "revoke",
+			Help: "Revoke granted role, user gets default one",
+			Role: RoleAdmin,
+			Args: []ArgSpec{
+				{Name: "user", Help: "User ID, `protocol:ID` for other protocols", Required: true},
+			},
+			Handler: reply(func(api *TorpedoBotAPI, cmd *ParsedCommand) (string, error) {
+				return tb.changeRole(api, cmd.String("user"), RoleUser)
+			}),
+		},
+		{
+			Name: "whois",
+			Help: "Show user role, yours if user is not set",
+			Args: []ArgSpec{
+				{Name: "user", Help: "User ID, `protocol:ID` for other protocols"},
+			},
+			Handler: reply(func(api *TorpedoBotAPI, cmd *ParsedCommand) (string, error) {
+				var protocol, id string
+				switch {
+				case cmd.Has("user"):
+					protocol, id = tb.parseUser(api, cmd.String("user"))
+				case api.UserProfile != nil && api.UserProfile.ID != "":
+					protocol, id = api.ProtocolName, api.UserProfile.ID
+				default:
+					return "", fmt.Errorf("Unknown user")
+				}
+				message := fmt.Sprintf("`%s` on %s is %s", id, protocol, tb.GetUserRole(protocol, id))
+				if _, ok := tb.configuredRole(protocol, id); ok {
+					message += " (set in config)"
+				}
+				return message, nil
+			}),
+		},
+	}
+}
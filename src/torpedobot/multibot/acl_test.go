@@ -0,0 +1,164 @@
+package multibot_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+	irc "github.com/thoj/go-ircevent"
+)
+
+func TestACL(t *testing.T) {
+	bot := multibot.New()
+	for _, command := range bot.ACLCommands() {
+		multibot.RegisterCommand(command)
+	}
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	torpedo_registry.Config.SetConfig("owners", "loopback:U0")
+	torpedo_registry.Config.SetConfig("admins", "U1")
+	defer torpedo_registry.Config.SetConfig("owners", "")
+	defer torpedo_registry.Config.SetConfig("admins", "")
+
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "torpedobot.yaml")
+	config := `
+acl:
+  commands:
+    picture: admin
+  rules:
+    - action: deny
+      command: echo
+      channel: loopback:acl-quiet
+      role: user
+    - action: allow
+      command: picture
+      channel: loopback:acl-pictures
+      role: user
+`
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	torpedo_registry.Config.SetConfig("configfile", path)
+	defer torpedo_registry.Config.SetConfig("configfile", "")
+	if err = bot.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ioutil.WriteFile(path, []byte("accounts: []\n"), 0600)
+		bot.ReloadConfig()
+	}()
+
+	// bot is shared by tests
+	defer bot.SetUserRole("loopback", "U2", multibot.RoleUser)
+
+	users := make(map[string]*torpedo_registry.UserProfile)
+	for _, id := range []string{"U0", "U1", "U2", "U3"} {
+		users[id] = &torpedo_registry.UserProfile{ID: id, Nick: strings.ToLower(id)}
+	}
+	cases := []struct {
+		user    string
+		channel string
+		message string
+		text    string
+	}{
+		{"U2", "", "!whois", "`U2` on loopback is user"},
+		{"U2", "", "!grant U3 banned", "You are not allowed to run `!grant`"},
+		{"U1", "", "!grant U3 banned", "`U3` on loopback is banned now"},
+		// banned users are ignored
+		{"U3", "", "!echo hi", ""},
+		{"U1", "", "!grant U2 admin", "You can't change role of `U2` to admin"},
+		{"U0", "", "!grant U2 admin", "`U2` on loopback is admin now"},
+		{"U2", "", "!revoke U1", "You can't change role of `U1` to user"},
+		{"U0", "", "!revoke U1", "Role of `U1` is set in config"},
+		{"U1", "", "!whois loopback:U0", "`U0` on loopback is owner (set in config)"},
+		{"U1", "", "!revoke U3", "`U3` on loopback is user now"},
+		{"U3", "", "!picture", "You are not allowed to run `!picture`"},
+		{"U3", "acl-pictures", "!picture", ""},
+		{"U3", "acl-quiet", "!echo hi", "You are not allowed to run `!echo`"},
+		// rule applies to users only
+		{"U1", "acl-quiet", "!echo hi", "u1 said: !echo hi"},
+	}
+	for idx, tc := range cases {
+		channel := tc.channel
+		if channel == "" {
+			channel = fmt.Sprintf("acl-%d", idx)
+		} else {
+			// NoSpam allows one message per channel per second
+			time.Sleep(multibot.DefaultRateLimit)
+		}
+		lp.Inject(users[tc.user], channel, tc.message)
+		timeout := replyTimeout
+		if tc.text == "" {
+			timeout = 100 * time.Millisecond
+		}
+		reply := lp.WaitReply(timeout)
+		switch {
+		case tc.text == "" && reply != nil && reply.Text != "":
+			t.Errorf("%s `%s`: unexpected reply %+v", tc.user, tc.message, reply)
+		case tc.text != "" && (reply == nil || reply.Text != tc.text):
+			t.Errorf("%s `%s`: got %+v, expected `%s`", tc.user, tc.message, reply, tc.text)
+		}
+	}
+}
+
+// unverifiedProtocol - webhook protocol without request signatures
+type unverifiedProtocol struct {
+	plainProtocol
+}
+
+func (up *unverifiedProtocol) VerifiedSenders() bool { return false }
+
+func TestACLUnverifiedSenders(t *testing.T) {
+	bot := multibot.New()
+	torpedo_registry.Config.SetConfig("admins", "U1")
+	defer torpedo_registry.Config.SetConfig("admins", "")
+
+	verified := bot.NewBotAPI(&plainProtocol{}, nil, &torpedo_registry.Account{})
+	verified.ProtocolName = "webhook"
+	verified.UserProfile = &torpedo_registry.UserProfile{ID: "U1"}
+	if !bot.IsAdmin(verified) {
+		t.Errorf("admin is not recognized")
+	}
+	// anyone can send admin ID through unsigned webhook
+	forged := bot.NewBotAPI(&unverifiedProtocol{}, nil, &torpedo_registry.Account{})
+	forged.ProtocolName = "webhook"
+	forged.UserProfile = &torpedo_registry.UserProfile{ID: "U1"}
+	if role := bot.UserRole(forged); role != multibot.RoleUser {
+		t.Errorf("unverified sender got %s role", role)
+	}
+}
+
+func TestACLIRCNetworks(t *testing.T) {
+	bot := multibot.New()
+	event := &irc.Event{Nick: "alice", User: "~alice", Host: "user/alice", Tags: map[string]string{"account": "alice15"}}
+	users := make([]*multibot.TorpedoBotAPI, 0, 2)
+	for _, server := range []string{"irc.one.example.com", "irc.two.example.com"} {
+		api := bot.NewBotAPI(&plainProtocol{}, nil, &torpedo_registry.Account{APIKey: "torpedobot:" + server})
+		api.ProtocolName = "irc"
+		api.UserProfile = &torpedo_registry.UserProfile{ID: multibot.IRCUserID(server, event), Nick: event.Nick, Server: server}
+		users = append(users, api)
+	}
+	if err := bot.SetUserRole("irc", users[0].UserProfile.ID, multibot.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	defer bot.SetUserRole("irc", users[0].UserProfile.ID, multibot.RoleUser)
+	// same services account on other network is other user
+	if !bot.IsAdmin(users[0]) || bot.IsAdmin(users[1]) {
+		t.Errorf("unexpected roles: %s, %s", bot.UserRole(users[0]), bot.UserRole(users[1]))
+	}
+	if id := multibot.IRCUserID("irc.two.example.com", &irc.Event{User: "~bob", Host: "example.net"}); id != "irc.two.example.com:~bob@example.net" {
+		t.Errorf("unexpected ID of user without account: %s", id)
+	}
+}
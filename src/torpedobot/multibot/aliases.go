@@ -0,0 +1,289 @@
+package multibot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+var (
+	// aliases - alias: command, shared by all channels
+	aliases     = make(map[string]string)
+	aliasesLock sync.RWMutex
+)
+
+// RegisterAlias - alternative name for registered command, help lists it along with command
+func RegisterAlias(alias, command string) {
+	aliasesLock.Lock()
+	defer aliasesLock.Unlock()
+	aliases[strings.ToLower(alias)] = strings.ToLower(command)
+}
+
+// ResolveAlias - command name for alias, name itself otherwise
+func ResolveAlias(name string) string {
+	aliasesLock.RLock()
+	defer aliasesLock.RUnlock()
+	name = strings.ToLower(name)
+	if command, ok := aliases[name]; ok {
+		return command
+	}
+	return name
+}
+
+// CommandAliases - sorted aliases of every command that has them
+func CommandAliases() (result map[string][]string) {
+	aliasesLock.RLock()
+	defer aliasesLock.RUnlock()
+	result = make(map[string][]string)
+	for alias, command := range aliases {
+		result[command] = append(result[command], alias)
+	}
+	for command := range result {
+		sort.Strings(result[command])
+	}
+	return
+}
+
+// ChannelKey - channel identifier for per-channel settings
+func ChannelKey(api *TorpedoBotAPI, channel interface{}) string {
+	return fmt.Sprintf("%s:%v", api.ProtocolName, channel)
+}
+
+// AccountKey - account identifier, protocol and WebhookAccountID
+func AccountKey(api *TorpedoBotAPI) string {
+	return fmt.Sprintf("%s/%s", api.ProtocolName, WebhookAccountID(api.Account))
+}
+
+// GetChannelAliases - aliases added in channel, loaded from storage on first use
+func (tb *TorpedoBot) GetChannelAliases(key string) (result map[string]string) {
+	tb.channelAliasesLock.Lock()
+	defer tb.channelAliasesLock.Unlock()
+	channel_aliases, ok := tb.channelAliases[key]
+	if !ok {
+		channel_aliases = make(map[string]string)
+		if tb.Store != nil {
+			stored, err := tb.Store.GetAliases(key)
+			if err != nil {
+				tb.logger.Printf("Could not get aliases of %s: %+v\n", key, err)
+			}
+			for alias, command := range stored {
+				channel_aliases[alias] = command
+			}
+		}
+		tb.channelAliases[key] = channel_aliases
+	}
+	result = make(map[string]string, len(channel_aliases))
+	for alias, command := range channel_aliases {
+		result[alias] = command
+	}
+	return
+}
+
+// SetChannelAlias - add or replace channel alias, command may include arguments
+func (tb *TorpedoBot) SetChannelAlias(key, alias, command string) (err error) {
+	alias = strings.ToLower(alias)
+	target := strings.Fields(command)
+	if len(target) == 0 {
+		return fmt.Errorf("Alias `%s` needs command", alias)
+	}
+	if _, ok := torpedo_registry.Config.GetHandlers()[alias]; ok || ResolveAlias(alias) != alias {
+		return fmt.Errorf("`%s` is already a command", alias)
+	}
+	if _, ok := torpedo_registry.Config.GetHandlers()[ResolveAlias(target[0])]; !ok {
+		return fmt.Errorf("Unknown command `%s`", target[0])
+	}
+	tb.GetChannelAliases(key)
+	if tb.Store != nil {
+		if err = tb.Store.SetAlias(key, alias, command); err != nil {
+			return
+		}
+	}
+	tb.channelAliasesLock.Lock()
+	defer tb.channelAliasesLock.Unlock()
+	tb.channelAliases[key][alias] = command
+	return
+}
+
+func (tb *TorpedoBot) RemoveChannelAlias(key, alias string) (err error) {
+	alias = strings.ToLower(alias)
+	if _, ok := tb.GetChannelAliases(key)[alias]; !ok {
+		return fmt.Errorf("No such alias: `%s`", alias)
+	}
+	if tb.Store != nil {
+		if err = tb.Store.RemoveAlias(key, alias); err != nil {
+			return
+		}
+	}
+	tb.channelAliasesLock.Lock()
+	defer tb.channelAliasesLock.Unlock()
+	delete(tb.channelAliases[key], alias)
+	return
+}
+
+// resolveCommand - handler name and message to pass to it, channel aliases are expanded
+// to their command with arguments, e.g. `!w Kyiv` to `!weather --units metric Kyiv`
+func (tb *TorpedoBot) resolveCommand(api *TorpedoBotAPI, channel interface{}, command string) (name, message string, ok bool) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return
+	}
+	name = strings.ToLower(fields[0])
+	message = api.CommandPrefix + command
+	handlers := torpedo_registry.Config.GetHandlers()
+	if _, ok = handlers[name]; ok {
+		return
+	}
+	if target, found := tb.GetChannelAliases(ChannelKey(api, channel))[name]; found {
+		command = target + strings.TrimPrefix(strings.TrimLeft(command, " "), fields[0])
+		fields = strings.Fields(command)
+		name = strings.ToLower(fields[0])
+	}
+	// handlers get canonical command name
+	if resolved := ResolveAlias(name); resolved != name {
+		command = resolved + strings.TrimPrefix(strings.TrimLeft(command, " "), fields[0])
+		name = resolved
+	}
+	message = api.CommandPrefix + command
+	_, ok = handlers[name]
+	return
+}
+
+// editDistance - Levenshtein distance
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	row := make([]int, len(rb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(rb); j++ {
+			current := row[j]
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			row[j] = min3(row[j]+1, row[j-1]+1, prev+cost)
+			prev = current
+		}
+	}
+	return row[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// MaxSuggestions - unknown command reply lists up to this many similar commands
+const MaxSuggestions = 3
+
+// suggestCommands - commands and aliases closest to unknown name
+func (tb *TorpedoBot) suggestCommands(api *TorpedoBotAPI, channel interface{}, name string) (suggestions []string) {
+	name = strings.ToLower(name)
+	candidates := make(map[string]int)
+	consider := func(candidate string) {
+		distance := editDistance(name, candidate)
+		// short names are similar to everything
+		if distance <= 2 && distance < len([]rune(name)) && distance < len([]rune(candidate)) {
+			candidates[candidate] = distance
+		}
+	}
+	for handler := range torpedo_registry.Config.GetHandlers() {
+		consider(handler)
+	}
+	for _, names := range CommandAliases() {
+		for _, alias := range names {
+			consider(alias)
+		}
+	}
+	for alias := range tb.GetChannelAliases(ChannelKey(api, channel)) {
+		consider(alias)
+	}
+	for candidate := range candidates {
+		suggestions = append(suggestions, candidate)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if candidates[suggestions[i]] != candidates[suggestions[j]] {
+			return candidates[suggestions[i]] < candidates[suggestions[j]]
+		}
+		return suggestions[i] < suggestions[j]
+	})
+	if len(suggestions) > MaxSuggestions {
+		suggestions = suggestions[:MaxSuggestions]
+	}
+	return
+}
+
+// AliasCommand - `alias` command, managing channel aliases requires admin role
+func (tb *TorpedoBot) AliasCommand() *Command {
+	reply := func(handler func(api *TorpedoBotAPI, key string, cmd *ParsedCommand) (string, error)) CommandHandler {
+		return func(botapi *torpedo_registry.BotAPI, channel interface{}, cmd *ParsedCommand) {
+			api := botapi.API.(*TorpedoBotAPI)
+			message, err := handler(api, ChannelKey(api, channel), cmd)
+			if err != nil {
+				message = err.Error()
+			}
+			api.PostMessage(channel, message)
+		}
+	}
+	return &Command{
+		Name: "alias",
+		Help: "Channel command aliases",
+		Subcommands: []*Command{
+			{
+				Name: "add",
+				Help: "Add alias, e.g. `alias add w weather --units metric`",
+				Role: RoleAdmin,
+				Args: []ArgSpec{
+					{Name: "name", Help: "Alias name", Required: true},
+					{Name: "command", Help: "Command with optional arguments", Required: true, Rest: true},
+				},
+				Handler: reply(func(api *TorpedoBotAPI, key string, cmd *ParsedCommand) (string, error) {
+					err := tb.SetChannelAlias(key, cmd.String("name"), cmd.String("command"))
+					return fmt.Sprintf("Alias `%s%s` added", api.CommandPrefix, strings.ToLower(cmd.String("name"))), err
+				}),
+			},
+			{
+				Name: "remove",
+				Help: "Remove alias",
+				Role: RoleAdmin,
+				Args: []ArgSpec{{Name: "name", Help: "Alias name", Required: true}},
+				Handler: reply(func(api *TorpedoBotAPI, key string, cmd *ParsedCommand) (string, error) {
+					err := tb.RemoveChannelAlias(key, cmd.String("name"))
+					return fmt.Sprintf("Alias `%s` removed", strings.ToLower(cmd.String("name"))), err
+				}),
+			},
+			{
+				Name: "list",
+				Help: "List channel aliases",
+				Handler: func(botapi *torpedo_registry.BotAPI, channel interface{}, cmd *ParsedCommand) {
+					api := botapi.API.(*TorpedoBotAPI)
+					channel_aliases := tb.GetChannelAliases(ChannelKey(api, channel))
+					names := make([]string, 0, len(channel_aliases))
+					for alias := range channel_aliases {
+						names = append(names, alias)
+					}
+					sort.Strings(names)
+					message := "No aliases in this channel"
+					if len(names) > 0 {
+						message = "Channel aliases:"
+						for _, alias := range names {
+							message += fmt.Sprintf("\n`%s%s` -> `%s%s`", api.CommandPrefix, alias, api.CommandPrefix, channel_aliases[alias])
+						}
+					}
+					api.PostMessage(channel, message)
+				},
+			},
+		},
+	}
+}
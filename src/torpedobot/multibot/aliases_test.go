@@ -0,0 +1,87 @@
+package multibot_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func init() {
+	multibot.RegisterAlias("say", "echo")
+}
+
+func TestAliases(t *testing.T) {
+	bot := multibot.New()
+	multibot.RegisterCommand(bot.AliasCommand())
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	torpedo_registry.Config.SetConfig("admins", "U1")
+	defer torpedo_registry.Config.SetConfig("admins", "")
+
+	admin := &torpedo_registry.UserProfile{ID: "U1", Nick: "alice"}
+	user := &torpedo_registry.UserProfile{ID: "U2", Nick: "bob"}
+	cases := []struct {
+		user    *torpedo_registry.UserProfile
+		channel string
+		message string
+		text    string
+	}{
+		// handlers get canonical command name
+		{admin, "alias-1", "!say hi", "alice said: !echo hi"},
+		{admin, "alias-2", "!ecoh hi", "Did you mean `!echo`?"},
+		{admin, "alias-3", "!nosuchcommand", "Command unknown. "},
+		{user, "alias-4", "!alias add greet echo hello", "You are not allowed to run `!alias add`"},
+		{admin, "alias-5", "!alias add greet echo hello", "Alias `!greet` added"},
+		{admin, "alias-6", "!alias add say picture", "`say` is already a command"},
+		{admin, "alias-7", "!alias add g nosuchcommand", "Unknown command `nosuchcommand`"},
+	}
+	for _, tc := range cases {
+		lp.Inject(tc.user, tc.channel, tc.message)
+		if reply := lp.WaitReply(replyTimeout); reply == nil || !strings.Contains(reply.Text, tc.text) {
+			t.Errorf("`%s`: got %+v, expected `%s`", tc.message, reply, tc.text)
+		}
+	}
+	if reply := lp.WaitReply(100 * time.Millisecond); reply != nil {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+
+	// channel alias works in its channel only
+	time.Sleep(multibot.DefaultRateLimit)
+	lp.Inject(user, "alias-5", "!greet world")
+	if reply := lp.WaitReply(replyTimeout); reply == nil || reply.Text != "bob said: !echo hello world" {
+		t.Errorf("channel alias: got %+v", reply)
+	}
+	lp.Inject(user, "alias-8", "!greet world")
+	if reply := lp.WaitReply(replyTimeout); reply == nil || !strings.Contains(reply.Text, "Command unknown") {
+		t.Errorf("channel alias in other channel: got %+v", reply)
+	}
+}
+
+func TestCommandSuggestions(t *testing.T) {
+	bot := multibot.New()
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	user := &torpedo_registry.UserProfile{ID: "U1", Nick: "alice"}
+	cases := map[string]string{
+		// aliases are suggested too
+		"!sya": "`!say`",
+		// short names are not similar to everything
+		"!x": "",
+	}
+	for message, suggestion := range cases {
+		lp.Inject(user, "suggest-"+message, message)
+		reply := lp.WaitReply(replyTimeout)
+		switch {
+		case reply == nil:
+			t.Errorf("`%s`: no reply", message)
+		case suggestion == "" && strings.Contains(reply.Text, "Did you mean"):
+			t.Errorf("`%s`: unexpected suggestion in `%s`", message, reply.Text)
+		case suggestion != "" && !strings.Contains(reply.Text, suggestion):
+			t.Errorf("`%s`: got `%s`, expected %s", message, reply.Text, suggestion)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package multibot
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// DefaultMaxAttachmentSize - downloads larger than this (in megabytes) are rejected, see -max_attachment_size
+const DefaultMaxAttachmentSize = 20
+
+var (
+	MaxAttachmentSize *int
+
+	// ErrAttachmentTooLarge - attachment size is over -max_attachment_size
+	ErrAttachmentTooLarge = errors.New("attachment is too large")
+	// ErrAttachmentExpired - downloaded file is removed once handlers of event are done
+	ErrAttachmentExpired = errors.New("attachment download expired")
+
+	attachmentHandlers     = make(map[string]attachmentHandler)
+	attachmentHandlersLock sync.RWMutex
+)
+
+// AttachmentKind - type of content attached to message
+type AttachmentKind string
+
+const (
+	AttachmentFile    AttachmentKind = "file"
+	AttachmentImage   AttachmentKind = "image"
+	AttachmentSticker AttachmentKind = "sticker"
+	AttachmentAudio   AttachmentKind = "audio"
+	AttachmentVideo   AttachmentKind = "video"
+)
+
+// MimeAttachmentKind - image, audio or video by MIME type, file otherwise
+func MimeAttachmentKind(mimetype string) AttachmentKind {
+	switch strings.SplitN(mimetype, "/", 2)[0] {
+	case "image":
+		return AttachmentImage
+	case "audio":
+		return AttachmentAudio
+	case "video":
+		return AttachmentVideo
+	}
+	return AttachmentFile
+}
+
+// Attachment - file, image, sticker, etc received with message
+type Attachment struct {
+	Kind AttachmentKind
+	// ID - platform file ID (Telegram file_id, Slack file ID, Matrix mxc:// URI)
+	ID       string
+	Name     string
+	MimeType string
+	// URL - download URL if platform provides one, may require account credentials, use Download
+	URL string
+	// Size - in bytes, 0 if unknown
+	Size     int
+	download *attachmentDownload
+}
+
+// attachmentDownload - lazy download, shared by copies of attachment
+type attachmentDownload struct {
+	fetch   func() (fname string, err error)
+	fname   string
+	expired bool
+	lock    sync.Mutex
+}
+
+// SetDownload - protocol specific download (e.g. authorized or by file ID), fetch saves content
+// to temp file with saveToTmp. URL is fetched with downloadURL otherwise
+func (a *Attachment) SetDownload(fetch func() (fname string, err error)) {
+	a.download = &attachmentDownload{fetch: fetch}
+}
+
+// Download - fetch attachment to temp file, once per event. File is removed after handlers are done
+func (a *Attachment) Download() (fname string, err error) {
+	if a.download == nil {
+		a.setDefaultDownload()
+	}
+	limit := maxAttachmentBytes()
+	if int64(a.Size) > limit {
+		return "", ErrAttachmentTooLarge
+	}
+	ad := a.download
+	ad.lock.Lock()
+	defer ad.lock.Unlock()
+	switch {
+	case ad.expired:
+		return "", ErrAttachmentExpired
+	case ad.fname != "":
+		return ad.fname, nil
+	}
+	if fname, err = ad.fetch(); err != nil {
+		return "", err
+	}
+	// size is not always known in advance
+	if info, serr := os.Stat(fname); serr == nil && info.Size() > limit {
+		os.Remove(fname)
+		return "", ErrAttachmentTooLarge
+	}
+	ad.fname = fname
+	return
+}
+
+// setDefaultDownload - download URL if there is one
+func (a *Attachment) setDefaultDownload() {
+	if a.URL == "" {
+		a.SetDownload(func() (string, error) { return "", ErrNotSupported })
+		return
+	}
+	a.SetDownload(downloadURL(a.URL, nil))
+}
+
+// downloadURL - fetch URL with saveToTmp, so download stops at -max_attachment_size.
+// Token is sent as bearer token if token source is set, it's called on each download
+func downloadURL(url string, token func() string) func() (string, error) {
+	return func() (fname string, err error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return
+		}
+		if token != nil {
+			req.Header.Set("Authorization", "Bearer "+token())
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("Attachment download failed: %s", resp.Status)
+			return
+		}
+		if resp.ContentLength > maxAttachmentBytes() {
+			err = ErrAttachmentTooLarge
+			return
+		}
+		return saveToTmp(resp.Body)
+	}
+}
+
+// removeDownload - remove downloaded file, further downloads fail
+func (a *Attachment) removeDownload() {
+	if a.download == nil {
+		return
+	}
+	a.download.lock.Lock()
+	defer a.download.lock.Unlock()
+	if a.download.fname != "" {
+		os.Remove(a.download.fname)
+	}
+	a.download.expired = true
+}
+
+// EffectiveMimeType - MIME type, `image/*` (`audio/*`, `video/*`) if only kind is known
+func (a *Attachment) EffectiveMimeType() string {
+	switch {
+	case a.MimeType != "":
+		return a.MimeType
+	case a.Kind == AttachmentImage || a.Kind == AttachmentSticker:
+		return "image/*"
+	case a.Kind == AttachmentAudio || a.Kind == AttachmentVideo:
+		return string(a.Kind) + "/*"
+	}
+	return "application/octet-stream"
+}
+
+// MatchMimeType - pattern is exact MIME type (`application/pdf`), `image/*` or `*/*`
+func (a *Attachment) MatchMimeType(pattern string) bool {
+	mimetype := strings.ToLower(a.EffectiveMimeType())
+	pattern = strings.ToLower(pattern)
+	if pattern == "*/*" || pattern == mimetype {
+		return true
+	}
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mimetype, strings.TrimSuffix(pattern, "*"))
+}
+
+// saveToTmp - save downloaded content to temp file, up to -max_attachment_size
+func saveToTmp(content io.Reader) (fname string, err error) {
+	tmp, err := ioutil.TempFile("", "torpedobot-attachment")
+	if err != nil {
+		return
+	}
+	defer tmp.Close()
+	limit := maxAttachmentBytes()
+	written, err := io.Copy(tmp, io.LimitReader(content, limit+1))
+	if err == nil && written > limit {
+		err = ErrAttachmentTooLarge
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	fname = tmp.Name()
+	return
+}
+
+// AttachmentHandler - called for incoming attachment matching MIME type handler was registered for
+type AttachmentHandler func(api *torpedo_registry.BotAPI, channel interface{}, attachment *Attachment)
+
+type attachmentHandler struct {
+	mimetype string
+	handler  AttachmentHandler
+}
+
+// RegisterAttachmentHandler - run handler for attachments of MIME type (`image/*`, `application/pdf`, `*/*`)
+// received in messages that are not commands
+func RegisterAttachmentHandler(name, mimetype string, handler AttachmentHandler) {
+	attachmentHandlersLock.Lock()
+	defer attachmentHandlersLock.Unlock()
+	attachmentHandlers[name] = attachmentHandler{mimetype: mimetype, handler: handler}
+}
+
+func (tb *TorpedoBot) ConfigureAttachments(cfg *torpedo_registry.ConfigStruct) {
+	MaxAttachmentSize = flag.Int("max_attachment_size", DefaultMaxAttachmentSize, "Max size of downloaded attachment in megabytes")
+}
+
+func (tb *TorpedoBot) ParseAttachments(cfg *torpedo_registry.ConfigStruct) {
+	if *MaxAttachmentSize <= 0 {
+		tb.logger.Printf("Invalid -max_attachment_size %d, using %d\n", *MaxAttachmentSize, DefaultMaxAttachmentSize)
+		*MaxAttachmentSize = DefaultMaxAttachmentSize
+	}
+}
+
+func maxAttachmentBytes() int64 {
+	size := DefaultMaxAttachmentSize
+	if MaxAttachmentSize != nil {
+		size = *MaxAttachmentSize
+	}
+	return int64(size) * 1024 * 1024
+}
+
+// processAttachments - run attachment handlers in name order
+func (tb *TorpedoBot) processAttachments(api *TorpedoBotAPI, channel interface{}, ev *Event) {
+	attachmentHandlersLock.RLock()
+	names := make([]string, 0, len(attachmentHandlers))
+	handlers := make(map[string]attachmentHandler, len(attachmentHandlers))
+	for name, handler := range attachmentHandlers {
+		names = append(names, name)
+		handlers[name] = handler
+	}
+	attachmentHandlersLock.RUnlock()
+	sort.Strings(names)
+	botapi := tb.GetBotAPI(api, channel, ev.Text)
+	for idx := range ev.Attachments {
+		attachment := &ev.Attachments[idx]
+		for _, name := range names {
+			if attachment.MatchMimeType(handlers[name].mimetype) {
+				tb.logger.Printf("Running attachment handler %s for %s\n", name, attachment.EffectiveMimeType())
+				handlers[name].handler(botapi, channel, attachment)
+			}
+		}
+	}
+}
+
+// prepareAttachments - attachments without protocol download get default one
+func (ev *Event) prepareAttachments() {
+	for idx := range ev.Attachments {
+		if ev.Attachments[idx].download == nil {
+			ev.Attachments[idx].setDefaultDownload()
+		}
+	}
+}
+
+// removeDownloads - clean up temp files of event
+func (ev *Event) removeDownloads() {
+	for idx := range ev.Attachments {
+		ev.Attachments[idx].removeDownload()
+	}
+}
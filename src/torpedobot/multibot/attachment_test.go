@@ -0,0 +1,172 @@
+package multibot_test
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func ImageStatsProcessAttachment(api *torpedo_registry.BotAPI, channel interface{}, attachment *multibot.Attachment) {
+	fname, err := attachment.Download()
+	if err != nil {
+		api.Bot.PostMessage(channel, attachment.Name+" "+err.Error(), api)
+		return
+	}
+	data, _ := ioutil.ReadFile(fname)
+	api.Bot.PostMessage(channel, attachment.Name+" "+string(data)+" "+fname, api)
+}
+
+func TestMimeTypeMatch(t *testing.T) {
+	png := &multibot.Attachment{Kind: multibot.AttachmentImage, MimeType: "image/PNG"}
+	photo := &multibot.Attachment{Kind: multibot.AttachmentImage}
+	file := &multibot.Attachment{Kind: multibot.AttachmentFile}
+	for _, tc := range []struct {
+		attachment *multibot.Attachment
+		pattern    string
+		match      bool
+	}{
+		{png, "image/png", true},
+		{png, "image/*", true},
+		{png, "*/*", true},
+		{png, "image/jpeg", false},
+		{png, "application/*", false},
+		{photo, "image/*", true},
+		{photo, "image/jpeg", false},
+		{file, "application/*", true},
+		{file, "image/*", false},
+	} {
+		if tc.attachment.MatchMimeType(tc.pattern) != tc.match {
+			t.Errorf("%s matching %s: expected %v", tc.attachment.EffectiveMimeType(), tc.pattern, tc.match)
+		}
+	}
+}
+
+func TestAttachmentHandler(t *testing.T) {
+	bot := multibot.New()
+	multibot.RegisterAttachmentHandler("imagestats", "image/*", ImageStatsProcessAttachment)
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+
+	downloads := 0
+	cat := multibot.Attachment{Kind: multibot.AttachmentImage, Name: "cat.png", MimeType: "image/png"}
+	cat.SetDownload(func() (string, error) {
+		downloads++
+		tmp, err := ioutil.TempFile("", "attachment-test")
+		if err != nil {
+			return "", err
+		}
+		defer tmp.Close()
+		_, err = tmp.WriteString("meow")
+		return tmp.Name(), err
+	})
+	large := multibot.Attachment{Kind: multibot.AttachmentImage, Name: "large.png", Size: (multibot.DefaultMaxAttachmentSize + 1) * 1024 * 1024}
+	sticker := multibot.Attachment{Kind: multibot.AttachmentSticker, Name: "sticker"}
+	pdf := multibot.Attachment{Kind: multibot.AttachmentFile, Name: "doc.pdf", MimeType: "application/pdf", URL: "http://localhost/doc.pdf"}
+
+	user := &torpedo_registry.UserProfile{ID: "U61", Nick: "alice"}
+	lp.InjectEvent(user, &multibot.Event{
+		Channel:     multibot.ChannelRef{Native: "attachment-a"},
+		Attachments: []multibot.Attachment{cat, large, pdf, sticker},
+	})
+	replies := make([]string, 0)
+	for reply := lp.WaitReply(replyTimeout); reply != nil; reply = lp.WaitReply(200 * time.Millisecond) {
+		replies = append(replies, reply.Text)
+	}
+	if len(replies) != 3 || !strings.HasPrefix(replies[0], "cat.png meow ") || replies[1] != "large.png "+multibot.ErrAttachmentTooLarge.Error() ||
+		replies[2] != "sticker "+multibot.ErrNotSupported.Error() {
+		t.Fatalf("unexpected replies: %+v", replies)
+	}
+	// temp file is removed once handlers are done
+	fname := strings.Fields(replies[0])[2]
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		os.Remove(fname)
+		t.Errorf("downloaded file was not removed: %+v", err)
+	}
+	if _, err := cat.Download(); err != multibot.ErrAttachmentExpired || downloads != 1 {
+		t.Errorf("unexpected download after event: %+v, %d downloads", err, downloads)
+	}
+}
+
+func TestAttachmentDownload(t *testing.T) {
+	chunk := make([]byte, 1024*1024)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer skype-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/cat.png" {
+			w.Write([]byte("meow"))
+			return
+		}
+		// no Content-Length, size is known once it's read
+		for written := 0; written <= multibot.DefaultMaxAttachmentSize+1; written++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+	// attacker's hosts record authorization they get
+	authorization := make(chan string, 2)
+	steal := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+		w.Write([]byte("stolen"))
+	})
+	attacker := httptest.NewTLSServer(steal)
+	defer attacker.Close()
+	plain := httptest.NewServer(steal)
+	defer plain.Close()
+	http.DefaultClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer func() { http.DefaultClient.Transport = nil }()
+	hosts := multibot.SkypeAttachmentHosts
+	multibot.SkypeAttachmentHosts = append([]string{"127.0.0.1"}, hosts...)
+	defer func() { multibot.SkypeAttachmentHosts = hosts }()
+
+	message := &multibot.SkypeIncomingMessage{}
+	for _, content_url := range []string{server.URL + "/cat.png", server.URL + "/large.png",
+		strings.Replace(attacker.URL, "127.0.0.1", "localhost", 1) + "/x.png", plain.URL + "/y.png"} {
+		message.Attachments = append(message.Attachments, &multibot.SkypeAttachment{ContentType: "image/png", ContentURL: content_url,
+			Name: path.Base(content_url)})
+	}
+	attachments := message.EventAttachments(func() string { return "skype-token" })
+	if len(attachments) != 4 {
+		t.Fatalf("unexpected attachments: %+v", attachments)
+	}
+	fname, err := attachments[0].Download()
+	if err != nil {
+		t.Fatalf("authorized download failed: %+v", err)
+	}
+	defer os.Remove(fname)
+	if data, _ := ioutil.ReadFile(fname); string(data) != "meow" {
+		t.Errorf("unexpected content: %q", data)
+	}
+	if _, err := attachments[1].Download(); err != multibot.ErrAttachmentTooLarge {
+		t.Errorf("expected too large attachment, got %+v", err)
+	}
+	// token is not sent to other hosts or over plain http
+	for _, attachment := range attachments[2:] {
+		fname, err := attachment.Download()
+		if err != nil {
+			t.Fatalf("%s: download failed: %+v", attachment.Name, err)
+		}
+		os.Remove(fname)
+		if header := <-authorization; header != "" {
+			t.Errorf("%s: token was sent to attacker: %q", attachment.Name, header)
+		}
+	}
+	// without token source request is not authorized
+	if _, err := message.EventAttachments(nil)[0].Download(); err == nil {
+		t.Errorf("unauthorized download succeeded")
+	}
+}
@@ -0,0 +1,257 @@
+package multibot
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// BlacklistRefreshInterval - stored rules are re-read this often to pick up changes made directly in storage
+var BlacklistRefreshInterval = time.Minute
+
+// BlacklistEntry - rule with its ID, see `blacklist list` and /api/v1/blacklist
+type BlacklistEntry struct {
+	ID string `json:"id"`
+	// Source - config or store, config file rules can't be removed at runtime
+	Source string `json:"source"`
+	BlackListRuleItem
+}
+
+// blacklistRule - rule with compiled pattern
+type blacklistRule struct {
+	BlackListRuleItem
+	re     *regexp.Regexp
+	stored bool
+}
+
+// Validate - check type and pattern, rules are rejected before they're stored
+func (rule *BlackListRuleItem) Validate() (err error) {
+	if rule.Type != "message" && rule.Type != "sender" {
+		return fmt.Errorf("blacklist rule `%s` has unknown type `%s`, should be message or sender", rule.Pattern, rule.Type)
+	}
+	if rule.Pattern == "" {
+		return fmt.Errorf("blacklist rule pattern is empty")
+	}
+	if _, err = regexp.Compile(rule.Pattern); err != nil {
+		return fmt.Errorf("blacklist rule `%s`: %+v", rule.Pattern, err)
+	}
+	return
+}
+
+// ID - short rule identifier, same pattern can be added once per channel
+func (rule *BlackListRuleItem) ID() string {
+	sum := sha1.Sum([]byte(rule.Channel + "\n" + rule.Pattern))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+func (rule *BlackListRuleItem) Expired(now time.Time) bool {
+	return rule.Expires != nil && !rule.Expires.After(now)
+}
+
+// item - rule copy, match counter is updated concurrently
+func (rule *blacklistRule) item() BlackListRuleItem {
+	return BlackListRuleItem{
+		Type:    rule.Type,
+		Pattern: rule.Pattern,
+		Matches: atomic.LoadInt64(&rule.Matches),
+		Channel: rule.Channel,
+		Expires: rule.Expires,
+	}
+}
+
+func compileBlacklist(rules []BlackListRuleItem, stored bool) (compiled []*blacklistRule, invalid []BlackListRuleItem) {
+	for _, rule := range rules {
+		if rule.Validate() != nil {
+			invalid = append(invalid, rule)
+			continue
+		}
+		compiled = append(compiled, &blacklistRule{BlackListRuleItem: rule, re: regexp.MustCompile(rule.Pattern), stored: stored})
+	}
+	return
+}
+
+// blacklistRules - config file rules followed by stored ones, stored rules are cached
+// for BlacklistRefreshInterval, expired ones are removed from storage
+func (tb *TorpedoBot) blacklistRules(refresh bool) (rules []*blacklistRule) {
+	rules = tb.noSpamSettings()
+	tb.blacklistLock.Lock()
+	defer tb.blacklistLock.Unlock()
+	if tb.Store == nil {
+		tb.storedBlacklist, tb.blacklistLoaded = nil, time.Time{}
+	} else if refresh || time.Since(tb.blacklistLoaded) > BlacklistRefreshInterval {
+		stored, err := tb.Store.GetBlacklistRules()
+		if err != nil {
+			tb.logger.Printf("Could not get blacklist rules: %+v\n", err)
+		} else {
+			compiled, invalid := compileBlacklist(stored, true)
+			for _, rule := range invalid {
+				tb.logger.Printf("Skipping invalid blacklist rule %+v\n", rule)
+			}
+			now := time.Now()
+			tb.storedBlacklist = make([]*blacklistRule, 0, len(compiled))
+			for _, rule := range compiled {
+				if !rule.Expired(now) {
+					tb.storedBlacklist = append(tb.storedBlacklist, rule)
+					continue
+				}
+				tb.logger.Printf("Blacklist rule %s expired\n", rule.ID())
+				if err = tb.Store.RemoveBlacklistRule(rule.item()); err != nil {
+					tb.logger.Printf("Could not remove expired blacklist rule %s: %+v\n", rule.ID(), err)
+				}
+			}
+			tb.blacklistLoaded = now
+		}
+	}
+	rules = append(append([]*blacklistRule{}, rules...), tb.storedBlacklist...)
+	return
+}
+
+// GetBlacklist - all rules with current match counts
+func (tb *TorpedoBot) GetBlacklist() (entries []BlacklistEntry) {
+	entries = make([]BlacklistEntry, 0)
+	for _, rule := range tb.blacklistRules(true) {
+		entry := BlacklistEntry{ID: rule.ID(), Source: "config", BlackListRuleItem: rule.item()}
+		if rule.stored {
+			entry.Source = "store"
+		}
+		entries = append(entries, entry)
+	}
+	return
+}
+
+// AddBlacklistRule - validate and store rule, replaces rule with same pattern and channel
+func (tb *TorpedoBot) AddBlacklistRule(rule BlackListRuleItem) (entry BlacklistEntry, err error) {
+	if err = rule.Validate(); err != nil {
+		return
+	}
+	if rule.Expired(time.Now()) {
+		err = fmt.Errorf("blacklist rule `%s` expiry time is in the past", rule.Pattern)
+		return
+	}
+	if tb.Store == nil {
+		err = fmt.Errorf("blacklist rules require storage")
+		return
+	}
+	rule.Matches = 0
+	if err = tb.Store.AddBlacklistRule(rule); err != nil {
+		return
+	}
+	tb.blacklistRules(true)
+	entry = BlacklistEntry{ID: rule.ID(), Source: "store", BlackListRuleItem: rule}
+	return
+}
+
+// RemoveBlacklistRule - remove stored rule by ID
+func (tb *TorpedoBot) RemoveBlacklistRule(id string) (err error) {
+	for _, rule := range tb.blacklistRules(true) {
+		if rule.ID() != id {
+			continue
+		}
+		if !rule.stored {
+			return fmt.Errorf("Blacklist rule %s is set in config file", id)
+		}
+		if err = tb.Store.RemoveBlacklistRule(rule.item()); err != nil {
+			return
+		}
+		tb.blacklistRules(true)
+		return
+	}
+	return fmt.Errorf("No such blacklist rule: %s", id)
+}
+
+// BlacklistCommand - `blacklist` command, admins only
+func (tb *TorpedoBot) BlacklistCommand() *Command {
+	reply := func(handler func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (string, error)) CommandHandler {
+		return func(botapi *torpedo_registry.BotAPI, channel interface{}, cmd *ParsedCommand) {
+			api := botapi.API.(*TorpedoBotAPI)
+			message, err := handler(api, channel, cmd)
+			if err != nil {
+				message = err.Error()
+			}
+			api.PostMessage(channel, message)
+		}
+	}
+	return &Command{
+		Name: "blacklist",
+		Help: "Manage message and sender blacklist",
+		Role: RoleAdmin,
+		Subcommands: []*Command{
+			{
+				Name: "add",
+				Help: "Ignore messages matching regular expression, e.g. `blacklist add --here --expires 24h (?i)buy now`",
+				Args: []ArgSpec{
+					{Name: "pattern", Help: "Regular expression, taken as typed", Required: true, Rest: true, Raw: true},
+				},
+				Flags: []ArgSpec{
+					{Name: "sender", Short: "s", Help: "Match sender ID instead of message", Type: ArgBool},
+					{Name: "here", Help: "Only in this channel", Type: ArgBool},
+					{Name: "expires", Short: "e", Help: "Remove rule after this time, e.g. 30m or 24h"},
+				},
+				Handler: reply(func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (message string, err error) {
+					rule := BlackListRuleItem{Type: "message", Pattern: cmd.String("pattern")}
+					if cmd.Bool("sender") {
+						rule.Type = "sender"
+					}
+					if cmd.Bool("here") {
+						rule.Channel = ChannelKey(api, channel)
+					}
+					if cmd.Has("expires") {
+						ttl, perr := time.ParseDuration(cmd.String("expires"))
+						if perr != nil || ttl <= 0 {
+							err = fmt.Errorf("Invalid expiry time `%s`, use e.g. 30m or 24h", cmd.String("expires"))
+							return
+						}
+						expires := time.Now().Add(ttl)
+						rule.Expires = &expires
+					}
+					entry, err := tb.AddBlacklistRule(rule)
+					message = fmt.Sprintf("Blacklist rule %s added", entry.ID)
+					return
+				}),
+			},
+			{
+				Name: "list",
+				Help: "List rules with match counts",
+				Handler: reply(func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (message string, err error) {
+					entries := tb.GetBlacklist()
+					if len(entries) == 0 {
+						message = "Blacklist is empty"
+						return
+					}
+					lines := []string{"Blacklist rules:"}
+					for _, entry := range entries {
+						line := fmt.Sprintf("`%s` %s `%s`, %d matches", entry.ID, entry.Type, entry.Pattern, entry.Matches)
+						if entry.Channel != "" {
+							line += ", in " + entry.Channel
+						}
+						if entry.Expires != nil {
+							line += ", expires " + entry.Expires.Format(time.RFC3339)
+						}
+						if entry.Source == "config" {
+							line += " (config)"
+						}
+						lines = append(lines, line)
+					}
+					message = strings.Join(lines, "\n")
+					return
+				}),
+			},
+			{
+				Name: "remove",
+				Help: "Remove rule by ID from `blacklist list`",
+				Args: []ArgSpec{{Name: "id", Help: "Rule ID", Required: true}},
+				Handler: reply(func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (message string, err error) {
+					err = tb.RemoveBlacklistRule(cmd.String("id"))
+					message = fmt.Sprintf("Blacklist rule %s removed", cmd.String("id"))
+					return
+				}),
+			},
+		},
+	}
+}
@@ -0,0 +1,112 @@
+package multibot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func TestBlacklist(t *testing.T) {
+	bot := multibot.New()
+	multibot.RegisterCommand(bot.BlacklistCommand())
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := multibot.NewBoltStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bot is shared by tests
+	bot.Store = store
+	defer func() {
+		bot.Store = nil
+		store.Close()
+	}()
+	torpedo_registry.Config.SetConfig("admins", "U1")
+	defer torpedo_registry.Config.SetConfig("admins", "")
+
+	invalid := []multibot.BlackListRuleItem{
+		{Type: "message", Pattern: "(unclosed"},
+		{Type: "subject", Pattern: "spam"},
+		{Type: "message", Pattern: ""},
+	}
+	for _, rule := range invalid {
+		if _, err = bot.AddBlacklistRule(rule); err == nil {
+			t.Errorf("rule %+v was accepted", rule)
+		}
+	}
+	expires := time.Now().Add(50 * time.Millisecond)
+	if _, err = bot.AddBlacklistRule(multibot.BlackListRuleItem{Type: "message", Pattern: "soon gone", Expires: &expires}); err != nil {
+		t.Fatal(err)
+	}
+
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	admin := &torpedo_registry.UserProfile{ID: "U1", Nick: "alice"}
+	user := &torpedo_registry.UserProfile{ID: "U2", Nick: "bob"}
+	send := func(user *torpedo_registry.UserProfile, channel, message string) string {
+		lp.Inject(user, channel, message)
+		if reply := lp.WaitReply(200 * time.Millisecond); reply != nil {
+			return reply.Text
+		}
+		return ""
+	}
+
+	if reply := send(user, "blacklist-1", "!blacklist add spam"); reply != "You are not allowed to run `!blacklist`" {
+		t.Errorf("user add: got `%s`", reply)
+	}
+	if reply := send(admin, "blacklist-2", "!blacklist add --here (?i)buy now"); !strings.HasPrefix(reply, "Blacklist rule ") {
+		t.Fatalf("add: got `%s`", reply)
+	}
+	time.Sleep(multibot.DefaultRateLimit)
+	if reply := send(user, "blacklist-2", "!echo BUY NOW"); reply != "" {
+		t.Errorf("blacklisted message got reply `%s`", reply)
+	}
+	// rule is limited to channel it was added in
+	if reply := send(user, "blacklist-3", "!echo buy now"); reply != "bob said: !echo buy now" {
+		t.Errorf("other channel: got `%s`", reply)
+	}
+
+	// expired rule is gone
+	time.Sleep(50 * time.Millisecond)
+	entries := bot.GetBlacklist()
+	if len(entries) != 1 || entries[0].Matches != 1 || entries[0].Channel != "loopback:blacklist-2" {
+		t.Fatalf("unexpected rules: %+v", entries)
+	}
+	if reply := send(admin, "blacklist-4", "!blacklist list"); !strings.Contains(reply, "`(?i)buy now`, 1 matches, in loopback:blacklist-2") {
+		t.Errorf("list: got `%s`", reply)
+	}
+	if reply := send(admin, "blacklist-5", "!blacklist remove "+entries[0].ID); reply != "Blacklist rule "+entries[0].ID+" removed" {
+		t.Errorf("remove: got `%s`", reply)
+	}
+	if reply := send(admin, "blacklist-6", "!blacklist remove "+entries[0].ID); !strings.HasPrefix(reply, "No such blacklist rule") {
+		t.Errorf("second remove: got `%s`", reply)
+	}
+
+	// pattern is kept as typed, backslashes and quotes included
+	for _, pattern := range []string{`code \d{4}  now`, `it's "quoted`} {
+		if reply := send(admin, "blacklist-7", "!blacklist add --here "+pattern); !strings.HasPrefix(reply, "Blacklist rule ") {
+			t.Fatalf("add `%s`: got `%s`", pattern, reply)
+		}
+		time.Sleep(multibot.DefaultRateLimit)
+	}
+	entries = bot.GetBlacklist()
+	if len(entries) != 2 || entries[0].Pattern != `code \d{4}  now` || entries[1].Pattern != `it's "quoted` {
+		t.Fatalf("unexpected rules: %+v", entries)
+	}
+	if reply := send(user, "blacklist-7", "!echo code 1234  now"); reply != "" {
+		t.Errorf("blacklisted message got reply `%s`", reply)
+	}
+	for _, entry := range entries {
+		bot.RemoveBlacklistRule(entry.ID)
+	}
+}
@@ -0,0 +1,405 @@
+package multibot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltCounters  = []byte("counters")
+	boltBlacklist = []byte("blacklist")
+	boltHistory   = []byte("history")
+	boltRooms     = []byte("rooms")
+	boltAliases   = []byte("aliases")
+	boltRoles     = []byte("roles")
+	boltBridges   = []byte("bridges")
+	boltJobs      = []byte("jobs")
+	// history indexes, keys end with history item key
+	boltHistoryChannel = []byte("history_channel")
+	boltHistoryNick    = []byte("history_nick")
+	boltHistoryExpires = []byte("history_expires")
+)
+
+// BoltStore - embedded Store, single file, no external services required
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string) (store *BoltStore, err error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltCounters, boltBlacklist, boltHistory, boltRooms, boltAliases, boltRoles, boltBridges, boltJobs,
+			boltHistoryChannel, boltHistoryNick, boltHistoryExpires} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return
+	}
+	store = &BoltStore{db: db}
+	return
+}
+
+func boltItob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func (bs *BoltStore) IncrementCounter(name string, delta int64) (value int64, err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltCounters)
+		if current := bucket.Get([]byte(name)); current != nil {
+			value = int64(binary.BigEndian.Uint64(current))
+		}
+		value += delta
+		return bucket.Put([]byte(name), boltItob(uint64(value)))
+	})
+	return
+}
+
+// boltBlacklistKey - pattern, prefixed with channel for channel rules
+func boltBlacklistKey(rule BlackListRuleItem) []byte {
+	if rule.Channel == "" {
+		return []byte(rule.Pattern)
+	}
+	return []byte(rule.Channel + "\n" + rule.Pattern)
+}
+
+func (bs *BoltStore) GetBlacklistRules() (rules []BlackListRuleItem, err error) {
+	rules = []BlackListRuleItem{}
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlacklist).ForEach(func(k, v []byte) error {
+			rule := BlackListRuleItem{}
+			if err := json.Unmarshal(v, &rule); err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+			return nil
+		})
+	})
+	return
+}
+
+func (bs *BoltStore) AddBlacklistRule(rule BlackListRuleItem) (err error) {
+	value, err := json.Marshal(&rule)
+	if err != nil {
+		return
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlacklist).Put(boltBlacklistKey(rule), value)
+	})
+	return
+}
+
+func (bs *BoltStore) RemoveBlacklistRule(rule BlackListRuleItem) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlacklist).Delete(boltBlacklistKey(rule))
+	})
+	return
+}
+
+func (bs *BoltStore) BlacklistRuleMatched(matched BlackListRuleItem) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBlacklist)
+		value := bucket.Get(boltBlacklistKey(matched))
+		if value == nil {
+			return nil
+		}
+		rule := BlackListRuleItem{}
+		if err := json.Unmarshal(value, &rule); err != nil {
+			return err
+		}
+		rule.Matches += 1
+		value, err := json.Marshal(&rule)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(boltBlacklistKey(matched), value)
+	})
+	return
+}
+
+func boltHistoryChannelKey(protocol, channel string) []byte {
+	return []byte(protocol + "\x00" + channel + "\x00")
+}
+
+func boltHistoryNickKey(nick string) []byte {
+	return []byte(strings.ToLower(nick) + "\x00")
+}
+
+func (bs *BoltStore) AddHistory(item *HistoryItem) (err error) {
+	value, err := json.Marshal(item)
+	if err != nil {
+		return
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltHistory)
+		// sequential keys keep history in insertion order
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := boltItob(id)
+		if err = bucket.Put(key, value); err != nil {
+			return err
+		}
+		if err = tx.Bucket(boltHistoryChannel).Put(append(boltHistoryChannelKey(item.Protocol, item.Channel), key...), key); err != nil {
+			return err
+		}
+		if item.Nick != "" {
+			if err = tx.Bucket(boltHistoryNick).Put(append(boltHistoryNickKey(item.Nick), key...), key); err != nil {
+				return err
+			}
+		}
+		if item.Expires != nil {
+			return tx.Bucket(boltHistoryExpires).Put(append(boltItob(uint64(item.Expires.UnixNano())), key...), key)
+		}
+		return nil
+	})
+	return
+}
+
+// boltReversePrefix - call fn for values of keys with prefix, last key first, until fn returns false
+func boltReversePrefix(bucket *bolt.Bucket, prefix []byte, fn func(value []byte) bool) {
+	cursor := bucket.Cursor()
+	// keys are prefix followed by 8 byte item key
+	k, v := cursor.Seek(append(append([]byte{}, prefix...), bytes.Repeat([]byte{0xff}, 9)...))
+	if k == nil {
+		k, v = cursor.Last()
+	} else {
+		k, v = cursor.Prev()
+	}
+	for ; k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Prev() {
+		if !fn(v) {
+			return
+		}
+	}
+}
+
+func (bs *BoltStore) SearchHistory(query HistoryQuery) (items []*HistoryItem, err error) {
+	items = make([]*HistoryItem, 0)
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(boltHistory)
+		var decode_err error
+		collect := func(value []byte) bool {
+			item := &HistoryItem{}
+			if decode_err = json.Unmarshal(value, item); decode_err != nil {
+				return false
+			}
+			if query.Matches(item) {
+				items = append(items, item)
+			}
+			return query.Limit <= 0 || len(items) < query.Limit
+		}
+		lookup := func(key []byte) bool {
+			return collect(history.Get(key))
+		}
+		// use most selective index
+		switch {
+		case query.Channel != "" && query.Protocol != "":
+			boltReversePrefix(tx.Bucket(boltHistoryChannel), boltHistoryChannelKey(query.Protocol, query.Channel), lookup)
+		case query.Nick != "":
+			boltReversePrefix(tx.Bucket(boltHistoryNick), boltHistoryNickKey(query.Nick), lookup)
+		default:
+			boltReversePrefix(history, []byte{}, collect)
+		}
+		return decode_err
+	})
+	return
+}
+
+func (bs *BoltStore) PruneHistory(now time.Time) (removed int, err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		history := tx.Bucket(boltHistory)
+		expires := tx.Bucket(boltHistoryExpires)
+		limit := boltItob(uint64(now.UnixNano()))
+		// deleting while iterating skips keys
+		expired := make([][2][]byte, 0)
+		cursor := expires.Cursor()
+		for k, key := cursor.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, key = cursor.Next() {
+			expired = append(expired, [2][]byte{append([]byte{}, k...), append([]byte{}, key...)})
+		}
+		for _, pair := range expired {
+			key := pair[1]
+			item := &HistoryItem{}
+			if value := history.Get(key); value != nil && json.Unmarshal(value, item) == nil {
+				tx.Bucket(boltHistoryChannel).Delete(append(boltHistoryChannelKey(item.Protocol, item.Channel), key...))
+				if item.Nick != "" {
+					tx.Bucket(boltHistoryNick).Delete(append(boltHistoryNickKey(item.Nick), key...))
+				}
+			}
+			if err := history.Delete(key); err != nil {
+				return err
+			}
+			if err := expires.Delete(pair[0]); err != nil {
+				return err
+			}
+			removed += 1
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *BoltStore) GetRooms(protocol, account string) (rooms []string, err error) {
+	rooms = make([]string, 0)
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRooms).Bucket([]byte(protocol + ":" + account))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			rooms = append(rooms, string(k))
+			return nil
+		})
+	})
+	return
+}
+
+func (bs *BoltStore) AddRoom(protocol, account, room string) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(boltRooms).CreateBucketIfNotExists([]byte(protocol + ":" + account))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(room), []byte{})
+	})
+	return
+}
+
+func (bs *BoltStore) GetAliases(channel string) (aliases map[string]string, err error) {
+	aliases = make(map[string]string)
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAliases).Bucket([]byte(channel))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			aliases[string(k)] = string(v)
+			return nil
+		})
+	})
+	return
+}
+
+func (bs *BoltStore) SetAlias(channel, alias, command string) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(boltAliases).CreateBucketIfNotExists([]byte(channel))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(alias), []byte(command))
+	})
+	return
+}
+
+func (bs *BoltStore) RemoveAlias(channel, alias string) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltAliases).Bucket([]byte(channel))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(alias))
+	})
+	return
+}
+
+func (bs *BoltStore) GetRoles() (roles map[string]string, err error) {
+	roles = make(map[string]string)
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRoles).ForEach(func(k, v []byte) error {
+			roles[string(k)] = string(v)
+			return nil
+		})
+	})
+	return
+}
+
+func (bs *BoltStore) SetRole(user, role string) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRoles).Put([]byte(user), []byte(role))
+	})
+	return
+}
+
+func (bs *BoltStore) RemoveRole(user string) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltRoles).Delete([]byte(user))
+	})
+	return
+}
+
+func (bs *BoltStore) GetBridges() (bridges map[string][]string, err error) {
+	bridges = make(map[string][]string)
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBridges).ForEach(func(k, v []byte) error {
+			bridges[string(k)] = strings.Split(string(v), "\n")
+			return nil
+		})
+	})
+	return
+}
+
+func (bs *BoltStore) SetBridge(name string, channels []string) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBridges).Put([]byte(name), []byte(strings.Join(channels, "\n")))
+	})
+	return
+}
+
+func (bs *BoltStore) RemoveBridge(name string) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBridges).Delete([]byte(name))
+	})
+	return
+}
+
+func (bs *BoltStore) GetJobs() (jobs []*ScheduledJob, err error) {
+	jobs = make([]*ScheduledJob, 0)
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJobs).ForEach(func(k, v []byte) error {
+			job := &ScheduledJob{}
+			if err := json.Unmarshal(v, job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+	return
+}
+
+func (bs *BoltStore) SaveJob(job *ScheduledJob) (err error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJobs).Put([]byte(job.ID), data)
+	})
+	return
+}
+
+func (bs *BoltStore) RemoveJob(id string) (err error) {
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJobs).Delete([]byte(id))
+	})
+	return
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
@@ -0,0 +1,106 @@
+package multibot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+	store, err := multibot.NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(1); i <= 3; i++ {
+		if value, err := store.IncrementCounter(multibot.CounterTotalMessages, 1); err != nil || value != i {
+			t.Errorf("counter: got %d (%+v), expected %d", value, err, i)
+		}
+	}
+
+	advertising := multibot.BlackListRuleItem{Type: "message", Pattern: "cheap advertising"}
+	spammer := multibot.BlackListRuleItem{Type: "sender", Pattern: "spammer@example.com"}
+	store.AddBlacklistRule(advertising)
+	store.AddBlacklistRule(spammer)
+	store.AddBlacklistRule(multibot.BlackListRuleItem{Type: "sender", Pattern: "spammer@example.com", Channel: "irc:#torpedo"})
+	store.BlacklistRuleMatched(advertising)
+	store.RemoveBlacklistRule(spammer)
+	rules, err := store.GetBlacklistRules()
+	if err != nil || len(rules) != 2 || rules[0].Matches != 1 || rules[1].Channel != "irc:#torpedo" {
+		t.Errorf("blacklist: got %+v (%+v)", rules, err)
+	}
+
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	history := []*multibot.HistoryItem{
+		{Timestamp: 1, Protocol: "irc", Channel: "#torpedo", Nick: "Alice", Message: "release is on Friday"},
+		{Timestamp: 2, Protocol: "irc", Channel: "#torpedo", Nick: "bob", Message: "which release?"},
+		{Timestamp: 3, Protocol: "slack", Channel: "C1", Nick: "alice", Message: "hello"},
+		{Timestamp: 4, Protocol: "irc", Channel: "#torpedo", Nick: "alice", Message: "old release", Expires: &expired},
+	}
+	for _, item := range history {
+		if err = store.AddHistory(item); err != nil {
+			t.Errorf("history: %+v", err)
+		}
+	}
+	if items, err := store.SearchHistory(multibot.HistoryQuery{Protocol: "irc", Channel: "#torpedo", Text: "RELEASE"}); err != nil || len(items) != 3 || items[0].Timestamp != 4 {
+		t.Errorf("history search: got %+v (%+v)", items, err)
+	}
+	if items, _ := store.SearchHistory(multibot.HistoryQuery{Nick: "alice", Limit: 2}); len(items) != 2 || items[1].Protocol != "slack" {
+		t.Errorf("history by nick: got %+v", items)
+	}
+	if removed, err := store.PruneHistory(now); err != nil || removed != 1 {
+		t.Errorf("history prune: removed %d (%+v)", removed, err)
+	}
+	if items, _ := store.SearchHistory(multibot.HistoryQuery{Text: "release"}); len(items) != 2 {
+		t.Errorf("history after prune: got %+v", items)
+	}
+
+	store.AddRoom("irc", "irc.example.com", "#torpedo")
+	store.AddRoom("irc", "irc.example.com", "#torpedo")
+	store.AddRoom("jabber", "bot@example.com", "room@conference.example.com")
+	if rooms, err := store.GetRooms("irc", "irc.example.com"); err != nil || len(rooms) != 1 || rooms[0] != "#torpedo" {
+		t.Errorf("rooms: got %+v (%+v)", rooms, err)
+	}
+	if rooms, _ := store.GetRooms("irc", "other.example.com"); len(rooms) != 0 {
+		t.Errorf("rooms of other server: %+v", rooms)
+	}
+
+	store.SetAlias("loopback:C1", "w", "weather --units metric")
+	store.SetAlias("loopback:C1", "x", "xkcd")
+	store.RemoveAlias("loopback:C1", "x")
+	if aliases, err := store.GetAliases("loopback:C1"); err != nil || len(aliases) != 1 || aliases["w"] != "weather --units metric" {
+		t.Errorf("aliases: got %+v (%+v)", aliases, err)
+	}
+	if aliases, _ := store.GetAliases("loopback:C2"); len(aliases) != 0 {
+		t.Errorf("aliases of other channel: %+v", aliases)
+	}
+
+	store.SetRole("slack:U1", "admin")
+	store.SetRole("irc:spammer@irc.example.com", "banned")
+	store.RemoveRole("slack:U1")
+	if roles, err := store.GetRoles(); err != nil || len(roles) != 1 || roles["irc:spammer@irc.example.com"] != "banned" {
+		t.Errorf("roles: got %+v (%+v)", roles, err)
+	}
+
+	// data survives reopen
+	store.Close()
+	store, err = multibot.NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if value, _ := store.IncrementCounter(multibot.CounterTotalMessages, 0); value != 3 {
+		t.Errorf("counter after reopen: got %d, expected 3", value)
+	}
+}
@@ -0,0 +1,424 @@
+package multibot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// BridgeEchoWindow - relayed message that comes back to channel within this interval is dropped,
+// some protocols (e.g. Jabber MUC) deliver bot's own messages back to it
+var BridgeEchoWindow = 30 * time.Second
+
+// maxRelayedMessages - recently relayed messages kept per channel for echo detection
+const maxRelayedMessages = 50
+
+// BridgeConfig - channels relaying messages to each other, `protocol:channel` (see ChannelKey)
+// or `protocol/account:channel` (see BridgeChannelKey)
+type BridgeConfig struct {
+	Name     string   `yaml:"name"`
+	Channels []string `yaml:"channels"`
+}
+
+type relayedMessage struct {
+	text string
+	at   time.Time
+}
+
+// BridgeChannelKey - channel key with ID of account that received message (see WebhookAccountID),
+// `protocol/account:channel`
+func BridgeChannelKey(api *TorpedoBotAPI, channel interface{}) string {
+	return fmt.Sprintf("%s:%v", AccountKey(api), channel)
+}
+
+// bridgeKeys - keys channel may be listed under in bridges, with account ID and without it
+func bridgeKeys(api *TorpedoBotAPI, channel interface{}) []string {
+	return []string{BridgeChannelKey(api, channel), ChannelKey(api, channel)}
+}
+
+// parseBridgeChannel - protocol, account ID (empty if not set) and channel name of bridge channel
+func parseBridgeChannel(key string) (protocol, account_id, channel string) {
+	protocol, channel = parseHistoryChannel(key)
+	if idx := strings.Index(protocol, "/"); idx != -1 {
+		protocol, account_id = protocol[:idx], protocol[idx+1:]
+	}
+	return
+}
+
+// validateBridgeChannel - channel is `protocol:channel` or `protocol/account:channel`
+func validateBridgeChannel(key string) error {
+	prefix, channel := parseHistoryChannel(key)
+	if prefix == "" || channel == "" || strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("Bridge channel `%s` should be `protocol:channel` or `protocol/account:channel`", key)
+	}
+	return nil
+}
+
+// Validate - bridge has name and at least two channels
+func (bc *BridgeConfig) Validate() error {
+	if bc.Name == "" {
+		return fmt.Errorf("bridge name is required")
+	}
+	if len(bc.Channels) < 2 {
+		return fmt.Errorf("bridge `%s` needs at least two channels", bc.Name)
+	}
+	for _, key := range bc.Channels {
+		if err := validateBridgeChannel(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBridges - names are unique and every channel is in one bridge only
+func validateBridges(bridges []BridgeConfig) error {
+	names := make(map[string]bool)
+	channels := make(map[string]string)
+	for _, bridge := range bridges {
+		if err := bridge.Validate(); err != nil {
+			return err
+		}
+		if names[bridge.Name] {
+			return fmt.Errorf("duplicate bridge `%s`", bridge.Name)
+		}
+		names[bridge.Name] = true
+		for _, key := range bridge.Channels {
+			if other, ok := channels[key]; ok {
+				return fmt.Errorf("`%s` is in bridges `%s` and `%s`", key, other, bridge.Name)
+			}
+			channels[key] = bridge.Name
+		}
+	}
+	return nil
+}
+
+func (tb *TorpedoBot) setBridgeSettings(bridges []BridgeConfig) {
+	tb.bridgesLock.Lock()
+	defer tb.bridgesLock.Unlock()
+	tb.configBridges = make(map[string][]string, len(bridges))
+	for _, bridge := range bridges {
+		tb.configBridges[bridge.Name] = bridge.Channels
+	}
+}
+
+// storedBridges - bridges linked with `bridge link`, loaded from storage on first use.
+// Call with bridgesLock held
+func (tb *TorpedoBot) storedBridges() map[string][]string {
+	if tb.bridges != nil {
+		return tb.bridges
+	}
+	tb.bridges = make(map[string][]string)
+	if tb.Store == nil {
+		return tb.bridges
+	}
+	stored, err := tb.Store.GetBridges()
+	if err != nil {
+		tb.logger.Printf("Could not get bridges: %+v\n", err)
+	}
+	for name, channels := range stored {
+		tb.bridges[name] = channels
+	}
+	return tb.bridges
+}
+
+// GetBridges - config file and linked bridges by name, configured tells which ones come from config
+func (tb *TorpedoBot) GetBridges() (bridges map[string][]string, configured map[string]bool) {
+	tb.bridgesLock.Lock()
+	defer tb.bridgesLock.Unlock()
+	bridges = make(map[string][]string)
+	configured = make(map[string]bool)
+	for name, channels := range tb.storedBridges() {
+		bridges[name] = append([]string{}, channels...)
+	}
+	for name, channels := range tb.configBridges {
+		bridges[name] = append([]string{}, channels...)
+		configured[name] = true
+	}
+	return
+}
+
+// bridgeOf - bridge channel listed under one of keys belongs to and key it's listed under, empty name if none
+func (tb *TorpedoBot) bridgeOf(keys ...string) (name string, channels []string, member string) {
+	bridges, _ := tb.GetBridges()
+	for bridge_name, bridge_channels := range bridges {
+		for _, channel := range bridge_channels {
+			for _, key := range keys {
+				if channel == key {
+					return bridge_name, bridge_channels, key
+				}
+			}
+		}
+	}
+	return
+}
+
+// LinkBridge - add channels to bridge, bridge is created if it doesn't exist. Config file bridges can't be changed
+func (tb *TorpedoBot) LinkBridge(name string, channels ...string) (err error) {
+	for _, key := range channels {
+		if err = validateBridgeChannel(key); err != nil {
+			return
+		}
+		if other, _, _ := tb.bridgeOf(key); other != "" && other != name {
+			return fmt.Errorf("`%s` is already in bridge `%s`", key, other)
+		}
+	}
+	tb.bridgesLock.Lock()
+	defer tb.bridgesLock.Unlock()
+	if _, ok := tb.configBridges[name]; ok {
+		return fmt.Errorf("Bridge `%s` is set in config", name)
+	}
+	linked := append([]string{}, tb.storedBridges()[name]...)
+	for _, key := range channels {
+		found := false
+		for _, channel := range linked {
+			found = found || channel == key
+		}
+		if !found {
+			linked = append(linked, key)
+		}
+	}
+	if len(linked) < 2 {
+		return fmt.Errorf("Bridge `%s` needs another channel", name)
+	}
+	if tb.Store != nil {
+		if err = tb.Store.SetBridge(name, linked); err != nil {
+			return
+		}
+	}
+	tb.bridges[name] = linked
+	return
+}
+
+// UnlinkBridge - remove channel from its bridge, bridge with one channel left is removed
+func (tb *TorpedoBot) UnlinkBridge(key string) (name string, err error) {
+	name, _, _ = tb.bridgeOf(key)
+	if name == "" {
+		err = fmt.Errorf("`%s` is not bridged", key)
+		return
+	}
+	tb.bridgesLock.Lock()
+	defer tb.bridgesLock.Unlock()
+	if _, ok := tb.configBridges[name]; ok {
+		err = fmt.Errorf("Bridge `%s` is set in config", name)
+		return
+	}
+	linked := make([]string, 0)
+	for _, channel := range tb.storedBridges()[name] {
+		if channel != key {
+			linked = append(linked, channel)
+		}
+	}
+	if len(linked) < 2 {
+		if tb.Store != nil {
+			err = tb.Store.RemoveBridge(name)
+		}
+		if err == nil {
+			delete(tb.bridges, name)
+		}
+		return
+	}
+	if tb.Store != nil {
+		if err = tb.Store.SetBridge(name, linked); err != nil {
+			return
+		}
+	}
+	tb.bridges[name] = linked
+	return
+}
+
+// relayAccount - account to send to protocol with: account with given ID, account that received message
+// if protocol is the same or first connected account of protocol
+func (tb *TorpedoBot) relayAccount(api *TorpedoBotAPI, protocol, account_id string) (proto Protocol, account *torpedo_registry.Account) {
+	if account_id != "" {
+		return tb.connectedAccountByKey(protocol, account_id)
+	}
+	if protocol == api.ProtocolName {
+		return api.Protocol, api.Account
+	}
+	return tb.connectedAccount(protocol, -1)
+}
+
+// protocolChannel - protocol channel by name, protocols with non-string channels implement ChannelParser
+func protocolChannel(proto Protocol, name string) (interface{}, error) {
+	if parser, ok := proto.(ChannelParser); ok {
+		return parser.ParseChannel(name)
+	}
+	return name, nil
+}
+
+// relayRichMessages - rich messages are passed to protocols that can show images,
+// others get image and link URLs appended to text
+func relayRichMessages(proto Protocol, message string, richmsgs []torpedo_registry.RichMessage) (string, []torpedo_registry.RichMessage) {
+	capabilities := proto.Capabilities()
+	if len(richmsgs) == 0 || capabilities.Images || capabilities.RichMessages {
+		return message, richmsgs
+	}
+	lines := make([]string, 0, len(richmsgs)+1)
+	if message != "" {
+		lines = append(lines, message)
+	}
+	for _, richmsg := range richmsgs {
+		for _, line := range []string{richmsg.Title, richmsg.Text, richmsg.ImageURL, richmsg.TitleLink} {
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// RelayMessage - send message to other channels of its bridge as `<nick@protocol> message`,
+// nick is empty for bot's own messages, which are relayed as is
+func (tb *TorpedoBot) RelayMessage(api *TorpedoBotAPI, channel interface{}, nick, message string, richmsgs []torpedo_registry.RichMessage) {
+	if message == "" && len(richmsgs) == 0 {
+		return
+	}
+	name, channels, key := tb.bridgeOf(bridgeKeys(api, channel)...)
+	if name == "" {
+		return
+	}
+	if nick != "" {
+		message = fmt.Sprintf("<%s@%s> %s", nick, api.ProtocolName, message)
+	}
+	for _, target := range channels {
+		if target == key {
+			continue
+		}
+		protocol, account_id, target_name := parseBridgeChannel(target)
+		proto, account := tb.relayAccount(api, protocol, account_id)
+		if proto == nil {
+			tb.logger.Printf("Bridge %s: no connected %s account for %s\n", name, protocol, target)
+			continue
+		}
+		target_channel, err := protocolChannel(proto, target_name)
+		if err != nil {
+			tb.logger.Printf("Bridge %s: %+v\n", name, err)
+			continue
+		}
+		text, target_richmsgs := relayRichMessages(proto, message, richmsgs)
+		botApi, err := tb.NewOutboundAPI(proto, account)
+		if err != nil {
+			tb.logger.Printf("Bridge %s: %s can't send messages on its own: %+v\n", name, protocol, err)
+			continue
+		}
+		// echo is looked up by key of account that sent message
+		tb.rememberRelay(BridgeChannelKey(botApi, target_channel), text)
+		botApi.Relayed = true
+		if _, err = botApi.Send(&Message{Channel: target_channel, Text: text, RichMessages: target_richmsgs}); err == nil {
+			MessagesRelayed.WithLabelValues(api.ProtocolName, protocol).Inc()
+		}
+	}
+}
+
+func (tb *TorpedoBot) rememberRelay(key, text string) {
+	tb.relayedLock.Lock()
+	defer tb.relayedLock.Unlock()
+	if tb.relayed == nil {
+		tb.relayed = make(map[string][]relayedMessage)
+	}
+	recent := append(tb.relayed[key], relayedMessage{text: text, at: time.Now()})
+	if len(recent) > maxRelayedMessages {
+		recent = recent[len(recent)-maxRelayedMessages:]
+	}
+	tb.relayed[key] = recent
+}
+
+// relayEcho - message is one bot relayed to channel recently, it's consumed on match
+func (tb *TorpedoBot) relayEcho(key, message string) bool {
+	tb.relayedLock.Lock()
+	defer tb.relayedLock.Unlock()
+	recent := make([]relayedMessage, 0, len(tb.relayed[key]))
+	echo := false
+	for _, relayed := range tb.relayed[key] {
+		if time.Since(relayed.at) > BridgeEchoWindow {
+			continue
+		}
+		if !echo && relayed.text == message {
+			echo = true
+			continue
+		}
+		recent = append(recent, relayed)
+	}
+	if len(recent) == 0 {
+		delete(tb.relayed, key)
+	} else {
+		tb.relayed[key] = recent
+	}
+	return echo
+}
+
+// BridgeCommand - `bridge` command, linking channels requires admin role
+func (tb *TorpedoBot) BridgeCommand() *Command {
+	// handlers get key channel is bridged under, key with account ID if it's not bridged
+	reply := func(handler func(api *TorpedoBotAPI, key string, cmd *ParsedCommand) (string, error)) CommandHandler {
+		return func(botapi *torpedo_registry.BotAPI, channel interface{}, cmd *ParsedCommand) {
+			api := botapi.API.(*TorpedoBotAPI)
+			keys := bridgeKeys(api, channel)
+			key := keys[0]
+			if _, _, member := tb.bridgeOf(keys...); member != "" {
+				key = member
+			}
+			message, err := handler(api, key, cmd)
+			if err != nil {
+				message = err.Error()
+			}
+			api.PostMessage(channel, message)
+		}
+	}
+	return &Command{
+		Name: "bridge",
+		Help: "Relay messages between channels on different networks",
+		Subcommands: []*Command{
+			{
+				Name: "link",
+				Help: "Add this and other channels to bridge, e.g. `bridge link team slack:C024BE91L telegram:-1001234`",
+				Role: RoleAdmin,
+				Args: []ArgSpec{
+					{Name: "name", Help: "Bridge name", Required: true},
+					{Name: "channels", Help: "Other channels, `protocol:channel` or `protocol/account:channel`", Rest: true},
+				},
+				Handler: reply(func(api *TorpedoBotAPI, key string, cmd *ParsedCommand) (string, error) {
+					name := cmd.String("name")
+					err := tb.LinkBridge(name, append([]string{key}, strings.Fields(cmd.String("channels"))...)...)
+					_, channels, _ := tb.bridgeOf(key)
+					return fmt.Sprintf("Bridge `%s`: %s", name, strings.Join(channels, ", ")), err
+				}),
+			},
+			{
+				Name: "unlink",
+				Help: "Remove this channel from its bridge",
+				Role: RoleAdmin,
+				Handler: reply(func(api *TorpedoBotAPI, key string, cmd *ParsedCommand) (string, error) {
+					name, err := tb.UnlinkBridge(key)
+					return fmt.Sprintf("Channel removed from bridge `%s`", name), err
+				}),
+			},
+			{
+				Name: "list",
+				Help: "List bridges",
+				Handler: reply(func(api *TorpedoBotAPI, key string, cmd *ParsedCommand) (string, error) {
+					bridges, configured := tb.GetBridges()
+					if len(bridges) == 0 {
+						return "No bridges", nil
+					}
+					names := make([]string, 0, len(bridges))
+					for name := range bridges {
+						names = append(names, name)
+					}
+					sort.Strings(names)
+					message := "Bridges:"
+					for _, name := range names {
+						message += fmt.Sprintf("\n`%s`: %s", name, strings.Join(bridges[name], ", "))
+						if configured[name] {
+							message += " (set in config)"
+						}
+					}
+					return message, nil
+				}),
+			},
+		},
+	}
+}
@@ -0,0 +1,196 @@
+package multibot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// collectReplies - replies by channel until none arrive for a while
+func collectReplies(lp *multibot.LoopbackProtocol) (replies map[string][]string) {
+	replies = make(map[string][]string)
+	for {
+		reply := lp.WaitReply(200 * time.Millisecond)
+		if reply == nil {
+			return
+		}
+		channel := reply.Channel.(string)
+		replies[channel] = append(replies[channel], reply.Text)
+	}
+}
+
+func TestBridge(t *testing.T) {
+	bot := multibot.New()
+	torpedo_registry.Config.RegisterHelpAndHandler("echo", "Echo message back", EchoProcessMessage)
+	multibot.RegisterCommand(bot.BridgeCommand())
+	torpedo_registry.Config.SetConfig("admins", "U29")
+	defer torpedo_registry.Config.SetConfig("admins", "")
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "torpedobot.yaml")
+	config := `
+nospam:
+  limits:
+    channel:
+      rate: 0
+bridges:
+  - name: test
+    channels: ["loopback:bridge-a", "loopback:bridge-b"]
+`
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	torpedo_registry.Config.SetConfig("configfile", path)
+	defer torpedo_registry.Config.SetConfig("configfile", "")
+	if err = bot.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ioutil.WriteFile(path, []byte("accounts: []\n"), 0600)
+		bot.ReloadConfig()
+	}()
+
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	alice := &torpedo_registry.UserProfile{ID: "U21", Nick: "alice"}
+	admin := &torpedo_registry.UserProfile{ID: "U29", Nick: "admin"}
+
+	lp.Inject(alice, "bridge-a", "hello")
+	replies := collectReplies(lp)
+	if len(replies) != 1 || len(replies["bridge-b"]) != 1 || replies["bridge-b"][0] != "<alice@loopback> hello" {
+		t.Fatalf("unexpected relay: %+v", replies)
+	}
+	// relayed message delivered back to bot is not relayed again
+	lp.Inject(&torpedo_registry.UserProfile{ID: "bridge-b/torpedobot"}, "bridge-b", "<alice@loopback> hello")
+	if replies = collectReplies(lp); len(replies) != 0 {
+		t.Errorf("echo was relayed: %+v", replies)
+	}
+
+	// commands and bot replies are relayed too
+	lp.Inject(alice, "bridge-a", "!echo hi")
+	replies = collectReplies(lp)
+	if len(replies["bridge-a"]) != 1 || strings.Join(replies["bridge-b"], "|") != "<alice@loopback> !echo hi|alice said: !echo hi" {
+		t.Errorf("unexpected command relay: %+v", replies)
+	}
+
+	lp.Inject(alice, "bridge-c", "!bridge link team loopback:bridge-d")
+	if replies = collectReplies(lp); len(replies["bridge-c"]) != 1 || !strings.Contains(replies["bridge-c"][0], "not allowed") {
+		t.Errorf("non-admin linked channels: %+v", replies)
+	}
+	lp.Inject(admin, "bridge-c", "!bridge link test")
+	if replies = collectReplies(lp); len(replies["bridge-c"]) != 1 || !strings.Contains(replies["bridge-c"][0], "set in config") {
+		t.Errorf("config bridge was changed: %+v", replies)
+	}
+	// channel link is run in is added with account ID
+	lp.Inject(admin, "bridge-c", "!bridge link team loopback:bridge-d")
+	replies = collectReplies(lp)
+	linked := "Bridge `team`: loopback/" + multibot.WebhookAccountID(lp.Account()) + ":bridge-c, loopback:bridge-d"
+	if len(replies["bridge-c"]) != 1 || len(replies["bridge-d"]) != 1 || replies["bridge-d"][0] != linked {
+		t.Errorf("unexpected link reply: %+v", replies)
+	}
+	lp.Inject(alice, "bridge-d", "hi there")
+	if replies = collectReplies(lp); len(replies) != 1 || len(replies["bridge-c"]) != 1 || replies["bridge-c"][0] != "<alice@loopback> hi there" {
+		t.Errorf("unexpected relay: %+v", replies)
+	}
+	lp.Inject(alice, "bridge-c", "!bridge list")
+	if replies = collectReplies(lp); len(replies["bridge-c"]) != 1 || !strings.Contains(replies["bridge-c"][0], "`test`: loopback:bridge-a, loopback:bridge-b (set in config)") {
+		t.Errorf("unexpected list reply: %+v", replies)
+	}
+
+	// bridge with one channel left is removed
+	lp.Inject(admin, "bridge-c", "!bridge unlink")
+	collectReplies(lp)
+	if bridges, _ := bot.GetBridges(); len(bridges) != 1 {
+		t.Errorf("unexpected bridges after unlink: %+v", bridges)
+	}
+	lp.Inject(alice, "bridge-d", "anyone?")
+	if replies = collectReplies(lp); len(replies) != 0 {
+		t.Errorf("unlinked channel was relayed: %+v", replies)
+	}
+
+	// relays are sent through account of target channel, with API protocol accepts
+	ba, sent := startStrict(bot, "strict-bridge")
+	defer stopStrict(bot, ba)
+	target := "strict-bridge/" + multibot.WebhookAccountID(ba.Account) + ":room"
+	if err = bot.LinkBridge("strict", "loopback:bridge-e", target); err != nil {
+		t.Fatal(err)
+	}
+	defer bot.UnlinkBridge(target)
+	lp.Inject(alice, "bridge-e", "to strict")
+	select {
+	case message := <-sent:
+		if message != "room: <alice@loopback> to strict" {
+			t.Errorf("unexpected relay: %s", message)
+		}
+	case <-time.After(replyTimeout):
+		t.Errorf("message was not relayed to strict protocol")
+	}
+	for _, key := range []string{"strict-bridge/:room", "/abc:room", "loopback:"} {
+		if err = bot.LinkBridge("invalid", "loopback:bridge-f", key); err == nil {
+			t.Errorf("invalid channel `%s` was linked", key)
+		}
+	}
+}
+
+func TestBridgeRateLimit(t *testing.T) {
+	bot := multibot.New()
+	torpedo_registry.Config.RegisterHelpAndHandler("echo", "Echo message back", EchoProcessMessage)
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "torpedobot.yaml")
+	config := `
+nospam:
+  limits:
+    channel:
+      rate: 1
+      per: 1h
+bridges:
+  - name: throttled
+    channels: ["loopback:throttle-a", "loopback:throttle-b"]
+`
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	torpedo_registry.Config.SetConfig("configfile", path)
+	defer torpedo_registry.Config.SetConfig("configfile", "")
+	if err = bot.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ioutil.WriteFile(path, []byte("accounts: []\n"), 0600)
+		bot.ReloadConfig()
+	}()
+
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	alice := &torpedo_registry.UserProfile{ID: "U23", Nick: "alice"}
+	// bot's own messages don't take channel tokens
+	lp.Inject(&torpedo_registry.UserProfile{ID: "torpedobot"}, "throttle-a", "bot reply")
+	if replies := collectReplies(lp); len(replies) != 0 {
+		t.Errorf("bot message was relayed: %+v", replies)
+	}
+	lp.Inject(alice, "throttle-a", "!echo one")
+	replies := collectReplies(lp)
+	if len(replies["throttle-a"]) != 1 || len(replies["throttle-b"]) != 2 {
+		t.Errorf("unexpected command replies: %+v", replies)
+	}
+	// throttled messages are relayed, but not handled
+	lp.Inject(alice, "throttle-a", "!echo two")
+	replies = collectReplies(lp)
+	if len(replies) != 1 || strings.Join(replies["throttle-b"], "|") != "<alice@loopback> !echo two" {
+		t.Errorf("unexpected throttled relay: %+v", replies)
+	}
+}
@@ -6,6 +6,8 @@ import (
 )
 
 func (tb *TorpedoBot) GetCreateCache(name string) (cache *memcache.MemCacheType) {
+	tb.cachesLock.Lock()
+	defer tb.cachesLock.Unlock()
 	value, success := tb.caches[name]
 	if !success {
 		cache = memcache.New()
@@ -17,7 +19,7 @@ func (tb *TorpedoBot) GetCreateCache(name string) (cache *memcache.MemCacheType)
 }
 
 func (tb *TorpedoBot) GetCachedItem(name string) (item string) {
-	cache := *tb.GetCreateCache(name)
+	cache := tb.GetCreateCache(name)
 	if cache.Len() > 0 {
 		tb.logger.Printf("\nUsing cached quote...%v\n", cache.Len())
 		key := ""
@@ -32,7 +34,7 @@ func (tb *TorpedoBot) GetCachedItem(name string) (item string) {
 }
 
 func (tb *TorpedoBot) SetCachedItems(name string, items map[int]string) (item string) {
-	cache := *tb.GetCreateCache(name)
+	cache := tb.GetCreateCache(name)
 	for idx := range items {
 		message := common.MD5Hash(items[idx])
 		_, ok := cache.Get(message)
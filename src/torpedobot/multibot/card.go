@@ -0,0 +1,212 @@
+package multibot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// ButtonReplyWindow - numbered buttons of cards sent as text can be pressed by replying with number for this long
+const ButtonReplyWindow = 10 * time.Minute
+
+var (
+	callbackHandlers     = make(map[string]CallbackHandler)
+	callbackHandlersLock sync.RWMutex
+)
+
+// CardField - title and value pair shown in card
+type CardField struct {
+	Title string
+	Value string
+	// Short - field may be shown side by side with other short fields
+	Short bool
+}
+
+// Button - card button or quick reply. Pressing it sends callback event with CallbackID and Value
+// to handler registered with RegisterCallbackHandler, buttons with URL open link instead.
+// Telegram limits CallbackID and Value to 63 bytes together, longer ones fail to send
+type Button struct {
+	Label      string
+	CallbackID string
+	Value      string
+	URL        string
+}
+
+// Card - interactive rich message, RichMessage fields (BarColor, Text, Title, TitleLink, ImageURL)
+// are rendered as in plain rich message. Send it with Message.Cards or TorpedoBotAPI.PostCard
+type Card struct {
+	torpedo_registry.RichMessage
+	Fields  []CardField
+	Buttons []Button
+	// Images - more images shown after ImageURL
+	Images []string
+}
+
+// AllImages - ImageURL followed by Images
+func (card *Card) AllImages() (images []string) {
+	if card.ImageURL != "" {
+		images = append(images, card.ImageURL)
+	}
+	return append(images, card.Images...)
+}
+
+// Summary - title, link, text and fields as plain text, for protocols that render buttons and images separately
+func (card *Card) Summary() string {
+	lines := make([]string, 0)
+	switch {
+	case card.Title != "" && card.TitleLink != "":
+		lines = append(lines, fmt.Sprintf("%s (%s)", card.Title, card.TitleLink))
+	case card.Title != "":
+		lines = append(lines, card.Title)
+	case card.TitleLink != "":
+		lines = append(lines, card.TitleLink)
+	}
+	if card.Text != "" {
+		lines = append(lines, card.Text)
+	}
+	for _, field := range card.Fields {
+		lines = append(lines, fmt.Sprintf("%s: %s", field.Title, field.Value))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// MaxTelegramCallbackData - Telegram callback_data limit, bytes
+const MaxTelegramCallbackData = 64
+
+// EncodeCallback - platform callback data for button
+func EncodeCallback(button Button) string {
+	return button.CallbackID + "|" + button.Value
+}
+
+// DecodeCallback - callback ID and value from platform callback data
+func DecodeCallback(data string) (callback_id, value string) {
+	parts := strings.SplitN(data, "|", 2)
+	callback_id = parts[0]
+	if len(parts) == 2 {
+		value = parts[1]
+	}
+	return
+}
+
+// CallbackHandler - called when button with CallbackID handler was registered for is pressed,
+// ev.CallbackValue is button value
+type CallbackHandler func(api *torpedo_registry.BotAPI, channel interface{}, ev *Event)
+
+// RegisterCallbackHandler - handle presses of buttons with callback_id
+func RegisterCallbackHandler(callback_id string, handler CallbackHandler) {
+	callbackHandlersLock.Lock()
+	defer callbackHandlersLock.Unlock()
+	callbackHandlers[callback_id] = handler
+}
+
+// PostCard - send cards with optional text, see Message.Cards
+func (tba *TorpedoBotAPI) PostCard(channel interface{}, text string, cards ...Card) (id string, err error) {
+	return tba.Send(&Message{Channel: channel, Text: text, Cards: cards})
+}
+
+// numberedButtons - buttons of cards sent as text, pressed by replying with number.
+// Only user whose message card was sent for may press them, anyone if user is not set
+type numberedButtons struct {
+	buttons []Button
+	user    string
+	expires time.Time
+}
+
+// cardsToText - copy of message with cards rendered as text for protocols without Cards capability,
+// callback buttons are numbered and remembered for channel, first image is sent as rich message
+func (tba *TorpedoBotAPI) cardsToText(msg *Message) *Message {
+	text := msg.Text
+	result := *msg
+	result.Cards = nil
+	image := ""
+	buttons := make([]Button, 0)
+	for idx := range msg.Cards {
+		card := &msg.Cards[idx]
+		lines := make([]string, 0)
+		if summary := card.Summary(); summary != "" {
+			lines = append(lines, summary)
+		}
+		images := card.AllImages()
+		if image == "" && len(msg.RichMessages) == 0 && len(images) > 0 && tba.Protocol.Capabilities().Images {
+			image, images = images[0], images[1:]
+		}
+		lines = append(lines, images...)
+		for _, button := range card.Buttons {
+			if button.URL != "" {
+				lines = append(lines, fmt.Sprintf("%s: %s", button.Label, button.URL))
+				continue
+			}
+			buttons = append(buttons, button)
+			lines = append(lines, fmt.Sprintf("%d. %s", len(buttons), button.Label))
+		}
+		if text != "" {
+			text += "\n"
+		}
+		text += strings.Join(lines, "\n")
+	}
+	if len(buttons) > 0 {
+		text += "\nReply with number to choose."
+		user := ""
+		if tba.UserProfile != nil {
+			user = tba.UserProfile.ID
+		}
+		tba.Bot.rememberButtons(ChannelKey(tba, msg.Channel), user, buttons)
+	}
+	result.Text = text
+	if image != "" {
+		// rich message text is shown instead of message text
+		result.RichMessages = []torpedo_registry.RichMessage{{Text: text, ImageURL: image}}
+	}
+	return &result
+}
+
+func (tb *TorpedoBot) rememberButtons(key, user string, buttons []Button) {
+	tb.buttonsLock.Lock()
+	defer tb.buttonsLock.Unlock()
+	if tb.buttons == nil {
+		tb.buttons = make(map[string]numberedButtons)
+	}
+	now := time.Now()
+	for other, pending := range tb.buttons {
+		if now.After(pending.expires) {
+			delete(tb.buttons, other)
+		}
+	}
+	tb.buttons[key] = numberedButtons{buttons: buttons, user: user, expires: now.Add(ButtonReplyWindow)}
+}
+
+// numberedButtonPress - turn number reply to card sent as text into callback event
+func (tb *TorpedoBot) numberedButtonPress(key string, ev *Event) bool {
+	number, err := strconv.Atoi(strings.TrimSpace(ev.Text))
+	if err != nil {
+		return false
+	}
+	tb.buttonsLock.Lock()
+	defer tb.buttonsLock.Unlock()
+	pending, ok := tb.buttons[key]
+	if !ok || time.Now().After(pending.expires) || number < 1 || number > len(pending.buttons) {
+		return false
+	}
+	if pending.user != "" && (ev.Sender == nil || ev.Sender.ID != pending.user) {
+		return false
+	}
+	button := pending.buttons[number-1]
+	ev.CallbackID, ev.CallbackValue = button.CallbackID, button.Value
+	return true
+}
+
+// processCallback - run handler registered for pressed button
+func (tb *TorpedoBot) processCallback(api *TorpedoBotAPI, channel interface{}, ev *Event) {
+	callbackHandlersLock.RLock()
+	handler, ok := callbackHandlers[ev.CallbackID]
+	callbackHandlersLock.RUnlock()
+	if !ok {
+		tb.logger.Printf("No handler for callback `%s`\n", ev.CallbackID)
+		return
+	}
+	handler(tb.GetBotAPI(api, channel, ev.Text), channel, ev)
+}
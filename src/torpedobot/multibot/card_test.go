@@ -0,0 +1,79 @@
+package multibot_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func VoteProcessCallback(api *torpedo_registry.BotAPI, channel interface{}, ev *multibot.Event) {
+	api.Bot.PostMessage(channel, ev.Sender.ID+" voted "+ev.CallbackValue, api)
+}
+
+func TestCards(t *testing.T) {
+	bot := multibot.New()
+	multibot.RegisterCallbackHandler("vote", VoteProcessCallback)
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+
+	card := multibot.Card{
+		Fields: []multibot.CardField{{Title: "Votes", Value: "0"}},
+		Buttons: []multibot.Button{
+			{Label: "Yes", CallbackID: "vote", Value: "yes"},
+			{Label: "Docs", URL: "http://localhost/docs"},
+			{Label: "No", CallbackID: "vote", Value: "no"},
+		},
+	}
+	card.Title = "Lunch?"
+
+	// loopback renders cards natively
+	tba := bot.NewBotAPI(lp, lp, lp.Account())
+	if _, err := tba.PostCard("card-a", "poll", card); err != nil {
+		t.Fatalf("post card failed: %+v", err)
+	}
+	reply := lp.WaitReply(replyTimeout)
+	if reply == nil || reply.Text != "poll" || len(reply.Cards) != 1 || reply.Cards[0].Title != "Lunch?" {
+		t.Fatalf("unexpected card reply: %+v", reply)
+	}
+
+	user := &torpedo_registry.UserProfile{ID: "U71", Nick: "alice"}
+	lp.InjectEvent(user, &multibot.Event{Channel: multibot.ChannelRef{Native: "card-a"}, CallbackID: "vote", CallbackValue: "yes"})
+	if reply = lp.WaitReply(replyTimeout); reply == nil || reply.Text != "U71 voted yes" {
+		t.Fatalf("unexpected callback reply: %+v", reply)
+	}
+
+	// protocols without cards get numbered buttons, number reply presses button
+	proto := &plainProtocol{}
+	tba = bot.NewBotAPI(proto, nil, lp.Account())
+	if _, err := tba.PostCard("card-b", "poll", card); err != nil {
+		t.Fatalf("post card as text failed: %+v", err)
+	}
+	expected := strings.Join([]string{"poll", "Lunch?", "Votes: 0", "1. Yes", "Docs: http://localhost/docs", "2. No",
+		"Reply with number to choose."}, "\n")
+	if len(proto.sent) != 1 || proto.sent[0] != expected {
+		t.Fatalf("unexpected card text: %+v", proto.sent)
+	}
+	lp.Inject(user, "card-b", "2")
+	if reply = lp.WaitReply(replyTimeout); reply == nil || reply.Text != "U71 voted no" {
+		t.Fatalf("unexpected number reply: %+v", reply)
+	}
+
+	// card sent in reply to user can be pressed by that user only
+	tba.UserProfile = user
+	if _, err := tba.PostCard("card-c", "poll", card); err != nil {
+		t.Fatalf("post card as text failed: %+v", err)
+	}
+	lp.Inject(&torpedo_registry.UserProfile{ID: "U72", Nick: "bob"}, "card-c", "1")
+	if reply = lp.WaitReply(200 * time.Millisecond); reply != nil {
+		t.Errorf("other user pressed button: %+v", reply)
+	}
+	time.Sleep(multibot.DefaultRateLimit)
+	lp.Inject(user, "card-c", "1")
+	if reply = lp.WaitReply(replyTimeout); reply == nil || reply.Text != "U71 voted yes" {
+		t.Errorf("unexpected number reply: %+v", reply)
+	}
+}
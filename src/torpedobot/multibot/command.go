@@ -5,47 +5,72 @@ import (
 	"strings"
 
 	"github.com/getsentry/raven-go"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tb0hdan/torpedo_registry"
 )
 
 func (tb *TorpedoBot) ProcessCommandMessage(api *TorpedoBotAPI, channel interface{}, incoming_message string) {
+	tb.processCommandMessage(api, channel, incoming_message)
+}
+
+// processCommandMessage - error if command is denied, throttled or unknown, handler errors are not reported
+func (tb *TorpedoBot) processCommandMessage(api *TorpedoBotAPI, channel interface{}, incoming_message string) (err error) {
 	var chat_message string
-	tb.Stats.ProcessedMessages += 1
+	tb.updateStats(func(stats *BotStats) { stats.ProcessedMessages += 1 })
 	// is it good idea to store it here?
 	// TODO: find better way
-	tb.Stats.ProcessedMessagesTotal = tb.Database.GetUpdateTotalMessages(1)
+	if tb.Store != nil {
+		if total, err := tb.Store.IncrementCounter(CounterTotalMessages, 1); err == nil {
+			tb.updateStats(func(stats *BotStats) { stats.ProcessedMessagesTotal = total })
+		} else {
+			tb.logger.Printf("Could not update message counter: %+v\n", err)
+		}
+	}
 	//
 	command := strings.TrimPrefix(incoming_message, api.CommandPrefix)
-	botapi := tb.GetBotAPI(api, channel, incoming_message)
-	found := 0
 	tb.logger.Printf("PROCESS! -> `%s`", command)
-	handlers := torpedo_registry.Config.GetHandlers()
-	for handler := range handlers {
-		if strings.ToLower(strings.Split(command, " ")[0]) == handler {
-			found += 1
-			if torpedo_registry.Config.GetConfig()["raven"] == "yes" {
-				raven.CapturePanicAndWait(func() {
-					handlers[handler](botapi, channel, incoming_message)
-				}, nil)
-			} else {
-				handlers[handler](botapi, channel, incoming_message)
-			}
-			break
+	// aliases are passed to handlers as their commands
+	handler, message, found := tb.resolveCommand(api, channel, command)
+	if found && !tb.CommandAllowed(api, channel, handler) {
+		tb.denyCommand(api, channel, handler)
+		err = fmt.Errorf("command %s is not allowed", handler)
+	} else if found && !tb.RateLimitOk(api, channel, handler) {
+		tb.logger.Printf("Command %s is throttled\n", handler)
+		err = fmt.Errorf("command %s is throttled", handler)
+	} else if found {
+		botapi := tb.GetBotAPI(api, channel, message)
+		handle := torpedo_registry.Config.GetHandlers()[handler]
+		CommandInvocations.WithLabelValues(handler).Inc()
+		timer := prometheus.NewTimer(CommandDuration.WithLabelValues(handler))
+		if torpedo_registry.Config.GetConfig()["raven"] == "yes" {
+			raven.CapturePanicAndWait(func() {
+				handle(botapi, channel, message)
+			}, nil)
+		} else {
+			handle(botapi, channel, message)
 		}
-	}
-	if found == 0 {
+		timer.ObserveDuration()
+	} else {
 		if torpedo_registry.Config.GetConfig()["trpe_host"] != "" {
 			tb.logger.Printf("Using TRPE! -> `%s`", command)
-			err, result := tb.processViaTRPE(channel, incoming_message, api.CommandPrefix, torpedo_registry.Config.GetConfig()["trpe_host"])
-			if err == nil {
+			trpe_err, result := tb.processViaTRPE(channel, incoming_message, api.CommandPrefix, torpedo_registry.Config.GetConfig()["trpe_host"])
+			if trpe_err == nil {
 				chat_message = result
 			} else {
-				chat_message = fmt.Sprintf("Could not forward message to TRPE host: %+v\n", err)
+				chat_message = fmt.Sprintf("Could not forward message to TRPE host: %+v\n", trpe_err)
+				err = trpe_err
 			}
 		} else {
 			chat_message = "Could not process your message: %s%s. Command unknown. "
 			chat_message += "Send `%shelp` for list of valid commands and `%shelp command` for details."
 			chat_message = fmt.Sprintf(chat_message, api.CommandPrefix, command, api.CommandPrefix, api.CommandPrefix)
+			err = fmt.Errorf("unknown command %s", command)
+			if suggestions := tb.suggestCommands(api, channel, handler); len(suggestions) > 0 {
+				for idx := range suggestions {
+					suggestions[idx] = fmt.Sprintf("`%s%s`", api.CommandPrefix, suggestions[idx])
+				}
+				chat_message += fmt.Sprintf(" Did you mean %s?", strings.Join(suggestions, " or "))
+			}
 		}
 		api.PostMessage(channel, chat_message)
 	}
@@ -0,0 +1,532 @@
+package multibot
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// ArgType - type of command argument or flag value
+type ArgType int
+
+const (
+	ArgString ArgType = iota
+	ArgInt
+	ArgFloat
+	ArgBool
+	// ArgEnum - one of Choices
+	ArgEnum
+)
+
+// ArgSpec - positional argument (Command.Args) or named flag (Command.Flags)
+type ArgSpec struct {
+	Name string
+	// Short - one letter flag alias, e.g. `u` for `-u metric`
+	Short    string
+	Help     string
+	Type     ArgType
+	Choices  []string
+	Required bool
+	Default  string
+	// Rest - last positional argument takes all remaining words
+	Rest bool
+	// Raw - Rest argument is taken from message as typed, quotes and backslashes are kept,
+	// flags are only recognized before it
+	Raw bool
+}
+
+// CommandHandler - receives validated arguments instead of raw message
+type CommandHandler func(api *torpedo_registry.BotAPI, channel interface{}, cmd *ParsedCommand)
+
+// Command - declared command, see RegisterCommand
+type Command struct {
+	Name        string
+	Aliases     []string
+	Help        string
+	Args        []ArgSpec
+	Flags       []ArgSpec
+	Subcommands []*Command
+	// Role - required to run command or subcommand, see RequireRole
+	Role Role
+	// Handler - optional for commands with subcommands, usage is sent then
+	Handler CommandHandler
+}
+
+// ParsedCommand - command arguments after validation
+type ParsedCommand struct {
+	// Path - command name followed by subcommand names
+	Path   []string
+	Prefix string
+	values map[string]interface{}
+	rest   map[string][]string
+}
+
+// CommandError - invalid command invocation, sent to user along with usage
+type CommandError struct {
+	Command *Command
+	Path    []string
+	Message string
+}
+
+func (e *CommandError) Error() string {
+	return e.Message
+}
+
+var (
+	commands     = make(map[string]*Command)
+	commandsLock sync.RWMutex
+)
+
+// RegisterCommand - register declared command as torpedo_registry handler, arguments
+// are parsed and validated before command handler runs
+func RegisterCommand(command *Command) {
+	commandsLock.Lock()
+	commands[strings.ToLower(command.Name)] = command
+	commandsLock.Unlock()
+	for _, alias := range command.Aliases {
+		RegisterAlias(alias, command.Name)
+	}
+	requireCommandRoles(strings.ToLower(command.Name), command)
+	torpedo_registry.Config.RegisterHelpAndHandler(strings.ToLower(command.Name), command.Help,
+		func(api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+			RunCommand(command, api, channel, incoming_message)
+		})
+}
+
+func requireCommandRoles(path string, command *Command) {
+	if command.Role != RoleUser {
+		RequireRole(path, command.Role)
+	}
+	for _, sub := range command.Subcommands {
+		requireCommandRoles(path+" "+strings.ToLower(sub.Name), sub)
+	}
+}
+
+// GetCommand - declared command by name or alias, nil for plain handlers
+func GetCommand(name string) *Command {
+	commandsLock.RLock()
+	defer commandsLock.RUnlock()
+	return commands[ResolveAlias(name)]
+}
+
+// RunCommand - parse message and run command handler, report errors with usage to user
+func RunCommand(command *Command, api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+	parsed, cmd, err := command.Parse(strings.TrimPrefix(incoming_message, api.CommandPrefix))
+	if err == nil && cmd.Handler == nil {
+		err = &CommandError{Command: cmd, Path: parsed.Path, Message: "Subcommand required"}
+	}
+	if err != nil {
+		message := err.Error()
+		if cerr, ok := err.(*CommandError); ok {
+			message += "\n" + cerr.Command.Usage(api.CommandPrefix, cerr.Path...)
+		}
+		api.Bot.PostMessage(channel, message, api)
+		return
+	}
+	parsed.Prefix = api.CommandPrefix
+	// command itself is checked before dispatch, subcommands here
+	if tbapi, ok := api.API.(*TorpedoBotAPI); ok && tbapi.Bot != nil && len(parsed.Path) > 1 {
+		if path := strings.Join(parsed.Path, " "); !tbapi.Bot.CommandAllowed(tbapi, channel, path) {
+			tbapi.Bot.denyCommand(tbapi, channel, path)
+			return
+		}
+	}
+	cmd.Handler(api, channel, parsed)
+}
+
+// SplitCommandLine - split message into words, single and double quotes group words,
+// backslash escapes next character
+func SplitCommandLine(line string) (words []string, err error) {
+	var starts []int
+	if words, starts, err = splitWords(line); err != nil {
+		words = words[:len(starts)-1]
+	}
+	return
+}
+
+// splitWords - words of command line along with their offsets in it. Unterminated
+// quoted word is returned as last word along with error
+func splitWords(line string) (words []string, starts []int, err error) {
+	var word strings.Builder
+	var quote rune
+	in_word, escaped := false, false
+	begin := func(idx int) {
+		if !in_word {
+			starts = append(starts, idx)
+			in_word = true
+		}
+	}
+	for idx, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			begin(idx)
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			begin(idx)
+			quote = r
+		case unicode.IsSpace(r):
+			if in_word {
+				words = append(words, word.String())
+				word.Reset()
+				in_word = false
+			}
+		default:
+			begin(idx)
+			word.WriteRune(r)
+		}
+	}
+	if in_word {
+		words = append(words, word.String())
+	}
+	if quote != 0 {
+		err = fmt.Errorf("Unterminated %c quote", quote)
+	}
+	return
+}
+
+// Parse - parse command line (without prefix), returns command or subcommand that should handle it
+func (c *Command) Parse(line string) (parsed *ParsedCommand, cmd *Command, err error) {
+	words, starts, split_err := splitWords(line)
+	if split_err != nil && !c.hasRaw() {
+		err = &CommandError{Command: c, Path: []string{c.Name}, Message: split_err.Error()}
+		return
+	}
+	parsed = &ParsedCommand{values: make(map[string]interface{}), rest: make(map[string][]string)}
+	cmd = c
+	parsed.Path = []string{c.Name}
+	if len(words) > 0 {
+		words, starts = words[1:], starts[1:]
+	}
+	// descend into subcommands
+	for len(words) > 0 && len(cmd.Subcommands) > 0 {
+		sub := cmd.subcommand(words[0])
+		if sub == nil {
+			if strings.HasPrefix(words[0], "-") {
+				break
+			}
+			err = &CommandError{Command: cmd, Path: parsed.Path, Message: fmt.Sprintf("Unknown subcommand `%s`", words[0])}
+			return
+		}
+		cmd = sub
+		parsed.Path = append(parsed.Path, sub.Name)
+		words, starts = words[1:], starts[1:]
+	}
+	fail := func(format string, args ...interface{}) {
+		err = &CommandError{Command: cmd, Path: parsed.Path, Message: fmt.Sprintf(format, args...)}
+	}
+	positional := make([]string, 0, len(words))
+
+	// raw argument is the rest of line starting with its first word
+	raw_index, raw := -1, ""
+	for idx, arg := range cmd.Args {
+		if arg.Rest && arg.Raw {
+			raw_index = idx
+		}
+	}
+	take_raw := func(idx int) bool {
+		if len(positional) != raw_index {
+			return false
+		}
+		raw = strings.TrimSpace(line[starts[idx]:])
+		positional = append(positional, words[idx:]...)
+		return true
+	}
+
+	for idx := 0; idx < len(words); idx++ {
+		word := words[idx]
+		if word == "--" {
+			for idx += 1; idx < len(words) && !take_raw(idx); idx++ {
+				positional = append(positional, words[idx])
+			}
+			break
+		}
+		if !strings.HasPrefix(word, "-") || word == "-" || isNumber(word) {
+			if take_raw(idx) {
+				break
+			}
+			positional = append(positional, word)
+			continue
+		}
+		name, value, has_value := strings.TrimLeft(word, "-"), "", false
+		if eq := strings.Index(name, "="); eq != -1 {
+			name, value, has_value = name[:eq], name[eq+1:], true
+		}
+		flag := cmd.flag(name, !strings.HasPrefix(word, "--"))
+		if flag == nil {
+			fail("Unknown flag `%s`", word)
+			return
+		}
+		if !has_value {
+			if flag.Type == ArgBool {
+				value = "true"
+			} else if idx+1 < len(words) {
+				idx += 1
+				value = words[idx]
+			} else {
+				fail("Flag `--%s` requires value", flag.Name)
+				return
+			}
+		}
+		if parsed.values[flag.Name], err = flag.convert(value); err != nil {
+			fail("Flag `--%s`: %s", flag.Name, err.Error())
+			return
+		}
+	}
+	// unterminated quote is only allowed in raw argument
+	if split_err != nil && raw == "" {
+		fail("%s", split_err.Error())
+		return
+	}
+	for _, flag := range cmd.Flags {
+		if _, ok := parsed.values[flag.Name]; ok {
+			continue
+		}
+		if flag.Required {
+			fail("Flag `--%s` is required", flag.Name)
+			return
+		}
+		if flag.Default != "" || flag.Type == ArgBool {
+			parsed.values[flag.Name], _ = flag.convert(flag.Default)
+		}
+	}
+
+	for _, arg := range cmd.Args {
+		if len(positional) == 0 {
+			if arg.Required {
+				fail("Missing argument `%s`", arg.Name)
+				return
+			}
+			if arg.Default != "" {
+				parsed.values[arg.Name], _ = arg.convert(arg.Default)
+			}
+			continue
+		}
+		if arg.Rest {
+			for _, word := range positional {
+				if _, err = arg.convert(word); err != nil {
+					fail("Argument `%s`: %s", arg.Name, err.Error())
+					return
+				}
+			}
+			parsed.rest[arg.Name] = positional
+			parsed.values[arg.Name] = strings.Join(positional, " ")
+			if arg.Raw {
+				parsed.values[arg.Name] = raw
+			}
+			positional = nil
+			break
+		}
+		if parsed.values[arg.Name], err = arg.convert(positional[0]); err != nil {
+			fail("Argument `%s`: %s", arg.Name, err.Error())
+			return
+		}
+		positional = positional[1:]
+	}
+	if len(positional) > 0 {
+		fail("Unexpected argument `%s`", positional[0])
+	}
+	return
+}
+
+// hasRaw - command or any of its subcommands has Raw argument
+func (c *Command) hasRaw() bool {
+	for _, arg := range c.Args {
+		if arg.Raw {
+			return true
+		}
+	}
+	for _, sub := range c.Subcommands {
+		if sub.hasRaw() {
+			return true
+		}
+	}
+	return false
+}
+
+func isNumber(word string) bool {
+	_, err := strconv.ParseFloat(word, 64)
+	return err == nil
+}
+
+func (c *Command) subcommand(name string) *Command {
+	for _, sub := range c.Subcommands {
+		if strings.EqualFold(sub.Name, name) {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (c *Command) flag(name string, short bool) *ArgSpec {
+	for idx := range c.Flags {
+		if (short && c.Flags[idx].Short == name) || (!short && c.Flags[idx].Name == name) {
+			return &c.Flags[idx]
+		}
+	}
+	return nil
+}
+
+func (a *ArgSpec) convert(value string) (result interface{}, err error) {
+	switch a.Type {
+	case ArgInt:
+		if result, err = strconv.ParseInt(value, 10, 64); err != nil {
+			err = fmt.Errorf("`%s` is not an integer", value)
+		}
+	case ArgFloat:
+		if result, err = strconv.ParseFloat(value, 64); err != nil {
+			err = fmt.Errorf("`%s` is not a number", value)
+		}
+	case ArgBool:
+		if value == "" {
+			value = "false"
+		}
+		if result, err = strconv.ParseBool(value); err != nil {
+			err = fmt.Errorf("`%s` is not true or false", value)
+		}
+	case ArgEnum:
+		for _, choice := range a.Choices {
+			if strings.EqualFold(choice, value) {
+				return choice, nil
+			}
+		}
+		err = fmt.Errorf("`%s` is not one of %s", value, strings.Join(a.Choices, ", "))
+	default:
+		result = value
+	}
+	return
+}
+
+// placeholder - argument value in usage line
+func (a *ArgSpec) placeholder() (text string) {
+	text = a.Name
+	switch a.Type {
+	case ArgEnum:
+		text = strings.Join(a.Choices, "|")
+	case ArgInt, ArgFloat:
+		text = a.Name + ":number"
+	}
+	if a.Rest {
+		text += "..."
+	}
+	return
+}
+
+// Usage - usage line, description, arguments, flags and subcommands of command or its subcommand,
+// path is command name followed by subcommand names, unknown names are ignored
+func (c *Command) Usage(prefix string, path ...string) string {
+	cmd := c
+	names := []string{c.Name}
+	if len(path) > 0 {
+		for _, name := range path[1:] {
+			sub := cmd.subcommand(name)
+			if sub == nil {
+				break
+			}
+			cmd = sub
+			names = append(names, sub.Name)
+		}
+	}
+	line := "Usage: " + prefix + strings.Join(names, " ")
+	if len(cmd.Subcommands) > 0 {
+		names := make([]string, 0, len(cmd.Subcommands))
+		for _, sub := range cmd.Subcommands {
+			names = append(names, sub.Name)
+		}
+		line += " " + strings.Join(names, "|")
+	}
+	for _, flag := range cmd.Flags {
+		item := "--" + flag.Name
+		if flag.Type != ArgBool {
+			item += " " + flag.placeholder()
+		}
+		if !flag.Required {
+			item = "[" + item + "]"
+		}
+		line += " " + item
+	}
+	for _, arg := range cmd.Args {
+		if arg.Required {
+			line += " <" + arg.placeholder() + ">"
+		} else {
+			line += " [" + arg.placeholder() + "]"
+		}
+	}
+	lines := []string{line}
+	if cmd.Help != "" {
+		lines = append(lines, cmd.Help)
+	}
+	describe := func(title string, specs []ArgSpec, dashes string) {
+		if len(specs) == 0 {
+			return
+		}
+		lines = append(lines, title)
+		for _, spec := range specs {
+			item := "  " + dashes + spec.Name
+			if spec.Short != "" {
+				item += ", -" + spec.Short
+			}
+			item += " - " + spec.Help
+			if spec.Default != "" {
+				item += fmt.Sprintf(" (default: %s)", spec.Default)
+			}
+			lines = append(lines, item)
+		}
+	}
+	describe("Arguments:", cmd.Args, "")
+	describe("Flags:", cmd.Flags, "--")
+	if len(cmd.Subcommands) > 0 {
+		lines = append(lines, "Subcommands:")
+		subs := make([]*Command, len(cmd.Subcommands))
+		copy(subs, cmd.Subcommands)
+		sort.Slice(subs, func(i, j int) bool { return subs[i].Name < subs[j].Name })
+		for _, sub := range subs {
+			lines = append(lines, "  "+sub.Name+" - "+sub.Help)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Has - argument or flag was given or has default value
+func (p *ParsedCommand) Has(name string) (ok bool) {
+	_, ok = p.values[name]
+	return
+}
+
+func (p *ParsedCommand) String(name string) (value string) {
+	value, _ = p.values[name].(string)
+	return
+}
+
+// Strings - words of Rest argument
+func (p *ParsedCommand) Strings(name string) []string {
+	return p.rest[name]
+}
+
+func (p *ParsedCommand) Int(name string) (value int64) {
+	value, _ = p.values[name].(int64)
+	return
+}
+
+func (p *ParsedCommand) Float(name string) (value float64) {
+	value, _ = p.values[name].(float64)
+	return
+}
+
+func (p *ParsedCommand) Bool(name string) (value bool) {
+	value, _ = p.values[name].(bool)
+	return
+}
@@ -0,0 +1,130 @@
+package multibot_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+var forecastCommand = &multibot.Command{
+	Name: "forecast",
+	Help: "Weather forecast",
+	Args: []multibot.ArgSpec{
+		{Name: "days", Help: "Number of days", Type: multibot.ArgInt, Required: true},
+		{Name: "city", Help: "City name", Rest: true, Default: "Kyiv"},
+	},
+	Flags: []multibot.ArgSpec{
+		{Name: "units", Short: "u", Help: "Units", Type: multibot.ArgEnum, Choices: []string{"metric", "imperial"}, Default: "metric"},
+		{Name: "verbose", Short: "v", Help: "Detailed forecast", Type: multibot.ArgBool},
+	},
+	Handler: func(api *torpedo_registry.BotAPI, channel interface{}, cmd *multibot.ParsedCommand) {
+		api.Bot.PostMessage(channel, fmt.Sprintf("%d days in %s (%s, verbose=%v)", cmd.Int("days"), cmd.String("city"), cmd.String("units"), cmd.Bool("verbose")), api)
+	},
+}
+
+var queueCommand = &multibot.Command{
+	Name: "queue",
+	Help: "Manage queue",
+	Subcommands: []*multibot.Command{
+		{Name: "add", Help: "Add item", Args: []multibot.ArgSpec{{Name: "item", Required: true}}},
+		{Name: "list", Help: "List items", Flags: []multibot.ArgSpec{{Name: "limit", Type: multibot.ArgInt, Default: "10"}}},
+	},
+}
+
+func init() {
+	multibot.RegisterCommand(forecastCommand)
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	cases := []struct {
+		line  string
+		words []string
+	}{
+		{`forecast 3 New York`, []string{"forecast", "3", "New", "York"}},
+		{`say "hello world"  'it''s'`, []string{"say", "hello world", "its"}},
+		{`say "quoted \"word\"" back\ slash`, []string{"say", `quoted "word"`, "back slash"}},
+		{`empty ""`, []string{"empty", ""}},
+	}
+	for _, tc := range cases {
+		if words, err := multibot.SplitCommandLine(tc.line); err != nil || !reflect.DeepEqual(words, tc.words) {
+			t.Errorf("`%s`: got %q (%+v), expected %q", tc.line, words, err, tc.words)
+		}
+	}
+	if _, err := multibot.SplitCommandLine(`say "unterminated`); err == nil {
+		t.Errorf("expected unterminated quote error")
+	}
+}
+
+func TestCommandParse(t *testing.T) {
+	parsed, _, err := forecastCommand.Parse(`forecast -u imperial 5 "San Francisco" --verbose`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Int("days") != 5 || parsed.String("city") != "San Francisco" || parsed.String("units") != "imperial" || !parsed.Bool("verbose") {
+		t.Errorf("unexpected values: %+v", parsed)
+	}
+	parsed, _, err = forecastCommand.Parse(`forecast --units=METRIC 2`)
+	if err != nil || parsed.String("units") != "metric" || parsed.String("city") != "Kyiv" || parsed.Bool("verbose") {
+		t.Errorf("defaults: %+v (%+v)", parsed, err)
+	}
+
+	errors := map[string]string{
+		`forecast`:               "Missing argument `days`",
+		`forecast three`:         "Argument `days`: `three` is not an integer",
+		`forecast 3 --units si`:  "Flag `--units`: `si` is not one of metric, imperial",
+		`forecast 3 --wind`:      "Unknown flag `--wind`",
+		`forecast 3 --units`:     "Flag `--units` requires value",
+		`queue remove x`:         "Unknown subcommand `remove`",
+		`queue add`:              "Missing argument `item`",
+		`queue list --limit ten`: "Flag `--limit`: `ten` is not an integer",
+	}
+	for line, expected := range errors {
+		command := forecastCommand
+		if strings.HasPrefix(line, "queue") {
+			command = queueCommand
+		}
+		if _, _, err := command.Parse(line); err == nil || err.Error() != expected {
+			t.Errorf("`%s`: got %+v, expected `%s`", line, err, expected)
+		}
+	}
+
+	parsed, cmd, err := queueCommand.Parse(`queue list`)
+	if err != nil || cmd.Name != "list" || parsed.Int("limit") != 10 || !reflect.DeepEqual(parsed.Path, []string{"queue", "list"}) {
+		t.Errorf("subcommand: %+v %+v (%+v)", parsed, cmd, err)
+	}
+}
+
+func TestCommandUsage(t *testing.T) {
+	usage := forecastCommand.Usage("!")
+	if !strings.HasPrefix(usage, "Usage: !forecast [--units metric|imperial] [--verbose] <days:number> [city...]\nWeather forecast\n") {
+		t.Errorf("unexpected usage:\n%s", usage)
+	}
+	if usage := queueCommand.Usage("!", "queue", "add"); !strings.HasPrefix(usage, "Usage: !queue add <item>") {
+		t.Errorf("unexpected subcommand usage:\n%s", usage)
+	}
+	if usage := queueCommand.Usage("!"); !strings.Contains(usage, "Usage: !queue add|list\n") || !strings.Contains(usage, "  list - List items") {
+		t.Errorf("unexpected usage with subcommands:\n%s", usage)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	bot := multibot.New()
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	user := &torpedo_registry.UserProfile{ID: "U1", Nick: "alice"}
+
+	lp.Inject(user, "forecast-1", `!forecast 3 "New York"`)
+	if reply := lp.WaitReply(replyTimeout); reply == nil || reply.Text != "3 days in New York (metric, verbose=false)" {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+	// validation error with usage, handler is not run
+	lp.Inject(user, "forecast-2", `!forecast soon`)
+	if reply := lp.WaitReply(replyTimeout); reply == nil || !strings.HasPrefix(reply.Text, "Argument `days`: `soon` is not an integer\nUsage: !forecast") {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+}
@@ -0,0 +1,96 @@
+package multibot_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func QuoteProcessMessage(api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+	quote := api.Bot.GetCachedItem("quotes")
+	if quote == "" {
+		quote = api.Bot.SetCachedItems("quotes", map[int]string{0: "first", 1: "second", 2: "third"})
+	}
+	api.Bot.PostMessage(channel, quote, api)
+}
+
+func init() {
+	torpedo_registry.Config.RegisterHelpAndHandler("quote", "Post cached quote", QuoteProcessMessage)
+}
+
+// Run with -race: accounts share stats, caches and registries
+func TestConcurrentAccounts(t *testing.T) {
+	const accounts = 5
+	const messages = 20
+	bot := multibot.New()
+	before := bot.GetStats()
+
+	loopbacks := make([]*multibot.LoopbackProtocol, accounts)
+	var started sync.WaitGroup
+	for i := range loopbacks {
+		started.Add(1)
+		go func(i int) {
+			defer started.Done()
+			loopbacks[i] = bot.StartLoopback("!")
+		}(i)
+	}
+	started.Wait()
+
+	// readers running alongside message processing
+	done := make(chan struct{})
+	readers := make(chan struct{})
+	go func() {
+		defer close(readers)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				bot.GetStats()
+				bot.GetAccounts()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i, lp := range loopbacks {
+		wg.Add(1)
+		go func(i int, lp *multibot.LoopbackProtocol) {
+			defer wg.Done()
+			defer lp.Close()
+			user := &torpedo_registry.UserProfile{ID: fmt.Sprintf("U%d", i), Nick: fmt.Sprintf("user%d", i)}
+			for j := 0; j < messages; j++ {
+				// NoSpam allows one message per channel per second
+				channel := fmt.Sprintf("race-%d-%d", i, j)
+				command := "!echo hi"
+				if j%2 == 1 {
+					command = "!quote"
+				}
+				lp.Inject(user, channel, command)
+				reply := lp.WaitReply(replyTimeout)
+				if reply == nil {
+					t.Errorf("account %d: no reply for `%s`", i, command)
+					return
+				}
+				if reply.Channel != channel || reply.Text == "" {
+					t.Errorf("account %d: unexpected reply %+v in %s", i, reply, channel)
+				}
+			}
+		}(i, lp)
+	}
+	wg.Wait()
+	close(done)
+	<-readers
+
+	after := bot.GetStats()
+	if got := after.ProcessedMessages - before.ProcessedMessages; got != accounts*messages {
+		t.Errorf("processed messages: got %d, expected %d", got, accounts*messages)
+	}
+	if got := after.TotalAccounts - before.TotalAccounts; got != accounts {
+		t.Errorf("total accounts: got %d, expected %d", got, accounts)
+	}
+}
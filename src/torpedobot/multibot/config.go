@@ -0,0 +1,317 @@
+package multibot
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	common "github.com/tb0hdan/torpedo_common"
+	"github.com/tb0hdan/torpedo_registry"
+	"gopkg.in/yaml.v2"
+)
+
+var ConfigFilePath *string
+
+// LoginDelay - pause between account logins
+var LoginDelay = 3 * time.Second
+
+// DefaultRateLimit - one command per channel per this interval, unless channel limit is set in config file
+const DefaultRateLimit = 1 * time.Second
+
+// ConfigFile - YAML config file, see doc/CONFIG.md
+type ConfigFile struct {
+	NoSpam   NoSpamConfig    `yaml:"nospam"`
+	ACL      ACLConfig       `yaml:"acl"`
+	History  HistoryConfig   `yaml:"history"`
+	Bridges  []BridgeConfig  `yaml:"bridges"`
+	Accounts []AccountConfig `yaml:"accounts"`
+}
+
+type NoSpamConfig struct {
+	// RateLimit - minimal interval between messages in channel, e.g. 1s or 500ms, limits.channel takes precedence
+	RateLimit time.Duration       `yaml:"rate_limit"`
+	Limits    RateLimitsConfig    `yaml:"limits"`
+	Detectors DetectorsConfig     `yaml:"detectors"`
+	Blacklist []BlackListRuleItem `yaml:"blacklist"`
+}
+
+type AccountConfig struct {
+	Protocol string `yaml:"protocol"`
+	// Prefix - single prefix or list, protocol default if unset
+	Prefix Prefixes `yaml:"prefix"`
+	// APIKey - legacy credentials string, same as on command line, used when Credentials are not set
+	APIKey      string                       `yaml:"api_key"`
+	Credentials map[string]string            `yaml:"credentials"`
+	Rooms       []string                     `yaml:"rooms"`
+	Plugins     map[string]map[string]string `yaml:"plugins"`
+}
+
+// credentialFields - credentials joined with `:` (in this order) to form API key protocol expects
+var credentialFields = map[string][]string{
+	"slack":    {"token"},
+	"telegram": {"token"},
+	"jabber":   {"jid", "password"},
+	"skype":    {"app_id", "app_password"},
+	"teams":    {"secret"},
+	"kik":      {"username", "api_key"},
+	"line":     {"client_secret", "client_token"},
+	"matrix":   {"id", "access_token"},
+	"facebook": {"page_token", "verify_token", "app_secret"},
+	"irc":      {"server", "port", "ssl", "password"},
+	"console":  {},
+}
+
+// optionalCredentials - protocol credentials that may be omitted
+var optionalCredentials = map[string]bool{
+	"irc:password": true,
+}
+
+func (tb *TorpedoBot) ConfigureConfigFile(cfg *torpedo_registry.ConfigStruct) {
+	ConfigFilePath = flag.String("config", "", "YAML config file with accounts and settings, reloaded on SIGHUP")
+}
+
+func (tb *TorpedoBot) ParseConfigFile(cfg *torpedo_registry.ConfigStruct) {
+	cfg.SetConfig("configfile", *ConfigFilePath)
+	if cfg.GetConfig()["configfile"] == "" {
+		cfg.SetConfig("configfile", common.GetStripEnv("TORPEDO_CONFIG"))
+	}
+}
+
+// AccountKey - protocol and credentials, identifies account across config reloads
+func (ac *AccountConfig) AccountKey() (key string, err error) {
+	apiKey, err := ac.BuildAPIKey()
+	if err != nil {
+		return
+	}
+	key = ac.Protocol + ":" + apiKey
+	return
+}
+
+// BuildAPIKey - convert structured credentials to API key format used on command line
+func (ac *AccountConfig) BuildAPIKey() (apiKey string, err error) {
+	if len(ac.Credentials) == 0 && ac.APIKey != "" {
+		apiKey = ac.APIKey
+		return
+	}
+	fields, ok := credentialFields[ac.Protocol]
+	if !ok {
+		err = fmt.Errorf("%s account requires api_key", ac.Protocol)
+		return
+	}
+	if len(fields) == 0 {
+		apiKey = ac.Protocol
+		return
+	}
+	values := make([]string, 0, len(fields))
+	for _, field := range fields {
+		value := ac.Credentials[field]
+		if value == "" {
+			if optionalCredentials[ac.Protocol+":"+field] {
+				continue
+			}
+			err = fmt.Errorf("%s account is missing `%s` credential", ac.Protocol, field)
+			return
+		}
+		if len(fields) > 1 && strings.Contains(value, ":") {
+			err = fmt.Errorf("%s account credential `%s` can't contain `:`", ac.Protocol, field)
+			return
+		}
+		if ac.Protocol == "irc" && field == "ssl" {
+			usessl, perr := strconv.ParseBool(value)
+			if perr != nil {
+				err = fmt.Errorf("irc account credential `ssl` should be true or false, got `%s`", value)
+				return
+			}
+			value = "0"
+			if usessl {
+				value = "1"
+			}
+		}
+		values = append(values, value)
+	}
+	// irc nick is part of server field, see IRCProtocol.Connect
+	if nick := ac.Credentials["nick"]; ac.Protocol == "irc" && nick != "" {
+		values[0] = nick + "@" + values[0]
+	}
+	apiKey = strings.Join(values, ":")
+	return
+}
+
+// LoadConfigFile - read and validate config file
+func LoadConfigFile(path string) (config *ConfigFile, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	config = &ConfigFile{}
+	if err = yaml.UnmarshalStrict(data, config); err != nil {
+		err = fmt.Errorf("%s: %+v", path, err)
+		return
+	}
+	if config.NoSpam.RateLimit < 0 {
+		err = fmt.Errorf("%s: nospam rate_limit can't be negative", path)
+		return
+	}
+	limits := []RateLimitConfig{config.NoSpam.Limits.User}
+	if config.NoSpam.Limits.Channel != nil {
+		limits = append(limits, *config.NoSpam.Limits.Channel)
+	}
+	command_limits := make(map[string]RateLimitConfig, len(config.NoSpam.Limits.Commands))
+	for command, limit := range config.NoSpam.Limits.Commands {
+		command_limits[strings.ToLower(command)] = limit
+		limits = append(limits, limit)
+	}
+	config.NoSpam.Limits.Commands = command_limits
+	for _, limit := range config.NoSpam.Limits.Outbound {
+		limits = append(limits, limit)
+	}
+	for _, limit := range limits {
+		if err = limit.Validate(); err != nil {
+			err = fmt.Errorf("%s: nospam %+v", path, err)
+			return
+		}
+	}
+	if err = config.NoSpam.Detectors.Validate(); err != nil {
+		err = fmt.Errorf("%s: nospam %+v", path, err)
+		return
+	}
+	for _, rule := range config.NoSpam.Blacklist {
+		if err = rule.Validate(); err != nil {
+			err = fmt.Errorf("%s: %+v", path, err)
+			return
+		}
+	}
+	for _, rule := range config.ACL.Rules {
+		if err = rule.Validate(); err != nil {
+			err = fmt.Errorf("%s: %+v", path, err)
+			return
+		}
+	}
+	if err = config.History.Validate(); err != nil {
+		err = fmt.Errorf("%s: history %+v", path, err)
+		return
+	}
+	if err = validateBridges(config.Bridges); err != nil {
+		err = fmt.Errorf("%s: %+v", path, err)
+		return
+	}
+	commands := make(map[string]Role, len(config.ACL.Commands))
+	for command, role := range config.ACL.Commands {
+		commands[strings.ToLower(command)] = role
+	}
+	config.ACL.Commands = commands
+	seen := make(map[string]bool)
+	for idx, ac := range config.Accounts {
+		key, kerr := ac.AccountKey()
+		if kerr != nil {
+			err = fmt.Errorf("%s: account #%d: %+v", path, idx, kerr)
+			return
+		}
+		if seen[key] {
+			err = fmt.Errorf("%s: account #%d: duplicate %s account", path, idx, ac.Protocol)
+			return
+		}
+		seen[key] = true
+		prefixes := Prefixes{}
+		for _, prefix := range ac.Prefix {
+			if prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		if len(prefixes) == 0 {
+			prefixes = Prefixes{DefaultPrefix(ac.Protocol)}
+		}
+		config.Accounts[idx].Prefix = prefixes
+	}
+	return
+}
+
+// protocolFromFlags - accounts of this protocol are set with flags or env and take precedence over config file
+func protocolFromFlags(protocol string) bool {
+	cfg := torpedo_registry.Config.GetConfig()
+	if protocol == "console" {
+		return cfg["console"] == "yes"
+	}
+	return cfg[protocol+"apikey"] != ""
+}
+
+// ReloadConfig - (re)read config file, start new accounts, disconnect removed ones
+// and apply changed settings to existing ones. Current config is kept on error.
+func (tb *TorpedoBot) ReloadConfig() (err error) {
+	tb.configLock.Lock()
+	defer tb.configLock.Unlock()
+	path := torpedo_registry.Config.GetConfig()["configfile"]
+	if path == "" {
+		err = fmt.Errorf("no config file set, use -config or TORPEDO_CONFIG")
+		return
+	}
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		return
+	}
+	for _, ac := range config.Accounts {
+		if !tb.HasProtocol(ac.Protocol) {
+			err = fmt.Errorf("%s: unknown protocol: `%s`", path, ac.Protocol)
+			return
+		}
+	}
+	tb.setNoSpamSettings(config.NoSpam)
+	tb.setACL(config.ACL)
+	tb.setHistorySettings(config.History)
+	tb.setBridgeSettings(config.Bridges)
+
+	current := make(map[string]*BotAccount)
+	tb.accountsLock.RLock()
+	for _, ba := range tb.botAccounts {
+		if ba.configured && !ba.removed {
+			current[ba.Protocol+":"+ba.Account.APIKey] = ba
+		}
+	}
+	tb.accountsLock.RUnlock()
+	added, updated, removed := 0, 0, 0
+	for _, ac := range config.Accounts {
+		if protocolFromFlags(ac.Protocol) {
+			tb.logger.Printf("%s accounts are set on command line, skipping config file ones\n", ac.Protocol)
+			continue
+		}
+		apiKey, _ := ac.BuildAPIKey()
+		key := ac.Protocol + ":" + apiKey
+		if ba, ok := current[key]; ok {
+			delete(current, key)
+			tb.SetAccountPrefixes(ba.Account, ac.Prefix)
+			tb.accountsLock.Lock()
+			ba.Rooms = ac.Rooms
+			ba.Plugins = ac.Plugins
+			tb.accountsLock.Unlock()
+			updated += 1
+			continue
+		}
+		account := &torpedo_registry.Account{
+			APIKey:        apiKey,
+			CommandPrefix: ac.Prefix[0],
+		}
+		ba := tb.AddAccount(ac.Protocol, account)
+		tb.SetAccountPrefixes(account, ac.Prefix)
+		tb.accountsLock.Lock()
+		ba.Rooms = ac.Rooms
+		ba.Plugins = ac.Plugins
+		ba.configured = true
+		tb.accountsLock.Unlock()
+		if added > 0 {
+			// slow down logins
+			time.Sleep(LoginDelay)
+		}
+		tb.StartAccount(ac.Protocol, account)
+		added += 1
+	}
+	for _, ba := range current {
+		tb.logger.Printf("Removing %s account #%d\n", ba.Protocol, ba.ID)
+		tb.RemoveAccount(ba.ID)
+		removed += 1
+	}
+	tb.logger.Printf("Loaded %s: %d accounts added, %d updated, %d removed\n", path, added, updated, removed)
+	return
+}
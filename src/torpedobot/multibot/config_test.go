@@ -0,0 +1,164 @@
+package multibot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func TestBuildAPIKey(t *testing.T) {
+	cases := []struct {
+		account multibot.AccountConfig
+		key     string
+	}{
+		{multibot.AccountConfig{Protocol: "slack", Credentials: map[string]string{"token": "xoxb-1"}}, "xoxb-1"},
+		{multibot.AccountConfig{Protocol: "telegram", Credentials: map[string]string{"token": "123:ABC"}}, "123:ABC"},
+		{multibot.AccountConfig{Protocol: "irc", Credentials: map[string]string{"nick": "bot", "server": "irc.example.com", "port": "6697", "ssl": "true"}}, "bot@irc.example.com:6697:1"},
+		{multibot.AccountConfig{Protocol: "irc", Credentials: map[string]string{"server": "irc.example.com", "port": "6667", "ssl": "false", "password": "secret"}}, "irc.example.com:6667:0:secret"},
+		{multibot.AccountConfig{Protocol: "facebook", Credentials: map[string]string{"page_token": "p", "verify_token": "v", "app_secret": "s"}}, "p:v:s"},
+		{multibot.AccountConfig{Protocol: "kik", APIKey: "user:key"}, "user:key"},
+		{multibot.AccountConfig{Protocol: "console"}, "console"},
+	}
+	for _, tc := range cases {
+		if key, err := tc.account.BuildAPIKey(); err != nil || key != tc.key {
+			t.Errorf("%s: got `%s` (%+v), expected `%s`", tc.account.Protocol, key, err, tc.key)
+		}
+	}
+	bad := []multibot.AccountConfig{
+		{Protocol: "jabber", Credentials: map[string]string{"jid": "bot@example.com"}},
+		{Protocol: "irc", Credentials: map[string]string{"server": "irc.example.com", "port": "6667", "ssl": "maybe"}},
+		{Protocol: "line", Credentials: map[string]string{"client_secret": "a:b", "client_token": "c"}},
+		{Protocol: "loopback"},
+	}
+	for _, account := range bad {
+		if key, err := account.BuildAPIKey(); err == nil {
+			t.Errorf("%s: expected error, got `%s`", account.Protocol, key)
+		}
+	}
+}
+
+func configuredAccounts(bot *multibot.TorpedoBot) (accounts map[string]*multibot.BotAccount) {
+	accounts = make(map[string]*multibot.BotAccount)
+	for _, ba := range bot.GetAccounts() {
+		if ba.Protocol == "loopback" && ba.Account.APIKey != "loopback" {
+			accounts[ba.Account.APIKey] = ba
+		}
+	}
+	return
+}
+
+func TestReloadConfig(t *testing.T) {
+	bot := multibot.New()
+	bot.RegisterProtocol("loopback", bot.NewLoopbackProtocol)
+	multibot.LoginDelay = 0
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "torpedobot.yaml")
+	torpedo_registry.Config.SetConfig("configfile", path)
+	defer torpedo_registry.Config.SetConfig("configfile", "")
+
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitRemoved := func(key string) map[string]*multibot.BotAccount {
+		deadline := time.Now().Add(replyTimeout)
+		for {
+			accounts := configuredAccounts(bot)
+			if _, ok := accounts[key]; !ok {
+				return accounts
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("removed account %s is still there", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	// drop remaining accounts and restore default settings
+	defer func() {
+		write("accounts: []\n")
+		bot.ReloadConfig()
+		waitRemoved("config-1")
+		waitRemoved("config-3")
+	}()
+	write(`
+nospam:
+  rate_limit: 10ms
+  blacklist:
+    - type: message
+      pattern: "(?i)buy now"
+accounts:
+  - protocol: loopback
+    api_key: config-1
+    prefix: "?"
+    plugins:
+      weather:
+        units: metric
+  - protocol: loopback
+    api_key: config-2
+`)
+	if err = bot.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	accounts := configuredAccounts(bot)
+	if len(accounts) != 2 || accounts["config-1"].Account.CommandPrefix != "?" || accounts["config-2"].Account.CommandPrefix != "!" {
+		t.Fatalf("unexpected accounts after load: %+v", accounts)
+	}
+	if units := bot.PluginSettings(accounts["config-1"].Account, "weather")["units"]; units != "metric" {
+		t.Errorf("plugin settings: got `%s`", units)
+	}
+
+	// config file blacklist and rate limit apply to all accounts
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	user := &torpedo_registry.UserProfile{ID: "U1", Nick: "alice"}
+	lp.Inject(user, "config", "!echo BUY NOW")
+	if reply := lp.WaitReply(100 * time.Millisecond); reply != nil {
+		t.Errorf("blacklisted message got reply: %+v", reply)
+	}
+	for _, message := range []string{"!echo hi", "!echo again"} {
+		lp.Inject(user, "config", message)
+		if reply := lp.WaitReply(replyTimeout); reply == nil {
+			t.Errorf("no reply to `%s`", message)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// bad config is rejected, accounts stay
+	write("accounts:\n  - protocol: nosuchprotocol\n    api_key: x\n")
+	if err = bot.ReloadConfig(); err == nil {
+		t.Errorf("expected error for unknown protocol")
+	}
+	if len(configuredAccounts(bot)) != 2 {
+		t.Errorf("accounts changed after failed reload")
+	}
+
+	write(`
+accounts:
+  - protocol: loopback
+    api_key: config-1
+    prefix: "%"
+  - protocol: loopback
+    api_key: config-3
+`)
+	if err = bot.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if accounts["config-1"].Account.CommandPrefix != "%" {
+		t.Errorf("prefix was not updated: `%s`", accounts["config-1"].Account.CommandPrefix)
+	}
+	accounts = waitRemoved("config-2")
+	if _, ok := accounts["config-3"]; len(accounts) != 2 || !ok {
+		t.Errorf("unexpected accounts after reload: %+v", accounts)
+	}
+}
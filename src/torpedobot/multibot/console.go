@@ -0,0 +1,111 @@
+package multibot
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+var (
+	ConsoleMode    *bool
+	ConsoleUser    *string
+	ConsoleChannel *string
+)
+
+// ConsoleProtocol reads messages from stdin and prints replies to stdout,
+// bot shuts down when input is closed
+type ConsoleProtocol struct {
+	bot     *TorpedoBot
+	account *torpedo_registry.Account
+	in      io.Reader
+	out     io.Writer
+}
+
+func (tb *TorpedoBot) NewConsoleProtocol() Protocol {
+	return tb.NewConsoleProtocolIO(os.Stdin, os.Stdout)
+}
+
+// NewConsoleProtocolIO - console reading messages from in and printing replies to out
+func (tb *TorpedoBot) NewConsoleProtocolIO(in io.Reader, out io.Writer) Protocol {
+	return &ConsoleProtocol{bot: tb, in: in, out: out}
+}
+
+func (tb *TorpedoBot) ConfigureConsoleBot(cfg *torpedo_registry.ConfigStruct) {
+	ConsoleMode = flag.Bool("console", false, "Run bot against stdin/stdout")
+	ConsoleUser = flag.String("console_user", "console", "User name for console messages")
+	ConsoleChannel = flag.String("console_channel", "console", "Channel name for console messages")
+}
+
+func (tb *TorpedoBot) ParseConsoleBot(cfg *torpedo_registry.ConfigStruct) {
+	cfg.SetConfig("console", bool2YN(*ConsoleMode))
+	cfg.SetConfig("consoleuser", *ConsoleUser)
+	cfg.SetConfig("consolechannel", *ConsoleChannel)
+}
+
+func (cp *ConsoleProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	cp.account = account
+	account.API = cp
+	return
+}
+
+func (cp *ConsoleProtocol) Capabilities() Capabilities {
+	return Capabilities{RichMessages: true, Images: true}
+}
+
+func (cp *ConsoleProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	if message != "" {
+		fmt.Fprintf(cp.out, "[%v] %s\n", channel, message)
+	}
+	for _, rm := range richmsgs {
+		if rm.IsEmpty() {
+			continue
+		}
+		if rm.Title != "" {
+			fmt.Fprintf(cp.out, "[%v] Title: %s\n", channel, rm.Title)
+		}
+		if rm.TitleLink != "" {
+			fmt.Fprintf(cp.out, "[%v] Link: %s\n", channel, rm.TitleLink)
+		}
+		if rm.Text != "" {
+			fmt.Fprintf(cp.out, "[%v] %s\n", channel, rm.Text)
+		}
+		if rm.ImageURL != "" {
+			fmt.Fprintf(cp.out, "[%v] Image: %s\n", channel, rm.ImageURL)
+		}
+	}
+	return
+}
+
+func (cp *ConsoleProtocol) Receive() (err error) {
+	cfg := torpedo_registry.Config.GetConfig()
+	user := cfg["consoleuser"]
+	channel := cfg["consolechannel"]
+	fmt.Fprintf(cp.out, "Console mode, type `%shelp` for list of commands\n", cp.account.CommandPrefix)
+	scanner := bufio.NewScanner(cp.in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		botApi := cp.bot.NewBotAPI(cp, cp, cp.account)
+		botApi.UserProfile = &torpedo_registry.UserProfile{ID: user, Nick: user}
+		botApi.Me = "torpedobot"
+		botApi.Direct = true
+		cp.bot.processChannelEvent(botApi, botApi.NewEvent(channel, line))
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	// stdin closed, console session is over
+	go cp.bot.Shutdown()
+	return ErrNoReconnect
+}
+
+func (cp *ConsoleProtocol) Close() (err error) {
+	return
+}
@@ -0,0 +1,68 @@
+package multibot_test
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// runIsolated - run test in child process, for tests that shut the shared bot down.
+// Returns true in child, test body should run then
+func runIsolated(t *testing.T) bool {
+	if os.Getenv("TORPEDO_ISOLATED_TEST") == t.Name() {
+		return true
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "TORPEDO_ISOLATED_TEST="+t.Name())
+	out, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "--- PASS: "+t.Name()) {
+		t.Fatalf("isolated test failed: %+v\n%s", err, out)
+	}
+	return false
+}
+
+func TestConsole(t *testing.T) {
+	if !runIsolated(t) {
+		return
+	}
+	bot := multibot.New()
+	torpedo_registry.Config.SetConfig("consoleuser", "alice")
+	torpedo_registry.Config.SetConfig("consolechannel", "console")
+	in_reader, in_writer := io.Pipe()
+	out_reader, out_writer := io.Pipe()
+	bot.RegisterProtocol("console-pipe", func() multibot.Protocol {
+		return bot.NewConsoleProtocolIO(in_reader, out_writer)
+	})
+	account := &torpedo_registry.Account{APIKey: "console", CommandPrefix: "!"}
+	bot.AddAccount("console-pipe", account)
+	bot.StartAccount("console-pipe", account)
+
+	output := bufio.NewReader(out_reader)
+	if line, err := output.ReadString('\n'); err != nil || !strings.HasPrefix(line, "Console mode") {
+		t.Fatalf("unexpected greeting: %q, %+v", line, err)
+	}
+	io.WriteString(in_writer, "!echo hello\n")
+	if line, err := output.ReadString('\n'); err != nil || line != "[console] alice said: !echo hello\n" {
+		t.Fatalf("unexpected reply: %q, %+v", line, err)
+	}
+	// closed input shuts bot down
+	in_writer.Close()
+	done := make(chan struct{})
+	go func() {
+		bot.RunLoop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(replyTimeout):
+		t.Fatalf("bot is still running after console input was closed")
+	}
+}
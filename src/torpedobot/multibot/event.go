@@ -0,0 +1,105 @@
+package multibot
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// ChannelKind - normalized channel type
+type ChannelKind string
+
+const (
+	// ChannelDirect - one to one chat
+	ChannelDirect ChannelKind = "direct"
+	// ChannelGroup - private group or multi-person chat
+	ChannelGroup ChannelKind = "group"
+	// ChannelPublic - public channel or room
+	ChannelPublic ChannelKind = "channel"
+)
+
+// ChannelRef - protocol independent channel reference
+type ChannelRef struct {
+	Protocol  string
+	AccountID int
+	// ID - channel ID as string, e.g. Telegram chat ID
+	ID   string
+	Kind ChannelKind
+	// Native - channel value protocol expects in Send (int64 on Telegram, string elsewhere)
+	Native interface{}
+}
+
+// Key - `protocol:id`, same key aliases, history and bridges use
+func (cr ChannelRef) Key() string {
+	return fmt.Sprintf("%s:%s", cr.Protocol, cr.ID)
+}
+
+// Event - incoming message with metadata, available to handlers as TorpedoBotAPI.Event
+type Event struct {
+	Channel ChannelRef
+	Sender  *torpedo_registry.UserProfile
+	// Text - message text with bot mention stripped, caption for media messages
+	Text      string
+	MessageID string
+	ThreadID  string
+	// ReplyTo - ID of message this one replies to (quotes)
+	ReplyTo   string
+	Timestamp time.Time
+	Mentioned bool
+	// Edited - message is edited version of MessageID, edits are not relayed and commands in them are not run
+	Edited      bool
+	Attachments []Attachment
+	// CallbackID, CallbackValue - pressed Button, see RegisterCallbackHandler
+	CallbackID    string
+	CallbackValue string
+	// Raw - platform payload (e.g. *slack.MessageEvent, *tgbotapi.Message, *gomatrix.Event)
+	Raw interface{}
+}
+
+// Direct - event was received in one to one chat
+func (ev *Event) Direct() bool {
+	return ev.Channel.Kind == ChannelDirect
+}
+
+// Attachment - first attachment of kind, nil if there's none
+func (ev *Event) Attachment(kind AttachmentKind) *Attachment {
+	for idx := range ev.Attachments {
+		if ev.Attachments[idx].Kind == kind {
+			return &ev.Attachments[idx]
+		}
+	}
+	return nil
+}
+
+// NewEvent - event for message received in channel, filled from API fields protocol has set
+// (UserProfile, MessageID, ThreadID, Direct, Mentioned). Protocols add the rest
+func (tba *TorpedoBotAPI) NewEvent(channel interface{}, text string) (ev *Event) {
+	kind := ChannelGroup
+	if tba.Direct {
+		kind = ChannelDirect
+	} else {
+		switch ChannelKind(ChannelType(tba.Protocol, channel)) {
+		case ChannelPublic:
+			kind = ChannelPublic
+		case ChannelDirect:
+			kind = ChannelDirect
+		}
+	}
+	ev = &Event{
+		Channel: ChannelRef{
+			Protocol:  tba.ProtocolName,
+			AccountID: tba.AccountID,
+			ID:        fmt.Sprintf("%v", channel),
+			Kind:      kind,
+			Native:    channel,
+		},
+		Sender:    tba.UserProfile,
+		Text:      text,
+		MessageID: tba.MessageID,
+		ThreadID:  tba.ThreadID,
+		Timestamp: time.Now(),
+		Mentioned: tba.Mentioned,
+	}
+	return
+}
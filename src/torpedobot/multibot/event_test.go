@@ -0,0 +1,51 @@
+package multibot_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func EventProcessMessage(api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+	ev := api.API.(*multibot.TorpedoBotAPI).Event
+	attachment := "none"
+	if image := ev.Attachment(multibot.AttachmentImage); image != nil {
+		attachment = image.Name
+	}
+	api.Bot.PostMessage(channel, fmt.Sprintf("%s %s %s %s reply:%s attachment:%s", ev.Channel.Key(), ev.Channel.Kind,
+		ev.Sender.Nick, ev.MessageID, ev.ReplyTo, attachment), api)
+}
+
+func TestEvent(t *testing.T) {
+	bot := multibot.New()
+	torpedo_registry.Config.RegisterHelpAndHandler("event", "Describe incoming event", EventProcessMessage)
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+
+	user := &torpedo_registry.UserProfile{ID: "U51", Nick: "alice"}
+	id := lp.Inject(user, "event-a", "!event")
+	if reply := lp.WaitReply(replyTimeout); reply == nil || reply.Text != "loopback:event-a group alice "+id+" reply: attachment:none" {
+		t.Errorf("unexpected event: %+v", reply)
+	}
+
+	direct_id := lp.InjectEvent(user, &multibot.Event{
+		Channel:     multibot.ChannelRef{Native: "event-b", Kind: multibot.ChannelDirect},
+		Text:        "!event",
+		ReplyTo:     id,
+		Attachments: []multibot.Attachment{{Kind: multibot.AttachmentImage, Name: "cat.png", MimeType: "image/png"}},
+	})
+	if reply := lp.WaitReply(replyTimeout); reply == nil || reply.Text != "loopback:event-b direct alice "+direct_id+" reply:"+id+" attachment:cat.png" {
+		t.Errorf("unexpected event: %+v", reply)
+	}
+
+	// commands in edited messages are not run again
+	time.Sleep(multibot.DefaultRateLimit)
+	lp.InjectEvent(user, &multibot.Event{Channel: multibot.ChannelRef{Native: "event-a"}, Text: "!event", MessageID: id, Edited: true})
+	if reply := lp.WaitReply(200 * time.Millisecond); reply != nil {
+		t.Errorf("edited command was run: %+v", reply)
+	}
+}
@@ -1,7 +1,6 @@
 package multibot
 
 import (
-	"net/http"
 	"strings"
 	"time"
 
@@ -13,6 +12,7 @@ import (
 	"fmt"
 
 	"github.com/paked/messenger"
+	log "github.com/sirupsen/logrus"
 )
 
 // https://developers.facebook.com/docs/messenger-platform/send-api-reference
@@ -23,7 +23,76 @@ var (
 	FacebookIncomingAddr *string
 )
 
-func HandleFacebookMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
+type FacebookProtocol struct {
+	bot     *TorpedoBot
+	account *torpedo_registry.Account
+	client  *messenger.Messenger
+	webhook *WebhookEndpoint
+	logger  *log.Logger
+}
+
+func (tb *TorpedoBot) NewFacebookProtocol() Protocol {
+	return &FacebookProtocol{bot: tb}
+}
+
+func (fp *FacebookProtocol) Capabilities() Capabilities {
+	return Capabilities{Images: true, Cards: true}
+}
+
+// SendMessage - cards are sent as text with quick replies (links are listed in text) after their images
+func (fp *FacebookProtocol) SendMessage(msg *Message, tba *TorpedoBotAPI) (id string, err error) {
+	if len(msg.Cards) == 0 {
+		return tba.sendPlain(msg)
+	}
+	api, ok := tba.API.(*messenger.Response)
+	if !ok {
+		err = fmt.Errorf("Facebook can only reply to incoming messages, got %T", tba.API)
+		return
+	}
+	if msg.Text != "" || len(msg.RichMessages) > 0 {
+		if err = fp.Send(msg.Channel, msg.Text, tba, msg.RichMessages); err != nil {
+			return
+		}
+	}
+	for _, card := range msg.Cards {
+		for _, image := range card.AllImages() {
+			if err = api.Attachment(messenger.ImageAttachment, image, messenger.ResponseType); err != nil {
+				return
+			}
+		}
+		lines := []string{card.Summary()}
+		replies := make([]messenger.QuickReply, 0)
+		for _, button := range card.Buttons {
+			if button.URL != "" {
+				lines = append(lines, fmt.Sprintf("%s: %s", button.Label, button.URL))
+				continue
+			}
+			replies = append(replies, messenger.QuickReply{ContentType: "text", Title: button.Label, Payload: EncodeCallback(button)})
+		}
+		text := strings.TrimSpace(strings.Join(lines, "\n"))
+		switch {
+		case len(replies) > 0:
+			if text == "" {
+				// quick replies can't be sent without text
+				text = "Choose:"
+			}
+			err = api.TextWithReplies(text, replies, messenger.ResponseType)
+		case text != "":
+			err = api.Text(text, messenger.ResponseType)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// OutboundAPI - page messages are sent as responses to incoming ones only
+func (fp *FacebookProtocol) OutboundAPI() (api interface{}, err error) {
+	return nil, ErrNotSupported
+}
+
+func (fp *FacebookProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
 	switch api := tba.API.(type) {
 	case *messenger.Response:
 		if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
@@ -34,25 +103,33 @@ func HandleFacebookMessage(channel interface{}, message string, tba *TorpedoBotA
 					if len(new_str) < FACEBOOK_TEXT_MAX {
 						new_str += string(msg[i])
 					} else {
-						api.Text(new_str, messenger.ResponseType)
+						if err = api.Text(new_str, messenger.ResponseType); err != nil {
+							return
+						}
 						new_str = ""
 						new_str += string(msg[i])
 					}
 				}
-				api.Text(new_str, messenger.ResponseType)
+				err = api.Text(new_str, messenger.ResponseType)
 			} else {
-				api.Text(msg, messenger.ResponseType)
+				err = api.Text(msg, messenger.ResponseType)
+			}
+			if err != nil {
+				return
 			}
-			api.Attachment(messenger.ImageAttachment, url, messenger.ResponseType)
+			err = api.Attachment(messenger.ImageAttachment, url, messenger.ResponseType)
 		} else {
-			api.Text(message, messenger.ResponseType)
+			err = api.Text(message, messenger.ResponseType)
 		}
+	default:
+		err = fmt.Errorf("Facebook can only reply to incoming messages, got %T", api)
 	}
+	return
 }
 
 func (tb *TorpedoBot) ConfigureFacebookBot(cfg *torpedo_registry.ConfigStruct) {
 	FacebookAPIKey = flag.String("facebook", "", "Comma separated list of Facebook creds, page_token1:verify_token1,..")
-	FacebookIncomingAddr = flag.String("facebook_incoming_addr", "0.0.0.0:3979", "Listen on this address for incoming Facebook messages")
+	FacebookIncomingAddr = flag.String("facebook_incoming_addr", "", "Listen on this address for incoming Facebook messages (defaults to -webhook_addr)")
 
 }
 
@@ -64,46 +141,54 @@ func (tb *TorpedoBot) ParseFacebookBot(cfg *torpedo_registry.ConfigStruct) {
 	}
 }
 
-func (tb *TorpedoBot) RunFacebookBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
-	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunFacebookBotAccount(account)
-}
-
-func (tb *TorpedoBot) RunFacebookBotAccount(account *torpedo_registry.Account) {
-	tb.Stats.ConnectedAccounts += 1
+func (fp *FacebookProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	tb := fp.bot
+	fp.account = account
 	cu := &common.Utils{}
 	logger := cu.NewLog("facebook-bot")
+	fp.logger = logger
 
-	tb.RegisteredProtocols["*messenger.Response"] = HandleFacebookMessage
-
-	pageToken := strings.Split(account.APIKey, ":")[0]
-	verifyToken := strings.Split(account.APIKey, ":")[1]
-	appSecret := strings.Split(account.APIKey, ":")[2]
+	creds := strings.Split(account.APIKey, ":")
+	if len(creds) != 3 {
+		err = fmt.Errorf("Facebook creds should be in page_token:verify_token:app_secret format")
+		return
+	}
+	pageToken := creds[0]
+	verifyToken := creds[1]
+	appSecret := creds[2]
 	client := messenger.New(messenger.Options{
 		AppSecret:   appSecret,
 		Verify:      true,
 		VerifyToken: verifyToken,
 		Token:       pageToken,
 	})
+	fp.client = client
 
 	account.API = client
 
 	client.HandleMessage(func(m messenger.Message, r *messenger.Response) {
 		logger.Printf("%v (Sent, %v)\n", m.Text, m.Time.Format(time.UnixDate))
 
-		botApi := &TorpedoBotAPI{}
-		botApi.API = r
-		botApi.Bot = tb
-		botApi.CommandPrefix = account.CommandPrefix
+		botApi := tb.NewBotAPI(fp, r, account)
 		botApi.UserProfile = &torpedo_registry.UserProfile{ID: fmt.Sprintf("%v", m.Sender.ID)}
 		// FIXME: Get ID and remove hardcode
 		botApi.Me = "torpedobot"
+		// page conversations are one to one
+		botApi.Direct = true
 
-		go tb.processChannelEvent(botApi, m.Sender.ID, m.Text)
+		ev := botApi.NewEvent(m.Sender.ID, m.Text)
+		if m.QuickReply != nil && m.QuickReply.Payload != "" {
+			ev.CallbackID, ev.CallbackValue = DecodeCallback(m.QuickReply.Payload)
+		}
+		for _, attachment := range m.Attachments {
+			// locations and templates have no content
+			switch kind := AttachmentKind(attachment.Type); kind {
+			case AttachmentImage, AttachmentAudio, AttachmentVideo, AttachmentFile:
+				ev.Attachments = append(ev.Attachments, Attachment{Kind: kind, URL: attachment.Payload.URL})
+			}
+		}
+		ev.Raw = m
+		go tb.processChannelEvent(botApi, ev)
 	})
 	// Setup a handler to be triggered when a message is delivered
 	client.HandleDelivery(func(d messenger.Delivery, r *messenger.Response) {
@@ -115,11 +200,24 @@ func (tb *TorpedoBot) RunFacebookBotAccount(account *torpedo_registry.Account) {
 		logger.Println("Read at:", m.Watermark().Format(time.UnixDate))
 	})
 
-	logger.Printf("Serving messenger bot on %s\n", torpedo_registry.Config.GetConfig()["facebookincomingaddr"])
+	fp.webhook = fp.bot.NewWebhookEndpoint(torpedo_registry.Config.GetConfig()["facebookincomingaddr"])
+	fp.webhook.Handle(fmt.Sprintf("/facebook/%s/webhook", WebhookAccountID(account)), client.Handler())
+	fp.webhook.HandleLegacy("/", client.Handler())
+	return
+}
+
+func (fp *FacebookProtocol) Receive() error {
+	return fp.webhook.Serve()
+}
+
+// Ready - webhook server is listening
+func (fp *FacebookProtocol) Ready() <-chan struct{} {
+	return fp.webhook.Ready()
+}
 
-	account.Connection.ReconnectCount += 1
-	if err := http.ListenAndServe(torpedo_registry.Config.GetConfig()["facebookincomingaddr"], client.Handler()); err != nil {
-		logger.Fatal(err)
+func (fp *FacebookProtocol) Close() error {
+	if fp.webhook == nil {
+		return nil
 	}
-	tb.Stats.ConnectedAccounts -= 1
+	return fp.webhook.Close()
 }
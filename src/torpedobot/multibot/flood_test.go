@@ -0,0 +1,159 @@
+package multibot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func TestFloodDetectors(t *testing.T) {
+	bot := multibot.New()
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := multibot.NewBoltStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bot is shared by tests
+	bot.Store = store
+	defer func() {
+		bot.Store = nil
+		store.Close()
+	}()
+	torpedo_registry.Config.SetConfig("admins", "U9")
+	defer torpedo_registry.Config.SetConfig("admins", "")
+
+	path := filepath.Join(dir, "torpedobot.yaml")
+	config := `
+nospam:
+  limits:
+    channel:
+      rate: 0
+  detectors:
+    repeat:
+      action: warn
+      threshold: 2
+    mentions:
+      action: blacklist
+      threshold: 3
+      expires: 1h
+    links:
+      action: notify
+      threshold: 2
+`
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	torpedo_registry.Config.SetConfig("configfile", path)
+	defer torpedo_registry.Config.SetConfig("configfile", "")
+	if err = bot.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ioutil.WriteFile(path, []byte("accounts: []\n"), 0600)
+		bot.ReloadConfig()
+	}()
+
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	users := make(map[string]*torpedo_registry.UserProfile)
+	for _, id := range []string{"U1", "U2", "U3", "U9"} {
+		users[id] = &torpedo_registry.UserProfile{ID: id, Nick: id}
+	}
+	cases := []struct {
+		user    string
+		message string
+		// replies as channel: text
+		replies []string
+	}{
+		{"U1", "!echo hi", []string{"flood: U1 said: !echo hi"}},
+		{"U1", "!echo HI", []string{"flood: U1, please stop flooding"}},
+		// warning is sent once per window
+		{"U1", "!echo hi", nil},
+		{"U1", "!echo bye", []string{"flood: U1 said: !echo bye"}},
+		// admins are not checked
+		{"U9", "!echo hi", []string{"flood: U9 said: !echo hi"}},
+		{"U9", "!echo hi", []string{"flood: U9 said: !echo hi"}},
+		{"U3", "!echo see http://example.com", []string{"flood: U3 said: !echo see http://example.com"}},
+		{"U3", "!echo and www.example.org", []string{
+			"U9: Flood detector links fired for `U3` (U3) in loopback:flood: !echo and www.example.org",
+			"flood: U3 said: !echo and www.example.org",
+		}},
+		{"U2", "!echo @a @b @c", nil},
+		{"U2", "!echo sorry", nil},
+	}
+	for _, tc := range cases {
+		lp.Inject(users[tc.user], "flood", tc.message)
+		for _, expected := range tc.replies {
+			reply := lp.WaitReply(replyTimeout)
+			if reply == nil || expected != reply.Channel.(string)+": "+reply.Text {
+				t.Errorf("%s `%s`: got %+v, expected `%s`", tc.user, tc.message, reply, expected)
+			}
+		}
+		if reply := lp.WaitReply(100 * time.Millisecond); reply != nil {
+			t.Errorf("%s `%s`: unexpected reply %+v", tc.user, tc.message, reply)
+		}
+	}
+	// admins get notifications in direct chats, sent through account rather than event API
+	ba, sent := startStrict(bot, "strict-flood")
+	defer stopStrict(bot, ba)
+	torpedo_registry.Config.SetConfig("admins", "U9,strict-flood:S9,loopback:U8")
+	api := bot.NewBotAPI(&strictProtocol{sent: sent}, "event", ba.Account)
+	api.UserProfile = &torpedo_registry.UserProfile{ID: "S1", Nick: "spammer"}
+	for _, message := range []string{"http://example.com", "http://example.org"} {
+		if !bot.FloodCheckOk(api, "strict", message) {
+			t.Errorf("notify action dropped message `%s`", message)
+		}
+	}
+	notified := make(map[string]bool)
+	for len(notified) < 2 {
+		select {
+		case message := <-sent:
+			notified[message] = true
+		case <-time.After(replyTimeout):
+			t.Fatalf("admins were not notified: %+v", notified)
+		}
+	}
+	for _, admin := range []string{"U9", "S9"} {
+		if expected := "direct-" + admin + ": Flood detector links fired for `S1` (spammer) in strict-flood:strict: http://example.org"; !notified[expected] {
+			t.Errorf("missing `%s` in %+v", expected, notified)
+		}
+	}
+
+	// unverified sender ID may be forged, it's not blacklisted
+	forged := bot.NewBotAPI(&unverifiedProtocol{}, nil, lp.Account())
+	forged.ProtocolName = "webhook"
+	forged.UserProfile = &torpedo_registry.UserProfile{ID: "U4", Nick: "U4"}
+	if bot.FloodCheckOk(forged, "flood", "@a @b @c") {
+		t.Errorf("flood from unverified sender was not dropped")
+	}
+
+	found := false
+	for _, entry := range bot.GetBlacklist() {
+		if entry.Type == "sender" && entry.Pattern == "^U4$" {
+			t.Errorf("unverified sender was blacklisted: %+v", entry)
+		}
+		if entry.Type == "sender" && entry.Pattern == "^U2$" && entry.Expires != nil && strings.HasPrefix(entry.Source, "store") &&
+			entry.Channel == "loopback/"+multibot.WebhookAccountID(lp.Account()) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("sender was not blacklisted: %+v", bot.GetBlacklist())
+	}
+	// same ID on other account is not blacklisted
+	api.UserProfile = &torpedo_registry.UserProfile{ID: "U2", Nick: "U2"}
+	if !bot.CheckMessageBlacklistOk(api, "strict", "hello") {
+		t.Errorf("sender was blacklisted on other account")
+	}
+}
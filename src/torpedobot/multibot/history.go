@@ -2,22 +2,282 @@ package multibot
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/tb0hdan/torpedo_registry"
 )
 
-func (tb *TorpedoBot) StoreMessageHistory(api *TorpedoBotAPI, channel interface{}, incoming_message string) {
-	session, collection, err := tb.Database.GetCollection("chatHistory")
-	defer session.Close()
-	if err != nil {
-		tb.logger.Fatal("Could not connect to database: %+v\n", err)
+// HistoryPruneInterval - expired history is removed this often
+var HistoryPruneInterval = 10 * time.Minute
+
+// MaxHistoryResults - search returns at most this many messages
+const MaxHistoryResults = 20
+
+// HistoryItem - message received or sent by bot
+type HistoryItem struct {
+	// Timestamp - unix time, seconds
+	Timestamp int64  `json:"timestamp"`
+	Protocol  string `json:"protocol"`
+	// Account - account ID, see /api/v1/accounts
+	Account int    `json:"account"`
+	Channel string `json:"channel"`
+	Sender  string `json:"sender"`
+	Nick    string `json:"nick"`
+	Message string `json:"message"`
+	// MessageID - protocol message ID, if protocol provides one
+	MessageID string `json:"message_id,omitempty"`
+	// Outgoing - sent by bot
+	Outgoing bool `json:"outgoing"`
+	// Expires - removed after this time, never if unset
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// HistoryQuery - empty fields match everything, results are newest first
+type HistoryQuery struct {
+	Protocol string
+	Channel  string
+	// Nick - case insensitive
+	Nick string
+	// Text - message contains all words, case insensitive
+	Text  string
+	Limit int
+}
+
+// HistoryConfig - `history` section of config file
+type HistoryConfig struct {
+	// Retention - keep messages this long, forever if unset
+	Retention time.Duration `yaml:"retention"`
+	// Channels - per channel settings by `protocol:channel` (see ChannelKey)
+	Channels map[string]HistoryChannelConfig `yaml:"channels"`
+}
+
+type HistoryChannelConfig struct {
+	// Disabled - channel opted out, nothing is recorded
+	Disabled  bool          `yaml:"disabled"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+// Validate - retention can't be negative
+func (config *HistoryConfig) Validate() error {
+	if config.Retention < 0 {
+		return fmt.Errorf("retention can't be negative")
+	}
+	for channel, settings := range config.Channels {
+		if settings.Retention < 0 {
+			return fmt.Errorf("`%s` retention can't be negative", channel)
+		}
+	}
+	return nil
+}
+
+// Matches - item satisfies query
+func (query *HistoryQuery) Matches(item *HistoryItem) bool {
+	if (query.Protocol != "" && query.Protocol != item.Protocol) || (query.Channel != "" && query.Channel != item.Channel) {
+		return false
+	}
+	if query.Nick != "" && !strings.EqualFold(query.Nick, item.Nick) {
+		return false
+	}
+	message := strings.ToLower(item.Message)
+	for _, word := range strings.Fields(strings.ToLower(query.Text)) {
+		if !strings.Contains(message, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (tb *TorpedoBot) setHistorySettings(config HistoryConfig) {
+	tb.historyLock.Lock()
+	defer tb.historyLock.Unlock()
+	tb.history = config
+}
+
+// historyRetention - channel retention, recorded is false for opted out channels
+func (tb *TorpedoBot) historyRetention(channel_key string) (retention time.Duration, recorded bool) {
+	tb.historyLock.RLock()
+	defer tb.historyLock.RUnlock()
+	retention = tb.history.Retention
+	if settings, ok := tb.history.Channels[channel_key]; ok {
+		if settings.Disabled {
+			return 0, false
+		}
+		if settings.Retention != 0 {
+			retention = settings.Retention
+		}
+	}
+	return retention, true
+}
+
+// RecordHistory - store incoming or outgoing message unless channel opted out, errors are logged
+func (tb *TorpedoBot) RecordHistory(api *TorpedoBotAPI, channel interface{}, message string, outgoing bool) {
+	if tb.Store == nil || message == "" {
+		return
 	}
-	err = collection.Insert(&torpedo_registry.MessageHistoryItem{Timestamp: int64(time.Now().Unix()), Channel: fmt.Sprintf("%v", channel),
-		Sender: api.UserProfile.ID, Message: incoming_message, Nick: api.UserProfile.Nick})
-	if err != nil {
-		tb.logger.Fatal(err)
+	retention, recorded := tb.historyRetention(ChannelKey(api, channel))
+	if !recorded {
+		return
+	}
+	now := time.Now()
+	item := &HistoryItem{
+		Timestamp: now.Unix(),
+		Protocol:  api.ProtocolName,
+		Account:   api.AccountID,
+		Channel:   fmt.Sprintf("%v", channel),
+		Outgoing:  outgoing,
+		Message:   message,
+	}
+	if outgoing {
+		item.Sender = api.Me
+	} else {
+		item.MessageID = api.MessageID
+		if api.UserProfile != nil {
+			item.Sender, item.Nick = api.UserProfile.ID, api.UserProfile.Nick
+		}
+	}
+	if retention > 0 {
+		expires := now.Add(retention)
+		item.Expires = &expires
+	}
+	if err := tb.Store.AddHistory(item); err != nil {
+		tb.logger.Printf("Could not store message history: %+v\n", err)
+	}
+}
+
+// SearchHistory - stored messages, newest first
+func (tb *TorpedoBot) SearchHistory(query HistoryQuery) (items []*HistoryItem, err error) {
+	if tb.Store == nil {
+		err = fmt.Errorf("history requires storage")
+		return
+	}
+	if query.Limit <= 0 || query.Limit > MaxHistoryResults {
+		query.Limit = MaxHistoryResults
+	}
+	return tb.Store.SearchHistory(query)
+}
+
+// PruneHistory - remove expired messages
+func (tb *TorpedoBot) PruneHistory() (removed int, err error) {
+	if tb.Store == nil {
+		return
+	}
+	return tb.Store.PruneHistory(time.Now())
+}
+
+func (tb *TorpedoBot) runHistoryPruner() {
+	ticker := time.NewTicker(HistoryPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if removed, err := tb.PruneHistory(); err != nil {
+				tb.logger.Printf("Could not prune history: %+v\n", err)
+			} else if removed > 0 {
+				tb.logger.Printf("Removed %d expired history messages\n", removed)
+			}
+		case <-tb.ctx.Done():
+			return
+		}
+	}
+}
+
+func formatHistoryItem(item *HistoryItem) string {
+	nick := item.Nick
+	if item.Outgoing {
+		nick = "bot"
+	} else if nick == "" {
+		nick = item.Sender
+	}
+	return fmt.Sprintf("[%s] %s:%s <%s> %s", time.Unix(item.Timestamp, 0).UTC().Format("2006-01-02 15:04"),
+		item.Protocol, item.Channel, nick, item.Message)
+}
+
+// HistoryCommands - `history` and `seen` commands
+func (tb *TorpedoBot) HistoryCommands() []*Command {
+	reply := func(handler func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (string, error)) CommandHandler {
+		return func(botapi *torpedo_registry.BotAPI, channel interface{}, cmd *ParsedCommand) {
+			api := botapi.API.(*TorpedoBotAPI)
+			message, err := handler(api, channel, cmd)
+			if err != nil {
+				message = err.Error()
+			}
+			api.PostMessage(channel, message)
+		}
+	}
+	return []*Command{
+		{
+			Name: "history",
+			Help: "Chat history",
+			Subcommands: []*Command{
+				{
+					Name: "search",
+					Help: "Find messages in this channel, e.g. `history search --limit 10 release date`",
+					Args: []ArgSpec{
+						{Name: "text", Help: "Words message contains", Required: true, Rest: true},
+					},
+					Flags: []ArgSpec{
+						{Name: "limit", Short: "l", Help: "Number of messages", Type: ArgInt, Default: "5"},
+						{Name: "all", Help: "Search all channels, admins only", Type: ArgBool},
+					},
+					Handler: reply(func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (message string, err error) {
+						query := HistoryQuery{Text: cmd.String("text"), Limit: int(cmd.Int("limit"))}
+						if cmd.Bool("all") && !tb.IsAdmin(api) {
+							err = fmt.Errorf("Only admins can search all channels")
+							return
+						}
+						if !cmd.Bool("all") {
+							query.Protocol, query.Channel = api.ProtocolName, fmt.Sprintf("%v", channel)
+						}
+						items, err := tb.SearchHistory(query)
+						if err != nil {
+							return
+						}
+						if len(items) == 0 {
+							message = "Nothing found"
+							return
+						}
+						lines := make([]string, 0, len(items))
+						for _, item := range items {
+							lines = append(lines, formatHistoryItem(item))
+						}
+						message = strings.Join(lines, "\n")
+						return
+					}),
+				},
+			},
+		},
+		{
+			Name: "seen",
+			Help: "When user was last seen on any network",
+			Args: []ArgSpec{{Name: "nick", Help: "User nick", Required: true}},
+			Handler: reply(func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (message string, err error) {
+				nick := strings.TrimPrefix(cmd.String("nick"), "@")
+				items, err := tb.SearchHistory(HistoryQuery{Nick: nick, Limit: 1})
+				if err != nil {
+					return
+				}
+				if len(items) == 0 {
+					message = fmt.Sprintf("I haven't seen %s", nick)
+					return
+				}
+				item := items[0]
+				ago := time.Since(time.Unix(item.Timestamp, 0)).Round(time.Second)
+				message = fmt.Sprintf("%s was last seen %s ago in %s:%s", item.Nick, ago, item.Protocol, item.Channel)
+				// messages from other channels stay there
+				if item.Protocol == api.ProtocolName && item.Channel == fmt.Sprintf("%v", channel) {
+					message += ": " + item.Message
+				}
+				return
+			}),
+		},
+	}
+}
+
+// parseHistoryChannel - `protocol:channel` to query fields
+func parseHistoryChannel(channel_key string) (protocol, channel string) {
+	if idx := strings.Index(channel_key, ":"); idx > 0 {
+		return channel_key[:idx], channel_key[idx+1:]
 	}
-	tb.logger.Printf("%v - %s - %s\n", channel, api.UserProfile.ID, incoming_message)
-	return
+	return "", channel_key
 }
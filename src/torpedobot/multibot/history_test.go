@@ -0,0 +1,95 @@
+package multibot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func TestHistory(t *testing.T) {
+	bot := multibot.New()
+	torpedo_registry.Config.RegisterHelpAndHandler("echo", "Echo message back", EchoProcessMessage)
+	for _, command := range bot.HistoryCommands() {
+		multibot.RegisterCommand(command)
+	}
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := multibot.NewBoltStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bot is shared by tests
+	bot.Store = store
+	defer func() {
+		bot.Store = nil
+		store.Close()
+	}()
+
+	path := filepath.Join(dir, "torpedobot.yaml")
+	config := `
+nospam:
+  limits:
+    channel:
+      rate: 0
+history:
+  retention: 24h
+  channels:
+    loopback:quiet:
+      disabled: true
+`
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	torpedo_registry.Config.SetConfig("configfile", path)
+	defer torpedo_registry.Config.SetConfig("configfile", "")
+	if err = bot.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ioutil.WriteFile(path, []byte("accounts: []\n"), 0600)
+		bot.ReloadConfig()
+	}()
+
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	alice := &torpedo_registry.UserProfile{ID: "U11", Nick: "alice"}
+	bob := &torpedo_registry.UserProfile{ID: "U12", Nick: "bob"}
+
+	// commands and replies are recorded
+	lp.Inject(alice, "history", "!echo release is on Friday")
+	lp.WaitReply(replyTimeout)
+	lp.Inject(alice, "quiet", "secret release plans")
+	items, err := bot.SearchHistory(multibot.HistoryQuery{Text: "release"})
+	if err != nil || len(items) != 2 || !items[0].Outgoing || items[1].Nick != "alice" || items[1].Expires == nil {
+		t.Fatalf("unexpected history: %+v (%+v)", items, err)
+	}
+
+	lp.Inject(bob, "history", "!history search friday")
+	reply := lp.WaitReply(replyTimeout)
+	if reply == nil || !strings.Contains(reply.Text, "<alice> !echo release is on Friday") || !strings.Contains(reply.Text, "<bot> alice said: !echo release is on Friday") {
+		t.Errorf("unexpected search reply: %+v", reply)
+	}
+	lp.Inject(bob, "history", "!history search --all friday")
+	if reply = lp.WaitReply(replyTimeout); reply == nil || !strings.Contains(reply.Text, "Only admins") {
+		t.Errorf("non-admin searched all channels: %+v", reply)
+	}
+
+	// message text is not shown in other channels
+	lp.Inject(bob, "other", "!seen Alice")
+	if reply = lp.WaitReply(replyTimeout); reply == nil || !strings.Contains(reply.Text, "alice was last seen") || strings.Contains(reply.Text, "Friday") {
+		t.Errorf("unexpected seen reply: %+v", reply)
+	}
+	lp.Inject(bob, "other", "!seen carol")
+	if reply = lp.WaitReply(replyTimeout); reply == nil || reply.Text != "I haven't seen carol" {
+		t.Errorf("unexpected seen reply: %+v", reply)
+	}
+}
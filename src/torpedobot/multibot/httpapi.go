@@ -1,21 +1,57 @@
 package multibot
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"flag"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	common "github.com/tb0hdan/torpedo_common"
 	"github.com/tb0hdan/torpedo_registry"
 )
 
-var APIADDR *string
+var (
+	APIADDR  *string
+	APIToken *string
+)
+
+// APIPrefix - REST API endpoints are served under this path
+const APIPrefix = "/api/v1"
+
+type APIHandler struct {
+	Name string `json:"name"`
+	Help string `json:"help"`
+}
+
+type APIHandlers struct {
+	Commands     []APIHandler `json:"commands"`
+	TextHandlers []string     `json:"text_handlers"`
+}
+
+type APIMessage struct {
+	// string or integer (Telegram) channel ID
+	Channel json.RawMessage `json:"channel"`
+	Text    string          `json:"text"`
+}
+
+// APIBlacklistRule - new blacklist rule, TTL (e.g. 24h) may be set instead of expiry time
+type APIBlacklistRule struct {
+	BlackListRuleItem
+	TTL string `json:"ttl"`
+}
 
 func (tb *TorpedoBot) ConfigureHTTPAPI(cfg *torpedo_registry.ConfigStruct) {
 	APIADDR = flag.String("apiaddr", "", "Listen on this address for incoming HTTP API Server connections. Example: :8080")
+	APIToken = flag.String("api_token", "", "Bearer token required for HTTP API requests")
 }
 
 func (tb *TorpedoBot) ParseHTTPAPI(cfg *torpedo_registry.ConfigStruct) {
@@ -24,18 +60,236 @@ func (tb *TorpedoBot) ParseHTTPAPI(cfg *torpedo_registry.ConfigStruct) {
 		// try supplied one first
 		cfg.SetConfig("apiaddr", common.GetStripEnv("APIADDR"))
 	}
+	cfg.SetConfig("apitoken", *APIToken)
+	if cfg.GetConfig()["apitoken"] == "" {
+		cfg.SetConfig("apitoken", common.GetStripEnv("API_TOKEN"))
+	}
+}
+
+func apiTokenOk(r *http.Request) bool {
+	token := torpedo_registry.Config.GetConfig()["apitoken"]
+	auth := r.Header.Get("Authorization")
+	supplied := strings.TrimPrefix(auth, "Bearer ")
+	return token != "" && supplied != auth && subtle.ConstantTimeCompare([]byte(supplied), []byte(token)) == 1
+}
+
+// APIAuth - require `Authorization: Bearer <token>` header
+func (tb *TorpedoBot) APIAuth(handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		if !apiTokenOk(r.Request) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="torpedobot"`)
+			rest.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// MetricsHandler - Prometheus metrics, same token as REST API
+func (tb *TorpedoBot) MetricsHandler() http.Handler {
+	metrics := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !apiTokenOk(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="torpedobot"`)
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		metrics.ServeHTTP(w, r)
+	})
+}
+
+func (tb *TorpedoBot) APIGetAccounts(w rest.ResponseWriter, r *rest.Request) {
+	accounts := make([]map[string]interface{}, 0)
+	for _, ba := range tb.GetAccounts() {
+		tb.connLock.Lock()
+		accounts = append(accounts, map[string]interface{}{
+			"id":              ba.ID,
+			"protocol":        ba.Protocol,
+			"command_prefix":  ba.Account.CommandPrefix,
+			"connected":       ba.Account.Connection.Connected,
+			"reconnect_count": ba.Account.Connection.ReconnectCount,
+		})
+		tb.connLock.Unlock()
+	}
+	w.WriteJson(accounts)
+}
+
+func (tb *TorpedoBot) APIPostMessage(w rest.ResponseWriter, r *rest.Request) {
+	id, err := strconv.Atoi(r.PathParam("id"))
+	if err != nil {
+		rest.Error(w, "Invalid account ID", http.StatusBadRequest)
+		return
+	}
+	if _, err = tb.GetAccount(id); err != nil {
+		rest.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	message := &APIMessage{}
+	if err = r.DecodeJsonPayload(message); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var channel interface{}
+	var channel_id int64
+	var channel_name string
+	if json.Unmarshal(message.Channel, &channel_id) == nil {
+		channel = channel_id
+	} else if json.Unmarshal(message.Channel, &channel_name) == nil && channel_name != "" {
+		channel = channel_name
+	}
+	if channel == nil || message.Text == "" {
+		rest.Error(w, "Both channel and text are required", http.StatusBadRequest)
+		return
+	}
+	message_id, err := tb.SendMessage(id, channel, message.Text)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteJson(map[string]string{"status": "sent", "id": message_id})
+}
+
+func (tb *TorpedoBot) APIGetStats(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(tb.GetStats())
+}
+
+func (tb *TorpedoBot) APIGetBuild(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(tb.Build)
+}
+
+func (tb *TorpedoBot) APIGetHandlers(w rest.ResponseWriter, r *rest.Request) {
+	handlers := &APIHandlers{Commands: make([]APIHandler, 0), TextHandlers: make([]string, 0)}
+	help := torpedo_registry.Config.GetHelp()
+	for name := range torpedo_registry.Config.GetHandlers() {
+		handlers.Commands = append(handlers.Commands, APIHandler{Name: name, Help: help[name]})
+	}
+	sort.Slice(handlers.Commands, func(i, j int) bool { return handlers.Commands[i].Name < handlers.Commands[j].Name })
+	for name := range torpedo_registry.Config.GetTextMessageHandlers() {
+		handlers.TextHandlers = append(handlers.TextHandlers, name)
+	}
+	sort.Strings(handlers.TextHandlers)
+	w.WriteJson(handlers)
+}
+
+func (tb *TorpedoBot) APIGetBlacklist(w rest.ResponseWriter, r *rest.Request) {
+	w.WriteJson(tb.GetBlacklist())
+}
+
+func (tb *TorpedoBot) APIAddBlacklistRule(w rest.ResponseWriter, r *rest.Request) {
+	rule := &APIBlacklistRule{}
+	if err := r.DecodeJsonPayload(rule); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rule.Type == "" {
+		rule.Type = "message"
+	}
+	if rule.TTL != "" {
+		ttl, err := time.ParseDuration(rule.TTL)
+		if err != nil || ttl <= 0 {
+			rest.Error(w, "Invalid ttl, use e.g. 30m or 24h", http.StatusBadRequest)
+			return
+		}
+		expires := time.Now().Add(ttl)
+		rule.Expires = &expires
+	}
+	entry, err := tb.AddBlacklistRule(rule.BlackListRuleItem)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.WriteJson(entry)
+}
+
+func (tb *TorpedoBot) APIRemoveBlacklistRule(w rest.ResponseWriter, r *rest.Request) {
+	found := false
+	for _, entry := range tb.GetBlacklist() {
+		found = found || entry.ID == r.PathParam("id")
+	}
+	if !found {
+		rest.Error(w, "No such blacklist rule", http.StatusNotFound)
+		return
+	}
+	if err := tb.RemoveBlacklistRule(r.PathParam("id")); err != nil {
+		rest.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteJson(map[string]string{"status": "removed"})
+}
+
+func (tb *TorpedoBot) APIGetHistory(w rest.ResponseWriter, r *rest.Request) {
+	params := r.URL.Query()
+	query := HistoryQuery{Protocol: params.Get("protocol"), Nick: params.Get("nick"), Text: params.Get("q")}
+	if channel := params.Get("channel"); channel != "" {
+		protocol, name := parseHistoryChannel(channel)
+		if protocol != "" {
+			query.Protocol = protocol
+		}
+		query.Channel = name
+	}
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value <= 0 {
+			rest.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		query.Limit = value
+	}
+	items, err := tb.SearchHistory(query)
+	if err != nil {
+		rest.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteJson(items)
 }
 
 func (tb *TorpedoBot) RunHTTPAPI() {
+	apiaddr := torpedo_registry.Config.GetConfig()["apiaddr"]
+	if apiaddr == "" {
+		return
+	}
+	if torpedo_registry.Config.GetConfig()["apitoken"] == "" {
+		tb.logger.Printf("HTTP API requires token (-api_token or API_TOKEN), not starting\n")
+		return
+	}
+
 	api := rest.NewApi()
 	api.Use(rest.DefaultDevStack...)
-	api.SetApp(rest.AppSimple(func(w rest.ResponseWriter, r *rest.Request) {
-		w.WriteJson(map[string]string{"Body": "Hello World!"})
-	}))
+	api.Use(rest.MiddlewareSimple(tb.APIAuth))
+	router, err := rest.MakeRouter(
+		rest.Get("/accounts", tb.APIGetAccounts),
+		rest.Post("/accounts/:id/messages", tb.APIPostMessage),
+		rest.Get("/stats", tb.APIGetStats),
+		rest.Get("/build", tb.APIGetBuild),
+		rest.Get("/handlers", tb.APIGetHandlers),
+		rest.Get("/blacklist", tb.APIGetBlacklist),
+		rest.Post("/blacklist", tb.APIAddBlacklistRule),
+		rest.Delete("/blacklist/:id", tb.APIRemoveBlacklistRule),
+		rest.Get("/history", tb.APIGetHistory),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	api.SetApp(router)
 
-	apiaddr := torpedo_registry.Config.GetConfig()["apiaddr"]
+	mux := http.NewServeMux()
+	mux.Handle(APIPrefix+"/", http.StripPrefix(APIPrefix, api.MakeHandler()))
+	mux.Handle("/metrics", tb.MetricsHandler())
+	tb.apiServer = &http.Server{Addr: apiaddr, Handler: mux}
+	go func() {
+		tb.logger.Printf("Starting HTTP API on %s%s\n", apiaddr, APIPrefix)
+		if err := tb.apiServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
 
-	if apiaddr != "" {
-		log.Fatal(http.ListenAndServe(apiaddr, api.MakeHandler()))
+func (tb *TorpedoBot) stopHTTPAPI() {
+	if tb.apiServer == nil {
+		return
 	}
+	ctx, cancel := tb.shutdownContext()
+	defer cancel()
+	tb.apiServer.Shutdown(ctx)
 }
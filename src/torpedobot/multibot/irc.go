@@ -11,11 +11,11 @@ import (
 
 	"log"
 	"os"
+	"sync"
 
 	common "github.com/tb0hdan/torpedo_common"
 	"github.com/tb0hdan/torpedo_registry"
 	irc "github.com/thoj/go-ircevent"
-	"gopkg.in/mgo.v2/bson"
 )
 
 var IRCAPIKey *string
@@ -32,42 +32,109 @@ func (tb *TorpedoBot) ParseIRCBot(cfg *torpedo_registry.ConfigStruct) {
 	}
 }
 
-type IRCChatroom struct {
-	MyServer string
-	Channel  string
-}
-
 type IRCAPI struct {
 	Connection *irc.Connection
 	Event      *irc.Event
 }
 
-func (ircapi *IRCAPI) Send(channel, message string, attachments ...*SkypeAttachment) {
-	if strings.HasPrefix(channel, "#") {
-		// public msg
-		for _, line := range strings.Split(message, "\n") {
-			if strings.TrimSpace(line) == "" {
-				continue
-			}
-			ircapi.Connection.Privmsg(channel, line)
+func (ircapi *IRCAPI) Send(channel, message string, attachments ...*SkypeAttachment) (err error) {
+	if !ircapi.Connection.Connected() {
+		err = fmt.Errorf("IRC connection is down")
+		return
+	}
+	target := channel
+	// private messages come to bot's nick, reply goes to sender
+	if ircapi.Event != nil && channel == ircapi.Connection.GetNick() {
+		target = ircapi.Event.Nick
+	}
+	for _, line := range strings.Split(message, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
 		}
-	} else {
-		// private msg
-		ircapi.Connection.Privmsg(ircapi.Event.Nick, message)
+		ircapi.Connection.Privmsg(target, line)
+	}
+	return
+}
+
+type IRCProtocol struct {
+	bot        *TorpedoBot
+	account    *torpedo_registry.Account
+	connection *irc.Connection
+	server     string
+	port       string
+	logger     *log.Logger
+	// nicks - last seen nick by user ID (see IRCUserID)
+	nicks     map[string]string
+	nicksLock sync.Mutex
+}
+
+func (tb *TorpedoBot) NewIRCProtocol() Protocol {
+	return &IRCProtocol{bot: tb, nicks: make(map[string]string)}
+}
+
+func (ip *IRCProtocol) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+func (ip *IRCProtocol) ChannelType(channel interface{}) string {
+	if id, _ := channel.(string); strings.HasPrefix(id, "#") || strings.HasPrefix(id, "&") {
+		return "channel"
+	}
+	return "direct"
+}
+
+// OutboundAPI - messages that are not replies are sent to channel or nick directly
+func (ip *IRCProtocol) OutboundAPI() (api interface{}, err error) {
+	return &IRCAPI{Connection: ip.connection}, nil
+}
+
+// DirectChannel - private messages go to nick, user has to be seen since connect
+func (ip *IRCProtocol) DirectChannel(user_id string) (channel interface{}, err error) {
+	ip.nicksLock.Lock()
+	defer ip.nicksLock.Unlock()
+	nick, ok := ip.nicks[user_id]
+	if !ok {
+		err = fmt.Errorf("no nick seen for %s", user_id)
+		return
 	}
+	return nick, nil
 }
 
-func HandleIRCMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
+// seen - remember nick of user
+func (ip *IRCProtocol) seen(user_id, nick string) {
+	ip.nicksLock.Lock()
+	defer ip.nicksLock.Unlock()
+	ip.nicks[user_id] = nick
+}
+
+// renamed - follow nick changes of seen users
+func (ip *IRCProtocol) renamed(nick, new_nick string) {
+	ip.nicksLock.Lock()
+	defer ip.nicksLock.Unlock()
+	for id, known := range ip.nicks {
+		if known == nick {
+			ip.nicks[id] = new_nick
+		}
+	}
+}
+
+func (ip *IRCProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	target, ok := channel.(string)
+	if !ok {
+		return fmt.Errorf("IRC channel should be string, got %T", channel)
+	}
 	switch api := tba.API.(type) {
 	case *IRCAPI:
 		if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
 			msg, url := richmsgs[0].ToGenericAttachment()
-			api.Send(channel.(string), fmt.Sprintf("%s\n%s", msg, url))
+			err = api.Send(target, fmt.Sprintf("%s\n%s", msg, url))
 		} else {
-			api.Send(channel.(string), message)
+			err = api.Send(target, message)
 		}
-
+	default:
+		err = fmt.Errorf("IRC can only reply to incoming messages, got %T", api)
 	}
+	return
 }
 
 // set custom logger + version
@@ -78,25 +145,22 @@ func (tb *TorpedoBot) myIRC(nick, user string, log *log.Logger) *irc.Connection
 	return connection
 }
 
-func (tb *TorpedoBot) RunIRCBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
-	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunIRCBotAccount(account)
-}
-
-func (tb *TorpedoBot) RunIRCBotAccount(account *torpedo_registry.Account) {
+func (ip *IRCProtocol) Connect(account *torpedo_registry.Account) (err error) {
 	var (
 		nick, server string
 	)
-	tb.Stats.ConnectedAccounts += 1
+	tb := ip.bot
+	ip.account = account
 	//cu := &common.Utils{}
 	logger := log.New(os.Stdout, "irc-bot: ", log.Lshortfile|log.LstdFlags) //cu.NewLog("irc-bot")
-	tb.RegisteredProtocols["*multibot.IRCAPI"] = HandleIRCMessage
+	ip.logger = logger
 
-	user_server := strings.Split(account.APIKey, ":")[0]
+	creds := strings.Split(account.APIKey, ":")
+	if len(creds) < 3 {
+		err = fmt.Errorf("IRC creds should be in server:port:usessl format, got `%s`", account.APIKey)
+		return
+	}
+	user_server := creds[0]
 	if len(strings.Split(user_server, "@")) == 2 {
 		nick = strings.Split(user_server, "@")[0]
 		server = strings.Split(user_server, "@")[1]
@@ -104,10 +168,13 @@ func (tb *TorpedoBot) RunIRCBotAccount(account *torpedo_registry.Account) {
 		nick = "torpedobot"
 		server = user_server
 	}
-	port := strings.Split(account.APIKey, ":")[1]
-	usessl := strings.Split(account.APIKey, ":")[2]
+	ip.server = server
+	ip.port = creds[1]
+	usessl := creds[2]
 
 	irccon := tb.myIRC(nick, fmt.Sprintf("%s bot", nick), logger)
+	ip.connection = irccon
+	account.API = irccon
 	if torpedo_registry.Config.GetConfig()["debug"] == "yes" {
 		irccon.VerboseCallbackHandler = true
 		irccon.Debug = true
@@ -120,70 +187,71 @@ func (tb *TorpedoBot) RunIRCBotAccount(account *torpedo_registry.Account) {
 	}
 
 	// Password config
-	if len(strings.Split(account.APIKey, ":")) > 3 {
-		irccon.Password = strings.Split(account.APIKey, ":")[3]
+	if len(creds) > 3 {
+		irccon.Password = creds[3]
 	}
+	// services account of sender is sent with messages, see IRCUserID
+	irccon.RequestCaps = []string{"account-tag"}
 
 	//welcome
-	session, collection, err := tb.Database.GetCollection("ircChatrooms")
-	if err != nil {
-		tb.logger.Fatal("Could not connect to database: %+v\n", err)
-	}
-	results := make([]*IRCChatroom, 0)
-	err = collection.Find(bson.M{"myserver": server}).All(&results)
-	if err != nil {
-		tb.logger.Printf("No rooms available to join: %+v\n", err)
-	}
-	session.Close()
-	for _, room := range results {
-		tb.logger.Printf("Joining IRC chatroom: %s\n", room.Channel)
-		irccon.AddCallback("001", func(e *irc.Event) { irccon.Join(room.Channel) })
+	for _, room := range tb.AccountRooms(account, "irc", server) {
+		tb.logger.Printf("Joining IRC chatroom: %s\n", room)
+		channel := room
+		irccon.AddCallback("001", func(e *irc.Event) { irccon.Join(channel) })
 	}
 	// end of names
 	irccon.AddCallback("366", func(e *irc.Event) {})
 	irccon.AddCallback("INVITE", func(e *irc.Event) {
-		session, collection, err := tb.Database.GetCollection("ircChatrooms")
-		if err != nil {
-			tb.logger.Fatal("Could not connect to database: %+v\n", err)
-		}
-		result := IRCChatroom{}
-		err = collection.Find(bson.M{"myserver": server, "channel": e.Arguments[1]}).One(&result)
-		if err != nil {
-			tb.logger.Println(err)
-			// no record, insert new one
-			err = collection.Insert(&IRCChatroom{MyServer: server, Channel: e.Arguments[1]})
-			if err != nil {
-				tb.logger.Fatal(err)
-			}
-			// join new room
-			irccon.Join(e.Arguments[1])
-		}
-		session.Close()
+		tb.AddRoom("irc", server, e.Arguments[1])
+		irccon.Join(e.Arguments[1])
+	})
+	irccon.AddCallback("NICK", func(event *irc.Event) {
+		ip.renamed(event.Nick, event.Message())
 	})
 	irccon.AddCallback("PRIVMSG", func(event *irc.Event) {
+		ip.seen(IRCUserID(server, event), event.Nick)
 		go func(event *irc.Event) {
-			botApi := &TorpedoBotAPI{}
 			api := &IRCAPI{Connection: irccon, Event: event}
-			botApi.API = api
-			botApi.Bot = tb
-			botApi.CommandPrefix = account.CommandPrefix
-			botApi.UserProfile = &torpedo_registry.UserProfile{ID: fmt.Sprintf("%s@%s", event.User, server), Nick: event.Nick, Server: server}
+			botApi := tb.NewBotAPI(ip, api, account)
+			botApi.UserProfile = &torpedo_registry.UserProfile{ID: IRCUserID(server, event), Nick: event.Nick, Server: server}
 			botApi.Me = irccon.GetNick()
+			message, mentioned := StripMention(event.Message(), botApi.Me)
+			botApi.Mentioned = mentioned
+			botApi.Direct = event.Arguments[0] == botApi.Me
 
-			tb.processChannelEvent(botApi, event.Arguments[0], event.Message())
+			ev := botApi.NewEvent(event.Arguments[0], message)
+			ev.Raw = event
+			tb.processChannelEvent(botApi, ev)
 		}(event)
 	})
 	//
-	err = irccon.Connect(server + ":" + port)
-	if err != nil {
-		tb.logger.Printf("Err %s", err)
-		return
+	err = irccon.Connect(server + ":" + ip.port)
+	return
+}
+
+// IRCUserID - server and services account of sender (account-tag capability) or user@host if sender is not logged in.
+// Nick and ident can be claimed by anyone, host is set by server (or services cloak). Accounts of
+// different networks are different users, so server is part of ID
+func IRCUserID(server string, event *irc.Event) string {
+	if account := event.Tags["account"]; account != "" && account != "*" {
+		return server + ":" + account
 	}
-	account.Connection.ReconnectCount += 1
+	return fmt.Sprintf("%s:%s@%s", server, event.User, event.Host)
+}
+
+func (ip *IRCProtocol) Receive() (err error) {
 	// blocking run here
-	irccon.Loop()
+	ip.connection.Loop()
+	ip.logger.Println("connection terminated")
+	if !ip.bot.IsShuttingDown() {
+		err = fmt.Errorf("IRC connection to %s terminated", ip.server)
+	}
+	return
+}
 
-	// we'll probably won't get here
-	logger.Println("connection terminated")
-	tb.Stats.ConnectedAccounts -= 1
+func (ip *IRCProtocol) Close() (err error) {
+	if ip.connection != nil && ip.connection.Connected() {
+		ip.connection.Quit()
+	}
+	return
 }
@@ -1,8 +1,10 @@
 package multibot
 
 import (
+	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"flag"
@@ -10,16 +12,14 @@ import (
 	common "github.com/tb0hdan/torpedo_common"
 
 	"github.com/mattn/go-xmpp"
+	log "github.com/sirupsen/logrus"
 	"github.com/tb0hdan/torpedo_registry"
-	"gopkg.in/mgo.v2/bson"
 )
 
 var JabberAPIKey *string
 
-type JabberChatroom struct {
-	MyJID    string
-	Chatroom string
-}
+// JabberRoomNick - bot nickname in chatrooms
+const JabberRoomNick = "TorpedoBot"
 
 func (tb *TorpedoBot) JabberServerInfo(jid, server string, c *xmpp.Client) (string, error) {
 	const namespace = "http://jabber.org/protocol/disco#info"
@@ -47,23 +47,79 @@ func (tb *TorpedoBot) JabberPinger(jid, server string, client *xmpp.Client) {
 	sleep := 60
 	tb.logger.Printf("Sending ping every %d seconds\n", sleep)
 	for {
-		client.PingC2S(jid, server)
-		time.Sleep(time.Duration(sleep) * time.Second)
+		// connection is gone, supervisor will start new pinger after reconnect
+		if err := client.PingC2S(jid, server); err != nil {
+			return
+		}
+		select {
+		case <-tb.ctx.Done():
+			return
+		case <-time.After(time.Duration(sleep) * time.Second):
+		}
 	}
 }
 
-func HandleJabberMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
-	switch api := tba.API.(type) {
-	case *xmpp.Client:
-		msg := xmpp.Chat{}
-		msg.Remote = channel.(string)
-		msg.Type = tba.Type
-		msg.Text = message
-		if tba.Type == "groupchat" {
-			msg.Remote = strings.Split(msg.Remote, "/")[0]
+type JabberProtocol struct {
+	bot        *TorpedoBot
+	account    *torpedo_registry.Account
+	talk       *xmpp.Client
+	jid        string
+	server     string
+	startup_ts int64
+	logger     *log.Logger
+	// rooms - joined chatrooms (bare JIDs), messages bot starts there are groupchat messages
+	rooms     map[string]bool
+	roomsLock sync.RWMutex
+}
+
+func (tb *TorpedoBot) NewJabberProtocol() Protocol {
+	return &JabberProtocol{bot: tb, rooms: make(map[string]bool)}
+}
+
+func (jp *JabberProtocol) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+// DirectChannel - user ID is JID, chat messages go to bare JID
+func (jp *JabberProtocol) DirectChannel(user_id string) (interface{}, error) {
+	return strings.Split(user_id, "/")[0], nil
+}
+
+func (jp *JabberProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	remote, ok := channel.(string)
+	if !ok {
+		return fmt.Errorf("Jabber channel should be string, got %T", channel)
+	}
+	msg := xmpp.Chat{}
+	msg.Remote = remote
+	msg.Type = tba.Type
+	// messages bot starts on its own (relays, notifications) go to rooms or users
+	if msg.Type == "" {
+		msg.Type = "chat"
+		if jp.isRoom(strings.Split(msg.Remote, "/")[0]) {
+			msg.Type = "groupchat"
 		}
-		api.Send(msg)
 	}
+	msg.Text = message
+	if tba.Type == "groupchat" {
+		msg.Remote = strings.Split(msg.Remote, "/")[0]
+	}
+	_, err = jp.talk.Send(msg)
+	return
+}
+
+// joinRoom - join chatroom and remember it for Send
+func (jp *JabberProtocol) joinRoom(room string) {
+	jp.roomsLock.Lock()
+	jp.rooms[strings.Split(room, "/")[0]] = true
+	jp.roomsLock.Unlock()
+	jp.talk.JoinMUCNoHistory(room, JabberRoomNick)
+}
+
+func (jp *JabberProtocol) isRoom(jid string) bool {
+	jp.roomsLock.RLock()
+	defer jp.roomsLock.RUnlock()
+	return jp.rooms[jid]
 }
 
 func GetStrippedJID(cli *xmpp.Client) (jid string) {
@@ -82,29 +138,23 @@ func (tb *TorpedoBot) ParseJabberBot(cfg *torpedo_registry.ConfigStruct) {
 	}
 }
 
-func (tb *TorpedoBot) RunJabberBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
-	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunJabberBotAccount(account)
-}
-
-func (tb *TorpedoBot) RunJabberBotAccount(account *torpedo_registry.Account) {
-	var talk *xmpp.Client
-	var err error
-	tb.Stats.ConnectedAccounts += 1
-	account.Connection.ReconnectCount += 1
+func (jp *JabberProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	tb := jp.bot
+	jp.account = account
 	cu := &common.Utils{}
 
 	logger := cu.NewLog("jabber-bot")
-	str_jid := strings.Split(account.APIKey, ":")[0]
-	password := strings.Split(account.APIKey, ":")[1]
-	server := strings.Split(str_jid, "@")[1]
-	options := xmpp.Options{Host: server,
-		User:          str_jid,
-		Password:      password,
+	jp.logger = logger
+	creds := strings.Split(account.APIKey, ":")
+	if len(creds) != 2 || !strings.Contains(creds[0], "@") {
+		err = fmt.Errorf("Jabber creds should be in user@host.com:password format")
+		return
+	}
+	jp.jid = creds[0]
+	jp.server = strings.Split(jp.jid, "@")[1]
+	options := xmpp.Options{Host: jp.server,
+		User:          jp.jid,
+		Password:      creds[1],
 		NoTLS:         true,
 		Debug:         true,
 		Session:       false,
@@ -112,73 +162,68 @@ func (tb *TorpedoBot) RunJabberBotAccount(account *torpedo_registry.Account) {
 		StatusMessage: "",
 	}
 
-	talk, err = options.NewClient()
-	account.API = talk
-	tb.RegisteredProtocols["*xmpp.Client"] = HandleJabberMessage
-
+	jp.talk, err = options.NewClient()
 	if err != nil {
-		logger.Fatal(err)
+		return
 	}
+	account.API = jp.talk
 
-	startup_ts := time.Now().Unix()
-	go tb.WaitAndSendJabberDisco(str_jid, server, talk)
+	jp.startup_ts = time.Now().Unix()
+	go tb.WaitAndSendJabberDisco(jp.jid, jp.server, jp.talk)
 	// join rooms
-	session, collection, err := tb.Database.GetCollection("jabberChatrooms")
-	if err != nil {
-		logger.Fatal("Could not connect to database: %+v\n", err)
-	}
-	results := make([]*JabberChatroom, 0)
-	err = collection.Find(bson.M{"myjid": GetStrippedJID(talk)}).All(&results)
-	if err != nil {
-		logger.Printf("No rooms available to join: %+v\n", err)
+	for _, room := range tb.AccountRooms(account, "jabber", GetStrippedJID(jp.talk)) {
+		logger.Printf("Joining chatroom: %s\n", room)
+		jp.joinRoom(room)
 	}
-	session.Close()
-	for _, room := range results {
-		logger.Printf("Joining chatroom: %s\n", room.Chatroom)
-		talk.JoinMUCNoHistory(room.Chatroom, "TorpedoBot")
+	return
+}
+
+func (jp *JabberProtocol) Close() error {
+	if jp.talk == nil {
+		return nil
 	}
-	//
+	jp.talk.SendOrg("<presence type='unavailable'/>")
+	return jp.talk.Close()
+}
+
+func (jp *JabberProtocol) Receive() (err error) {
+	tb := jp.bot
+	logger := jp.logger
+	talk := jp.talk
 	for {
 		chat, err := talk.Recv()
 		if err != nil {
-			logger.Fatal(err)
+			if jp.bot.IsShuttingDown() {
+				return nil
+			}
+			return err
 		}
 		switch v := chat.(type) {
 		case xmpp.Chat:
-			passed := int64(time.Now().Unix()) - int64(startup_ts)
+			passed := int64(time.Now().Unix()) - int64(jp.startup_ts)
 			logger.Println(v.Remote, v.Text, v.Stamp.Unix(), v.Type, v.Other, v.OtherElem)
 			for _, element := range v.OtherElem {
 				if element.XMLName.Space == "jabber:x:conference" {
-					session, collection, err := tb.Database.GetCollection("jabberChatrooms")
-					if err != nil {
-						logger.Fatal("Could not connect to database: %+v\n", err)
-					}
-					result := JabberChatroom{}
-					err = collection.Find(bson.M{"myjid": GetStrippedJID(talk), "chatroom": v.Remote}).One(&result)
-					if err != nil {
-						logger.Println(err)
-						// no record, insert new one
-						err = collection.Insert(&JabberChatroom{GetStrippedJID(talk), v.Remote})
-						if err != nil {
-							logger.Fatal(err)
-						}
-						// join new room
-						talk.JoinMUCNoHistory(v.Remote, "TorpedoBot")
-					}
-					session.Close()
+					jp.JoinInvitedRoom(v.Remote)
 					break
 				}
 			}
+			// chatrooms send bot's own messages back from room/nick
+			if v.Type == "groupchat" && strings.HasSuffix(v.Remote, "/"+JabberRoomNick) {
+				break
+			}
 			// Since v.Stamp returns default value, use some time to catch up on messages
 			if passed > 30 {
-				botApi := &TorpedoBotAPI{}
-				botApi.API = talk
-				botApi.Bot = tb
-				botApi.CommandPrefix = account.CommandPrefix
+				botApi := tb.NewBotAPI(jp, talk, jp.account)
 				botApi.UserProfile = &torpedo_registry.UserProfile{ID: v.Remote}
 				botApi.Me = GetStrippedJID(talk)
 				botApi.Type = v.Type
-				go tb.processChannelEvent(botApi, v.Remote, v.Text)
+				message, mentioned := StripMention(v.Text, JabberRoomNick, strings.Split(jp.jid, "@")[0])
+				botApi.Mentioned = mentioned
+				botApi.Direct = v.Type == "chat"
+				ev := botApi.NewEvent(v.Remote, message)
+				ev.Raw = v
+				go tb.processChannelEvent(botApi, ev)
 			}
 		case xmpp.Presence:
 			if v.Type == "subscribe" {
@@ -190,12 +235,15 @@ func (tb *TorpedoBot) RunJabberBotAccount(account *torpedo_registry.Account) {
 				logger.Printf("Got pong from %s to %s\n", v.From, v.To)
 			}
 			if strings.Contains(string(v.Query), "urn:xmpp:ping") {
-				go tb.JabberPinger(str_jid, server, talk)
+				go tb.JabberPinger(jp.jid, jp.server, talk)
 			}
 		default:
 			logger.Printf("Unknown event: %T\n", v)
 		}
 	}
-	tb.Stats.ConnectedAccounts -= 1
+}
 
+func (jp *JabberProtocol) JoinInvitedRoom(room string) {
+	jp.bot.AddRoom("jabber", GetStrippedJID(jp.talk), room)
+	jp.joinRoom(room)
 }
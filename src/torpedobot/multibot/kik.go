@@ -108,7 +108,7 @@ func (ka *KikAPI) Configure() {
 	return
 }
 
-func (ka *KikAPI) SendMessages(messages *KikMessages) {
+func (ka *KikAPI) SendMessages(messages *KikMessages) (err error) {
 	client := &http.Client{}
 	config_json, err := json.Marshal(messages)
 	if err != nil {
@@ -122,42 +122,70 @@ func (ka *KikAPI) SendMessages(messages *KikMessages) {
 	req.Header.Set("User-Agent", common.User_Agent)
 	resp, err := client.Do(req)
 	if err != nil {
-		ka.logger.Printf("%+v\n", err)
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("Kik API returned %s", resp.Status)
+	}
 	return
 }
 
-func (ka *KikAPI) Text(channel, to, message string) {
+func (ka *KikAPI) Text(channel, to, message string) error {
 	msgs := make([]*KikMessage, 1)
 	msgs[0] = &KikMessage{Body: message, To: to, Type: "text", ChatID: channel}
 	messages := &KikMessages{Messages: msgs}
-	ka.SendMessages(messages)
+	return ka.SendMessages(messages)
 }
 
-func (ka *KikAPI) Image(channel, to, url string) {
+func (ka *KikAPI) Image(channel, to, url string) error {
 	msgs := make([]*KikMessage, 1)
 	msgs[0] = &KikMessage{PictureURL: url, To: to, Type: "picture", ChatID: channel}
 	messages := &KikMessages{Messages: msgs}
-	ka.SendMessages(messages)
-}
-
-func HandleKikMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
-	switch api := tba.API.(type) {
-	case *KikAPI:
-		if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
-			msg, url := richmsgs[0].ToGenericAttachment()
-			api.Text(channel.(string), tba.From, msg)
-			api.Image(channel.(string), tba.From, url)
-		} else {
-			api.Text(channel.(string), tba.From, message)
+	return ka.SendMessages(messages)
+}
+
+type KikProtocol struct {
+	bot      *TorpedoBot
+	account  *torpedo_registry.Account
+	api      *KikAPI
+	username string
+	webhook  *WebhookEndpoint
+	logger   *log.Logger
+}
+
+func (tb *TorpedoBot) NewKikProtocol() Protocol {
+	return &KikProtocol{bot: tb}
+}
+
+// VerifiedSenders - incoming request signature is not checked, sender IDs may be forged
+func (kp *KikProtocol) VerifiedSenders() bool {
+	return false
+}
+
+func (kp *KikProtocol) Capabilities() Capabilities {
+	return Capabilities{Images: true}
+}
+
+func (kp *KikProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	chat_id, ok := channel.(string)
+	if !ok {
+		return fmt.Errorf("Kik chat ID should be string, got %T", channel)
+	}
+	if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
+		msg, url := richmsgs[0].ToGenericAttachment()
+		if err = kp.api.Text(chat_id, tba.From, msg); err != nil {
+			return
 		}
+		err = kp.api.Image(chat_id, tba.From, url)
+	} else {
+		err = kp.api.Text(chat_id, tba.From, message)
 	}
+	return
 }
 
 func (tb *TorpedoBot) ConfigureKikBot(cfg *torpedo_registry.ConfigStruct) {
-	KikIncomingAddr = flag.String("kik_incoming_addr", "0.0.0.0:3980", "Listen on this address for incoming Kik messages")
+	KikIncomingAddr = flag.String("kik_incoming_addr", "", "Listen on this address for incoming Kik messages (defaults to -webhook_addr)")
 	KikWebHook = flag.String("kik_webhook_url", "", "Webhook URL (external) for incoming Kik messages")
 	KikAPIKey = flag.String("kik", "", "Comma separated list of Kik creds, username:api_key,")
 
@@ -176,64 +204,84 @@ func (tb *TorpedoBot) ParseKikBot(cfg *torpedo_registry.ConfigStruct) {
 	}
 }
 
-func (tb *TorpedoBot) RunKikBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
-	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunKikBotAccount(account)
-}
-
-func (tb *TorpedoBot) RunKikBotAccount(account *torpedo_registry.Account) {
-	tb.Stats.ConnectedAccounts += 1
-	account.Connection.ReconnectCount += 1
+func (kp *KikProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	kp.account = account
 
 	cu := &common.Utils{}
 
 	logger := cu.NewLog("kik-bot")
+	kp.logger = logger
+	creds := strings.Split(account.APIKey, ":")
+	if len(creds) != 2 {
+		err = fmt.Errorf("Kik creds should be in username:api_key format")
+		return
+	}
+	kp.username = creds[0]
 	api := &KikAPI{}
 	api.logger = logger
 	api.WebHook = torpedo_registry.Config.GetConfig()["kikwebhook"]
-	api.GetToken(strings.Split(account.APIKey, ":")[0], strings.Split(account.APIKey, ":")[1])
+	api.GetToken(creds[0], creds[1])
 	api.Configure()
+	kp.api = api
 
 	account.API = api
 
-	tb.RegisteredProtocols["*multibot.KikAPI"] = HandleKikMessage
+	kp.webhook = kp.bot.NewWebhookEndpoint(torpedo_registry.Config.GetConfig()["kikincomingaddr"])
+	kp.webhook.Handle(fmt.Sprintf("/kik/%s/incoming", WebhookAccountID(account)), http.HandlerFunc(kp.HandleIncoming))
+	kp.webhook.HandleLegacy("/incoming", http.HandlerFunc(kp.HandleIncoming))
+	return
+}
 
-	http.HandleFunc("/incoming", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-type", "application/json")
-		defer r.Body.Close()
-		body_bytes, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			logger.Fatalf("readAll failed with %+v\n", err)
-			return
-		}
-		logger.Printf("Kik incoming message: %s\n", string(body_bytes))
-		messages := &KikIncomingMessages{}
-		err = json.Unmarshal(body_bytes, messages)
-		if err != nil {
-			logger.Fatalf("JSON unmarshalling failed with %+v\n", err)
-			return
-		}
-		for _, message := range messages.Messages {
-			botApi := &TorpedoBotAPI{}
-			botApi.API = api
-			botApi.Bot = tb
-			botApi.CommandPrefix = account.CommandPrefix
-			botApi.UserProfile = &torpedo_registry.UserProfile{ID: message.From}
-			// FIXME: Remove hardcode
-			botApi.Me = "torpedobot"
-
-			botApi.From = message.From
-			logger.Printf("Message: `%s`\n", message.Body)
-			go tb.processChannelEvent(botApi, message.ChatID, message.Body)
+func (kp *KikProtocol) HandleIncoming(w http.ResponseWriter, r *http.Request) {
+	logger := kp.logger
+	w.Header().Set("Content-type", "application/json")
+	defer r.Body.Close()
+	body_bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Printf("readAll failed with %+v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logger.Printf("Kik incoming message: %s\n", string(body_bytes))
+	messages := &KikIncomingMessages{}
+	err = json.Unmarshal(body_bytes, messages)
+	if err != nil {
+		logger.Printf("JSON unmarshalling failed with %+v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, message := range messages.Messages {
+		botApi := kp.bot.NewBotAPI(kp, kp.api, kp.account)
+		botApi.UserProfile = &torpedo_registry.UserProfile{ID: message.From}
+		// FIXME: Remove hardcode
+		botApi.Me = "torpedobot"
+
+		botApi.From = message.From
+		botApi.Direct = message.ChatType == "direct"
+		body, mentioned := StripMention(message.Body, kp.username)
+		botApi.Mentioned = mentioned
+		logger.Printf("Message: `%s`\n", body)
+		ev := botApi.NewEvent(message.ChatID, body)
+		if message.PictureURL != "" {
+			ev.Attachments = append(ev.Attachments, Attachment{Kind: AttachmentImage, URL: message.PictureURL})
 		}
-	})
-	logger.Printf("Starting Kik API listener on %s\n", torpedo_registry.Config.GetConfig()["kikincomingaddr"])
-	if err := http.ListenAndServe(torpedo_registry.Config.GetConfig()["kikincomingaddr"], nil); err != nil {
-		logger.Fatal(err)
+		ev.Raw = message
+		go kp.bot.processChannelEvent(botApi, ev)
+	}
+}
+
+func (kp *KikProtocol) Receive() error {
+	return kp.webhook.Serve()
+}
+
+// Ready - webhook server is listening
+func (kp *KikProtocol) Ready() <-chan struct{} {
+	return kp.webhook.Ready()
+}
+
+func (kp *KikProtocol) Close() error {
+	if kp.webhook == nil {
+		return nil
 	}
-	tb.Stats.ConnectedAccounts -= 1
+	return kp.webhook.Close()
 }
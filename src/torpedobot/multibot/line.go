@@ -2,12 +2,14 @@ package multibot
 
 import (
 	"flag"
+	"fmt"
 	"net/http"
 	"strings"
 
 	common "github.com/tb0hdan/torpedo_common"
 
 	"github.com/line/line-bot-sdk-go/linebot"
+	log "github.com/sirupsen/logrus"
 	"github.com/tb0hdan/torpedo_registry"
 )
 
@@ -16,25 +18,122 @@ var (
 	LineIncomingAddr *string
 )
 
-func HandleLineMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
-	switch api := tba.API.(type) {
-	case *linebot.Client:
-		if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
-			msg, url := richmsgs[0].ToGenericAttachment()
-			// Use replyToken as channel
-			api.PushMessage(channel.(string), linebot.NewTextMessage(msg)).Do()
-			api.PushMessage(channel.(string), linebot.NewImageMessage(url, url)).Do()
+type LineProtocol struct {
+	bot     *TorpedoBot
+	account *torpedo_registry.Account
+	api     *linebot.Client
+	webhook *WebhookEndpoint
+	logger  *log.Logger
+}
 
-		} else {
-			// Use replyToken as channel
-			api.PushMessage(channel.(string), linebot.NewTextMessage(message)).Do()
+func (tb *TorpedoBot) NewLineProtocol() Protocol {
+	return &LineProtocol{bot: tb}
+}
+
+func (lp *LineProtocol) Capabilities() Capabilities {
+	return Capabilities{Images: true, Cards: true}
+}
+
+// Line buttons template limits
+const (
+	LineTemplateActions = 4
+	LineTemplateTitle   = 40
+	LineTemplateText    = 160
+	// LineTemplateImageText - text limit of template with image
+	LineTemplateImageText = 60
+)
+
+// SendMessage - cards are sent as buttons templates (first four buttons), more images as image messages
+func (lp *LineProtocol) SendMessage(msg *Message, tba *TorpedoBotAPI) (id string, err error) {
+	if len(msg.Cards) == 0 {
+		return tba.sendPlain(msg)
+	}
+	to, ok := msg.Channel.(string)
+	if !ok {
+		err = fmt.Errorf("Line channel should be string, got %T", msg.Channel)
+		return
+	}
+	if msg.Text != "" || len(msg.RichMessages) > 0 {
+		if err = lp.Send(msg.Channel, msg.Text, tba, msg.RichMessages); err != nil {
+			return
+		}
+	}
+	for _, card := range msg.Cards {
+		images := card.AllImages()
+		thumbnail := ""
+		if len(images) > 0 {
+			thumbnail, images = images[0], images[1:]
+		}
+		text := card.Text
+		for _, field := range card.Fields {
+			text += fmt.Sprintf("\n%s: %s", field.Title, field.Value)
+		}
+		actions := make([]linebot.TemplateAction, 0, LineTemplateActions)
+		for _, button := range card.Buttons {
+			if len(actions) == LineTemplateActions {
+				break
+			}
+			if button.URL != "" {
+				actions = append(actions, linebot.NewURITemplateAction(button.Label, button.URL))
+			} else {
+				actions = append(actions, linebot.NewPostbackTemplateAction(button.Label, EncodeCallback(button), ""))
+			}
+		}
+		limit := LineTemplateText
+		if thumbnail != "" {
+			limit = LineTemplateImageText
+		}
+		alt := card.Summary()
+		template := linebot.NewButtonsTemplate(thumbnail, truncateRunes(card.Title, LineTemplateTitle),
+			truncateRunes(strings.TrimSpace(text), limit), actions...)
+		if _, err = lp.api.PushMessage(to, linebot.NewTemplateMessage(truncateRunes(alt, 400), template)).Do(); err != nil {
+			return
+		}
+		for _, image := range images {
+			if _, err = lp.api.PushMessage(to, linebot.NewImageMessage(image, image)).Do(); err != nil {
+				return
+			}
 		}
 	}
+	return
+}
+
+// truncateRunes - cut text to limit characters
+func truncateRunes(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+// DirectChannel - messages are pushed to user ID
+func (lp *LineProtocol) DirectChannel(user_id string) (interface{}, error) {
+	return user_id, nil
+}
+
+func (lp *LineProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	to, ok := channel.(string)
+	if !ok {
+		return fmt.Errorf("Line channel should be string, got %T", channel)
+	}
+	if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
+		msg, url := richmsgs[0].ToGenericAttachment()
+		// Use replyToken as channel
+		if _, err = lp.api.PushMessage(to, linebot.NewTextMessage(msg)).Do(); err != nil {
+			return
+		}
+		_, err = lp.api.PushMessage(to, linebot.NewImageMessage(url, url)).Do()
+	} else {
+		// Use replyToken as channel
+		_, err = lp.api.PushMessage(to, linebot.NewTextMessage(message)).Do()
+	}
+	return
 }
 
 func (tb *TorpedoBot) ConfigureLineBot(cfg *torpedo_registry.ConfigStruct) {
 	LineAPIKey = flag.String("line", "", "Line.Me credentials client_secret:client_token,")
-	LineIncomingAddr = flag.String("line_incoming_addr", "0.0.0.0:3981", "Listen on this address for incoming Line.Me messages")
+	LineIncomingAddr = flag.String("line_incoming_addr", "", "Listen on this address for incoming Line.Me messages (defaults to -webhook_addr)")
 
 }
 
@@ -46,76 +145,136 @@ func (tb *TorpedoBot) ParseLineBot(cfg *torpedo_registry.ConfigStruct) {
 	}
 }
 
-func (tb *TorpedoBot) RunLineBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
-	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunLineBotAccount(account)
-}
-
-func (tb *TorpedoBot) RunLineBotAccount(account *torpedo_registry.Account) {
-	tb.Stats.ConnectedAccounts += 1
-	account.Connection.ReconnectCount += 1
+func (lp *LineProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	lp.account = account
 
 	cu := &common.Utils{}
 
-	logger := cu.NewLog("line-bot")
+	lp.logger = cu.NewLog("line-bot")
 
-	bot, err := linebot.New(strings.Split(account.APIKey, ":")[0],
-		strings.Split(account.APIKey, ":")[1])
+	creds := strings.Split(account.APIKey, ":")
+	if len(creds) != 2 {
+		err = fmt.Errorf("Line creds should be in client_secret:client_token format")
+		return
+	}
+	lp.api, err = linebot.New(creds[0], creds[1])
 	if err != nil {
-		logger.Fatal(err)
+		return
 	}
 
-	account.API = bot
-	tb.RegisteredProtocols["*linebot.Client"] = HandleLineMessage
+	account.API = lp.api
 
-	http.HandleFunc("/callback", func(w http.ResponseWriter, req *http.Request) {
-		events, err := bot.ParseRequest(req)
-		if err != nil {
-			if err == linebot.ErrInvalidSignature {
-				w.WriteHeader(400)
-			} else {
-				w.WriteHeader(500)
-			}
-			return
+	lp.webhook = lp.bot.NewWebhookEndpoint(torpedo_registry.Config.GetConfig()["lineincomingaddr"])
+	lp.webhook.Handle(fmt.Sprintf("/line/%s/callback", WebhookAccountID(account)), http.HandlerFunc(lp.HandleIncoming))
+	lp.webhook.HandleLegacy("/callback", http.HandlerFunc(lp.HandleIncoming))
+	return
+}
+
+func (lp *LineProtocol) HandleIncoming(w http.ResponseWriter, req *http.Request) {
+	events, err := lp.api.ParseRequest(req)
+	if err != nil {
+		if err == linebot.ErrInvalidSignature {
+			w.WriteHeader(400)
+		} else {
+			w.WriteHeader(500)
 		}
-		for _, event := range events {
-			if event.Type == linebot.EventTypeMessage {
-				var channel string
-				if event.Source.GroupID != "" {
-					channel = event.Source.GroupID
-				} else if event.Source.RoomID != "" {
-					channel = event.Source.RoomID
-				} else if event.Source.UserID != "" {
-					channel = event.Source.UserID
-				}
-				switch message := event.Message.(type) {
-				case *linebot.TextMessage:
-					botApi := &TorpedoBotAPI{}
-					botApi.API = bot
-					botApi.Bot = tb
-					botApi.CommandPrefix = account.CommandPrefix
-					botApi.UserProfile = &torpedo_registry.UserProfile{ID: channel}
-					botApi.Me = "torpedobot"
-
-					go tb.processChannelEvent(botApi, channel, message.Text)
-				default:
-					logger.Printf("Got message type %T\n", message)
-
-				}
-			} else {
-				logger.Printf("Got event type %T\n", event)
+		return
+	}
+	for _, event := range events {
+		if event.Type == linebot.EventTypeMessage {
+			channel := lineChannel(event.Source)
+			var id, text string
+			var attachments []Attachment
+			switch message := event.Message.(type) {
+			case *linebot.TextMessage:
+				id, text = message.ID, message.Text
+			case *linebot.ImageMessage:
+				id = message.ID
+				attachments = append(attachments, lp.attachment(AttachmentImage, id, "", 0))
+			case *linebot.VideoMessage:
+				id = message.ID
+				attachments = append(attachments, lp.attachment(AttachmentVideo, id, "", 0))
+			case *linebot.AudioMessage:
+				id = message.ID
+				attachments = append(attachments, lp.attachment(AttachmentAudio, id, "", 0))
+			case *linebot.FileMessage:
+				id = message.ID
+				attachments = append(attachments, lp.attachment(AttachmentFile, id, message.FileName, message.FileSize))
+			case *linebot.StickerMessage:
+				// stickers can't be downloaded
+				id = message.ID
+				attachments = append(attachments, Attachment{Kind: AttachmentSticker, ID: message.StickerID, Name: message.PackageID})
+			default:
+				lp.logger.Printf("Got message type %T\n", message)
+				continue
 			}
+			botApi := lp.bot.NewBotAPI(lp, lp.api, lp.account)
+			botApi.UserProfile = &torpedo_registry.UserProfile{ID: channel}
+			botApi.Me = "torpedobot"
+			botApi.Direct = event.Source.Type == linebot.EventSourceTypeUser
+			botApi.MessageID = id
+			text, mentioned := StripMention(text, botApi.Me)
+			botApi.Mentioned = mentioned
+
+			ev := botApi.NewEvent(channel, text)
+			ev.Attachments = attachments
+			ev.Raw = event
+			go lp.bot.processChannelEvent(botApi, ev)
+		} else if event.Type == linebot.EventTypePostback && event.Postback != nil {
+			// buttons template press
+			channel := lineChannel(event.Source)
+			botApi := lp.bot.NewBotAPI(lp, lp.api, lp.account)
+			botApi.UserProfile = &torpedo_registry.UserProfile{ID: channel}
+			botApi.Me = "torpedobot"
+			botApi.Direct = event.Source.Type == linebot.EventSourceTypeUser
+			ev := botApi.NewEvent(channel, "")
+			ev.CallbackID, ev.CallbackValue = DecodeCallback(event.Postback.Data)
+			ev.Raw = event
+			go lp.bot.processChannelEvent(botApi, ev)
+		} else {
+			lp.logger.Printf("Got event type %T\n", event)
 		}
+	}
+}
+
+// lineChannel - group, room or user messages come from
+func lineChannel(source *linebot.EventSource) (channel string) {
+	if source.GroupID != "" {
+		channel = source.GroupID
+	} else if source.RoomID != "" {
+		channel = source.RoomID
+	} else if source.UserID != "" {
+		channel = source.UserID
+	}
+	return
+}
+
+// attachment - media and files are downloaded by message ID
+func (lp *LineProtocol) attachment(kind AttachmentKind, id, name string, size int) (attachment Attachment) {
+	attachment = Attachment{Kind: kind, ID: id, Name: name, Size: size}
+	attachment.SetDownload(func() (fname string, err error) {
+		content, err := lp.api.GetMessageContent(id).Do()
+		if err != nil {
+			return
+		}
+		defer content.Content.Close()
+		return saveToTmp(content.Content)
 	})
+	return
+}
 
-	tb.logger.Printf("Serving Line bot on %s\n", torpedo_registry.Config.GetConfig()["lineincomingaddr"])
+func (lp *LineProtocol) Receive() error {
+	return lp.webhook.Serve()
+}
+
+// Ready - webhook server is listening
+func (lp *LineProtocol) Ready() <-chan struct{} {
+	return lp.webhook.Ready()
+}
 
-	if err := http.ListenAndServe(torpedo_registry.Config.GetConfig()["lineincomingaddr"], nil); err != nil {
-		logger.Fatal(err)
+func (lp *LineProtocol) Close() error {
+	if lp.webhook == nil {
+		return nil
 	}
-	tb.Stats.ConnectedAccounts -= 1
+	return lp.webhook.Close()
 }
@@ -0,0 +1,170 @@
+package multibot
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// LoopbackMessage - message posted by bot to loopback protocol
+type LoopbackMessage struct {
+	Channel      interface{}
+	Text         string
+	RichMessages []torpedo_registry.RichMessage
+	Cards        []Card
+	// ID - assigned to posted messages, target ID for edits, deletes and reactions
+	ID       string
+	ReplyTo  string
+	ThreadID string
+	Edit     string
+	Delete   string
+	Reaction string
+}
+
+// LoopbackProtocol is in-process transport, useful for testing plugins without live service
+type LoopbackProtocol struct {
+	bot     *TorpedoBot
+	account *torpedo_registry.Account
+	Replies chan *LoopbackMessage
+	done    chan struct{}
+	once    sync.Once
+	connect sync.Once
+	lastID  int64
+}
+
+func (tb *TorpedoBot) NewLoopbackProtocol() Protocol {
+	return &LoopbackProtocol{bot: tb,
+		Replies: make(chan *LoopbackMessage, 100),
+		done:    make(chan struct{}),
+	}
+}
+
+// StartLoopback - create loopback account and run it
+func (tb *TorpedoBot) StartLoopback(cmd_prefix string) (lp *LoopbackProtocol) {
+	lp = tb.NewLoopbackProtocol().(*LoopbackProtocol)
+	account := &torpedo_registry.Account{
+		APIKey:        "loopback",
+		CommandPrefix: cmd_prefix,
+	}
+	tb.AddAccount("loopback", account)
+	// make sure account is set before Inject is called
+	lp.Connect(account)
+	go tb.RunProtocolAccount(lp, account)
+	return
+}
+
+// Connect - called by StartLoopback and again by account runner, only first call counts
+func (lp *LoopbackProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	lp.connect.Do(func() {
+		lp.account = account
+		account.API = lp
+	})
+	return
+}
+
+func (lp *LoopbackProtocol) Account() *torpedo_registry.Account {
+	return lp.account
+}
+
+func (lp *LoopbackProtocol) Receive() (err error) {
+	<-lp.done
+	return ErrNoReconnect
+}
+
+func (lp *LoopbackProtocol) Close() (err error) {
+	lp.once.Do(func() { close(lp.done) })
+	return
+}
+
+func (lp *LoopbackProtocol) Capabilities() Capabilities {
+	return Capabilities{RichMessages: true, Images: true, Replies: true, Threads: true, Edits: true, Deletes: true, Reactions: true, Cards: true}
+}
+
+func (lp *LoopbackProtocol) newID() string {
+	return fmt.Sprintf("loopback-%d", atomic.AddInt64(&lp.lastID, 1))
+}
+
+// DirectChannel - user ID is channel
+func (lp *LoopbackProtocol) DirectChannel(user_id string) (interface{}, error) {
+	return user_id, nil
+}
+
+func (lp *LoopbackProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	_, err = lp.SendMessage(&Message{Channel: channel, Text: message, RichMessages: richmsgs}, tba)
+	return
+}
+
+// SendMessage - every operation is posted to Replies, new messages get IDs
+func (lp *LoopbackProtocol) SendMessage(msg *Message, tba *TorpedoBotAPI) (id string, err error) {
+	switch {
+	case msg.Edit != "":
+		id = msg.Edit
+	case msg.Delete != "":
+		id = msg.Delete
+	case msg.Reaction != "":
+		id = msg.ReplyTo
+	default:
+		id = lp.newID()
+	}
+	lp.Replies <- &LoopbackMessage{Channel: msg.Channel, Text: msg.Text, RichMessages: msg.RichMessages, Cards: msg.Cards, ID: id,
+		ReplyTo: msg.ReplyTo, ThreadID: msg.ThreadID, Edit: msg.Edit, Delete: msg.Delete, Reaction: msg.Reaction}
+	return
+}
+
+// Inject - process message as if it was sent by user to channel, returns message ID.
+// Command handlers are run synchronously, text handlers run in background
+func (lp *LoopbackProtocol) Inject(user *torpedo_registry.UserProfile, channel interface{}, message string) string {
+	return lp.inject(user, channel, message, false, "")
+}
+
+// InjectDirect - same as Inject, but message is sent in direct chat
+func (lp *LoopbackProtocol) InjectDirect(user *torpedo_registry.UserProfile, channel interface{}, message string) string {
+	return lp.inject(user, channel, message, true, "")
+}
+
+// InjectThread - same as Inject, but message is posted in thread
+func (lp *LoopbackProtocol) InjectThread(user *torpedo_registry.UserProfile, channel interface{}, thread, message string) string {
+	return lp.inject(user, channel, message, false, thread)
+}
+
+func (lp *LoopbackProtocol) inject(user *torpedo_registry.UserProfile, channel interface{}, message string, direct bool, thread string) string {
+	event := &Event{Channel: ChannelRef{Native: channel}, Text: message, ThreadID: thread}
+	if direct {
+		event.Channel.Kind = ChannelDirect
+	}
+	return lp.InjectEvent(user, event)
+}
+
+// InjectEvent - same as Inject, but with event metadata: Channel.Native, Channel.Kind (direct or not), Text,
+// MessageID (new one is assigned if empty), ThreadID, ReplyTo, Edited, Attachments, CallbackID and CallbackValue are used
+func (lp *LoopbackProtocol) InjectEvent(user *torpedo_registry.UserProfile, event *Event) (id string) {
+	id = event.MessageID
+	if id == "" {
+		id = lp.newID()
+	}
+	botApi := lp.bot.NewBotAPI(lp, lp, lp.account)
+	botApi.UserProfile = user
+	botApi.Me = "torpedobot"
+	botApi.Direct = event.Channel.Kind == ChannelDirect
+	botApi.MessageID = id
+	botApi.ThreadID = event.ThreadID
+	message, mentioned := StripMention(event.Text, botApi.Me)
+	botApi.Mentioned = mentioned
+	ev := botApi.NewEvent(event.Channel.Native, message)
+	ev.ReplyTo, ev.Edited, ev.Attachments, ev.Raw = event.ReplyTo, event.Edited, event.Attachments, event
+	ev.CallbackID, ev.CallbackValue = event.CallbackID, event.CallbackValue
+	lp.bot.processChannelEvent(botApi, ev)
+	return
+}
+
+// WaitReply - wait for next bot reply, nil on timeout
+func (lp *LoopbackProtocol) WaitReply(timeout time.Duration) (reply *LoopbackMessage) {
+	select {
+	case reply = <-lp.Replies:
+	case <-time.After(timeout):
+	}
+	return
+}
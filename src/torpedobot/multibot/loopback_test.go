@@ -0,0 +1,145 @@
+package multibot_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+const replyTimeout = 3 * time.Second
+
+func EchoProcessMessage(api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+	api.Bot.PostMessage(channel, fmt.Sprintf("%s said: %s", api.UserProfile.Nick, incoming_message), api)
+}
+
+func PictureProcessMessage(api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+	richmsg := torpedo_registry.RichMessage{Text: "cat", Title: "Cat", ImageURL: "http://example.com/cat.png"}
+	api.Bot.PostMessage(channel, "", api, richmsg)
+}
+
+func PingTextMessage(api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+	if incoming_message == "ping" {
+		api.Bot.PostMessage(channel, "pong", api)
+	}
+}
+
+func init() {
+	torpedo_registry.Config.RegisterHelpAndHandler("echo", "Echo message back", EchoProcessMessage)
+	torpedo_registry.Config.RegisterHelpAndHandler("picture", "Post cat picture", PictureProcessMessage)
+	torpedo_registry.Config.RegisterTextMessageHandler("ping", PingTextMessage)
+}
+
+func TestLoopbackCommands(t *testing.T) {
+	bot := multibot.New()
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+
+	echoes := testutil.ToFloat64(multibot.CommandInvocations.WithLabelValues("echo"))
+	user := &torpedo_registry.UserProfile{ID: "U1", Nick: "alice"}
+	cases := []struct {
+		name    string
+		message string
+		text    string
+		rich    string
+	}{
+		{"command", "!echo hello", "alice said: !echo hello", ""},
+		{"case insensitive", "!ECHO hi", "alice said: !ECHO hi", ""},
+		{"rich message", "!picture", "", "http://example.com/cat.png"},
+		{"unknown command", "!nosuchcommand", "Command unknown", ""},
+		{"text handler", "ping", "pong", ""},
+	}
+	for idx, tc := range cases {
+		// NoSpam allows one message per channel per second, use separate channels
+		channel := fmt.Sprintf("C%d", idx)
+		lp.Inject(user, channel, tc.message)
+		reply := lp.WaitReply(replyTimeout)
+		if reply == nil {
+			t.Fatalf("%s: no reply for `%s`", tc.name, tc.message)
+		}
+		if reply.Channel != channel {
+			t.Errorf("%s: reply sent to %v, expected %v", tc.name, reply.Channel, channel)
+		}
+		if !strings.Contains(reply.Text, tc.text) {
+			t.Errorf("%s: got `%s`, expected `%s`", tc.name, reply.Text, tc.text)
+		}
+		if tc.rich != "" && (len(reply.RichMessages) == 0 || reply.RichMessages[0].ImageURL != tc.rich) {
+			t.Errorf("%s: got rich messages %+v, expected image %s", tc.name, reply.RichMessages, tc.rich)
+		}
+	}
+	if got := testutil.ToFloat64(multibot.CommandInvocations.WithLabelValues("echo")) - echoes; got != 2 {
+		t.Errorf("echo invocations metric: got %v, expected 2", got)
+	}
+}
+
+func TestLoopbackTRPE(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status": "ok", "message": "trpe: %s"}`, r.Form.Get("incoming_message"))
+	}))
+	defer server.Close()
+	torpedo_registry.Config.SetConfig("trpe_host", server.URL)
+	defer torpedo_registry.Config.SetConfig("trpe_host", "")
+
+	bot := multibot.New()
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+
+	lp.Inject(&torpedo_registry.UserProfile{ID: "U2", Nick: "bob"}, "trpe", "!remote")
+	reply := lp.WaitReply(replyTimeout)
+	if reply == nil || reply.Text != "trpe: !remote" {
+		t.Errorf("unexpected TRPE reply: %+v", reply)
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	bot := multibot.New()
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+
+	accounts := bot.GetAccounts()
+	id := accounts[len(accounts)-1].ID
+	var message_id string
+	var err error
+	// account runner starts in background
+	for i := 0; i < 10; i++ {
+		if message_id, err = bot.SendMessage(id, "ops", "deploy finished"); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("SendMessage failed: %+v", err)
+	}
+	reply := lp.WaitReply(replyTimeout)
+	if reply == nil || reply.Channel != "ops" || reply.Text != "deploy finished" || reply.ID != message_id {
+		t.Errorf("unexpected message: %+v", reply)
+	}
+	if _, err = bot.SendMessage(len(accounts)+100, "ops", "nowhere"); err == nil {
+		t.Errorf("expected error for unknown account")
+	}
+
+	// protocols that reply with incoming message API send with their outbound API
+	ba, sent := startStrict(bot, "strict-send")
+	defer bot.RemoveAccount(ba.ID)
+	for i := 0; i < 10; i++ {
+		if _, err = bot.SendMessage(ba.ID, "ops", "deploy finished"); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("SendMessage to strict protocol failed: %+v", err)
+	}
+	if message := <-sent; message != "ops: deploy finished" {
+		t.Errorf("unexpected message: %s", message)
+	}
+}
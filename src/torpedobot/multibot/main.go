@@ -1,7 +1,8 @@
 package multibot
 
 import (
-	"fmt"
+	"context"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
@@ -14,7 +15,6 @@ import (
 
 	"github.com/getsentry/raven-go"
 	common "github.com/tb0hdan/torpedo_common"
-	database "github.com/tb0hdan/torpedo_common/database"
 	memcache "github.com/tb0hdan/torpedo_common/memcache"
 	"github.com/tb0hdan/torpedo_registry"
 )
@@ -30,14 +30,73 @@ type BotStats struct {
 	TotalAccounts          int32
 }
 
+// GetStats - consistent copy of bot statistics
+func (tb *TorpedoBot) GetStats() BotStats {
+	tb.statsLock.RLock()
+	defer tb.statsLock.RUnlock()
+	return tb.Stats
+}
+
+func (tb *TorpedoBot) updateStats(update func(stats *BotStats)) {
+	tb.statsLock.Lock()
+	defer tb.statsLock.Unlock()
+	update(&tb.Stats)
+}
+
 type TorpedoBot struct {
+	ctx                 context.Context
+	cancel              context.CancelFunc
+	accounts            sync.WaitGroup
+	inflight            sync.WaitGroup
+	shuttingDown        bool
+	shutdownLock        sync.RWMutex
+	shutdownDone        chan struct{}
+	shutdownTimeout     time.Duration
+	exitCode            int
+	connLock            sync.Mutex
+	webhooks            map[string]*WebhookServer
+	webhooksLock        sync.Mutex
+	channelAliases      map[string]map[string]string
+	channelAliasesLock  sync.Mutex
+	acl                 ACLConfig
+	roles               map[string]Role
+	aclLock             sync.Mutex
+	botAccounts         []*BotAccount
+	nextAccountID       int
+	accountsLock        sync.RWMutex
+	configLock          sync.Mutex
+	limits              RateLimitsConfig
+	limiter             *rateLimiter
+	detectors           DetectorsConfig
+	flood               *floodTracker
+	configBlacklist     []*blacklistRule
+	storedBlacklist     []*blacklistRule
+	blacklistLoaded     time.Time
+	blacklistLock       sync.Mutex
+	noSpamLock          sync.RWMutex
+	history             HistoryConfig
+	historyLock         sync.RWMutex
+	configBridges       map[string][]string
+	bridges             map[string][]string
+	bridgesLock         sync.Mutex
+	relayed             map[string][]relayedMessage
+	relayedLock         sync.Mutex
+	jobs                map[string]*ScheduledJob
+	jobsStore           Store
+	jobsLock            sync.Mutex
+	buttons             map[string]numberedButtons
+	buttonsLock         sync.Mutex
+	apiServer           *http.Server
 	caches              map[string]*memcache.MemCacheType
-	Database            *database.MongoDB
+	cachesLock          sync.Mutex
+	Store               Store
 	logger              *log.Logger
-	throttle            *memcache.MemCacheType
-	RegisteredProtocols map[string]func(interface{}, string, *TorpedoBotAPI, []torpedo_registry.RichMessage)
-	Stats               BotStats
-	Build               struct {
+	RegisteredProtocols map[string]ProtocolFactory
+	protocolsLock       sync.RWMutex
+	// use GetStats/updateStats, accounts are served concurrently
+	Stats     BotStats
+	statsLock sync.RWMutex
+	Build     struct {
 		Build      string
 		BuildDate  string
 		GoVersion  string
@@ -48,6 +107,9 @@ type TorpedoBot struct {
 
 type TorpedoBotAPI struct {
 	API           interface{}
+	Protocol      Protocol
+	ProtocolName  string
+	Account       *torpedo_registry.Account
 	CommandPrefix string
 	Bot           *TorpedoBot
 	// FIXME: Move From field to UserProfile struct
@@ -55,6 +117,20 @@ type TorpedoBotAPI struct {
 	Type        string
 	UserProfile *torpedo_registry.UserProfile
 	Me          string
+	// Mentioned - protocol stripped bot mention from message
+	Mentioned bool
+	// Direct - message was sent in direct (one to one) chat
+	Direct bool
+	// AccountID - BotAccount.ID
+	AccountID int
+	// MessageID - protocol ID of incoming message, empty if protocol has none
+	MessageID string
+	// ThreadID - thread incoming message was posted in, empty if none
+	ThreadID string
+	// Relayed - message is relayed from bridged channel and is not relayed further
+	Relayed bool
+	// Event - incoming message with metadata, nil for messages not received from protocol
+	Event *Event
 }
 
 // This is required for plugins to have loose coupling with bot itself
@@ -67,25 +143,15 @@ func (tb *TorpedoBot) GetBotAPI(api *TorpedoBotAPI, channel interface{}, incomin
 	botapi.Bot.GetCachedItem = api.Bot.GetCachedItem
 	botapi.Bot.SetCachedItems = api.Bot.SetCachedItems
 	botapi.Bot.PostMessage = api.Bot.PostMessage
-	botapi.Bot.Stats = api.Bot.Stats
+	botapi.Bot.GetHelp = torpedo_registry.Config.GetHelp
+	botapi.Bot.Stats = api.Bot.GetStats()
 	botapi.Bot.Build = api.Bot.Build
 	botapi.UserProfile = api.UserProfile
 	return
 }
 
 func (tba *TorpedoBotAPI) PostMessage(channel interface{}, message string, richmsgs ...torpedo_registry.RichMessage) {
-	ran := 0
-	for proto := range tba.Bot.RegisteredProtocols {
-		if proto == fmt.Sprintf("%T", tba.API) {
-			ran += 1
-			tba.Bot.RegisteredProtocols[proto](channel, message, tba, richmsgs)
-			break
-		}
-	}
-	if ran == 0 {
-		tba.Bot.logger.Printf("Unsupported bot API: %T\n", tba.API)
-
-	}
+	tba.Send(&Message{Channel: channel, Text: message, RichMessages: richmsgs})
 }
 
 func (tb *TorpedoBot) PostMessage(channel interface{}, message string, api *torpedo_registry.BotAPI, richmsgs ...interface{}) {
@@ -97,14 +163,59 @@ func (tb *TorpedoBot) PostMessage(channel interface{}, message string, api *torp
 	}
 }
 
-func (tb *TorpedoBot) processChannelEvent(api *TorpedoBotAPI, channel interface{}, incoming_message string) {
+// processChannelEvent - handle incoming message, protocols create event with api.NewEvent
+func (tb *TorpedoBot) processChannelEvent(api *TorpedoBotAPI, ev *Event) {
+	// stop accepting events on shutdown
+	if !tb.beginEvent() {
+		return
+	}
+	defer tb.endEvent()
+	api.Event = ev
+	ev.prepareAttachments()
+	channel, incoming_message := ev.Channel.Native, ev.Text
+	MessagesReceived.WithLabelValues(api.ProtocolName, ChannelType(api.Protocol, channel)).Inc()
+	// bot's own message relayed to bridged channel
+	if tb.relayEcho(BridgeChannelKey(api, channel), incoming_message) {
+		return
+	}
 	// ignore spam messages
 	if !tb.NoSpam(api, channel, incoming_message) {
 		return
 	}
-	// handle commands
-	if strings.HasPrefix(incoming_message, api.CommandPrefix) {
-		tb.ProcessCommandMessage(api, channel, incoming_message)
+	own_message := api.UserProfile.ID != "" && api.UserProfile.ID == api.Me
+	if ev.CallbackID == "" {
+		// record history, commands included (skip if sender ID is not set)
+		if api.UserProfile.ID != "" && !own_message {
+			tb.RecordHistory(api, channel, incoming_message, false)
+		}
+		// relay to bridged channels, replies are relayed by send. Edits are not relayed
+		if !ev.Edited && !own_message {
+			nick := api.UserProfile.Nick
+			if nick == "" {
+				nick = api.UserProfile.ID
+			}
+			if nick == "" {
+				nick = api.From
+			}
+			tb.RelayMessage(api, channel, nick, incoming_message, nil)
+		}
+	}
+	command, is_command := tb.commandMessage(api, incoming_message)
+	// throttled messages are still recorded and relayed, bot's own messages don't take tokens
+	if incoming_message != "" && !own_message && !tb.rateLimitOk(api, channel, "", is_command) {
+		return
+	}
+	// button presses, numbered replies to cards sent as text included
+	if ev.CallbackID != "" || (api.UserProfile.ID != api.Me && tb.numberedButtonPress(ChannelKey(api, channel), ev)) {
+		tb.processCallback(api, channel, ev)
+		return
+	}
+	// handle commands, edited ones were run already
+	if is_command {
+		if !ev.Edited {
+			tb.ProcessCommandMessage(api, channel, command)
+		}
+		ev.removeDownloads()
 	} else {
 		// ignore bot messages
 		if api.UserProfile.ID != "" && api.Me != "" && api.UserProfile.ID == api.Me {
@@ -113,12 +224,16 @@ func (tb *TorpedoBot) processChannelEvent(api *TorpedoBotAPI, channel interface{
 		}
 
 		// handle text messages in separate goroutine
-		go tb.processTextMessage(api, channel, incoming_message)
+		tb.inflight.Add(1)
+		go func() {
+			defer tb.endEvent()
+			defer ev.removeDownloads()
+			tb.processTextMessage(api, channel, incoming_message)
+			if !ev.Edited {
+				tb.processAttachments(api, channel, ev)
+			}
+		}()
 
-		// handle history (skip if sender ID is not set)
-		if api.UserProfile.ID != "" && api.Me != "" {
-			tb.StoreMessageHistory(api, channel, incoming_message)
-		}
 	}
 }
 
@@ -132,31 +247,27 @@ func (tb *TorpedoBot) processTextMessage(api *TorpedoBotAPI, channel interface{}
 	return
 }
 
-func (tb *TorpedoBot) Cleanup() {
-	tb.logger.Printf("Running cleanup...")
-	return
-}
-
-func (tb *TorpedoBot) RunBotsCSV(method func(apiKey, cmd_prefix string), CSV, cmd_prefix string) {
-	wrapped := func(a, b string) {}
-	if torpedo_registry.Config.GetConfig()["raven"] == "yes" {
-		wrapped = func(apiKey, cmd_prefix string) {
-			// this should (!) capture bot protocol panic
-			raven.CapturePanicAndWait(func() {
-				method(apiKey, cmd_prefix)
-			}, nil)
-		}
-	} else {
-		wrapped = method
+// RunBotsCSV - start accounts set on command line, prefixes are set with -prefix or are protocol defaults
+func (tb *TorpedoBot) RunBotsCSV(protocol, CSV string) {
+	if !tb.HasProtocol(protocol) {
+		tb.logger.Printf("Unknown protocol: `%s`\n", protocol)
+		return
 	}
+	prefixes := CommandPrefixes(protocol)
 	for _, key := range strings.Split(CSV, ",") {
 		if key == "" {
 			continue
 		}
-		tb.Stats.TotalAccounts += 1
+		account := &torpedo_registry.Account{
+			APIKey:        key,
+			CommandPrefix: prefixes[0],
+		}
+		tb.AddAccount(protocol, account)
+		tb.SetAccountPrefixes(account, prefixes)
 		// slow down logins
-		time.Sleep(3 * time.Second)
-		go wrapped(key, cmd_prefix)
+		time.Sleep(LoginDelay)
+		// protocol panics and disconnects are handled by supervisor
+		tb.StartAccount(protocol, account)
 	}
 }
 
@@ -202,37 +313,51 @@ func (tb *TorpedoBot) RunCoroutines() {
 }
 
 func New() *TorpedoBot {
-	cleanup_channel := make(chan os.Signal)
-	signal.Notify(cleanup_channel, os.Interrupt, os.Kill)
+	cleanup_channel := make(chan os.Signal, 1)
+	signal.Notify(cleanup_channel, os.Interrupt, syscall.SIGTERM)
+	reload_channel := make(chan os.Signal, 1)
+	signal.Notify(reload_channel, syscall.SIGHUP)
 
 	once.Do(func() {
 		bot = &TorpedoBot{}
 		cu := &common.Utils{}
 		bot.logger = cu.NewLog("torpedo-bot")
+		bot.ctx, bot.cancel = context.WithCancel(context.Background())
+		bot.shutdownDone = make(chan struct{})
+		bot.shutdownTimeout = 10 * time.Second
 		bot.caches = make(map[string]*memcache.MemCacheType)
-		bot.throttle = memcache.New()
+		bot.setNoSpamSettings(NoSpamConfig{})
 		env_dsn := os.Getenv("SENTRY_DSN")
 		if env_dsn != "" {
 			bot.logger.Print("Using Sentry error reporting...\n")
 			raven.SetDSN(env_dsn)
 			torpedo_registry.Config.SetConfig("raven", "yes")
 		}
-		bot.RegisteredProtocols = make(map[string]func(interface{}, string, *TorpedoBotAPI, []torpedo_registry.RichMessage))
+		bot.RegisteredProtocols = make(map[string]ProtocolFactory)
+		bot.webhooks = make(map[string]*WebhookServer)
+		bot.channelAliases = make(map[string]map[string]string)
 		bot.Stats = BotStats{}
 		bot.Stats.StartTimestamp = int64(time.Now().Unix())
 
-		// Add signal listener
+		// Add signal listener, RunLoop returns exit code once shutdown is done
 		go func() {
 			for {
 				sig := <-cleanup_channel
-				bot.Cleanup()
 				bot.logger.Printf("\nGot %q signal. Exiting...\n", sig)
-
 				exitCode := 1
 				if sysSig, ok := sig.(syscall.Signal); ok {
 					exitCode = int(sysSig)
 				}
-				os.Exit(exitCode + 128)
+				bot.shutdown(exitCode + 128)
+			}
+		}()
+		// Reload config file
+		go func() {
+			for range reload_channel {
+				bot.logger.Printf("Got SIGHUP, reloading config...\n")
+				if err := bot.ReloadConfig(); err != nil {
+					bot.logger.Printf("Config reload failed: %+v\n", err)
+				}
 			}
 		}()
 
@@ -240,12 +365,14 @@ func New() *TorpedoBot {
 	return bot
 }
 
-func (tb *TorpedoBot) RunLoop() {
-	if tb.Stats.TotalAccounts > 0 {
-		for {
-			time.Sleep(time.Second)
-		}
+// RunLoop - wait for shutdown, returns process exit code (128+signal if bot was stopped by signal)
+func (tb *TorpedoBot) RunLoop() (exit_code int) {
+	if tb.GetStats().TotalAccounts > 0 {
+		<-tb.shutdownDone
 	} else {
 		tb.logger.Fatal("No accounts configured, exiting...\n")
 	}
+	tb.shutdownLock.RLock()
+	defer tb.shutdownLock.RUnlock()
+	return tb.exitCode
 }
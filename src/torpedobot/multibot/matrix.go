@@ -11,21 +11,79 @@ import (
 	common "github.com/tb0hdan/torpedo_common"
 
 	"github.com/matrix-org/gomatrix"
+	log "github.com/sirupsen/logrus"
 	"github.com/tb0hdan/torpedo_registry"
 )
 
 var MatrixAPIKey *string
 
-func HandleMatrixMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
-	switch api := tba.API.(type) {
-	case *gomatrix.Client:
-		if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
-			msg, url := richmsgs[0].ToGenericAttachment()
-			api.SendImage(channel.(string), msg, url)
-		} else {
-			api.SendText(channel.(string), message)
-		}
+// MatrixMediaURL - media download endpoint, mxc://server/id is downloaded from MatrixMediaURL + server/id
+const MatrixMediaURL = "https://matrix.org/_matrix/media/r0/download/"
+
+type MatrixProtocol struct {
+	bot     *TorpedoBot
+	account *torpedo_registry.Account
+	cli     *gomatrix.Client
+	logger  *log.Logger
+}
+
+func (tb *TorpedoBot) NewMatrixProtocol() Protocol {
+	return &MatrixProtocol{bot: tb}
+}
+
+func (mp *MatrixProtocol) Capabilities() Capabilities {
+	return Capabilities{Images: true, Replies: true, Edits: true, Deletes: true, Reactions: true}
+}
+
+func (mp *MatrixProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	_, err = mp.SendMessage(&Message{Channel: channel, Text: message, RichMessages: richmsgs}, tba)
+	return
+}
+
+// SendMessage - message IDs are event IDs, edits and reactions are relations (m.replace, m.annotation),
+// messages in thread reply to its first message
+func (mp *MatrixProtocol) SendMessage(msg *Message, tba *TorpedoBotAPI) (id string, err error) {
+	room, ok := msg.Channel.(string)
+	if !ok {
+		err = fmt.Errorf("Matrix room should be string, got %T", msg.Channel)
+		return
+	}
+	var resp *gomatrix.RespSendEvent
+	reply_to := msg.ReplyTo
+	if reply_to == "" {
+		reply_to = msg.ThreadID
+	}
+	switch {
+	case msg.Delete != "":
+		_, err = mp.cli.RedactEvent(room, msg.Delete, &gomatrix.ReqRedact{})
+		return msg.Delete, err
+	case msg.Reaction != "":
+		resp, err = mp.cli.SendMessageEvent(room, "m.reaction", map[string]interface{}{
+			"m.relates_to": map[string]string{"rel_type": "m.annotation", "event_id": msg.ReplyTo, "key": msg.Reaction},
+		})
+	case msg.Edit != "":
+		resp, err = mp.cli.SendMessageEvent(room, "m.room.message", map[string]interface{}{
+			"msgtype":       "m.text",
+			"body":          "* " + msg.Text,
+			"m.new_content": map[string]string{"msgtype": "m.text", "body": msg.Text},
+			"m.relates_to":  map[string]string{"rel_type": "m.replace", "event_id": msg.Edit},
+		})
+	case len(msg.RichMessages) > 0 && !msg.RichMessages[0].IsEmpty():
+		text, url := msg.RichMessages[0].ToGenericAttachment()
+		resp, err = mp.cli.SendImage(room, text, url)
+	case reply_to != "":
+		resp, err = mp.cli.SendMessageEvent(room, "m.room.message", map[string]interface{}{
+			"msgtype":      "m.text",
+			"body":         msg.Text,
+			"m.relates_to": map[string]interface{}{"m.in_reply_to": map[string]string{"event_id": reply_to}},
+		})
+	default:
+		resp, err = mp.cli.SendText(room, msg.Text)
 	}
+	if err == nil && resp != nil {
+		id = resp.EventID
+	}
+	return
 }
 
 func (tb *TorpedoBot) ConfigureMatrixBot(cfg *torpedo_registry.ConfigStruct) {
@@ -39,25 +97,26 @@ func (tb *TorpedoBot) ParseMatrixBot(cfg *torpedo_registry.ConfigStruct) {
 	}
 }
 
-func (tb *TorpedoBot) RunMatrixBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
-	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunMatrixBotAccount(account)
-}
-
-func (tb *TorpedoBot) RunMatrixBotAccount(account *torpedo_registry.Account) {
-	tb.Stats.ConnectedAccounts += 1
-	account.Connection.ReconnectCount += 1
+func (mp *MatrixProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	tb := mp.bot
+	mp.account = account
 
 	cu := &common.Utils{}
 
 	logger := cu.NewLog("matrix-bot")
+	mp.logger = logger
 
-	clientID := fmt.Sprintf("@%s:matrix.org", strings.Split(account.APIKey, ":")[0])
-	cli, _ := gomatrix.NewClient("https://matrix.org", clientID, strings.Split(account.APIKey, ":")[1])
+	creds := strings.Split(account.APIKey, ":")
+	if len(creds) != 2 {
+		err = fmt.Errorf("Matrix creds should be in ID:AccessToken format")
+		return
+	}
+	clientID := fmt.Sprintf("@%s:matrix.org", creds[0])
+	cli, err := gomatrix.NewClient("https://matrix.org", clientID, creds[1])
+	if err != nil {
+		return
+	}
+	mp.cli = cli
 	// anything which implements the Storer interface
 	customStore := gomatrix.NewInMemoryStore()
 	cli.Store = customStore
@@ -75,15 +134,23 @@ func (tb *TorpedoBot) RunMatrixBotAccount(account *torpedo_registry.Account) {
 		logger.Printf("Message: %+v\n", ev)
 		if ev.Sender != clientID {
 
-			botApi := &TorpedoBotAPI{}
-			botApi.API = cli
-			botApi.Bot = tb
-			botApi.CommandPrefix = account.CommandPrefix
+			botApi := tb.NewBotAPI(mp, cli, account)
 			botApi.UserProfile = &torpedo_registry.UserProfile{ID: ev.Sender}
 			botApi.Me = clientID
-
-			msg, _ := ev.Body()
-			go tb.processChannelEvent(botApi, ev.RoomID, msg)
+			botApi.MessageID = ev.ID
+
+			msg, reply_to, edit, attachments := parseMatrixMessage(ev)
+			if edit != "" {
+				botApi.MessageID = edit
+			}
+			msg, botApi.Mentioned = StripMention(msg, creds[0])
+			event := botApi.NewEvent(ev.RoomID, msg)
+			event.Timestamp = time.Unix(0, ev.Timestamp*int64(time.Millisecond))
+			event.ReplyTo = reply_to
+			event.Edited = edit != ""
+			event.Attachments = attachments
+			event.Raw = ev
+			go tb.processChannelEvent(botApi, event)
 		}
 
 	})
@@ -95,17 +162,71 @@ func (tb *TorpedoBot) RunMatrixBotAccount(account *torpedo_registry.Account) {
 		}
 		cli.JoinRoom(ev.RoomID, servername, "")
 	})
+	return
+}
 
-	logger.Printf("Starting Matrix.Org bot...")
+func (mp *MatrixProtocol) Close() error {
+	if mp.cli != nil {
+		mp.cli.StopSync()
+	}
+	return nil
+}
 
-	tb.RegisteredProtocols["*gomatrix.Client"] = HandleMatrixMessage
+func (mp *MatrixProtocol) Receive() (err error) {
+	mp.logger.Printf("Starting Matrix.Org bot...")
 
-	for {
-		if err := cli.Sync(); err != nil {
-			logger.Printf("Sync() failed with: %+v\n", err)
+	// blocks until sync fails or StopSync is called, supervisor takes care of retries
+	err = mp.cli.Sync()
+	if err == nil && !mp.bot.IsShuttingDown() {
+		err = fmt.Errorf("Matrix sync stopped")
+	}
+	return
+}
+
+// parseMatrixMessage - text, replied and edited event IDs and attachment of m.room.message event.
+// Media messages have file name as body, attachment ID is mxc:// URI, URL is its download URL
+func parseMatrixMessage(ev *gomatrix.Event) (text, reply_to, edit string, attachments []Attachment) {
+	text, _ = ev.Body()
+	if relates, ok := ev.Content["m.relates_to"].(map[string]interface{}); ok {
+		if in_reply_to, ok := relates["m.in_reply_to"].(map[string]interface{}); ok {
+			reply_to, _ = in_reply_to["event_id"].(string)
+			// strip quoted fallback: "> <@user:server> quoted text\n\nreply"
+			if idx := strings.Index(text, "\n\n"); strings.HasPrefix(text, "> ") && idx != -1 {
+				text = text[idx+2:]
+			}
+		}
+		if relates["rel_type"] == "m.replace" {
+			edit, _ = relates["event_id"].(string)
+			if content, ok := ev.Content["m.new_content"].(map[string]interface{}); ok {
+				text, _ = content["body"].(string)
+			}
+		}
+	}
+	var kind AttachmentKind
+	switch msgtype, _ := ev.MessageType(); msgtype {
+	case "m.image":
+		kind = AttachmentImage
+	case "m.audio":
+		kind = AttachmentAudio
+	case "m.video":
+		kind = AttachmentVideo
+	case "m.file":
+		kind = AttachmentFile
+	default:
+		return
+	}
+	attachment := Attachment{Kind: kind, Name: text}
+	attachment.ID, _ = ev.Content["url"].(string)
+	if strings.HasPrefix(attachment.ID, "mxc://") {
+		attachment.URL = MatrixMediaURL + strings.TrimPrefix(attachment.ID, "mxc://")
+	}
+	if info, ok := ev.Content["info"].(map[string]interface{}); ok {
+		attachment.MimeType, _ = info["mimetype"].(string)
+		if size, ok := info["size"].(float64); ok {
+			attachment.Size = int(size)
 		}
-		// Optional: Wait a period of time before trying to sync again.
-		time.Sleep(10 * time.Second)
 	}
-	tb.Stats.ConnectedAccounts -= 1
+	attachments = append(attachments, attachment)
+	text = ""
+	return
 }
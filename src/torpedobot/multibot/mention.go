@@ -0,0 +1,74 @@
+package multibot
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// StripMention - remove leading mention of bot by one of its names: `@name text`, `name: text` or `name, text`.
+// Protocols convert native mention markup (e.g. Slack's <@U024BE7LH>) to `@name` before calling it.
+func StripMention(message string, names ...string) (text string, mentioned bool) {
+	text = message
+	trimmed := strings.TrimLeftFunc(message, unicode.IsSpace)
+	for _, name := range names {
+		name = strings.TrimPrefix(name, "@")
+		if name == "" {
+			continue
+		}
+		rest := trimmed
+		at := strings.HasPrefix(rest, "@")
+		if at {
+			rest = rest[1:]
+		}
+		if len(rest) < len(name) || !strings.EqualFold(rest[:len(name)], name) {
+			continue
+		}
+		rest = rest[len(name):]
+		switch {
+		case strings.HasPrefix(rest, ":") || strings.HasPrefix(rest, ","):
+			rest = rest[1:]
+		case at && (rest == "" || unicode.IsSpace([]rune(rest)[0])):
+		default:
+			// part of longer word, e.g. @torpedobot2 or torpedobots
+			continue
+		}
+		return strings.TrimSpace(rest), true
+	}
+	return
+}
+
+// isCommandName - first word of message is registered command
+func isCommandName(message string) bool {
+	fields := strings.Fields(message)
+	if len(fields) == 0 {
+		return false
+	}
+	_, ok := torpedo_registry.Config.GetHandlers()[ResolveAlias(fields[0])]
+	return ok
+}
+
+// commandMessage - detect command by one of account prefixes, known command in direct message or after bot mention
+// (chatter mentioning bot is not a command).
+// Returned message always starts with prefix that is also set as api.CommandPrefix
+func (tb *TorpedoBot) commandMessage(api *TorpedoBotAPI, incoming_message string) (message string, ok bool) {
+	prefixes := tb.AccountPrefixes(api.Account)
+	if len(prefixes) == 0 {
+		prefixes = []string{api.CommandPrefix}
+	}
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(incoming_message, prefix) {
+			api.CommandPrefix = prefix
+			return incoming_message, true
+		}
+	}
+	if strings.TrimSpace(incoming_message) == "" {
+		return
+	}
+	if (api.Mentioned || api.Direct) && isCommandName(incoming_message) {
+		api.CommandPrefix = prefixes[0]
+		return prefixes[0] + strings.TrimSpace(incoming_message), true
+	}
+	return
+}
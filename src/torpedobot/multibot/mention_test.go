@@ -0,0 +1,78 @@
+package multibot_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func TestStripMention(t *testing.T) {
+	cases := []struct {
+		message   string
+		text      string
+		mentioned bool
+	}{
+		{"@torpedobot help", "help", true},
+		{"@TorpedoBot", "", true},
+		{"torpedobot: help weather", "help weather", true},
+		{"torpedobot, help", "help", true},
+		{"  @torpedobot:  help", "help", true},
+		{"torpedobot help", "torpedobot help", false},
+		{"@torpedobot2 help", "@torpedobot2 help", false},
+		{"torpedobots: help", "torpedobots: help", false},
+		{"hi @torpedobot", "hi @torpedobot", false},
+	}
+	for _, tc := range cases {
+		text, mentioned := multibot.StripMention(tc.message, "", "torpedobot")
+		if text != tc.text || mentioned != tc.mentioned {
+			t.Errorf("`%s`: got `%s`/%v, expected `%s`/%v", tc.message, text, mentioned, tc.text, tc.mentioned)
+		}
+	}
+}
+
+func TestCommandTriggers(t *testing.T) {
+	bot := multibot.New()
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	bot.SetAccountPrefixes(lp.Account(), []string{"!", "."})
+
+	user := &torpedo_registry.UserProfile{ID: "U1", Nick: "alice"}
+	cases := []struct {
+		message string
+		direct  bool
+		text    string
+	}{
+		{"!echo hi", false, "alice said: !echo hi"},
+		{".echo hi", false, "alice said: .echo hi"},
+		{"@torpedobot echo hi", false, "alice said: !echo hi"},
+		{"torpedobot: .echo hi", false, "alice said: .echo hi"},
+		{"echo hi", true, "alice said: !echo hi"},
+		{"echo hi", false, ""},
+		{"@torpedobot thanks", false, ""},
+		{"torpedobot: nice one", false, ""},
+		{"hello there", true, ""},
+	}
+	for idx, tc := range cases {
+		channel := fmt.Sprintf("trigger-%d", idx)
+		if tc.direct {
+			lp.InjectDirect(user, channel, tc.message)
+		} else {
+			lp.Inject(user, channel, tc.message)
+		}
+		timeout := replyTimeout
+		if tc.text == "" {
+			timeout = 100 * time.Millisecond
+		}
+		reply := lp.WaitReply(timeout)
+		switch {
+		case tc.text == "" && reply != nil:
+			t.Errorf("`%s`: unexpected reply %+v", tc.message, reply)
+		case tc.text != "" && (reply == nil || reply.Text != tc.text):
+			t.Errorf("`%s`: got %+v, expected `%s`", tc.message, reply, tc.text)
+		}
+	}
+}
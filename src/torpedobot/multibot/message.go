@@ -0,0 +1,113 @@
+package multibot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// ErrNotSupported - protocol can't do requested message operation (e.g. reactions on IRC)
+var ErrNotSupported = errors.New("not supported by protocol")
+
+// Message - outgoing message, see TorpedoBotAPI.Send. Protocols that can't reply, thread or edit
+// post it as new message, deletes and reactions fail with ErrNotSupported there
+type Message struct {
+	Channel      interface{}
+	Text         string
+	RichMessages []torpedo_registry.RichMessage
+	// Cards - interactive rich messages with fields, buttons and images
+	Cards []Card
+	// ReplyTo - message ID to reply to (quote), e.g. TorpedoBotAPI.MessageID
+	ReplyTo string
+	// ThreadID - thread to post in, e.g. TorpedoBotAPI.ThreadID
+	ThreadID string
+	// Edit - ID of bot message to replace text of
+	Edit string
+	// Delete - ID of bot message to delete, only Channel is used
+	Delete string
+	// Reaction - emoji name (e.g. `thumbsup`) added to ReplyTo message instead of posting text
+	Reaction string
+}
+
+// MessageSender - optional Protocol extension, sends Message and returns platform message ID
+type MessageSender interface {
+	SendMessage(msg *Message, tba *TorpedoBotAPI) (id string, err error)
+}
+
+// Send - deliver message, id is empty if protocol doesn't report one
+func (tba *TorpedoBotAPI) Send(msg *Message) (id string, err error) {
+	if tba.Protocol == nil {
+		err = fmt.Errorf("No protocol set for bot API: %T", tba.API)
+	} else {
+		tba.Bot.waitOutbound(tba.ProtocolName)
+		if len(msg.Cards) > 0 && !tba.Protocol.Capabilities().Cards {
+			msg = tba.cardsToText(msg)
+		}
+		if sender, ok := tba.Protocol.(MessageSender); ok {
+			id, err = sender.SendMessage(msg, tba)
+		} else {
+			id, err = tba.sendPlain(msg)
+		}
+	}
+	if err == ErrNotSupported {
+		return
+	}
+	if err != nil {
+		tba.Bot.logger.Printf("Could not send message to %v: %+v\n", msg.Channel, err)
+		SendFailures.WithLabelValues(tba.ProtocolName).Inc()
+		return
+	}
+	if msg.Delete != "" || msg.Reaction != "" || msg.Edit != "" {
+		return
+	}
+	// cards are relayed as rich messages
+	richmsgs := msg.RichMessages
+	for _, card := range msg.Cards {
+		richmsgs = append(richmsgs, card.RichMessage)
+	}
+	text := msg.Text
+	if text == "" && len(richmsgs) > 0 {
+		text = richmsgs[0].Text
+		if text == "" {
+			text = richmsgs[0].Title
+		}
+	}
+	tba.Bot.RecordHistory(tba, msg.Channel, text, true)
+	if !tba.Relayed {
+		tba.Bot.RelayMessage(tba, msg.Channel, "", msg.Text, richmsgs)
+	}
+	return
+}
+
+// sendPlain - protocols without MessageSender post text and rich messages only
+func (tba *TorpedoBotAPI) sendPlain(msg *Message) (id string, err error) {
+	if msg.Delete != "" || msg.Reaction != "" {
+		err = ErrNotSupported
+		return
+	}
+	err = tba.Protocol.Send(msg.Channel, msg.Text, tba, msg.RichMessages)
+	return
+}
+
+// Reply - reply to incoming message, in its thread if it has one
+func (tba *TorpedoBotAPI) Reply(channel interface{}, text string, richmsgs ...torpedo_registry.RichMessage) (id string, err error) {
+	return tba.Send(&Message{Channel: channel, Text: text, RichMessages: richmsgs, ReplyTo: tba.MessageID, ThreadID: tba.ThreadID})
+}
+
+// EditMessage - replace text of bot message, posted as new message if protocol can't edit
+func (tba *TorpedoBotAPI) EditMessage(channel interface{}, id, text string) (string, error) {
+	return tba.Send(&Message{Channel: channel, Text: text, Edit: id})
+}
+
+// DeleteMessage - delete bot message
+func (tba *TorpedoBotAPI) DeleteMessage(channel interface{}, id string) (err error) {
+	_, err = tba.Send(&Message{Channel: channel, Delete: id})
+	return
+}
+
+// React - add emoji reaction to message
+func (tba *TorpedoBotAPI) React(channel interface{}, id, emoji string) (err error) {
+	_, err = tba.Send(&Message{Channel: channel, ReplyTo: id, Reaction: emoji})
+	return
+}
@@ -0,0 +1,149 @@
+package multibot_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// plainProtocol - protocol without MessageSender, records posted text
+type plainProtocol struct {
+	sent []string
+}
+
+func (pp *plainProtocol) Connect(account *torpedo_registry.Account) error { return nil }
+func (pp *plainProtocol) Receive() error                                  { return nil }
+func (pp *plainProtocol) Close() error                                    { return nil }
+func (pp *plainProtocol) Capabilities() multibot.Capabilities             { return multibot.Capabilities{} }
+func (pp *plainProtocol) Send(channel interface{}, message string, tba *multibot.TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) error {
+	pp.sent = append(pp.sent, message)
+	return nil
+}
+
+// strictAPI - per-message API of strictProtocol, like IRC event connection
+type strictAPI struct{}
+
+// strictProtocol - protocol which Send accepts its own API type only (as IRC), messages that
+// are not replies are sent with OutboundAPI
+type strictProtocol struct {
+	sent chan string
+	done chan struct{}
+}
+
+func (sp *strictProtocol) Connect(account *torpedo_registry.Account) error {
+	account.API = "connection"
+	return nil
+}
+func (sp *strictProtocol) Receive() error {
+	<-sp.done
+	return nil
+}
+func (sp *strictProtocol) Close() error {
+	close(sp.done)
+	return nil
+}
+func (sp *strictProtocol) Capabilities() multibot.Capabilities       { return multibot.Capabilities{} }
+func (sp *strictProtocol) OutboundAPI() (api interface{}, err error) { return &strictAPI{}, nil }
+func (sp *strictProtocol) DirectChannel(user_id string) (interface{}, error) {
+	return "direct-" + user_id, nil
+}
+func (sp *strictProtocol) Send(channel interface{}, message string, tba *multibot.TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) error {
+	if _, ok := tba.API.(*strictAPI); !ok {
+		return fmt.Errorf("can only reply to incoming messages, got %T", tba.API)
+	}
+	sp.sent <- fmt.Sprintf("%v: %s", channel, message)
+	return nil
+}
+
+// startStrict - run strictProtocol account and wait until it's connected, sent messages are delivered
+// to returned channel
+func startStrict(bot *multibot.TorpedoBot, name string) (ba *multibot.BotAccount, sent chan string) {
+	sent = make(chan string, 10)
+	bot.RegisterProtocol(name, func() multibot.Protocol {
+		return &strictProtocol{sent: sent, done: make(chan struct{})}
+	})
+	account := &torpedo_registry.Account{APIKey: name, CommandPrefix: "!"}
+	ba = bot.AddAccount(name, account)
+	bot.StartAccount(name, account)
+	deadline := time.Now().Add(replyTimeout)
+	for testutil.ToFloat64(multibot.AccountsConnected.WithLabelValues(name)) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return
+}
+
+// stopStrict - remove account and wait until supervisor forgets it, account counters are checked by other tests
+func stopStrict(bot *multibot.TorpedoBot, ba *multibot.BotAccount) {
+	bot.RemoveAccount(ba.ID)
+	deadline := time.Now().Add(replyTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := bot.GetAccount(ba.ID); err != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func ThreadProcessMessage(api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+	tba := api.API.(*multibot.TorpedoBotAPI)
+	id, _ := tba.Reply(channel, "working on it")
+	tba.EditMessage(channel, id, "done")
+	tba.React(channel, tba.MessageID, "thumbsup")
+	tba.DeleteMessage(channel, id)
+}
+
+func TestMessage(t *testing.T) {
+	bot := multibot.New()
+	torpedo_registry.Config.RegisterHelpAndHandler("thread", "Reply, edit, react and delete", ThreadProcessMessage)
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+
+	user := &torpedo_registry.UserProfile{ID: "U41", Nick: "alice"}
+	incoming := lp.InjectThread(user, "message", "T1", "!thread")
+	replies := make([]*multibot.LoopbackMessage, 0)
+	for idx := 0; idx < 4; idx++ {
+		reply := lp.WaitReply(replyTimeout)
+		if reply == nil {
+			t.Fatalf("got %d replies of 4", len(replies))
+		}
+		replies = append(replies, reply)
+	}
+	id := replies[0].ID
+	if id == "" || id == incoming || replies[0].ReplyTo != incoming || replies[0].ThreadID != "T1" || replies[0].Text != "working on it" {
+		t.Errorf("unexpected reply: %+v", replies[0])
+	}
+	if replies[1].Edit != id || replies[1].Text != "done" {
+		t.Errorf("unexpected edit: %+v", replies[1])
+	}
+	if replies[2].ReplyTo != incoming || replies[2].Reaction != "thumbsup" {
+		t.Errorf("unexpected reaction: %+v", replies[2])
+	}
+	if replies[3].Delete != id {
+		t.Errorf("unexpected delete: %+v", replies[3])
+	}
+
+	// protocols without MessageSender post replies and edits as new messages
+	proto := &plainProtocol{}
+	tba := bot.NewBotAPI(proto, nil, &torpedo_registry.Account{})
+	tba.MessageID = "M1"
+	if _, err := tba.Reply("plain", "hello"); err != nil {
+		t.Errorf("reply failed: %+v", err)
+	}
+	if _, err := tba.EditMessage("plain", "M2", "hello again"); err != nil {
+		t.Errorf("edit failed: %+v", err)
+	}
+	if err := tba.React("plain", "M1", "thumbsup"); err != multibot.ErrNotSupported {
+		t.Errorf("reaction: got %+v", err)
+	}
+	if err := tba.DeleteMessage("plain", "M2"); err != multibot.ErrNotSupported {
+		t.Errorf("delete: got %+v", err)
+	}
+	if len(proto.sent) != 2 || proto.sent[0] != "hello" || proto.sent[1] != "hello again" {
+		t.Errorf("unexpected messages: %+v", proto.sent)
+	}
+}
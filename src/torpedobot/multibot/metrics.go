@@ -0,0 +1,84 @@
+package multibot
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus metrics, served on API address as /metrics.
+// Default registry also exports Go runtime and process stats.
+var (
+	MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "torpedobot",
+		Name:      "messages_received_total",
+		Help:      "Messages received, by protocol and channel type",
+	}, []string{"protocol", "channel_type"})
+	CommandInvocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "torpedobot",
+		Name:      "command_invocations_total",
+		Help:      "Command handler invocations",
+	}, []string{"command"})
+	CommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "torpedobot",
+		Name:      "command_duration_seconds",
+		Help:      "Command handler latency",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+	TRPEDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "torpedobot",
+		Name:      "trpe_duration_seconds",
+		Help:      "TRPE call latency",
+		Buckets:   prometheus.DefBuckets,
+	})
+	TRPEErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "torpedobot",
+		Name:      "trpe_errors_total",
+		Help:      "Failed TRPE calls",
+	})
+	NoSpamRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "torpedobot",
+		Name:      "nospam_rejected_total",
+		Help:      "Messages rejected by NoSpam, by reason (blacklist, flood, ratelimit)",
+	}, []string{"reason"})
+	SendFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "torpedobot",
+		Name:      "send_failures_total",
+		Help:      "Outbound messages that could not be delivered",
+	}, []string{"protocol"})
+	MessagesRelayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "torpedobot",
+		Name:      "messages_relayed_total",
+		Help:      "Messages relayed to bridged channels, by source and target protocol",
+	}, []string{"from", "to"})
+	Reconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "torpedobot",
+		Name:      "reconnects_total",
+		Help:      "Account (re)connections",
+	}, []string{"protocol"})
+	AccountsConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "torpedobot",
+		Name:      "accounts_connected",
+		Help:      "Currently connected accounts",
+	}, []string{"protocol"})
+)
+
+func init() {
+	prometheus.MustRegister(MessagesReceived,
+		CommandInvocations,
+		CommandDuration,
+		TRPEDuration,
+		TRPEErrors,
+		NoSpamRejected,
+		SendFailures,
+		MessagesRelayed,
+		Reconnects,
+		AccountsConnected,
+	)
+}
+
+// ChannelType - channel type label for metrics, protocols that know it implement ChannelTyper
+func ChannelType(proto Protocol, channel interface{}) string {
+	if typer, ok := proto.(ChannelTyper); ok {
+		return typer.ChannelType(channel)
+	}
+	return "unknown"
+}
@@ -2,14 +2,69 @@ package multibot
 
 import (
 	"flag"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 
 	common "github.com/tb0hdan/torpedo_common"
 	database "github.com/tb0hdan/torpedo_common/database"
 	"github.com/tb0hdan/torpedo_registry"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var MongoDBConnection *string
 
+type IRCChatroom struct {
+	MyServer string
+	Channel  string
+}
+
+type JabberChatroom struct {
+	MyJID    string
+	Chatroom string
+}
+
+// Chatroom - rooms of protocols other than IRC and Jabber
+type Chatroom struct {
+	Protocol string
+	Account  string
+	Room     string
+}
+
+// ChannelAlias - command alias added in channel
+type ChannelAlias struct {
+	Channel string
+	Alias   string
+	Command string
+}
+
+// StoreRole - role granted with `grant` command
+type StoreRole struct {
+	User string
+	Role string
+}
+
+// StoreBridge - bridge linked with `bridge link`
+type StoreBridge struct {
+	Name     string
+	Channels []string
+}
+
+type StoreCounter struct {
+	Name  string
+	Value int64
+}
+
+// MongoStore - Store backed by MongoDB, uses collections created by earlier versions
+type MongoStore struct {
+	db             *database.MongoDB
+	historyIndexes sync.Once
+}
+
 func (tb *TorpedoBot) ConfigureMongoDBPlugin(cfg *torpedo_registry.ConfigStruct) {
 	MongoDBConnection = flag.String("mongo", "", "MongoDB server hostname")
 }
@@ -23,11 +78,385 @@ func (tb *TorpedoBot) ParseMongoDBPlugin(cfg *torpedo_registry.ConfigStruct) {
 		if cfg.GetConfig()["mongo"] == "" {
 			cfg.SetConfig("mongo", common.GetStripEnv("MONGO_PORT_27017_TCP_ADDR"))
 		}
-		// fallback to localhost
-		if cfg.GetConfig()["mongo"] == "" {
-			cfg.SetConfig("mongo", "localhost")
+	}
+}
+
+func NewMongoStore(host string) *MongoStore {
+	return &MongoStore{db: database.New(host, "")}
+}
+
+func (ms *MongoStore) IncrementCounter(name string, delta int64) (value int64, err error) {
+	if name == CounterTotalMessages {
+		value = ms.db.GetUpdateTotalMessages(delta)
+		return
+	}
+	session, collection, err := ms.db.GetCollection("counters")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	result := &StoreCounter{}
+	_, err = collection.Find(bson.M{"name": name}).Apply(mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"value": delta}},
+		Upsert:    true,
+		ReturnNew: true,
+	}, result)
+	value = result.Value
+	return
+}
+
+// mongoBlacklistQuery - rules added with mongo shell may have no channel field
+func mongoBlacklistQuery(rule BlackListRuleItem) bson.M {
+	if rule.Channel == "" {
+		return bson.M{"pattern": rule.Pattern, "channel": bson.M{"$in": []interface{}{"", nil}}}
+	}
+	return bson.M{"pattern": rule.Pattern, "channel": rule.Channel}
+}
+
+func (ms *MongoStore) GetBlacklistRules() (rules []BlackListRuleItem, err error) {
+	session, collection, err := ms.db.GetCollection("blackListItems")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	rules = []BlackListRuleItem{}
+	err = collection.Find(bson.M{}).All(&rules)
+	return
+}
+
+func (ms *MongoStore) AddBlacklistRule(rule BlackListRuleItem) (err error) {
+	session, collection, err := ms.db.GetCollection("blackListItems")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	_, err = collection.Upsert(mongoBlacklistQuery(rule), &rule)
+	return
+}
+
+func (ms *MongoStore) RemoveBlacklistRule(rule BlackListRuleItem) (err error) {
+	session, collection, err := ms.db.GetCollection("blackListItems")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	err = collection.Remove(mongoBlacklistQuery(rule))
+	return
+}
+
+func (ms *MongoStore) BlacklistRuleMatched(rule BlackListRuleItem) (err error) {
+	session, collection, err := ms.db.GetCollection("blackListItems")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	err = collection.Update(mongoBlacklistQuery(rule), bson.M{"$inc": bson.M{"matches": 1}})
+	return
+}
+
+// mongoHistoryItem - history document, lowercase nick is indexed for case insensitive lookups
+type mongoHistoryItem struct {
+	HistoryItem `bson:",inline"`
+	NickLower   string `bson:"nick_lower"`
+}
+
+// historyCollection - chatHistory collection, indexes are created on first use
+func (ms *MongoStore) historyCollection() (session *mgo.Session, collection *mgo.Collection, err error) {
+	session, collection, err = ms.db.GetCollection("chatHistory")
+	if err != nil {
+		return
+	}
+	ms.historyIndexes.Do(func() {
+		for _, index := range []mgo.Index{
+			{Key: []string{"protocol", "channel", "-timestamp"}},
+			{Key: []string{"nick_lower", "-timestamp"}},
+			{Key: []string{"expires"}, Sparse: true},
+			{Key: []string{"$text:message"}},
+		} {
+			if ierr := collection.EnsureIndex(index); ierr != nil {
+				log.Printf("Could not create history index %+v: %+v\n", index.Key, ierr)
+			}
+		}
+	})
+	return
+}
+
+func (ms *MongoStore) AddHistory(item *HistoryItem) (err error) {
+	session, collection, err := ms.historyCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	err = collection.Insert(&mongoHistoryItem{HistoryItem: *item, NickLower: strings.ToLower(item.Nick)})
+	return
+}
+
+func (ms *MongoStore) SearchHistory(query HistoryQuery) (items []*HistoryItem, err error) {
+	items = make([]*HistoryItem, 0)
+	session, collection, err := ms.historyCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	filter := bson.M{}
+	if query.Protocol != "" {
+		filter["protocol"] = query.Protocol
+	}
+	if query.Channel != "" {
+		filter["channel"] = query.Channel
+	}
+	if query.Nick != "" {
+		filter["nick_lower"] = strings.ToLower(query.Nick)
+	}
+	if words := strings.Fields(query.Text); len(words) > 0 {
+		// quoted words are all required
+		for idx := range words {
+			words[idx] = strconv.Quote(words[idx])
+		}
+		filter["$text"] = bson.M{"$search": strings.Join(words, " ")}
+	}
+	results := make([]*mongoHistoryItem, 0)
+	q := collection.Find(filter).Sort("-timestamp", "-_id")
+	if query.Limit > 0 {
+		q = q.Limit(query.Limit)
+	}
+	if err = q.All(&results); err != nil {
+		return
+	}
+	for _, result := range results {
+		item := result.HistoryItem
+		items = append(items, &item)
+	}
+	return
+}
+
+func (ms *MongoStore) PruneHistory(now time.Time) (removed int, err error) {
+	session, collection, err := ms.historyCollection()
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	info, err := collection.RemoveAll(bson.M{"expires": bson.M{"$lte": now}})
+	if info != nil {
+		removed = info.Removed
+	}
+	return
+}
+
+func (ms *MongoStore) GetRooms(protocol, account string) (rooms []string, err error) {
+	rooms = make([]string, 0)
+	switch protocol {
+	case "irc":
+		session, collection, err := ms.db.GetCollection("ircChatrooms")
+		if err != nil {
+			return rooms, err
+		}
+		defer session.Close()
+		results := make([]*IRCChatroom, 0)
+		err = collection.Find(bson.M{"myserver": account}).All(&results)
+		for _, room := range results {
+			rooms = append(rooms, room.Channel)
 		}
+		return rooms, err
+	case "jabber":
+		session, collection, err := ms.db.GetCollection("jabberChatrooms")
+		if err != nil {
+			return rooms, err
+		}
+		defer session.Close()
+		results := make([]*JabberChatroom, 0)
+		err = collection.Find(bson.M{"myjid": account}).All(&results)
+		for _, room := range results {
+			rooms = append(rooms, room.Chatroom)
+		}
+		return rooms, err
+	}
+	session, collection, err := ms.db.GetCollection("chatrooms")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	results := make([]*Chatroom, 0)
+	err = collection.Find(bson.M{"protocol": protocol, "account": account}).All(&results)
+	for _, room := range results {
+		rooms = append(rooms, room.Room)
+	}
+	return
+}
+
+func (ms *MongoStore) AddRoom(protocol, account, room string) (err error) {
+	var name string
+	var query bson.M
+	var record interface{}
+	switch protocol {
+	case "irc":
+		name = "ircChatrooms"
+		query = bson.M{"myserver": account, "channel": room}
+		record = &IRCChatroom{MyServer: account, Channel: room}
+	case "jabber":
+		name = "jabberChatrooms"
+		query = bson.M{"myjid": account, "chatroom": room}
+		record = &JabberChatroom{MyJID: account, Chatroom: room}
+	default:
+		name = "chatrooms"
+		query = bson.M{"protocol": protocol, "account": account, "room": room}
+		record = &Chatroom{Protocol: protocol, Account: account, Room: room}
+	}
+	session, collection, err := ms.db.GetCollection(name)
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	_, err = collection.Upsert(query, record)
+	return
+}
+
+func (ms *MongoStore) GetAliases(channel string) (aliases map[string]string, err error) {
+	aliases = make(map[string]string)
+	session, collection, err := ms.db.GetCollection("aliases")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	results := make([]*ChannelAlias, 0)
+	err = collection.Find(bson.M{"channel": channel}).All(&results)
+	for _, item := range results {
+		aliases[item.Alias] = item.Command
+	}
+	return
+}
 
+func (ms *MongoStore) SetAlias(channel, alias, command string) (err error) {
+	session, collection, err := ms.db.GetCollection("aliases")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	_, err = collection.Upsert(bson.M{"channel": channel, "alias": alias}, &ChannelAlias{Channel: channel, Alias: alias, Command: command})
+	return
+}
+
+func (ms *MongoStore) RemoveAlias(channel, alias string) (err error) {
+	session, collection, err := ms.db.GetCollection("aliases")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	err = collection.Remove(bson.M{"channel": channel, "alias": alias})
+	return
+}
+
+func (ms *MongoStore) GetRoles() (roles map[string]string, err error) {
+	roles = make(map[string]string)
+	session, collection, err := ms.db.GetCollection("roles")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	results := make([]*StoreRole, 0)
+	err = collection.Find(bson.M{}).All(&results)
+	for _, item := range results {
+		roles[item.User] = item.Role
+	}
+	return
+}
+
+func (ms *MongoStore) SetRole(user, role string) (err error) {
+	session, collection, err := ms.db.GetCollection("roles")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	_, err = collection.Upsert(bson.M{"user": user}, &StoreRole{User: user, Role: role})
+	return
+}
+
+func (ms *MongoStore) RemoveRole(user string) (err error) {
+	session, collection, err := ms.db.GetCollection("roles")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	err = collection.Remove(bson.M{"user": user})
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+func (ms *MongoStore) Close() error {
+	// sessions are opened per call
+	return nil
+}
+
+func (ms *MongoStore) GetBridges() (bridges map[string][]string, err error) {
+	bridges = make(map[string][]string)
+	session, collection, err := ms.db.GetCollection("bridges")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	results := make([]*StoreBridge, 0)
+	err = collection.Find(bson.M{}).All(&results)
+	for _, item := range results {
+		bridges[item.Name] = item.Channels
+	}
+	return
+}
+
+func (ms *MongoStore) SetBridge(name string, channels []string) (err error) {
+	session, collection, err := ms.db.GetCollection("bridges")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	_, err = collection.Upsert(bson.M{"name": name}, &StoreBridge{Name: name, Channels: channels})
+	return
+}
+
+func (ms *MongoStore) RemoveBridge(name string) (err error) {
+	session, collection, err := ms.db.GetCollection("bridges")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	err = collection.Remove(bson.M{"name": name})
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+func (ms *MongoStore) GetJobs() (jobs []*ScheduledJob, err error) {
+	jobs = make([]*ScheduledJob, 0)
+	session, collection, err := ms.db.GetCollection("jobs")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	err = collection.Find(bson.M{}).All(&jobs)
+	return
+}
+
+func (ms *MongoStore) SaveJob(job *ScheduledJob) (err error) {
+	session, collection, err := ms.db.GetCollection("jobs")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	_, err = collection.Upsert(bson.M{"id": job.ID}, job)
+	return
+}
+
+func (ms *MongoStore) RemoveJob(id string) (err error) {
+	session, collection, err := ms.db.GetCollection("jobs")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+	err = collection.Remove(bson.M{"id": id})
+	if err == mgo.ErrNotFound {
+		err = nil
 	}
-	tb.Database = database.New(cfg.GetConfig()["mongo"], "")
+	return
 }
@@ -2,96 +2,320 @@ package multibot
 
 import (
 	"fmt"
-	"strconv"
-	"time"
-
 	"regexp"
-
-	"gopkg.in/mgo.v2/bson"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type BlackListRuleItem struct {
 	// sender, message
-	Type string
-	// mongo regexp
-	Pattern string
+	Type string `json:"type"`
+	// regular expression
+	Pattern string `json:"pattern"`
 	// match count
-	Matches int64
+	Matches int64 `json:"matches"`
+	// Channel - protocol:channel (see ChannelKey) or protocol/account (see AccountKey) for all channels of account,
+	// all channels if empty
+	Channel string `json:"channel,omitempty"`
+	// Expires - rule is removed after this time, never if unset
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// DetectorsConfig - `nospam.detectors` section of config file
+type DetectorsConfig struct {
+	// Repeat - same message from sender Threshold times in a row within Window
+	Repeat DetectorConfig `yaml:"repeat"`
+	// Links - Threshold links from sender within Window
+	Links DetectorConfig `yaml:"links"`
+	// Mentions - Threshold mentions in one message
+	Mentions DetectorConfig `yaml:"mentions"`
+	// NewSenderLinks - link from sender first seen less than Window ago. First seen times are kept
+	// in memory, detector is inactive for Window after every start
+	NewSenderLinks DetectorConfig `yaml:"new_sender_links"`
+}
+
+type DetectorConfig struct {
+	// Action - ignore, warn, blacklist or notify, detector is disabled if unset
+	Action    string        `yaml:"action"`
+	Threshold int           `yaml:"threshold"`
+	Window    time.Duration `yaml:"window"`
+	// Expires - blacklist action rule lifetime
+	Expires time.Duration `yaml:"expires"`
+}
+
+// detectorActions - ignore drops message, warn drops it and asks sender to stop (once per window),
+// blacklist drops it and blacklists sender, notify sends message to admins and lets it through
+var detectorActions = map[string]bool{"ignore": true, "warn": true, "blacklist": true, "notify": true}
+
+// detectorDefaults - used for values not set in config
+var detectorDefaults = map[string]DetectorConfig{
+	"repeat":           {Threshold: 3, Window: time.Minute, Expires: time.Hour},
+	"links":            {Threshold: 5, Window: time.Minute, Expires: time.Hour},
+	"mentions":         {Threshold: 5, Window: time.Minute, Expires: time.Hour},
+	"new_sender_links": {Window: 10 * time.Minute, Expires: time.Hour},
+}
+
+// MaxTrackedSenders - senders not seen for an hour are forgotten when there are more of them
+const MaxTrackedSenders = 10000
+
+var (
+	linkRegexp    = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+	mentionRegexp = regexp.MustCompile(`(?:^|\s)@\w+|<@[^>]+>`)
+)
+
+func (detectors *DetectorsConfig) named() map[string]*DetectorConfig {
+	return map[string]*DetectorConfig{
+		"repeat":           &detectors.Repeat,
+		"links":            &detectors.Links,
+		"mentions":         &detectors.Mentions,
+		"new_sender_links": &detectors.NewSenderLinks,
+	}
+}
+
+func (detectors *DetectorsConfig) Validate() error {
+	for name, detector := range detectors.named() {
+		if detector.Action != "" && !detectorActions[detector.Action] {
+			return fmt.Errorf("detector %s has unknown action `%s`, should be ignore, warn, blacklist or notify", name, detector.Action)
+		}
+		if detector.Threshold < 0 || detector.Window < 0 || detector.Expires < 0 {
+			return fmt.Errorf("detector %s values can't be negative", name)
+		}
+	}
+	return nil
 }
 
-func (tb *TorpedoBot) UpdateChannelTS(channel interface{}, message string) {
-	var values []string
-	chatID := fmt.Sprintf("%+v", channel)
-	tb.logger.Printf("New channel")
-	values = make([]string, 2)
-	values[0] = fmt.Sprintf("%f", float64(time.Now().Unix()))
-	values[1] = message
-	tb.throttle.Set(chatID, values)
+type senderState struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	last      string
+	repeats   int
+	links     []time.Time
 }
 
-func (tb *TorpedoBot) GetChannelTSValues(channel interface{}) (values []string, ok bool) {
-	chatID := fmt.Sprintf("%+v", channel)
-	values, ok = tb.throttle.Get(chatID)
+// floodTracker - recent activity by sender
+type floodTracker struct {
+	lock    sync.Mutex
+	started time.Time
+	senders map[string]*senderState
+}
+
+func newFloodTracker() *floodTracker {
+	return &floodTracker{started: time.Now(), senders: make(map[string]*senderState)}
+}
+
+// observe - record message and return names of detectors that fired, in fixed order
+func (ft *floodTracker) observe(sender, message string, detectors DetectorsConfig) (fired []string) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	now := time.Now()
+	state, ok := ft.senders[sender]
+	if !ok {
+		if len(ft.senders) >= MaxTrackedSenders {
+			for key, old := range ft.senders {
+				if now.Sub(old.lastSeen) > time.Hour {
+					delete(ft.senders, key)
+				}
+			}
+		}
+		state = &senderState{firstSeen: now}
+		ft.senders[sender] = state
+	}
+	text := strings.ToLower(strings.TrimSpace(message))
+	if text == state.last && now.Sub(state.lastSeen) <= detectors.Repeat.Window {
+		state.repeats += 1
+	} else {
+		state.last, state.repeats = text, 1
+	}
+	state.lastSeen = now
+	links := len(linkRegexp.FindAllString(message, -1))
+	recent := state.links[:0]
+	for _, seen := range state.links {
+		if now.Sub(seen) <= detectors.Links.Window {
+			recent = append(recent, seen)
+		}
+	}
+	for i := 0; i < links; i++ {
+		recent = append(recent, now)
+	}
+	state.links = recent
+
+	if detectors.Repeat.Action != "" && state.repeats >= detectors.Repeat.Threshold {
+		fired = append(fired, "repeat")
+	}
+	if detectors.Links.Action != "" && links > 0 && len(state.links) >= detectors.Links.Threshold {
+		fired = append(fired, "links")
+	}
+	if detectors.Mentions.Action != "" && len(mentionRegexp.FindAllString(message, -1)) >= detectors.Mentions.Threshold {
+		fired = append(fired, "mentions")
+	}
+	// everyone is new right after start
+	window := detectors.NewSenderLinks.Window
+	if detectors.NewSenderLinks.Action != "" && links > 0 && now.Sub(state.firstSeen) < window && state.firstSeen.Sub(ft.started) >= window {
+		fired = append(fired, "new_sender_links")
+	}
 	return
 }
 
-func (tb *TorpedoBot) CheckMessageBlacklistOk(api *TorpedoBotAPI, message string) (status bool) {
+func (tb *TorpedoBot) setNoSpamSettings(config NoSpamConfig) {
+	compiled, _ := compileBlacklist(config.Blacklist, false)
+	limits := config.Limits
+	if limits.Channel == nil && config.RateLimit != 0 {
+		// one message per rate_limit interval
+		limits.Channel = &RateLimitConfig{Rate: 1, Per: config.RateLimit, Burst: 1}
+	}
+	outbound := make(map[string]RateLimitConfig)
+	for protocol, limit := range DefaultOutboundLimits {
+		outbound[protocol] = limit
+	}
+	for protocol, limit := range limits.Outbound {
+		outbound[protocol] = limit
+	}
+	limits.Outbound = outbound
+	tb.noSpamLock.Lock()
+	defer tb.noSpamLock.Unlock()
+	tb.limits = limits
+	tb.limiter = newRateLimiter()
+	tb.configBlacklist = compiled
+	detectors := config.Detectors
+	for name, detector := range detectors.named() {
+		defaults := detectorDefaults[name]
+		if detector.Threshold == 0 {
+			detector.Threshold = defaults.Threshold
+		}
+		if detector.Window == 0 {
+			detector.Window = defaults.Window
+		}
+		if detector.Expires == 0 {
+			detector.Expires = defaults.Expires
+		}
+	}
+	tb.detectors = detectors
+	if tb.flood == nil {
+		tb.flood = newFloodTracker()
+	}
+}
+
+// noSpamSettings - config file blacklist rules
+func (tb *TorpedoBot) noSpamSettings() (blacklist []*blacklistRule) {
+	tb.noSpamLock.RLock()
+	defer tb.noSpamLock.RUnlock()
+	return tb.configBlacklist
+}
+
+func (tb *TorpedoBot) CheckMessageBlacklistOk(api *TorpedoBotAPI, channel interface{}, message string) (status bool) {
+	now := time.Now()
+	channel_key, account_key := ChannelKey(api, channel), AccountKey(api)
+	for _, rule := range tb.blacklistRules(false) {
+		if rule.Expired(now) || (rule.Channel != "" && rule.Channel != channel_key && rule.Channel != account_key) {
+			continue
+		}
+		subject := message
+		if rule.Type == "sender" {
+			if api.UserProfile == nil {
+				continue
+			}
+			subject = api.UserProfile.ID
+		}
+		if !rule.re.MatchString(subject) {
+			continue
+		}
+		tb.logger.Printf("Blacklist rule %s matched\n", rule.ID())
+		atomic.AddInt64(&rule.Matches, 1)
+		if rule.stored && tb.Store != nil {
+			// config file rules are not stored, their counters are kept in memory
+			if err := tb.Store.BlacklistRuleMatched(rule.item()); err != nil {
+				tb.logger.Printf("Could not update record %s - %+v\n", rule.ID(), err)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// FloodCheckOk - run flood detectors for sender, admins and bot itself are not checked
+func (tb *TorpedoBot) FloodCheckOk(api *TorpedoBotAPI, channel interface{}, message string) (status bool) {
 	status = true
-	session, collection, err := tb.Database.GetCollection("blackListItems")
-	defer session.Close()
-	if err != nil {
-		tb.logger.Fatal("Could not connect to database: %+v\n", err)
-	}
-	result := []BlackListRuleItem{}
-	err = collection.Find(bson.M{}).All(&result)
-	for idx, filterItem := range result {
-		tb.logger.Printf("Running filter check #%v\n", idx)
-		switch filterItem.Type {
-		case "message":
-			r := regexp.MustCompile(filterItem.Pattern)
-			if r.FindStringSubmatch(message) != nil {
-				err = collection.Update(bson.M{"pattern": filterItem.Pattern}, bson.M{"matches": filterItem.Matches + 1,
-					"type": filterItem.Type, "pattern": filterItem.Pattern})
-				if err != nil {
-					tb.logger.Fatalf("Could not update record %+v - %+v\n", filterItem, err)
-				}
-				status = false
-				break
+	if api.UserProfile == nil || api.UserProfile.ID == "" || api.UserProfile.ID == api.Me || tb.IsAdmin(api) {
+		return
+	}
+	tb.noSpamLock.RLock()
+	detectors, tracker, limiter := tb.detectors, tb.flood, tb.limiter
+	tb.noSpamLock.RUnlock()
+	sender := UserKey(api.ProtocolName, api.UserProfile.ID)
+	for _, name := range tracker.observe(sender, message, detectors) {
+		detector := detectors.named()[name]
+		tb.logger.Printf("Flood detector %s fired for %s in %s, action: %s\n", name, sender, ChannelKey(api, channel), detector.Action)
+		if detector.Action != "notify" {
+			status = false
+		}
+		switch detector.Action {
+		case "warn":
+			if limiter.noticeDue("flood:"+name+":"+sender, detector.Window) {
+				api.PostMessage(channel, fmt.Sprintf("%s, please stop flooding", api.UserProfile.Nick))
 			}
-		case "sender":
-			r := regexp.MustCompile(filterItem.Pattern)
-			if r.FindStringSubmatch(api.UserProfile.ID) != nil {
-				status = false
+		case "blacklist":
+			// anyone can flood with forged sender ID to get it blacklisted
+			if verifier, ok := api.Protocol.(SenderVerifier); ok && !verifier.VerifiedSenders() {
+				tb.logger.Printf("%s sender IDs are not verified, %s is not blacklisted\n", api.ProtocolName, sender)
 				break
 			}
-		default:
-			tb.logger.Fatalf("Got unknown filter type: `%s`\n", filterItem.Type)
+			// same ID on other protocol or account may be other user
+			expires := time.Now().Add(detector.Expires)
+			rule := BlackListRuleItem{Type: "sender", Pattern: "^" + regexp.QuoteMeta(api.UserProfile.ID) + "$",
+				Channel: AccountKey(api), Expires: &expires}
+			if entry, err := tb.AddBlacklistRule(rule); err != nil {
+				tb.logger.Printf("Could not blacklist %s: %+v\n", sender, err)
+			} else {
+				tb.logger.Printf("Sender %s blacklisted by %s detector until %s, rule %s\n", sender, name, expires.Format(time.RFC3339), entry.ID)
+			}
+		case "notify":
+			tb.notifyAdmins(api, fmt.Sprintf("Flood detector %s fired for `%s` (%s) in %s: %s",
+				name, api.UserProfile.ID, api.UserProfile.Nick, ChannelKey(api, channel), message))
 		}
 	}
+	if !status {
+		NoSpamRejected.WithLabelValues("flood").Inc()
+	}
 	return
 }
 
+// notifyAdmins - send message to admins and owners of message protocol in direct chats,
+// through account message came to
+func (tb *TorpedoBot) notifyAdmins(api *TorpedoBotAPI, message string) {
+	messenger, ok := api.Protocol.(DirectMessenger)
+	if !ok {
+		tb.logger.Printf("%s can't send direct messages, admins are not notified\n", api.ProtocolName)
+		return
+	}
+	outbound, err := tb.NewOutboundAPI(api.Protocol, api.Account)
+	if err != nil {
+		tb.logger.Printf("%s can't send messages on its own, admins are not notified: %+v\n", api.ProtocolName, err)
+		return
+	}
+	for _, admin := range tb.AdminIDs(api.ProtocolName) {
+		channel, err := messenger.DirectChannel(admin)
+		if err != nil {
+			tb.logger.Printf("Could not notify admin %s: %+v\n", UserKey(api.ProtocolName, admin), err)
+			continue
+		}
+		outbound.PostMessage(channel, message)
+	}
+}
+
+// NoSpam - blacklist and flood checks, rate limits are checked by RateLimitOk
 func (tb *TorpedoBot) NoSpam(api *TorpedoBotAPI, channel interface{}, message string) (status bool) {
 	// empty messages are ok
 	if message == "" {
 		return true
 	}
 	// blacklisted sender/message check
-	status = tb.CheckMessageBlacklistOk(api, message)
+	status = tb.CheckMessageBlacklistOk(api, channel, message)
 	if !status {
 		tb.logger.Printf("Message blacklisted: %s", message)
+		NoSpamRejected.WithLabelValues("blacklist").Inc()
 		return
 	}
-	// message rate check
-	values, ok := tb.GetChannelTSValues(channel)
-	if !ok {
-		tb.UpdateChannelTS(channel, message)
-		status = true
-	} else if val, err := strconv.ParseFloat(values[0], 64); err == nil && float64(time.Now().Unix()) > val+1 {
-		tb.UpdateChannelTS(channel, message)
-		status = true
-	} else {
-		tb.logger.Printf("Message rate exceeded for chat: %s", fmt.Sprintf("%+v", channel))
-	}
-	return
+	return tb.FloodCheckOk(api, channel, message)
 }
@@ -0,0 +1,64 @@
+package multibot
+
+import (
+	"flag"
+	"strings"
+
+	common "github.com/tb0hdan/torpedo_common"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+var CommandPrefix *string
+
+// defaultPrefixes - protocol command prefixes when not set explicitly, `!` for the rest
+var defaultPrefixes = map[string]string{
+	"telegram": "/",
+}
+
+// Prefixes - command prefixes, YAML accepts either single prefix or list
+type Prefixes []string
+
+func (p *Prefixes) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var prefix string
+	if err = unmarshal(&prefix); err == nil {
+		*p = Prefixes{prefix}
+		return
+	}
+	var prefixes []string
+	if err = unmarshal(&prefixes); err == nil {
+		*p = Prefixes(prefixes)
+	}
+	return
+}
+
+func (tb *TorpedoBot) ConfigureCommandPrefix(cfg *torpedo_registry.ConfigStruct) {
+	CommandPrefix = flag.String("prefix", "", "Comma separated list of command prefixes for accounts set on command line (default: / for Telegram, ! for others)")
+}
+
+func (tb *TorpedoBot) ParseCommandPrefix(cfg *torpedo_registry.ConfigStruct) {
+	cfg.SetConfig("prefix", *CommandPrefix)
+	if cfg.GetConfig()["prefix"] == "" {
+		cfg.SetConfig("prefix", common.GetStripEnv("TORPEDO_PREFIX"))
+	}
+}
+
+// DefaultPrefix - protocol default command prefix
+func DefaultPrefix(protocol string) string {
+	if prefix, ok := defaultPrefixes[protocol]; ok {
+		return prefix
+	}
+	return "!"
+}
+
+// CommandPrefixes - prefixes set with -prefix, protocol default otherwise
+func CommandPrefixes(protocol string) (prefixes []string) {
+	for _, prefix := range strings.Split(torpedo_registry.Config.GetConfig()["prefix"], ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{DefaultPrefix(protocol)}
+	}
+	return
+}
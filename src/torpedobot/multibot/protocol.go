@@ -0,0 +1,132 @@
+package multibot
+
+import (
+	"fmt"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// Capabilities describe what protocol is able to render
+type Capabilities struct {
+	// RichMessages - protocol has native support for RichMessage (attachments, cards, etc)
+	RichMessages bool
+	// Images - protocol can send images
+	Images bool
+	// Replies, Threads, Edits, Deletes, Reactions - Message fields protocol supports, see MessageSender
+	Replies   bool
+	Threads   bool
+	Edits     bool
+	Deletes   bool
+	Reactions bool
+	// Cards - protocol renders Message.Cards with MessageSender, cards are sent as text with numbered buttons otherwise
+	Cards bool
+}
+
+// Protocol is implemented by every chat transport (Slack, Telegram, IRC, etc)
+type Protocol interface {
+	// Connect - prepare protocol API for account, called once before Receive
+	Connect(account *torpedo_registry.Account) error
+	// Receive - run protocol event loop, blocks until connection is terminated
+	Receive() error
+	// Send - deliver message (and optional rich messages) to channel
+	Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) error
+	// Capabilities - report what this protocol can render
+	Capabilities() Capabilities
+	// Close - terminate connection and free resources
+	Close() error
+}
+
+// ChannelTyper - optional Protocol extension, reports channel type (channel, group, direct)
+type ChannelTyper interface {
+	ChannelType(channel interface{}) string
+}
+
+// ChannelParser - optional Protocol extension, converts channel name from config or command
+// (e.g. bridge channel) to channel protocol expects, names are used as is otherwise
+type ChannelParser interface {
+	ParseChannel(name string) (interface{}, error)
+}
+
+// ReadyNotifier - optional Protocol extension for protocols that are not ready when Connect returns
+// (e.g. webhook protocols wait for shared server), account is marked connected once Ready is closed
+type ReadyNotifier interface {
+	Ready() <-chan struct{}
+}
+
+// OutboundSender - optional Protocol extension for protocols which Send needs API of incoming message
+// (IRC, Teams, Facebook). OutboundAPI returns API for messages bot sends on its own (relays, scheduled jobs,
+// REST API), ErrNotSupported if protocol can only reply. Account.API is used otherwise
+type OutboundSender interface {
+	OutboundAPI() (api interface{}, err error)
+}
+
+// DirectMessenger - optional Protocol extension, direct (one to one) channel with user by user ID,
+// used for messages bot starts on its own (e.g. admin notifications). Sent through OutboundAPI
+type DirectMessenger interface {
+	DirectChannel(user_id string) (channel interface{}, err error)
+}
+
+// SenderVerifier - optional Protocol extension, protocols that can't verify sender IDs (webhooks without
+// request signatures) return false and their users never get roles above user, see UserRole
+type SenderVerifier interface {
+	VerifiedSenders() bool
+}
+
+// ProtocolFactory returns new (unconnected) protocol instance, one per account
+type ProtocolFactory func() Protocol
+
+func (tb *TorpedoBot) RegisterProtocol(name string, factory ProtocolFactory) {
+	tb.protocolsLock.Lock()
+	defer tb.protocolsLock.Unlock()
+	tb.RegisteredProtocols[name] = factory
+}
+
+func (tb *TorpedoBot) HasProtocol(name string) (ok bool) {
+	tb.protocolsLock.RLock()
+	defer tb.protocolsLock.RUnlock()
+	_, ok = tb.RegisteredProtocols[name]
+	return
+}
+
+func (tb *TorpedoBot) GetProtocol(name string) (proto Protocol, err error) {
+	tb.protocolsLock.RLock()
+	factory, ok := tb.RegisteredProtocols[name]
+	tb.protocolsLock.RUnlock()
+	if !ok {
+		err = fmt.Errorf("unknown protocol: `%s`", name)
+		return
+	}
+	proto = factory()
+	return
+}
+
+// NewBotAPI - create per-message API wrapper that routes replies back through proto
+func (tb *TorpedoBot) NewBotAPI(proto Protocol, api interface{}, account *torpedo_registry.Account) (botApi *TorpedoBotAPI) {
+	botApi = &TorpedoBotAPI{}
+	botApi.API = api
+	botApi.Protocol = proto
+	botApi.Bot = tb
+	botApi.Account = account
+	// prefix may be changed by config reload
+	tb.accountsLock.RLock()
+	if ba := tb.findAccount(account); ba != nil {
+		botApi.ProtocolName = ba.Protocol
+		botApi.AccountID = ba.ID
+	}
+	botApi.CommandPrefix = account.CommandPrefix
+	tb.accountsLock.RUnlock()
+	botApi.UserProfile = &torpedo_registry.UserProfile{}
+	return
+}
+
+// NewOutboundAPI - API wrapper for sending to account without incoming message, see OutboundSender
+func (tb *TorpedoBot) NewOutboundAPI(proto Protocol, account *torpedo_registry.Account) (botApi *TorpedoBotAPI, err error) {
+	api := account.API
+	if sender, ok := proto.(OutboundSender); ok {
+		if api, err = sender.OutboundAPI(); err != nil {
+			return
+		}
+	}
+	botApi = tb.NewBotAPI(proto, api, account)
+	return
+}
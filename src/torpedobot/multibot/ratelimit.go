@@ -0,0 +1,227 @@
+package multibot
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig - Rate tokens per Per (1s if unset), up to Burst (Rate if unset) at once. Zero rate is unlimited.
+type RateLimitConfig struct {
+	Rate  int           `yaml:"rate"`
+	Per   time.Duration `yaml:"per"`
+	Burst int           `yaml:"burst"`
+}
+
+// RateLimitsConfig - `nospam.limits` section of config file
+type RateLimitsConfig struct {
+	// User - messages per user
+	User RateLimitConfig `yaml:"user"`
+	// Channel - messages per channel, nospam.rate_limit interval if unset. Commands only are limited
+	// to one per channel per DefaultRateLimit if both are unset
+	Channel *RateLimitConfig `yaml:"channel"`
+	// Commands - invocations per command per channel
+	Commands map[string]RateLimitConfig `yaml:"commands"`
+	// Notice - tell throttled user to slow down, once per limit period
+	Notice bool `yaml:"notice"`
+	// Outbound - messages sent by bot per protocol, see DefaultOutboundLimits
+	Outbound map[string]RateLimitConfig `yaml:"outbound"`
+}
+
+// DefaultOutboundLimits - protocol API limits, override with nospam.limits.outbound
+var DefaultOutboundLimits = map[string]RateLimitConfig{
+	"slack":    {Rate: 1, Per: time.Second, Burst: 5},
+	"telegram": {Rate: 30, Per: time.Second},
+}
+
+// MaxRateLimitBuckets - idle buckets are dropped when there are more of them
+const MaxRateLimitBuckets = 10000
+
+func (limit RateLimitConfig) Validate() error {
+	if limit.Rate < 0 || limit.Per < 0 || limit.Burst < 0 {
+		return fmt.Errorf("rate limit values can't be negative: %+v", limit)
+	}
+	return nil
+}
+
+func (limit RateLimitConfig) period() time.Duration {
+	if limit.Per == 0 {
+		return time.Second
+	}
+	return limit.Per
+}
+
+// TokenBucket - rate limiter, tokens are refilled continuously
+type TokenBucket struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	updated time.Time
+}
+
+func NewTokenBucket(limit RateLimitConfig) *TokenBucket {
+	burst := limit.Burst
+	if burst == 0 {
+		burst = limit.Rate
+	}
+	return &TokenBucket{
+		rate:    float64(limit.Rate) / limit.period().Seconds(),
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		updated: time.Now(),
+	}
+}
+
+// refill - call with lock held
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+}
+
+// Allow - take token if there is one, otherwise return time until next one
+func (b *TokenBucket) Allow() (ok bool, wait time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Reserve - take token in advance, return time to wait before using it
+func (b *TokenBucket) Reserve() (wait time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(time.Now())
+	b.tokens -= 1
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	return
+}
+
+func (b *TokenBucket) idle(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// rateLimiter - buckets by key, reset on config reload
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*TokenBucket
+	notices map[string]time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*TokenBucket), notices: make(map[string]time.Time)}
+}
+
+func (rl *rateLimiter) bucket(key string, limit RateLimitConfig) *TokenBucket {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		if len(rl.buckets) >= MaxRateLimitBuckets {
+			now := time.Now()
+			for key, bucket := range rl.buckets {
+				if bucket.idle(now) {
+					delete(rl.buckets, key)
+					delete(rl.notices, key)
+				}
+			}
+		}
+		bucket = NewTokenBucket(limit)
+		rl.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// noticeDue - true once per period for key
+func (rl *rateLimiter) noticeDue(key string, period time.Duration) bool {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := time.Now()
+	if last, ok := rl.notices[key]; ok && now.Sub(last) < period {
+		return false
+	}
+	rl.notices[key] = now
+	return true
+}
+
+// rateLimits - limits with defaults applied
+func (tb *TorpedoBot) rateLimits() (limits RateLimitsConfig, limiter *rateLimiter) {
+	tb.noSpamLock.RLock()
+	defer tb.noSpamLock.RUnlock()
+	return tb.limits, tb.limiter
+}
+
+// RateLimitOk - take tokens from sender and channel buckets (command is empty) or from command bucket.
+// Throttled user gets notice if enabled.
+func (tb *TorpedoBot) RateLimitOk(api *TorpedoBotAPI, channel interface{}, command string) bool {
+	return tb.rateLimitOk(api, channel, command, false)
+}
+
+// rateLimitOk - incoming commands take channel token even if channel limit is not set, see DefaultRateLimit
+func (tb *TorpedoBot) rateLimitOk(api *TorpedoBotAPI, channel interface{}, command string, incoming_command bool) bool {
+	limits, limiter := tb.rateLimits()
+	type check struct {
+		key   string
+		limit RateLimitConfig
+	}
+	checks := make([]check, 0, 2)
+	channel_key := ChannelKey(api, channel)
+	if command == "" {
+		if api.UserProfile != nil && api.UserProfile.ID != "" {
+			checks = append(checks, check{"user:" + UserKey(api.ProtocolName, api.UserProfile.ID), limits.User})
+		}
+		switch {
+		case limits.Channel != nil:
+			checks = append(checks, check{"channel:" + channel_key, *limits.Channel})
+		case incoming_command:
+			checks = append(checks, check{"channel:" + channel_key, RateLimitConfig{Rate: 1, Per: DefaultRateLimit, Burst: 1}})
+		}
+	} else if limit, ok := limits.Commands[command]; ok {
+		checks = append(checks, check{"command:" + command + ":" + channel_key, limit})
+	}
+	for _, check := range checks {
+		if check.limit.Rate == 0 {
+			continue
+		}
+		ok, wait := limiter.bucket(check.key, check.limit).Allow()
+		if ok {
+			continue
+		}
+		tb.logger.Printf("Rate limit exceeded: %s\n", check.key)
+		NoSpamRejected.WithLabelValues("ratelimit").Inc()
+		if limits.Notice && limiter.noticeDue(check.key, check.limit.period()) {
+			api.PostMessage(channel, fmt.Sprintf("Slow down, try again in %s", time.Duration(math.Ceil(wait.Seconds()))*time.Second))
+		}
+		return false
+	}
+	return true
+}
+
+// waitOutbound - delay message to stay within protocol send rate limit
+func (tb *TorpedoBot) waitOutbound(protocol string) {
+	limits, limiter := tb.rateLimits()
+	limit, ok := limits.Outbound[protocol]
+	if !ok || limit.Rate == 0 {
+		return
+	}
+	wait := limiter.bucket("outbound:"+protocol, limit).Reserve()
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-tb.ctx.Done():
+	}
+}
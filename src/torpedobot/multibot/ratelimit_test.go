@@ -0,0 +1,109 @@
+package multibot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := multibot.NewTokenBucket(multibot.RateLimitConfig{Rate: 2, Per: 100 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		if ok, _ := bucket.Allow(); !ok {
+			t.Fatalf("token #%d was not allowed", i)
+		}
+	}
+	ok, wait := bucket.Allow()
+	if ok || wait <= 0 || wait > 50*time.Millisecond {
+		t.Fatalf("empty bucket: got %v, %s", ok, wait)
+	}
+	time.Sleep(wait + 5*time.Millisecond)
+	if ok, _ = bucket.Allow(); !ok {
+		t.Errorf("token was not refilled")
+	}
+	if wait = bucket.Reserve(); wait <= 0 {
+		t.Errorf("reserve from empty bucket: got %s", wait)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	bot := multibot.New()
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "torpedobot.yaml")
+	config := `
+nospam:
+  limits:
+    notice: true
+    user:
+      rate: 1
+      per: 1h
+    channel:
+      rate: 0
+    commands:
+      picture:
+        rate: 1
+        per: 1h
+`
+	if err = ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	torpedo_registry.Config.SetConfig("configfile", path)
+	defer torpedo_registry.Config.SetConfig("configfile", "")
+	if err = bot.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ioutil.WriteFile(path, []byte("accounts: []\n"), 0600)
+		bot.ReloadConfig()
+	}()
+
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	users := make(map[string]*torpedo_registry.UserProfile)
+	for _, id := range []string{"U1", "U2", "U3", "U4"} {
+		users[id] = &torpedo_registry.UserProfile{ID: id, Nick: id}
+	}
+	cases := []struct {
+		user    string
+		channel string
+		message string
+		text    string
+	}{
+		{"U1", "limits-1", "!echo one", "U1 said: !echo one"},
+		{"U1", "limits-1", "!echo two", "Slow down, try again in 1h0m0s"},
+		// notice is sent once per period
+		{"U1", "limits-2", "!echo three", ""},
+		// one user doesn't block channel
+		{"U2", "limits-1", "!echo four", "U2 said: !echo four"},
+		{"U3", "limits-3", "!picture", "cat"},
+		{"U4", "limits-3", "!picture", "Slow down, try again in 1h0m0s"},
+	}
+	for _, tc := range cases {
+		lp.Inject(users[tc.user], tc.channel, tc.message)
+		timeout := replyTimeout
+		if tc.text == "" {
+			timeout = 100 * time.Millisecond
+		}
+		reply := lp.WaitReply(timeout)
+		text := ""
+		if reply != nil {
+			text = reply.Text
+			if len(reply.RichMessages) > 0 {
+				text = reply.RichMessages[0].Text
+			}
+		}
+		if text != tc.text {
+			t.Errorf("%s `%s`: got `%s`, expected `%s`", tc.user, tc.message, text, tc.text)
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package multibot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+var (
+	// SchedulerInterval - due jobs are checked this often
+	SchedulerInterval = time.Second
+	// SchedulerRetry - job is postponed by this interval if its account is not connected or sending failed
+	SchedulerRetry = time.Minute
+	// MinUserJobInterval - cron jobs of non-admins can't run more often
+	MinUserJobInterval = 5 * time.Minute
+)
+
+const (
+	// MaxUserJobs - scheduled jobs per user, admins are not limited
+	MaxUserJobs = 10
+	// MaxJobRetries - failed sends retried before one-shot job is dropped (cron job waits for next run)
+	MaxJobRetries = 10
+)
+
+// errNoAccount - job account is not connected, job is retried without counting retries
+var errNoAccount = errors.New("no connected account")
+
+// ScheduledJob - message posted (or command run) in channel at set time or by cron schedule
+type ScheduledJob struct {
+	ID string `json:"id"`
+	// Cron - standard cron expression (`0 9 * * 1-5`) or descriptor (`@daily`, `@every 1h`), empty for one-shot jobs
+	Cron string `json:"cron,omitempty"`
+	// Next - next run, unix time
+	Next     int64  `json:"next"`
+	Protocol string `json:"protocol"`
+	// Account - account ID job was created on, first connected account of protocol is used if it's gone
+	Account int    `json:"account"`
+	Channel string `json:"channel"`
+	// Owner, Nick - user who created job, commands run with their role
+	Owner   string `json:"owner"`
+	Nick    string `json:"nick"`
+	Message string `json:"message"`
+	// Command - message is command to run, without prefix
+	Command bool  `json:"command,omitempty"`
+	Created int64 `json:"created"`
+	// Retries - failed sends since last successful run
+	Retries int `json:"retries,omitempty"`
+}
+
+// scheduleNext - next cron run after time
+func (job *ScheduledJob) scheduleNext(after time.Time) (err error) {
+	schedule, err := cron.ParseStandard(job.Cron)
+	if err != nil {
+		return fmt.Errorf("Invalid schedule `%s`: %+v", job.Cron, err)
+	}
+	next := schedule.Next(after)
+	if next.IsZero() {
+		return fmt.Errorf("Schedule `%s` never runs", job.Cron)
+	}
+	job.Next = next.Unix()
+	return
+}
+
+// checkInterval - gaps between next runs of cron job are at least interval
+func (job *ScheduledJob) checkInterval(interval time.Duration, now time.Time) (err error) {
+	schedule, err := cron.ParseStandard(job.Cron)
+	if err != nil {
+		return fmt.Errorf("Invalid schedule `%s`: %+v", job.Cron, err)
+	}
+	// gaps vary for expressions like `*/10 9 * * *`, few runs are checked
+	prev := schedule.Next(now)
+	for idx := 0; idx < 10 && !prev.IsZero(); idx++ {
+		next := schedule.Next(prev)
+		if !next.IsZero() && next.Sub(prev) < interval {
+			return fmt.Errorf("Schedule `%s` runs more often than every %s", job.Cron, interval)
+		}
+		prev = next
+	}
+	return
+}
+
+func newJobID() string {
+	id := make([]byte, 4)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// scheduledJobs - jobs by ID, (re)loaded from storage when it changes. Call with jobsLock held
+func (tb *TorpedoBot) scheduledJobs() map[string]*ScheduledJob {
+	if tb.jobs != nil && tb.jobsStore == tb.Store {
+		return tb.jobs
+	}
+	tb.jobs = make(map[string]*ScheduledJob)
+	tb.jobsStore = tb.Store
+	if tb.Store == nil {
+		return tb.jobs
+	}
+	stored, err := tb.Store.GetJobs()
+	if err != nil {
+		tb.logger.Printf("Could not get scheduled jobs: %+v\n", err)
+	}
+	for _, job := range stored {
+		tb.jobs[job.ID] = job
+	}
+	return tb.jobs
+}
+
+// AddJob - schedule job, ID and next run of cron jobs are set here
+func (tb *TorpedoBot) AddJob(job *ScheduledJob) (err error) {
+	now := time.Now()
+	if job.Cron != "" {
+		if err = job.scheduleNext(now); err != nil {
+			return
+		}
+	}
+	if job.Next == 0 {
+		return fmt.Errorf("Job needs time or schedule")
+	}
+	job.ID, job.Created = newJobID(), now.Unix()
+	tb.jobsLock.Lock()
+	defer tb.jobsLock.Unlock()
+	jobs := tb.scheduledJobs()
+	if tb.Store != nil {
+		if err = tb.Store.SaveJob(job); err != nil {
+			return
+		}
+	}
+	jobs[job.ID] = job
+	return
+}
+
+// GetJobs - scheduled jobs, soonest first
+func (tb *TorpedoBot) GetJobs() (jobs []ScheduledJob) {
+	tb.jobsLock.Lock()
+	defer tb.jobsLock.Unlock()
+	for _, job := range tb.scheduledJobs() {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].Next != jobs[j].Next {
+			return jobs[i].Next < jobs[j].Next
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return
+}
+
+func (tb *TorpedoBot) CancelJob(id string) (err error) {
+	tb.jobsLock.Lock()
+	defer tb.jobsLock.Unlock()
+	jobs := tb.scheduledJobs()
+	if _, ok := jobs[id]; !ok {
+		return fmt.Errorf("No such job: `%s`", id)
+	}
+	if tb.Store != nil {
+		if err = tb.Store.RemoveJob(id); err != nil {
+			return
+		}
+	}
+	delete(jobs, id)
+	return
+}
+
+// fireJob - post job message or run its command, errNoAccount if account is not connected.
+// Command jobs fail if command is denied, throttled or unknown, replies are sent by command handler
+// and their errors are not reported
+func (tb *TorpedoBot) fireJob(job ScheduledJob) (err error) {
+	proto, account := tb.connectedAccount(job.Protocol, job.Account)
+	if proto == nil {
+		return errNoAccount
+	}
+	// protocols expect channel type they produce themselves
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not send to %s: %v", job.Channel, r)
+		}
+	}()
+	channel, err := protocolChannel(proto, job.Channel)
+	if err != nil {
+		return
+	}
+	botApi, err := tb.NewOutboundAPI(proto, account)
+	if err != nil {
+		return
+	}
+	botApi.UserProfile = &torpedo_registry.UserProfile{ID: job.Owner, Nick: job.Nick}
+	if job.Command {
+		botApi.Event = botApi.NewEvent(channel, botApi.CommandPrefix+job.Message)
+		return tb.processCommandMessage(botApi, channel, botApi.CommandPrefix+job.Message)
+	}
+	_, err = botApi.Send(&Message{Channel: channel, Text: job.Message})
+	return
+}
+
+// RunDueJobs - fire jobs due at time, cron jobs are rescheduled, one-shot ones removed.
+// Failed jobs are retried in SchedulerRetry up to MaxJobRetries times
+func (tb *TorpedoBot) RunDueJobs(now time.Time) {
+	due := make([]ScheduledJob, 0)
+	tb.jobsLock.Lock()
+	for _, job := range tb.scheduledJobs() {
+		if job.Next <= now.Unix() {
+			due = append(due, *job)
+		}
+	}
+	tb.jobsLock.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].Next < due[j].Next })
+	for _, job := range due {
+		if !tb.beginEvent() {
+			return
+		}
+		fire_err := tb.fireJob(job)
+		tb.endEvent()
+		tb.jobsLock.Lock()
+		jobs := tb.scheduledJobs()
+		current, ok := jobs[job.ID]
+		if !ok {
+			// cancelled meanwhile
+			tb.jobsLock.Unlock()
+			continue
+		}
+		var err error
+		switch {
+		case fire_err == errNoAccount:
+			tb.logger.Printf("Job %s: no connected %s account, retrying in %s\n", job.ID, job.Protocol, SchedulerRetry)
+			current.Next = now.Add(SchedulerRetry).Unix()
+		case fire_err != nil && current.Retries+1 < MaxJobRetries:
+			current.Retries += 1
+			tb.logger.Printf("Job %s failed (%d of %d), retrying in %s: %+v\n", job.ID, current.Retries, MaxJobRetries, SchedulerRetry, fire_err)
+			current.Next = now.Add(SchedulerRetry).Unix()
+		case current.Cron != "":
+			if fire_err != nil {
+				tb.logger.Printf("Job %s failed %d times, waiting for next run: %+v\n", job.ID, MaxJobRetries, fire_err)
+			}
+			current.Retries = 0
+			err = current.scheduleNext(now)
+		default:
+			if fire_err != nil {
+				tb.logger.Printf("Job %s failed %d times, dropping it: %+v\n", job.ID, MaxJobRetries, fire_err)
+			}
+			if tb.Store != nil {
+				err = tb.Store.RemoveJob(job.ID)
+			}
+			delete(jobs, job.ID)
+		}
+		if _, ok = jobs[job.ID]; ok && err == nil && tb.Store != nil {
+			err = tb.Store.SaveJob(current)
+		}
+		tb.jobsLock.Unlock()
+		if err != nil {
+			tb.logger.Printf("Could not update job %s: %+v\n", job.ID, err)
+		}
+	}
+}
+
+func (tb *TorpedoBot) runScheduler() {
+	ticker := time.NewTicker(SchedulerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			tb.RunDueJobs(now)
+		case <-tb.ctx.Done():
+			return
+		}
+	}
+}
+
+// parseRemindTime - `15:04` (today or tomorrow), `2006-01-02 15:04` or RFC3339, bot's local time
+func parseRemindTime(value string, now time.Time) (at time.Time, err error) {
+	if at, err = time.ParseInLocation("15:04", value, now.Location()); err == nil {
+		at = time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", time.RFC3339} {
+		if at, err = time.ParseInLocation(layout, value, now.Location()); err == nil {
+			return
+		}
+	}
+	err = fmt.Errorf("Invalid time `%s`, use e.g. `15:04` or `2006-01-02 15:04`", value)
+	return
+}
+
+func formatJob(job ScheduledJob, prefix string) string {
+	when := "once"
+	if job.Cron != "" {
+		when = fmt.Sprintf("`%s`", job.Cron)
+	}
+	message := job.Message
+	if job.Command {
+		message = fmt.Sprintf("`%s%s`", prefix, job.Message)
+	}
+	return fmt.Sprintf("`%s` %s, next %s, by %s: %s", job.ID, when,
+		time.Unix(job.Next, 0).Format("2006-01-02 15:04 MST"), job.Nick, message)
+}
+
+// jobOwner - user may manage job: created it or is admin
+func (tb *TorpedoBot) jobOwner(api *TorpedoBotAPI, job ScheduledJob) bool {
+	if tb.IsAdmin(api) {
+		return true
+	}
+	return api.UserProfile != nil && job.Protocol == api.ProtocolName && job.Owner == api.UserProfile.ID
+}
+
+// addUserJob - AddJob for commands, cron jobs of non-admins can't run more often than MinUserJobInterval
+func (tb *TorpedoBot) addUserJob(api *TorpedoBotAPI, job *ScheduledJob) (err error) {
+	if job.Cron != "" && !tb.IsAdmin(api) {
+		if err = job.checkInterval(MinUserJobInterval, time.Now()); err != nil {
+			return
+		}
+	}
+	return tb.AddJob(job)
+}
+
+// newJob - job in channel, owned by message sender, limited to MaxUserJobs for non-admins
+func (tb *TorpedoBot) newJob(api *TorpedoBotAPI, channel interface{}) (job *ScheduledJob, err error) {
+	if api.UserProfile == nil || api.UserProfile.ID == "" {
+		err = fmt.Errorf("Unknown user")
+		return
+	}
+	job = &ScheduledJob{
+		Protocol: api.ProtocolName,
+		Account:  api.AccountID,
+		Channel:  fmt.Sprintf("%v", channel),
+		Owner:    api.UserProfile.ID,
+		Nick:     api.UserProfile.Nick,
+	}
+	if job.Nick == "" {
+		job.Nick = job.Owner
+	}
+	if tb.IsAdmin(api) {
+		return
+	}
+	owned := 0
+	for _, other := range tb.GetJobs() {
+		if other.Protocol == job.Protocol && other.Owner == job.Owner {
+			owned += 1
+		}
+	}
+	if owned >= MaxUserJobs {
+		err = fmt.Errorf("You have %d jobs already, cancel some first", owned)
+	}
+	return
+}
+
+// SchedulerCommands - `remind` and `schedule` commands
+func (tb *TorpedoBot) SchedulerCommands() []*Command {
+	reply := func(handler func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (string, error)) CommandHandler {
+		return func(botapi *torpedo_registry.BotAPI, channel interface{}, cmd *ParsedCommand) {
+			api := botapi.API.(*TorpedoBotAPI)
+			message, err := handler(api, channel, cmd)
+			if err != nil {
+				message = err.Error()
+			}
+			api.PostMessage(channel, message)
+		}
+	}
+	return []*Command{
+		{
+			Name: "remind",
+			Help: "Reminder in this channel, e.g. `remind me in 2h stand up`, `remind here at 15:30 call` or `remind here every \"0 9 * * 1-5\" standup`",
+			Args: []ArgSpec{
+				{Name: "who", Help: "`me` mentions you, `here` doesn't", Type: ArgEnum, Choices: []string{"me", "here"}, Required: true},
+				{Name: "when", Help: "In duration, at time or every cron schedule", Type: ArgEnum, Choices: []string{"in", "at", "every"}, Required: true},
+				{Name: "time", Help: "Duration (`2h`), time (`15:04`, `\"2006-01-02 15:04\"`) or schedule (`@daily`, `\"0 9 * * 1-5\"`)", Required: true},
+				{Name: "text", Help: "Reminder text", Required: true, Rest: true},
+			},
+			Handler: reply(func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (message string, err error) {
+				job, err := tb.newJob(api, channel)
+				if err != nil {
+					return
+				}
+				job.Message = cmd.String("text")
+				if cmd.String("who") == "me" {
+					job.Message = fmt.Sprintf("%s, reminder: %s", job.Nick, job.Message)
+				}
+				now := time.Now()
+				value := cmd.String("time")
+				switch cmd.String("when") {
+				case "in":
+					delay, derr := time.ParseDuration(value)
+					if derr != nil || delay <= 0 {
+						err = fmt.Errorf("Invalid duration `%s`, use e.g. `30m` or `2h`", value)
+						return
+					}
+					job.Next = now.Add(delay).Unix()
+				case "at":
+					at, terr := parseRemindTime(value, now)
+					if terr != nil {
+						err = terr
+						return
+					}
+					if !at.After(now) {
+						err = fmt.Errorf("`%s` is in the past", value)
+						return
+					}
+					job.Next = at.Unix()
+				case "every":
+					// `every 1h` is `@every 1h`
+					if _, derr := time.ParseDuration(value); derr == nil {
+						value = "@every " + value
+					}
+					job.Cron = value
+				}
+				if err = tb.addUserJob(api, job); err != nil {
+					return
+				}
+				message = fmt.Sprintf("Reminder `%s` set for %s", job.ID, time.Unix(job.Next, 0).Format("2006-01-02 15:04 MST"))
+				return
+			}),
+		},
+		{
+			Name: "schedule",
+			Help: "Scheduled messages and commands",
+			Subcommands: []*Command{
+				{
+					Name: "add",
+					Help: "Post message by cron schedule, e.g. `schedule add \"0 9 * * 1-5\" Good morning` or `schedule add --command @daily xkcd`",
+					Args: []ArgSpec{
+						{Name: "schedule", Help: "Cron expression or `@hourly`, `@daily`, `@every 30m`", Required: true},
+						{Name: "message", Help: "Message, command without prefix with `--command`", Required: true, Rest: true},
+					},
+					Flags: []ArgSpec{
+						{Name: "command", Short: "c", Help: "Run message as command", Type: ArgBool},
+					},
+					Handler: reply(func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (message string, err error) {
+						job, err := tb.newJob(api, channel)
+						if err != nil {
+							return
+						}
+						job.Cron, job.Message, job.Command = cmd.String("schedule"), cmd.String("message"), cmd.Bool("command")
+						if job.Command {
+							job.Message = strings.TrimPrefix(job.Message, api.CommandPrefix)
+						}
+						if err = tb.addUserJob(api, job); err != nil {
+							return
+						}
+						message = fmt.Sprintf("Job `%s` scheduled, next run %s", job.ID, time.Unix(job.Next, 0).Format("2006-01-02 15:04 MST"))
+						return
+					}),
+				},
+				{
+					Name: "list",
+					Help: "List jobs of this channel",
+					Flags: []ArgSpec{
+						{Name: "all", Help: "Jobs of all channels, admins only", Type: ArgBool},
+					},
+					Handler: reply(func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (message string, err error) {
+						if cmd.Bool("all") && !tb.IsAdmin(api) {
+							err = fmt.Errorf("Only admins can list all jobs")
+							return
+						}
+						lines := make([]string, 0)
+						for _, job := range tb.GetJobs() {
+							if cmd.Bool("all") {
+								lines = append(lines, fmt.Sprintf("%s:%s %s", job.Protocol, job.Channel, formatJob(job, api.CommandPrefix)))
+							} else if job.Protocol == api.ProtocolName && job.Channel == fmt.Sprintf("%v", channel) {
+								lines = append(lines, formatJob(job, api.CommandPrefix))
+							}
+						}
+						message = "No scheduled jobs"
+						if len(lines) > 0 {
+							message = "Scheduled jobs:\n" + strings.Join(lines, "\n")
+						}
+						return
+					}),
+				},
+				{
+					Name: "cancel",
+					Help: "Cancel job, admins may cancel any job",
+					Args: []ArgSpec{{Name: "id", Help: "Job ID, see `schedule list`", Required: true}},
+					Handler: reply(func(api *TorpedoBotAPI, channel interface{}, cmd *ParsedCommand) (message string, err error) {
+						id := cmd.String("id")
+						for _, job := range tb.GetJobs() {
+							if job.ID == id && !tb.jobOwner(api, job) {
+								err = fmt.Errorf("Job `%s` is not yours", id)
+								return
+							}
+						}
+						if err = tb.CancelJob(id); err != nil {
+							return
+						}
+						message = fmt.Sprintf("Job `%s` cancelled", id)
+						return
+					}),
+				},
+			},
+		},
+	}
+}
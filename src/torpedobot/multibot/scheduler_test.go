@@ -0,0 +1,168 @@
+package multibot_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// failingProtocol - strictProtocol which can't send anything
+type failingProtocol struct {
+	strictProtocol
+}
+
+func (fp *failingProtocol) Send(channel interface{}, message string, tba *multibot.TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) error {
+	return errors.New("send failed")
+}
+
+func TestScheduler(t *testing.T) {
+	bot := multibot.New()
+	torpedo_registry.Config.RegisterHelpAndHandler("echo", "Echo message back", EchoProcessMessage)
+	for _, command := range bot.SchedulerCommands() {
+		multibot.RegisterCommand(command)
+	}
+	dir, err := ioutil.TempDir("", "torpedobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+	store, err := multibot.NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bot is shared by tests
+	bot.Store = store
+	defer func() {
+		bot.Store.Close()
+		bot.Store = nil
+	}()
+
+	lp := bot.StartLoopback("!")
+	defer lp.Close()
+	alice := &torpedo_registry.UserProfile{ID: "U31", Nick: "alice"}
+	bob := &torpedo_registry.UserProfile{ID: "U32", Nick: "bob"}
+
+	lp.Inject(alice, "schedule-a", "!remind me in 2h stand up")
+	if reply := lp.WaitReply(replyTimeout); reply == nil || !strings.HasPrefix(reply.Text, "Reminder `") {
+		t.Fatalf("unexpected remind reply: %+v", reply)
+	}
+	time.Sleep(multibot.DefaultRateLimit)
+	lp.Inject(alice, "schedule-a", "!schedule add --command \"@every 1h\" echo tick")
+	if reply := lp.WaitReply(replyTimeout); reply == nil || !strings.HasPrefix(reply.Text, "Job `") {
+		t.Fatalf("unexpected schedule reply: %+v", reply)
+	}
+	time.Sleep(multibot.DefaultRateLimit)
+	lp.Inject(alice, "schedule-a", "!remind me at 25:99 never")
+	if reply := lp.WaitReply(replyTimeout); reply == nil || !strings.HasPrefix(reply.Text, "Invalid time") {
+		t.Errorf("unexpected reply to bad time: %+v", reply)
+	}
+	// non-admins can't schedule frequent jobs
+	for _, command := range []string{"!schedule add \"@every 1m\" spam", "!remind here every \"*/2 * * * *\" spam"} {
+		time.Sleep(multibot.DefaultRateLimit)
+		lp.Inject(bob, "schedule-a", command)
+		if reply := lp.WaitReply(replyTimeout); reply == nil || !strings.Contains(reply.Text, "runs more often than every 5m") {
+			t.Errorf("`%s`: unexpected reply %+v", command, reply)
+		}
+	}
+	jobs := bot.GetJobs()
+	if len(jobs) != 2 || jobs[0].Cron != "@every 1h" || !jobs[0].Command || jobs[1].Message != "alice, reminder: stand up" {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+
+	later := time.Now().Add(3 * time.Hour)
+	bot.RunDueJobs(later)
+	replies := make([]string, 0)
+	for reply := lp.WaitReply(replyTimeout); reply != nil; reply = lp.WaitReply(200 * time.Millisecond) {
+		if reply.Channel != "schedule-a" {
+			t.Errorf("reply in wrong channel: %+v", reply)
+		}
+		replies = append(replies, reply.Text)
+	}
+	if strings.Join(replies, "|") != "alice said: !echo tick|alice, reminder: stand up" {
+		t.Errorf("unexpected job messages: %+v", replies)
+	}
+	// one-shot job is removed, recurring one rescheduled
+	jobs = bot.GetJobs()
+	if len(jobs) != 1 || jobs[0].Next != later.Add(time.Hour).Unix() {
+		t.Fatalf("unexpected jobs after run: %+v", jobs)
+	}
+
+	// jobs survive restart
+	store.Close()
+	if bot.Store, err = multibot.NewBoltStore(path); err != nil {
+		t.Fatal(err)
+	}
+	if restored := bot.GetJobs(); len(restored) != 1 || restored[0].ID != jobs[0].ID {
+		t.Errorf("unexpected jobs after reopen: %+v", restored)
+	}
+
+	time.Sleep(multibot.DefaultRateLimit)
+	lp.Inject(bob, "schedule-a", "!schedule cancel "+jobs[0].ID)
+	if reply := lp.WaitReply(replyTimeout); reply == nil || !strings.Contains(reply.Text, "not yours") {
+		t.Errorf("other user cancelled job: %+v", reply)
+	}
+	time.Sleep(multibot.DefaultRateLimit)
+	lp.Inject(alice, "schedule-a", "!schedule cancel "+jobs[0].ID)
+	if reply := lp.WaitReply(replyTimeout); reply == nil || !strings.HasSuffix(reply.Text, "cancelled") {
+		t.Errorf("unexpected cancel reply: %+v", reply)
+	}
+	if jobs = bot.GetJobs(); len(jobs) != 0 {
+		t.Errorf("jobs left: %+v", jobs)
+	}
+}
+
+func TestSchedulerRetry(t *testing.T) {
+	bot := multibot.New()
+	bot.RegisterProtocol("failing", func() multibot.Protocol {
+		return &failingProtocol{strictProtocol{done: make(chan struct{})}}
+	})
+	account := &torpedo_registry.Account{APIKey: "failing", CommandPrefix: "!"}
+	ba := bot.AddAccount("failing", account)
+	defer stopStrict(bot, ba)
+	bot.StartAccount("failing", account)
+	deadline := time.Now().Add(replyTimeout)
+	for testutil.ToFloat64(multibot.AccountsConnected.WithLabelValues("failing")) < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	now := time.Now()
+	job := &multibot.ScheduledJob{Protocol: "failing", Account: ba.ID, Channel: "ops", Owner: "U33", Message: "deploy", Next: now.Unix()}
+	if err := bot.AddJob(job); err != nil {
+		t.Fatal(err)
+	}
+	defer bot.CancelJob(job.ID)
+	// one-shot job is kept until it fails MaxJobRetries times
+	for retry := 1; retry < multibot.MaxJobRetries; retry++ {
+		bot.RunDueJobs(now)
+		jobs := bot.GetJobs()
+		if len(jobs) != 1 || jobs[0].Retries != retry || jobs[0].Next != now.Add(multibot.SchedulerRetry).Unix() {
+			t.Fatalf("retry %d: unexpected jobs %+v", retry, jobs)
+		}
+		now = now.Add(multibot.SchedulerRetry)
+	}
+	bot.RunDueJobs(now)
+	if jobs := bot.GetJobs(); len(jobs) != 0 {
+		t.Errorf("failed job was not dropped: %+v", jobs)
+	}
+	// command job fails if command can't be run
+	command := &multibot.ScheduledJob{Protocol: "failing", Account: ba.ID, Channel: "ops", Owner: "U33", Message: "nosuchcommand",
+		Command: true, Next: now.Unix()}
+	if err := bot.AddJob(command); err != nil {
+		t.Fatal(err)
+	}
+	defer bot.CancelJob(command.ID)
+	bot.RunDueJobs(now)
+	if jobs := bot.GetJobs(); len(jobs) != 1 || jobs[0].Retries != 1 {
+		t.Errorf("failed command job was not retried: %+v", jobs)
+	}
+}
@@ -0,0 +1,138 @@
+package multibot
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+var (
+	ShutdownTimeout *int
+
+	cleanupHooks     = make(map[string]func())
+	cleanupHooksLock sync.Mutex
+)
+
+// RegisterCleanupHook - register function that will be called on bot shutdown,
+// after all accounts are disconnected and in-flight handlers are finished
+func RegisterCleanupHook(name string, hook func()) {
+	cleanupHooksLock.Lock()
+	defer cleanupHooksLock.Unlock()
+	cleanupHooks[name] = hook
+}
+
+func (tb *TorpedoBot) ConfigureShutdown(cfg *torpedo_registry.ConfigStruct) {
+	ShutdownTimeout = flag.Int("shutdown_timeout", 10, "Seconds to wait for in-flight handlers on shutdown")
+}
+
+func (tb *TorpedoBot) ParseShutdown(cfg *torpedo_registry.ConfigStruct) {
+	tb.shutdownTimeout = time.Duration(*ShutdownTimeout) * time.Second
+}
+
+// Context - bot context, cancelled when shutdown starts
+func (tb *TorpedoBot) Context() context.Context {
+	return tb.ctx
+}
+
+func (tb *TorpedoBot) IsShuttingDown() bool {
+	tb.shutdownLock.RLock()
+	defer tb.shutdownLock.RUnlock()
+	return tb.shuttingDown
+}
+
+// beginEvent - register in-flight event, returns false if bot is shutting down
+func (tb *TorpedoBot) beginEvent() bool {
+	tb.shutdownLock.RLock()
+	defer tb.shutdownLock.RUnlock()
+	if tb.shuttingDown {
+		return false
+	}
+	tb.inflight.Add(1)
+	return true
+}
+
+// beginAccount - register account runner, returns false if bot is shutting down
+func (tb *TorpedoBot) beginAccount() bool {
+	tb.shutdownLock.RLock()
+	defer tb.shutdownLock.RUnlock()
+	if tb.shuttingDown {
+		return false
+	}
+	tb.accounts.Add(1)
+	return true
+}
+
+func (tb *TorpedoBot) endEvent() {
+	tb.inflight.Done()
+}
+
+// shutdownContext - context for webhook and HTTP API server shutdown, expires after shutdown timeout
+func (tb *TorpedoBot) shutdownContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), tb.shutdownTimeout)
+}
+
+// waitTimeout - wait for group, false on timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Shutdown - stop accepting events, disconnect accounts, wait for in-flight handlers
+// and run cleanup hooks. Safe to call more than once.
+func (tb *TorpedoBot) Shutdown() {
+	tb.shutdown(0)
+}
+
+// shutdown - first call sets exit code returned by RunLoop
+func (tb *TorpedoBot) shutdown(exit_code int) {
+	tb.shutdownLock.Lock()
+	if tb.shuttingDown {
+		tb.shutdownLock.Unlock()
+		<-tb.shutdownDone
+		return
+	}
+	tb.shuttingDown = true
+	tb.exitCode = exit_code
+	tb.shutdownLock.Unlock()
+
+	tb.logger.Printf("Shutting down, waiting up to %v...\n", tb.shutdownTimeout)
+	// every account runner watches this context and closes its protocol
+	tb.cancel()
+	if !waitTimeout(&tb.accounts, tb.shutdownTimeout) {
+		tb.logger.Printf("Some accounts did not disconnect in time\n")
+	}
+	// accounts removed their routes, let pending webhook requests finish
+	tb.stopWebhookServers()
+	tb.stopHTTPAPI()
+	if !waitTimeout(&tb.inflight, tb.shutdownTimeout) {
+		tb.logger.Printf("Some handlers did not finish in time\n")
+	}
+	// handlers are finished, nothing writes to storage anymore
+	tb.closeStore()
+	tb.Cleanup()
+	close(tb.shutdownDone)
+}
+
+func (tb *TorpedoBot) Cleanup() {
+	tb.logger.Printf("Running cleanup...")
+	cleanupHooksLock.Lock()
+	defer cleanupHooksLock.Unlock()
+	for name, hook := range cleanupHooks {
+		if torpedo_registry.Config.GetConfig()["debug"] == "yes" {
+			tb.logger.Printf("Running cleanup hook: %s\n", name)
+		}
+		hook()
+	}
+}
@@ -0,0 +1,66 @@
+package multibot_test
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func TestShutdown(t *testing.T) {
+	if !runIsolated(t) {
+		return
+	}
+	bot := multibot.New()
+	timeout := 1
+	multibot.ShutdownTimeout = &timeout
+	bot.ParseShutdown(torpedo_registry.Config)
+
+	var quick_done, cleaned int32
+	started := make(chan struct{}, 2)
+	torpedo_registry.Config.RegisterHelpAndHandler("quick", "Finishes during shutdown", func(api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+		started <- struct{}{}
+		time.Sleep(300 * time.Millisecond)
+		atomic.StoreInt32(&quick_done, 1)
+	})
+	torpedo_registry.Config.RegisterHelpAndHandler("stuck", "Outlives shutdown timeout", func(api *torpedo_registry.BotAPI, channel interface{}, incoming_message string) {
+		started <- struct{}{}
+		time.Sleep(time.Minute)
+	})
+	multibot.RegisterCleanupHook("shutdown-test", func() {
+		// in-flight handlers that finished in time ran before cleanup
+		atomic.StoreInt32(&cleaned, 1+atomic.LoadInt32(&quick_done))
+	})
+	lp := bot.StartLoopback("!")
+	user := &torpedo_registry.UserProfile{ID: "U81", Nick: "alice"}
+	go lp.Inject(user, "shutdown-a", "!quick")
+	go lp.Inject(user, "shutdown-b", "!stuck")
+	<-started
+	<-started
+
+	begin := time.Now()
+	process, _ := os.FindProcess(os.Getpid())
+	process.Signal(syscall.SIGTERM)
+	exit_code := bot.RunLoop()
+	elapsed := time.Since(begin)
+	if exit_code != 128+int(syscall.SIGTERM) {
+		t.Errorf("unexpected exit code: %d", exit_code)
+	}
+	// stuck handler is given up on after shutdown timeout
+	if elapsed < time.Second || elapsed > 3*time.Second {
+		t.Errorf("shutdown took %v with 1s timeout", elapsed)
+	}
+	if atomic.LoadInt32(&cleaned) != 2 {
+		t.Errorf("cleanup hook did not run after handlers: %d", atomic.LoadInt32(&cleaned))
+	}
+	// no events are accepted after shutdown
+	lp.Inject(user, "shutdown-c", "!echo late")
+	if reply := lp.WaitReply(200 * time.Millisecond); reply != nil {
+		t.Errorf("unexpected reply after shutdown: %+v", reply)
+	}
+}
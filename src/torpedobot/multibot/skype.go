@@ -11,6 +11,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -37,7 +38,8 @@ type SkypeIncomingMessage struct {
 		Name string `json:"name"`
 	} `json:"from"`
 	Conversation struct {
-		ID string `json:"id"`
+		ID      string `json:"id"`
+		IsGroup bool   `json:"isGroup"`
 	} `json:"conversation"`
 	Recipient struct {
 		ID   string `json:"id"`
@@ -52,15 +54,105 @@ type SkypeIncomingMessage struct {
 	ChannelData struct {
 		Text string `json:"text"`
 	} `json:"channelData"`
+	Attachments []*SkypeAttachment `json:"attachments"`
+	// Value - messageBack card button value
+	Value struct {
+		Callback string `json:"torpedobot_callback"`
+	} `json:"value"`
+}
+
+// SkypeAttachmentHosts - bot token is sent with attachment downloads from these hosts only, over https.
+// Ones starting with dot match subdomains
+var SkypeAttachmentHosts = []string{".skype.com", ".botframework.com", "smba.trafficmanager.net"}
+
+// teamsFileDownloadInfo - content type of file uploaded to Teams chat, content has downloadUrl
+const teamsFileDownloadInfo = "application/vnd.microsoft.teams.file.download.info"
+
+var botFrameworkMention = regexp.MustCompile(`<at[^>]*>([^<]*)</at>`)
+
+// NormalizedText - message text with bot mention (`<at>Name</at>` or `@Name`) stripped, sets botApi Mentioned and Direct
+func (message *SkypeIncomingMessage) NormalizedText(botApi *TorpedoBotAPI) (text string) {
+	text = botFrameworkMention.ReplaceAllString(message.Text, "@$1")
+	text = strings.Replace(text, "&nbsp;", " ", -1)
+	text, botApi.Mentioned = StripMention(text, message.Recipient.Name, botApi.Me)
+	botApi.Direct = !message.Conversation.IsGroup
+	return
+}
+
+// EventAttachments - incoming files and images, downloaded from ContentURL with bearer token from token source
+// if it's set and URL is on SkypeAttachmentHosts. Teams file uploads come with pre-authorized download URL
+func (message *SkypeIncomingMessage) EventAttachments(token func() string) (attachments []Attachment) {
+	for _, attachment := range message.Attachments {
+		if attachment.ContentType == teamsFileDownloadInfo {
+			info, _ := attachment.Content.(map[string]interface{})
+			url, _ := info["downloadUrl"].(string)
+			if url == "" {
+				continue
+			}
+			file := Attachment{Kind: AttachmentFile, Name: attachment.Name, URL: url}
+			file.SetDownload(downloadURL(url, nil))
+			attachments = append(attachments, file)
+			continue
+		}
+		if attachment.ContentURL == "" {
+			// cards, etc
+			continue
+		}
+		file := Attachment{Kind: MimeAttachmentKind(attachment.ContentType),
+			Name: attachment.Name, MimeType: attachment.ContentType, URL: attachment.ContentURL}
+		// incoming requests are not authenticated, anyone could ask to send token to their host
+		if skypeAttachmentHost(attachment.ContentURL) {
+			file.SetDownload(downloadURL(attachment.ContentURL, token))
+		} else {
+			file.SetDownload(downloadURL(attachment.ContentURL, nil))
+		}
+		attachments = append(attachments, file)
+	}
+	return
+}
+
+// skypeAttachmentHost - URL is https one on SkypeAttachmentHosts
+func skypeAttachmentHost(content_url string) bool {
+	parsed, err := url.Parse(content_url)
+	if err != nil || parsed.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, allowed := range SkypeAttachmentHosts {
+		if host == strings.TrimPrefix(allowed, ".") || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
 }
 
 type SkypeAttachment struct {
 	// base64 encoded content of media, this or ContentURL
 	// data:image/png;base64,iVBORw0KGgo…
-	Content     string `json:"content,omitempty"`
-	ContentType string `json:"contentType"`
-	ContentURL  string `json:"contentUrl"`
-	Name        string `json:"name"`
+	// or card (SkypeHeroCard)
+	Content     interface{} `json:"content,omitempty"`
+	ContentType string      `json:"contentType"`
+	ContentURL  string      `json:"contentUrl,omitempty"`
+	Name        string      `json:"name,omitempty"`
+}
+
+// SkypeHeroCard - https://docs.microsoft.com/en-us/azure/bot-service/rest-api/bot-framework-rest-connector-api-reference#herocard-object
+type SkypeHeroCard struct {
+	Title   string            `json:"title,omitempty"`
+	Text    string            `json:"text,omitempty"`
+	Images  []SkypeCardImage  `json:"images,omitempty"`
+	Buttons []SkypeCardAction `json:"buttons,omitempty"`
+}
+
+type SkypeCardImage struct {
+	URL string `json:"url"`
+}
+
+type SkypeCardAction struct {
+	Type  string      `json:"type"`
+	Title string      `json:"title"`
+	Text  string      `json:"text,omitempty"`
+	Value interface{} `json:"value"`
 }
 
 type SkypeOutgoingMessage struct {
@@ -76,37 +168,67 @@ type SkypeTokenResponse struct {
 	AccessToken string `json:"access_token"`
 }
 
+// SkypeAPI - shared by account webhook handlers, use credentials and setters
 type SkypeAPI struct {
 	ServiceURL  string
 	AccessToken string
 	ExpiresIn   int64
 	logger      *log.Logger
+	lock        sync.RWMutex
 }
 
-func (sapi *SkypeAPI) Send(channel, message string, attachments ...*SkypeAttachment) {
+// credentials - service URL of last incoming message and access token
+func (sapi *SkypeAPI) credentials() (service_url, token string) {
+	sapi.lock.RLock()
+	defer sapi.lock.RUnlock()
+	return sapi.ServiceURL, sapi.AccessToken
+}
+
+func (sapi *SkypeAPI) setServiceURL(service_url string) {
+	sapi.lock.Lock()
+	defer sapi.lock.Unlock()
+	sapi.ServiceURL = service_url
+}
+
+// tokenExpiresIn - seconds until access token expires
+func (sapi *SkypeAPI) tokenExpiresIn() int64 {
+	sapi.lock.RLock()
+	defer sapi.lock.RUnlock()
+	return sapi.ExpiresIn - int64(time.Now().Unix())
+}
+
+func (sapi *SkypeAPI) Send(channel, message string, attachments ...*SkypeAttachment) (err error) {
 	client := &http.Client{}
 	outgoing_message := &SkypeOutgoingMessage{Text: message,
 		Type:        "message",
 		TextFormat:  "plain",
 		Attachments: attachments}
-	parsed, _ := url.Parse(sapi.ServiceURL)
+	service_url, token := sapi.credentials()
+	parsed, err := url.Parse(service_url)
+	if err != nil {
+		return
+	}
 	host := parsed.Host
 	body, _ := json.Marshal(outgoing_message)
 
 	req, err := http.NewRequest("POST",
 		fmt.Sprintf("https://%s/v3/conversations/%s/activities", host, channel),
 		bytes.NewReader(body))
-	sapi.logger.Printf(sapi.AccessToken)
+	if err != nil {
+		return
+	}
 	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", sapi.AccessToken))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
 	req.Header.Set("User-Agent", common.User_Agent)
 	resp, err := client.Do(req)
 	if err != nil {
-		sapi.logger.Printf("%+v\n", err)
 		return
 	}
 	defer resp.Body.Close()
 	sapi.logger.Println(resp)
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("Skype API returned %s", resp.Status)
+	}
 	return
 }
 
@@ -119,12 +241,13 @@ func (sapi *SkypeAPI) GetToken(app_id, app_password string) (token_response *Sky
 
 	r, err := http.DefaultClient.Post("https://login.microsoftonline.com/botframework.com/oauth2/v2.0/token",
 		"application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	token_response = &SkypeTokenResponse{}
 	if err != nil {
 		sapi.logger.Printf("%+v\n", err)
+		return
 	}
 	defer r.Body.Close()
 	data, _ := ioutil.ReadAll(r.Body)
-	token_response = &SkypeTokenResponse{}
 	err = json.Unmarshal(data, token_response)
 	if err != nil {
 		sapi.logger.Printf("An error occured during token unmarshalling: %+v\n", err)
@@ -146,20 +269,95 @@ func ToSkypeAttachment(rm torpedo_registry.RichMessage) (attachment *SkypeAttach
 	return
 }
 
-func HandleSkypeMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
-	switch api := tba.API.(type) {
-	case *SkypeAPI:
-		if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
-			api.Send(channel.(string), richmsgs[0].Text, ToSkypeAttachment(richmsgs[0]))
-		} else {
-			api.Send(channel.(string), message)
+// ToSkypeHeroCard - card as hero card attachment, button presses are sent back as messageBack value
+func ToSkypeHeroCard(card Card) (attachment *SkypeAttachment) {
+	hero := &SkypeHeroCard{Title: card.Title, Text: card.Summary()}
+	if card.Title != "" && card.TitleLink == "" {
+		// title is shown on its own
+		hero.Text = strings.TrimPrefix(strings.TrimPrefix(hero.Text, card.Title), "\n")
+	}
+	for _, image := range card.AllImages() {
+		hero.Images = append(hero.Images, SkypeCardImage{URL: image})
+	}
+	for _, button := range card.Buttons {
+		if button.URL != "" {
+			hero.Buttons = append(hero.Buttons, SkypeCardAction{Type: "openUrl", Title: button.Label, Value: button.URL})
+			continue
 		}
+		hero.Buttons = append(hero.Buttons, SkypeCardAction{Type: "messageBack", Title: button.Label,
+			Value: map[string]string{"torpedobot_callback": EncodeCallback(button)}})
+	}
+	return &SkypeAttachment{ContentType: "application/vnd.microsoft.card.hero", Content: hero}
+}
 
+// skypeMessageAttachments - rich message image and cards of message
+func skypeMessageAttachments(msg *Message) (text string, attachments []*SkypeAttachment) {
+	text = msg.Text
+	if len(msg.RichMessages) > 0 && !msg.RichMessages[0].IsEmpty() {
+		text = msg.RichMessages[0].Text
+		if attachment := ToSkypeAttachment(msg.RichMessages[0]); attachment != nil {
+			attachments = append(attachments, attachment)
+		}
+	}
+	for _, card := range msg.Cards {
+		attachments = append(attachments, ToSkypeHeroCard(card))
 	}
+	return
+}
+
+type SkypeProtocol struct {
+	bot          *TorpedoBot
+	account      *torpedo_registry.Account
+	api          *SkypeAPI
+	app_id       string
+	app_password string
+	webhook      *WebhookEndpoint
+	logger       *log.Logger
+}
+
+func (tb *TorpedoBot) NewSkypeProtocol() Protocol {
+	return &SkypeProtocol{bot: tb}
+}
+
+// VerifiedSenders - incoming requests are not authenticated, sender IDs may be forged
+func (sp *SkypeProtocol) VerifiedSenders() bool {
+	return false
+}
+
+func (sp *SkypeProtocol) Capabilities() Capabilities {
+	return Capabilities{RichMessages: true, Images: true, Cards: true}
+}
+
+// SendMessage - cards are sent as hero cards
+func (sp *SkypeProtocol) SendMessage(msg *Message, tba *TorpedoBotAPI) (id string, err error) {
+	if len(msg.Cards) == 0 {
+		return tba.sendPlain(msg)
+	}
+	conversation, ok := msg.Channel.(string)
+	if !ok {
+		err = fmt.Errorf("Skype conversation should be string, got %T", msg.Channel)
+		return
+	}
+	text, attachments := skypeMessageAttachments(msg)
+	err = sp.api.Send(conversation, text, attachments...)
+	return
+}
+
+func (sp *SkypeProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	conversation, ok := channel.(string)
+	if !ok {
+		return fmt.Errorf("Skype conversation should be string, got %T", channel)
+	}
+	if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
+		err = sp.api.Send(conversation, richmsgs[0].Text, ToSkypeAttachment(richmsgs[0]))
+	} else {
+		err = sp.api.Send(conversation, message)
+	}
+	return
 }
 
 func (tb *TorpedoBot) ConfigureSkypeBot(cfg *torpedo_registry.ConfigStruct) {
-	SkypeIncomingAddr = flag.String("skype_incoming_addr", "0.0.0.0:3978", "Listen on this address for incoming Skype messages")
+	SkypeIncomingAddr = flag.String("skype_incoming_addr", "", "Listen on this address for incoming Skype messages (defaults to -webhook_addr)")
 	SkypeAPIKey = flag.String("skype", "", "Comma separated list of dev.botframework.com creds, app_id:app_password,")
 }
 
@@ -171,80 +369,100 @@ func (tb *TorpedoBot) ParseSkypeBot(cfg *torpedo_registry.ConfigStruct) {
 	}
 }
 
-func (tb *TorpedoBot) RunSkypeBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
-	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunSkypeBotAccount(account)
+func (sp *SkypeProtocol) RefreshToken() {
+	token_response := sp.api.GetToken(sp.app_id, sp.app_password)
+	sp.logger.Printf("Got token, expires in %vs\n", token_response.ExpiresIn)
+	sp.api.lock.Lock()
+	defer sp.api.lock.Unlock()
+	sp.api.AccessToken = token_response.AccessToken
+	sp.api.ExpiresIn = int64(time.Now().Unix()) + int64(token_response.ExpiresIn)
 }
 
-func (tb *TorpedoBot) RunSkypeBotAccount(account *torpedo_registry.Account) {
-	tb.Stats.ConnectedAccounts += 1
-	account.Connection.ReconnectCount += 1
+func (sp *SkypeProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	sp.account = account
 
-	skype_api := &SkypeAPI{}
 	cu := &common.Utils{}
 
 	logger := cu.NewLog("skype-bot")
-	skype_api.logger = logger
-	app_id := strings.Split(account.APIKey, ":")[0]
-	app_password := strings.Split(account.APIKey, ":")[1]
+	sp.logger = logger
+	sp.api = &SkypeAPI{logger: logger}
+	creds := strings.Split(account.APIKey, ":")
+	if len(creds) != 2 {
+		err = fmt.Errorf("Skype creds should be in app_id:app_password format")
+		return
+	}
+	sp.app_id = creds[0]
+	sp.app_password = creds[1]
 	logger.Printf("Waiting for Skype token...\n")
-	token_response := skype_api.GetToken(app_id, app_password)
-	logger.Printf("Got Token: %s\n", token_response.AccessToken)
-	skype_api.AccessToken = token_response.AccessToken
-	skype_api.ExpiresIn = int64(time.Now().Unix()) + int64(token_response.ExpiresIn)
-
-	tb.RegisteredProtocols["*multibot.SkypeAPI"] = HandleSkypeMessage
-
-	account.API = skype_api
-
-	http.HandleFunc("/api/messages", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-type", "application/json")
-		defer r.Body.Close()
-		body_bytes, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			tb.logger.Fatalf("readAll failed with %+v\n", err)
-			return
-		}
-		logger.Printf("Skype incoming message: %s\n", string(body_bytes))
-		message := &SkypeIncomingMessage{}
-		err = json.Unmarshal(body_bytes, message)
-		if err != nil {
-			logger.Fatalf("JSON unmarshalling failed with %+v\n", err)
-			return
-		}
+	sp.RefreshToken()
 
-		// Check token (ExpiresIn is in the future)
-		if 1+skype_api.ExpiresIn-int64(time.Now().Unix()) <= 0 {
-			// Get new token
-			token_response := skype_api.GetToken(app_id, app_password)
-			logger.Printf("Got Token: %s\n", token_response.AccessToken)
-			skype_api.AccessToken = token_response.AccessToken
-			skype_api.ExpiresIn = int64(time.Now().Unix()) + int64(token_response.ExpiresIn)
-		} else {
-			logger.Printf("Token expires in %vs\n", skype_api.ExpiresIn-int64(time.Now().Unix()))
-		}
+	account.API = sp.api
+
+	sp.webhook = sp.bot.NewWebhookEndpoint(torpedo_registry.Config.GetConfig()["skypeincomingaddr"])
+	sp.webhook.Handle(fmt.Sprintf("/skype/%s/api/messages", WebhookAccountID(account)), http.HandlerFunc(sp.HandleIncoming))
+	sp.webhook.HandleLegacy("/api/messages", http.HandlerFunc(sp.HandleIncoming))
+	return
+}
+
+func (sp *SkypeProtocol) HandleIncoming(w http.ResponseWriter, r *http.Request) {
+	logger := sp.logger
+	w.Header().Set("Content-type", "application/json")
+	defer r.Body.Close()
+	body_bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Printf("readAll failed with %+v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logger.Printf("Skype incoming message: %s\n", string(body_bytes))
+	message := &SkypeIncomingMessage{}
+	err = json.Unmarshal(body_bytes, message)
+	if err != nil {
+		logger.Printf("JSON unmarshalling failed with %+v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Check token (ExpiresIn is in the future)
+	if expires_in := sp.api.tokenExpiresIn(); 1+expires_in <= 0 {
+		// Get new token
+		sp.RefreshToken()
+	} else {
+		logger.Printf("Token expires in %vs\n", expires_in)
+	}
+
+	sp.api.setServiceURL(message.ServiceURL)
+	botApi := sp.bot.NewBotAPI(sp, sp.api, sp.account)
+	botApi.UserProfile = &torpedo_registry.UserProfile{ID: message.From.ID, Nick: message.From.Name}
+	// FIXME: Remove hardcode
+	botApi.Me = "torpedobot"
 
-		botApi := &TorpedoBotAPI{}
-		skype_api.ServiceURL = message.ServiceURL
-		botApi.API = skype_api
-		botApi.Bot = tb
-		botApi.CommandPrefix = account.CommandPrefix
-		botApi.UserProfile = &torpedo_registry.UserProfile{ID: message.From.ID, Nick: message.From.Name}
-		// FIXME: Remove hardcode
-		botApi.Me = "torpedobot"
-
-		re := regexp.MustCompile(`^(@[^\s]+\s)?`)
-		msg := re.ReplaceAllString(message.Text, "")
-		logger.Printf("Message: `%s`\n", msg)
-		go tb.processChannelEvent(botApi, message.Conversation.ID, msg)
+	msg := message.NormalizedText(botApi)
+	logger.Printf("Message: `%s`\n", msg)
+	ev := botApi.NewEvent(message.Conversation.ID, msg)
+	ev.Attachments = message.EventAttachments(func() string {
+		_, token := sp.api.credentials()
+		return token
 	})
-	logger.Printf("Starting Skype API listener on %s\n", torpedo_registry.Config.GetConfig()["skypeincomingaddr"])
-	if err := http.ListenAndServe(torpedo_registry.Config.GetConfig()["skypeincomingaddr"], nil); err != nil {
-		logger.Fatal(err)
+	if message.Value.Callback != "" {
+		ev.CallbackID, ev.CallbackValue = DecodeCallback(message.Value.Callback)
+	}
+	ev.Raw = message
+	go sp.bot.processChannelEvent(botApi, ev)
+}
+
+func (sp *SkypeProtocol) Receive() error {
+	return sp.webhook.Serve()
+}
+
+// Ready - webhook server is listening
+func (sp *SkypeProtocol) Ready() <-chan struct{} {
+	return sp.webhook.Ready()
+}
+
+func (sp *SkypeProtocol) Close() error {
+	if sp.webhook == nil {
+		return nil
 	}
-	tb.Stats.ConnectedAccounts -= 1
+	return sp.webhook.Close()
 }
@@ -1,10 +1,16 @@
 package multibot
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	common "github.com/tb0hdan/torpedo_common"
@@ -13,7 +19,10 @@ import (
 	"github.com/tb0hdan/torpedo_registry"
 )
 
-var SlackAPIKey *string
+var (
+	SlackAPIKey            *string
+	SlackVerificationToken *string
+)
 
 func ToSlackAttachment(rm torpedo_registry.RichMessage) (params slack.PostMessageParameters) {
 	attachment := slack.Attachment{
@@ -27,27 +36,149 @@ func ToSlackAttachment(rm torpedo_registry.RichMessage) (params slack.PostMessag
 	return
 }
 
-func HandleSlackMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
+// ToSlackCard - fields and buttons become attachment fields and actions, more images are separate attachments.
+// Button presses are delivered to interactive endpoint, see -slack_verification_token
+func ToSlackCard(card Card) (attachments []slack.Attachment) {
+	attachment := ToSlackAttachment(card.RichMessage).Attachments[0]
+	attachment.Fallback = card.Summary()
+	attachment.CallbackID = "torpedobot"
+	for _, field := range card.Fields {
+		attachment.Fields = append(attachment.Fields, slack.AttachmentField{Title: field.Title, Value: field.Value, Short: field.Short})
+	}
+	for _, button := range card.Buttons {
+		action := slack.AttachmentAction{Name: button.CallbackID, Text: button.Label, Type: "button", Value: button.Value}
+		if button.URL != "" {
+			action = slack.AttachmentAction{Name: "link", Text: button.Label, Type: "button", URL: button.URL}
+		}
+		attachment.Actions = append(attachment.Actions, action)
+	}
+	attachments = append(attachments, attachment)
+	for _, image := range card.Images {
+		attachments = append(attachments, slack.Attachment{ImageURL: image, Fallback: image})
+	}
+	return
+}
+
+type SlackProtocol struct {
+	bot     *TorpedoBot
+	account *torpedo_registry.Account
+	api     *slack.Client
+	rtm     *slack.RTM
+	webhook *WebhookEndpoint
+	logger  *log.Logger
+	// threads - thread timestamps of recent threaded messages, oldest first in threadOrder
+	threads     map[string]string
+	threadOrder []string
+	threadsLock sync.Mutex
+}
+
+// maxSlackThreads - threaded messages remembered per account, replies to them are posted in their thread
+const maxSlackThreads = 1000
+
+func (tb *TorpedoBot) NewSlackProtocol() Protocol {
+	return &SlackProtocol{bot: tb}
+}
+
+func (sp *SlackProtocol) Capabilities() Capabilities {
+	return Capabilities{RichMessages: true, Images: true, Replies: true, Threads: true, Edits: true, Deletes: true, Reactions: true, Cards: true}
+}
+
+// ChannelType - Slack IDs are prefixed with C (channel), G (private channel or group DM), D (direct)
+func (sp *SlackProtocol) ChannelType(channel interface{}) string {
+	switch id, _ := channel.(string); {
+	case strings.HasPrefix(id, "C"):
+		return "channel"
+	case strings.HasPrefix(id, "G"):
+		return "group"
+	case strings.HasPrefix(id, "D"):
+		return "direct"
+	}
+	return "unknown"
+}
+
+// DirectChannel - messages posted to user ID go to direct chat with bot
+func (sp *SlackProtocol) DirectChannel(user_id string) (interface{}, error) {
+	return user_id, nil
+}
+
+func (sp *SlackProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	_, err = sp.SendMessage(&Message{Channel: channel, Text: message, RichMessages: richmsgs}, tba)
+	return
+}
+
+// rememberThread - thread timestamp of threaded message
+func (sp *SlackProtocol) rememberThread(ts, thread_ts string) {
+	sp.threadsLock.Lock()
+	defer sp.threadsLock.Unlock()
+	if sp.threads == nil {
+		sp.threads = make(map[string]string)
+	}
+	if _, ok := sp.threads[ts]; !ok {
+		sp.threadOrder = append(sp.threadOrder, ts)
+	}
+	sp.threads[ts] = thread_ts
+	if len(sp.threadOrder) > maxSlackThreads {
+		delete(sp.threads, sp.threadOrder[0])
+		sp.threadOrder = sp.threadOrder[1:]
+	}
+}
+
+// threadOf - thread message is in, message itself if it's not threaded (reply starts thread then)
+func (sp *SlackProtocol) threadOf(ts string) string {
+	sp.threadsLock.Lock()
+	defer sp.threadsLock.Unlock()
+	if thread_ts, ok := sp.threads[ts]; ok {
+		return thread_ts
+	}
+	return ts
+}
+
+// SendMessage - message IDs are timestamps, replies are posted in thread of replied message
+func (sp *SlackProtocol) SendMessage(msg *Message, tba *TorpedoBotAPI) (id string, err error) {
+	channel, ok := msg.Channel.(string)
+	if !ok {
+		err = fmt.Errorf("Slack channel should be string, got %T", msg.Channel)
+		return
+	}
+	switch {
+	case msg.Delete != "":
+		_, id, err = sp.api.DeleteMessage(channel, msg.Delete)
+		return
+	case msg.Reaction != "":
+		err = sp.api.AddReaction(strings.Trim(msg.Reaction, ":"), slack.NewRefToMessage(channel, msg.ReplyTo))
+		return msg.ReplyTo, err
+	case msg.Edit != "":
+		_, id, _, err = sp.api.UpdateMessage(channel, msg.Edit, msg.Text)
+		return
+	}
 	var params slack.PostMessageParameters
-	if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
-		params = ToSlackAttachment(richmsgs[0])
+	if len(msg.RichMessages) > 0 && !msg.RichMessages[0].IsEmpty() {
+		params = ToSlackAttachment(msg.RichMessages[0])
+	}
+	for _, card := range msg.Cards {
+		params.Attachments = append(params.Attachments, ToSlackCard(card)...)
 	}
 	params.UnfurlLinks = true
 	params.UnfurlMedia = true
+	params.ThreadTimestamp = msg.ThreadID
+	if params.ThreadTimestamp == "" && msg.ReplyTo != "" {
+		params.ThreadTimestamp = sp.threadOf(msg.ReplyTo)
+	}
 
-	switch api := tba.API.(type) {
-	case *slack.Client:
-		channelID, timestamp, err := api.PostMessage(channel.(string), message, params)
-		if err != nil {
-			tba.Bot.logger.Printf("%s\n", err)
-			return
-		}
-		tba.Bot.logger.Printf("Message successfully sent to channel %s at %s", channelID, timestamp)
+	channelID, id, err := sp.api.PostMessage(channel, msg.Text, params)
+	if err != nil {
+		return
 	}
+	if params.ThreadTimestamp != "" {
+		sp.rememberThread(id, params.ThreadTimestamp)
+	}
+	sp.logger.Printf("Message successfully sent to channel %s at %s", channelID, id)
+	return
 }
 
 func (tb *TorpedoBot) ConfigureSlackBot(cfg *torpedo_registry.ConfigStruct) {
 	SlackAPIKey = flag.String("slack", "", "Comma separated list of Slack legacy tokens")
+	SlackVerificationToken = flag.String("slack_verification_token", "", "Slack app verification token, enables button callbacks on -webhook_addr")
 
 }
 
@@ -56,44 +187,114 @@ func (tb *TorpedoBot) ParseSlackBot(cfg *torpedo_registry.ConfigStruct) {
 	if cfg.GetConfig()["slackapikey"] == "" {
 		cfg.SetConfig("slackapikey", common.GetStripEnv("SLACK"))
 	}
-}
-
-func (tb *TorpedoBot) RunSlackBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
+	cfg.SetConfig("slackverificationtoken", *SlackVerificationToken)
+	if cfg.GetConfig()["slackverificationtoken"] == "" {
+		cfg.SetConfig("slackverificationtoken", common.GetStripEnv("SLACK_VERIFICATION_TOKEN"))
 	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunSlackBotAccount(account)
 }
 
-func (tb *TorpedoBot) RunSlackBotAccount(account *torpedo_registry.Account) {
-	tb.Stats.ConnectedAccounts += 1
-
-	api := slack.New(account.APIKey)
-	account.API = api
+func (sp *SlackProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	sp.account = account
+	sp.api = slack.New(account.APIKey)
+	account.API = sp.api
 	//cu := &common.Utils{}
 
-	logger := log.New(os.Stdout, "slack-bot: ", log.Lshortfile|log.LstdFlags) //cu.NewLog("slack-bot")
-	slack.SetLogger(logger)
+	sp.logger = log.New(os.Stdout, "slack-bot: ", log.Lshortfile|log.LstdFlags) //cu.NewLog("slack-bot")
+	slack.SetLogger(sp.logger)
 
 	if torpedo_registry.Config.GetConfig()["debug"] == "yes" {
-		api.SetDebug(true)
+		sp.api.SetDebug(true)
 
 	}
 
-	rtm := api.NewRTM()
-	go rtm.ManageConnection()
+	sp.rtm = sp.api.NewRTM()
+	go sp.rtm.ManageConnection()
+	// RTM doesn't deliver button presses, Slack posts them to app's interactive components request URL
+	if token := torpedo_registry.Config.GetConfig()["slackverificationtoken"]; token != "" {
+		sp.webhook = sp.bot.NewWebhookEndpoint("")
+		sp.webhook.Handle(fmt.Sprintf("/slack/%s/interactive", WebhookAccountID(account)), sp.interactionHandler(token))
+		go func(webhook *WebhookEndpoint) {
+			if err := webhook.Serve(); err != nil {
+				sp.logger.Printf("Slack interactive endpoint failed: %+v\n", err)
+			}
+		}(sp.webhook)
+	}
+	return
+}
 
-	botApi := &TorpedoBotAPI{}
-	botApi.API = api
-	botApi.Bot = tb
-	botApi.CommandPrefix = account.CommandPrefix
-	botApi.UserProfile = &torpedo_registry.UserProfile{}
+func (sp *SlackProtocol) Close() error {
+	if sp.webhook != nil {
+		sp.webhook.Close()
+	}
+	if sp.rtm == nil {
+		return nil
+	}
+	return sp.rtm.Disconnect()
+}
 
-	tb.RegisteredProtocols["*slack.Client"] = HandleSlackMessage
+// slackInteraction - interactive message payload, actions are card buttons
+type slackInteraction struct {
+	Token     string `json:"token"`
+	MessageTS string `json:"message_ts"`
+	Channel   struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	User struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"user"`
+	Actions []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"actions"`
+}
 
-	for msg := range rtm.IncomingEvents {
+// interactionHandler - turn button presses into callback events
+func (sp *SlackProtocol) interactionHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		interaction := &slackInteraction{}
+		if err := json.Unmarshal([]byte(r.PostFormValue("payload")), interaction); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(interaction.Token), []byte(token)) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// original message is left as is
+		w.WriteHeader(http.StatusOK)
+		for _, action := range interaction.Actions {
+			if action.Name == "link" {
+				continue
+			}
+			botApi := sp.bot.NewBotAPI(sp, sp.api, sp.account)
+			botApi.UserProfile = &torpedo_registry.UserProfile{ID: interaction.User.ID, Nick: interaction.User.Name}
+			botApi.Direct = strings.HasPrefix(interaction.Channel.ID, "D")
+			botApi.MessageID = interaction.MessageTS
+			ev := botApi.NewEvent(interaction.Channel.ID, "")
+			ev.CallbackID, ev.CallbackValue = action.Name, action.Value
+			ev.Raw = interaction
+			go sp.bot.processChannelEvent(botApi, ev)
+		}
+	}
+}
+
+func (sp *SlackProtocol) Receive() (err error) {
+	tb := sp.bot
+	logger := sp.logger
+	account := sp.account
+	api := sp.api
+	// bot user ID and name, known after connecting
+	var me, my_name string
+	ctx := tb.accountContext(account)
+
+	for {
+		var msg slack.RTMEvent
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-sp.rtm.IncomingEvents:
+		}
 		// TODO: Use proper logger instead
 		if torpedo_registry.Config.GetConfig()["debug"] == "yes" {
 			logger.Print("Event Received: ")
@@ -103,21 +304,31 @@ func (tb *TorpedoBot) RunSlackBotAccount(account *torpedo_registry.Account) {
 			// Ignore hello
 
 		case *slack.ConnectedEvent:
-			account.Connection.Connected = true
-			account.Connection.ReconnectCount += 1
+			// first connection is accounted for by supervisor, the rest are RTM reconnects
+			tb.markConnected(account, ev.ConnectionCount > 0)
 			// TODO: Use proper logger instead
 			if torpedo_registry.Config.GetConfig()["debug"] == "yes" {
 				logger.Println("Infos:", ev.Info)
 				logger.Println("Connection counter:", ev.ConnectionCount)
 			}
-			botApi.Me = ev.Info.User.ID
+			me = ev.Info.User.ID
+			my_name = ev.Info.User.Name
 			// Replace #general with your Channel ID
 			// rtm.SendMessage(rtm.NewOutgoingMessage("Hello world", "#general"))
 
 		case *slack.MessageEvent:
 			logger.Printf("Message: %v\n", ev)
-			if ev.Type == "message" && ev.User != "" {
-				user, err := api.GetUserInfo(ev.User)
+			// edits come as message_changed event with new version of message in SubMessage
+			msg, edited := &ev.Msg, false
+			if ev.SubType == "message_changed" && ev.SubMessage != nil {
+				msg, edited = ev.SubMessage, true
+			}
+			if ev.Type == "message" && msg.User != "" {
+				// events are processed concurrently, each one gets its own API wrapper
+				botApi := tb.NewBotAPI(sp, api, account)
+				botApi.Me = me
+				botApi.UserProfile = &torpedo_registry.UserProfile{ID: msg.User}
+				user, err := api.GetUserInfo(msg.User)
 				if err == nil {
 					botApi.UserProfile = &torpedo_registry.UserProfile{Nick: user.Name,
 						RealName: user.RealName,
@@ -128,19 +339,47 @@ func (tb *TorpedoBot) RunSlackBotAccount(account *torpedo_registry.Account) {
 						ID:       user.ID,
 					}
 				} else {
-					logger.Printf("Error getting user info for %s\n", ev.User)
+					logger.Printf("Error getting user info for %s\n", msg.User)
 				}
 
 				channel := ev.Channel
-				incoming_message := ev.Text
+				// <@U024BE7LH> mentions
+				incoming_message := strings.Replace(msg.Text, "<@"+me+">", "@"+me, -1)
+				incoming_message, botApi.Mentioned = StripMention(incoming_message, me, my_name)
+				botApi.Direct = strings.HasPrefix(channel, "D")
+				botApi.MessageID = msg.Timestamp
+				botApi.ThreadID = msg.ThreadTimestamp
+				if msg.ThreadTimestamp != "" {
+					sp.rememberThread(msg.Timestamp, msg.ThreadTimestamp)
+				}
 				messageTS, _ := strconv.ParseFloat(ev.Timestamp, 64)
 				jitter := int64(time.Now().Unix()) - int64(messageTS)
 				// System notifications, like "you've been invited / kicked" come from USLACKBOT, ignore them...
 				if jitter < 10 && botApi.UserProfile.ID != "USLACKBOT" {
-					go tb.processChannelEvent(botApi, channel, incoming_message)
+					event := botApi.NewEvent(channel, incoming_message)
+					event.Timestamp = time.Unix(0, int64(messageTS*1e9))
+					event.Edited = edited
+					event.Raw = ev
+					for _, file := range msg.Files {
+						url := file.URLPrivateDownload
+						if url == "" {
+							url = file.URLPrivate
+						}
+						attachment := Attachment{Kind: MimeAttachmentKind(file.Mimetype),
+							ID: file.ID, Name: file.Name, MimeType: file.Mimetype, URL: url, Size: file.Size}
+						// private file URLs require bot token
+						attachment.SetDownload(downloadURL(url, func() string { return account.APIKey }))
+						event.Attachments = append(event.Attachments, attachment)
+					}
+					go tb.processChannelEvent(botApi, event)
 				}
 			}
 
+		case *slack.DisconnectedEvent:
+			// RTM will try to reconnect on its own
+			logger.Printf("Disconnected: %+v\n", ev.Cause)
+			tb.markDisconnected(account)
+
 		case *slack.PresenceChangeEvent:
 			logger.Printf("Presence Change: %v\n", ev)
 
@@ -151,14 +390,12 @@ func (tb *TorpedoBot) RunSlackBotAccount(account *torpedo_registry.Account) {
 			logger.Printf("Error: %s\n", ev.Error())
 
 		case *slack.InvalidAuthEvent:
-			account.Connection.Connected = false
-			logger.Printf("Invalid credentials")
-			break
+			err = fmt.Errorf("Invalid credentials")
+			return
 
 		default:
 			// Ignore other events..
 			//logger.Printf("Unexpected: %v\n", msg.Data)
 		}
 	}
-	tb.Stats.ConnectedAccounts -= 1
 }
@@ -0,0 +1,131 @@
+package multibot
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	common "github.com/tb0hdan/torpedo_common"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// CounterTotalMessages - processed commands, all sessions
+const CounterTotalMessages = "totalMessages"
+
+var (
+	StoreBackend *string
+	StorePath    *string
+)
+
+// Store - persistent bot state
+type Store interface {
+	// IncrementCounter - add delta to named counter and return new value
+	IncrementCounter(name string, delta int64) (int64, error)
+	GetBlacklistRules() ([]BlackListRuleItem, error)
+	// AddBlacklistRule, RemoveBlacklistRule, BlacklistRuleMatched - rules are identified by pattern and channel
+	AddBlacklistRule(rule BlackListRuleItem) error
+	RemoveBlacklistRule(rule BlackListRuleItem) error
+	// BlacklistRuleMatched - bump rule match counter
+	BlacklistRuleMatched(rule BlackListRuleItem) error
+	AddHistory(item *HistoryItem) error
+	SearchHistory(query HistoryQuery) ([]*HistoryItem, error)
+	// PruneHistory - remove messages that expired before time
+	PruneHistory(now time.Time) (int, error)
+	// GetRooms - rooms account should join on connect, account is protocol specific (server, JID)
+	GetRooms(protocol, account string) ([]string, error)
+	AddRoom(protocol, account, room string) error
+	// GetAliases - channel command aliases, alias: command with arguments
+	GetAliases(channel string) (map[string]string, error)
+	SetAlias(channel, alias, command string) error
+	RemoveAlias(channel, alias string) error
+	// GetRoles - granted roles by user key (see UserKey)
+	GetRoles() (map[string]string, error)
+	SetRole(user, role string) error
+	RemoveRole(user string) error
+	// GetBridges - bridges linked with `bridge link`, name: channels
+	GetBridges() (map[string][]string, error)
+	SetBridge(name string, channels []string) error
+	RemoveBridge(name string) error
+	// GetJobs - scheduled jobs, SaveJob adds or replaces job by ID
+	GetJobs() ([]*ScheduledJob, error)
+	SaveJob(job *ScheduledJob) error
+	RemoveJob(id string) error
+	Close() error
+}
+
+func (tb *TorpedoBot) ConfigureStore(cfg *torpedo_registry.ConfigStruct) {
+	StoreBackend = flag.String("store", "", "Storage backend: bolt or mongo (default: mongo if MongoDB host is set, bolt otherwise)")
+	StorePath = flag.String("store_path", "torpedobot.db", "Database file for bolt storage backend")
+}
+
+func (tb *TorpedoBot) ParseStore(cfg *torpedo_registry.ConfigStruct) {
+	cfg.SetConfig("store", *StoreBackend)
+	if cfg.GetConfig()["store"] == "" {
+		cfg.SetConfig("store", common.GetStripEnv("STORE"))
+	}
+	cfg.SetConfig("storepath", *StorePath)
+	if env_path := common.GetStripEnv("STORE_PATH"); env_path != "" {
+		cfg.SetConfig("storepath", env_path)
+	}
+}
+
+// OpenStore - open configured storage backend, call after parsers
+func (tb *TorpedoBot) OpenStore() (err error) {
+	cfg := torpedo_registry.Config.GetConfig()
+	backend := cfg["store"]
+	if backend == "" {
+		backend = "bolt"
+		if cfg["mongo"] != "" {
+			backend = "mongo"
+		}
+	}
+	switch backend {
+	case "mongo":
+		host := cfg["mongo"]
+		if host == "" {
+			host = "localhost"
+		}
+		tb.logger.Printf("Using MongoDB storage at %s\n", host)
+		tb.Store = NewMongoStore(host)
+	case "bolt":
+		tb.logger.Printf("Using bolt storage at %s\n", cfg["storepath"])
+		tb.Store, err = NewBoltStore(cfg["storepath"])
+	default:
+		err = fmt.Errorf("unknown storage backend: `%s`", backend)
+	}
+	if err == nil {
+		go tb.runHistoryPruner()
+		go tb.runScheduler()
+	}
+	return
+}
+
+func (tb *TorpedoBot) closeStore() {
+	if tb.Store == nil {
+		return
+	}
+	if err := tb.Store.Close(); err != nil {
+		tb.logger.Printf("Could not close storage: %+v\n", err)
+	}
+}
+
+// GetRooms - rooms to join, errors are logged and treated as no rooms
+func (tb *TorpedoBot) GetRooms(protocol, account string) (rooms []string) {
+	if tb.Store == nil {
+		return
+	}
+	rooms, err := tb.Store.GetRooms(protocol, account)
+	if err != nil {
+		tb.logger.Printf("No rooms available to join: %+v\n", err)
+	}
+	return
+}
+
+func (tb *TorpedoBot) AddRoom(protocol, account, room string) {
+	if tb.Store == nil {
+		return
+	}
+	if err := tb.Store.AddRoom(protocol, account, room); err != nil {
+		tb.logger.Printf("Could not store %s room %s: %+v\n", protocol, room, err)
+	}
+}
@@ -0,0 +1,197 @@
+package multibot
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/getsentry/raven-go"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+const (
+	// first reconnect delay
+	ReconnectMinDelay = 1 * time.Second
+	// reconnect delay won't grow above this
+	ReconnectMaxDelay = 5 * time.Minute
+	// connection that lived this long is considered stable, backoff is reset
+	ReconnectStableAfter = 2 * time.Minute
+)
+
+// ErrNoReconnect - returned by Protocol.Receive when connection should not be restarted
+var ErrNoReconnect = errors.New("protocol stopped, not reconnecting")
+
+// Backoff - exponential backoff with full jitter
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt uint
+}
+
+func NewBackoff(min, max time.Duration) *Backoff {
+	return &Backoff{Min: min, Max: max}
+}
+
+// Next - delay before next attempt, random value in [Min, Min*2^attempt] capped at Max
+func (b *Backoff) Next() (delay time.Duration) {
+	ceiling := b.Max
+	if b.attempt < 32 {
+		if exp := b.Min << b.attempt; exp > 0 && exp < b.Max {
+			ceiling = exp
+		}
+	}
+	b.attempt += 1
+	delay = b.Min
+	if ceiling > b.Min {
+		delay += time.Duration(rand.Int63n(int64(ceiling - b.Min)))
+	}
+	return
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// markConnected - update account state and connected accounts counter
+func (tb *TorpedoBot) markConnected(account *torpedo_registry.Account, reconnect bool) {
+	tb.connLock.Lock()
+	defer tb.connLock.Unlock()
+	protocol := tb.AccountProtocol(account)
+	if reconnect {
+		account.Connection.ReconnectCount += 1
+		Reconnects.WithLabelValues(protocol).Inc()
+	}
+	if !account.Connection.Connected {
+		account.Connection.Connected = true
+		tb.updateStats(func(stats *BotStats) { stats.ConnectedAccounts += 1 })
+		AccountsConnected.WithLabelValues(protocol).Inc()
+	}
+}
+
+func (tb *TorpedoBot) markDisconnected(account *torpedo_registry.Account) {
+	tb.connLock.Lock()
+	defer tb.connLock.Unlock()
+	if account.Connection.Connected {
+		account.Connection.Connected = false
+		tb.updateStats(func(stats *BotStats) { stats.ConnectedAccounts -= 1 })
+		AccountsConnected.WithLabelValues(tb.AccountProtocol(account)).Dec()
+	}
+}
+
+// StartAccount - supervise account in background, see SuperviseAccount
+func (tb *TorpedoBot) StartAccount(protocol string, account *torpedo_registry.Account) {
+	// registered before goroutine starts, so shutdown waits for it
+	if !tb.beginAccount() {
+		tb.forgetAccount(account)
+		return
+	}
+	go tb.superviseAccount(protocol, account)
+}
+
+// SuperviseAccount - run account using fresh protocol instance, restart it with
+// jittered exponential backoff until account is removed or bot is shutting down
+func (tb *TorpedoBot) SuperviseAccount(protocol string, account *torpedo_registry.Account) {
+	if !tb.beginAccount() {
+		tb.forgetAccount(account)
+		return
+	}
+	tb.superviseAccount(protocol, account)
+}
+
+func (tb *TorpedoBot) superviseAccount(protocol string, account *torpedo_registry.Account) {
+	defer tb.accounts.Done()
+	defer tb.forgetAccount(account)
+	ctx := tb.accountContext(account)
+	backoff := NewBackoff(ReconnectMinDelay, ReconnectMaxDelay)
+	// connects after first successful one are reconnects
+	was_connected := false
+	for ctx.Err() == nil {
+		proto, err := tb.GetProtocol(protocol)
+		if err != nil {
+			tb.logger.Printf("%+v\n", err)
+			return
+		}
+		started := time.Now()
+		connected, err := tb.runProtocolAccount(proto, account, was_connected)
+		was_connected = was_connected || connected
+		if err == ErrNoReconnect || ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > ReconnectStableAfter {
+			backoff.Reset()
+		}
+		delay := backoff.Next()
+		tb.logger.Printf("%s account disconnected (%+v), reconnecting in %v\n", protocol, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// RunProtocolAccount - connect account and run its event loop until connection
+// is terminated, account is removed or bot is shutting down
+func (tb *TorpedoBot) RunProtocolAccount(proto Protocol, account *torpedo_registry.Account) (err error) {
+	_, err = tb.runProtocolAccount(proto, account, false)
+	return
+}
+
+// runProtocolAccount - connected is set once account is marked connected, reconnect counts it as reconnect
+func (tb *TorpedoBot) runProtocolAccount(proto Protocol, account *torpedo_registry.Account, reconnect bool) (connected bool, err error) {
+	ctx := tb.accountContext(account)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("protocol panic: %v", r)
+			if torpedo_registry.Config.GetConfig()["raven"] == "yes" {
+				raven.CaptureErrorAndWait(err, nil)
+			}
+		}
+		tb.markDisconnected(account)
+		tb.setAccountProtocol(account, nil)
+		if cerr := proto.Close(); cerr != nil {
+			tb.logger.Printf("Close failed: %+v\n", cerr)
+		}
+	}()
+	if err = proto.Connect(account); err != nil {
+		tb.logger.Printf("Could not connect account: %+v\n", err)
+		return
+	}
+	tb.setAccountProtocol(account, proto)
+
+	received := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				received <- fmt.Errorf("protocol panic: %v", r)
+			}
+		}()
+		received <- proto.Receive()
+	}()
+	if notifier, ok := proto.(ReadyNotifier); ok {
+		select {
+		case <-notifier.Ready():
+		case err = <-received:
+			tb.logger.Printf("Connection terminated before it was ready: %+v\n", err)
+			if err == nil {
+				err = fmt.Errorf("protocol stopped before it was ready")
+			}
+			return
+		case <-ctx.Done():
+			tb.logger.Printf("Disconnecting account...\n")
+			return
+		}
+	}
+	tb.markConnected(account, reconnect)
+	connected = true
+	select {
+	case err = <-received:
+		if err != nil && err != ErrNoReconnect {
+			tb.logger.Printf("Connection terminated: %+v\n", err)
+		}
+	case <-ctx.Done():
+		tb.logger.Printf("Disconnecting account...\n")
+	}
+	return
+}
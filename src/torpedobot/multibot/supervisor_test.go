@@ -0,0 +1,96 @@
+package multibot_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+// flakyProtocol - first connection drops once it's ready, later ones stay up until closed.
+// Connection is ready once ready channel is closed
+type flakyProtocol struct {
+	connects *int32
+	ready    chan struct{}
+	done     chan struct{}
+}
+
+func (fp *flakyProtocol) Connect(account *torpedo_registry.Account) error { return nil }
+func (fp *flakyProtocol) Capabilities() multibot.Capabilities             { return multibot.Capabilities{} }
+func (fp *flakyProtocol) Ready() <-chan struct{}                          { return fp.ready }
+func (fp *flakyProtocol) Close() error {
+	close(fp.done)
+	return nil
+}
+func (fp *flakyProtocol) Send(channel interface{}, message string, tba *multibot.TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) error {
+	return nil
+}
+func (fp *flakyProtocol) Receive() error {
+	if atomic.AddInt32(fp.connects, 1) == 1 {
+		<-fp.ready
+		time.Sleep(50 * time.Millisecond)
+		return errors.New("connection reset")
+	}
+	<-fp.done
+	return nil
+}
+
+func TestBackoff(t *testing.T) {
+	backoff := multibot.NewBackoff(time.Second, 8*time.Second)
+	if delay := backoff.Next(); delay != time.Second {
+		t.Errorf("first delay should be minimal, got %v", delay)
+	}
+	for attempt := 1; attempt < 40; attempt++ {
+		ceiling := 8 * time.Second
+		if attempt < 3 {
+			ceiling = time.Second << uint(attempt)
+		}
+		if delay := backoff.Next(); delay < time.Second || delay > ceiling {
+			t.Errorf("attempt %d: delay %v is out of [1s, %v]", attempt, delay, ceiling)
+		}
+	}
+	backoff.Reset()
+	if delay := backoff.Next(); delay != time.Second {
+		t.Errorf("delay after reset should be minimal, got %v", delay)
+	}
+}
+
+func TestSupervisorReconnect(t *testing.T) {
+	bot := multibot.New()
+	var connects int32
+	ready := make(chan struct{})
+	bot.RegisterProtocol("flaky", func() multibot.Protocol {
+		return &flakyProtocol{connects: &connects, ready: ready, done: make(chan struct{})}
+	})
+	account := &torpedo_registry.Account{APIKey: "flaky", CommandPrefix: "!"}
+	ba := bot.AddAccount("flaky", account)
+	bot.StartAccount("flaky", account)
+
+	// account is not connected until protocol is ready
+	time.Sleep(100 * time.Millisecond)
+	if connected := testutil.ToFloat64(multibot.AccountsConnected.WithLabelValues("flaky")); connected != 0 {
+		t.Errorf("account connected before it was ready: %v", connected)
+	}
+	close(ready)
+	deadline := time.Now().Add(multibot.ReconnectMinDelay + replyTimeout)
+	for atomic.LoadInt32(&connects) < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&connects) != 2 {
+		t.Fatalf("account did not reconnect")
+	}
+	time.Sleep(100 * time.Millisecond)
+	// first connect is not a reconnect
+	if reconnects := testutil.ToFloat64(multibot.Reconnects.WithLabelValues("flaky")); reconnects != 1 {
+		t.Errorf("expected 1 reconnect, got %v", reconnects)
+	}
+	if connected := testutil.ToFloat64(multibot.AccountsConnected.WithLabelValues("flaky")); connected != 1 {
+		t.Errorf("expected connected account, got %v", connected)
+	}
+	bot.RemoveAccount(ba.ID)
+}
@@ -3,9 +3,9 @@ package multibot
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"net/http"
-	"regexp"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -44,20 +44,72 @@ func (sapi *TeamsAPI) Send(channel, message string, attachments ...*SkypeAttachm
 	return
 }
 
-func HandleTeamsMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
+type TeamsProtocol struct {
+	bot     *TorpedoBot
+	account *torpedo_registry.Account
+	api     *TeamsAPI
+	webhook *WebhookEndpoint
+	logger  *log.Logger
+}
+
+func (tb *TorpedoBot) NewTeamsProtocol() Protocol {
+	return &TeamsProtocol{bot: tb}
+}
+
+// VerifiedSenders - HMAC of incoming requests is not checked, sender IDs may be forged
+func (tp *TeamsProtocol) VerifiedSenders() bool {
+	return false
+}
+
+func (tp *TeamsProtocol) Capabilities() Capabilities {
+	return Capabilities{RichMessages: true, Images: true, Cards: true}
+}
+
+// SendMessage - cards are sent as hero cards, with text in the only reply
+func (tp *TeamsProtocol) SendMessage(msg *Message, tba *TorpedoBotAPI) (id string, err error) {
+	if len(msg.Cards) == 0 {
+		return tba.sendPlain(msg)
+	}
+	api, ok := tba.API.(*TeamsAPI)
+	if !ok {
+		err = fmt.Errorf("Teams can only reply to incoming messages, got %T", tba.API)
+		return
+	}
+	conversation, ok := msg.Channel.(string)
+	if !ok {
+		err = fmt.Errorf("Teams conversation should be string, got %T", msg.Channel)
+		return
+	}
+	text, attachments := skypeMessageAttachments(msg)
+	api.Send(conversation, text, attachments...)
+	return
+}
+
+// OutboundAPI - custom bots can only reply to incoming messages
+func (tp *TeamsProtocol) OutboundAPI() (api interface{}, err error) {
+	return nil, ErrNotSupported
+}
+
+func (tp *TeamsProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	conversation, ok := channel.(string)
+	if !ok {
+		return fmt.Errorf("Teams conversation should be string, got %T", channel)
+	}
 	switch api := tba.API.(type) {
 	case *TeamsAPI:
 		if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
-			api.Send(channel.(string), richmsgs[0].Text, ToSkypeAttachment(richmsgs[0]))
+			api.Send(conversation, richmsgs[0].Text, ToSkypeAttachment(richmsgs[0]))
 		} else {
-			api.Send(channel.(string), message)
+			api.Send(conversation, message)
 		}
-
+	default:
+		err = fmt.Errorf("Teams can only reply to incoming messages, got %T", api)
 	}
+	return
 }
 
 func (tb *TorpedoBot) ConfigureTeamsBot(cfg *torpedo_registry.ConfigStruct) {
-	TeamsIncomingAddr = flag.String("teams_incoming_addr", "0.0.0.0:3982", "Listen on this address for incoming Teams messages")
+	TeamsIncomingAddr = flag.String("teams_incoming_addr", "", "Listen on this address for incoming Teams messages (defaults to -webhook_addr)")
 	TeamsAPIKey = flag.String("teams", "", "Comma separated list of Microsoft Teams user bot secrets")
 }
 
@@ -69,86 +121,93 @@ func (tb *TorpedoBot) ParseTeamsBot(cfg *torpedo_registry.ConfigStruct) {
 	}
 }
 
-func (tb *TorpedoBot) RunTeamsBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
-	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunTeamsBotAccount(account)
-}
-
-func (tb *TorpedoBot) RunTeamsBotAccount(account *torpedo_registry.Account) {
-	tb.Stats.ConnectedAccounts += 1
-	account.Connection.ReconnectCount += 1
+func (tp *TeamsProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	tp.account = account
 	cu := &common.Utils{}
-	logger := cu.NewLog("teams-bot")
+	tp.logger = cu.NewLog("teams-bot")
 
-	teams_api := &TeamsAPI{}
-	teams_api.logger = logger
+	tp.api = &TeamsAPI{}
+	tp.api.logger = tp.logger
 
-	account.API = teams_api
-	tb.RegisteredProtocols["*multibot.TeamsAPI"] = HandleTeamsMessage
+	account.API = tp.api
 
-	http.HandleFunc("/api/teams-messages", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-type", "application/json")
-		defer r.Body.Close()
-		body_bytes, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			tb.logger.Fatalf("readAll failed with %+v\n", err)
-			return
-		}
-		logger.Printf("Teams incoming message: %s\n", string(body_bytes))
-		// SkypeIncomming message seems to be compatible with Teams User Bot incoming message:
-		// https://msdn.microsoft.com/en-us/microsoft-teams/botsconversation#receiving-messages
-		message := &SkypeIncomingMessage{}
-		err = json.Unmarshal(body_bytes, message)
-		if err != nil {
-			logger.Fatalf("JSON unmarshalling failed with %+v\n", err)
-			return
-		}
+	tp.webhook = tp.bot.NewWebhookEndpoint(torpedo_registry.Config.GetConfig()["teamsincomingaddr"])
+	tp.webhook.Handle(fmt.Sprintf("/teams/%s/api/messages", WebhookAccountID(account)), http.HandlerFunc(tp.HandleIncoming))
+	tp.webhook.HandleLegacy("/api/teams-messages", http.HandlerFunc(tp.HandleIncoming))
+	return
+}
 
-		botApi := &TorpedoBotAPI{}
-		teams_api.GUID = uuid.New().String()
-		botApi.API = teams_api
-		botApi.Bot = tb
-		botApi.CommandPrefix = account.CommandPrefix
-		botApi.UserProfile = &torpedo_registry.UserProfile{ID: message.From.ID, Nick: message.From.Name}
-		// FIXME: Remove hardcode
-		botApi.Me = "torpedobot"
-
-		re := regexp.MustCompile(`^(<at>.+</at>(\s|&nbsp;))?`)
-		msg := re.ReplaceAllString(message.Text, "")
-		logger.Printf("Message: `%s`\n", msg)
-		go tb.processChannelEvent(botApi, message.Conversation.ID, msg)
-
-		stopFlag := false
-		ticker := time.NewTicker(time.Millisecond * 100)
-		go func() {
-			for range ticker.C {
-				body, ok := TeamsMessageQueue.Get(teams_api.GUID)
-				if ok {
-					w.Write([]byte(body[0]))
-					TeamsMessageQueue.Delete(teams_api.GUID)
-					stopFlag = true
-					break
-				}
-			}
-		}()
-		for i := 0; i <= sleepMax*10; i++ {
-			if stopFlag {
-				break
-			} else {
-				time.Sleep(time.Millisecond * 100)
+func (tp *TeamsProtocol) HandleIncoming(w http.ResponseWriter, r *http.Request) {
+	logger := tp.logger
+	w.Header().Set("Content-type", "application/json")
+	defer r.Body.Close()
+	body_bytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.Printf("readAll failed with %+v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logger.Printf("Teams incoming message: %s\n", string(body_bytes))
+	// SkypeIncomming message seems to be compatible with Teams User Bot incoming message:
+	// https://msdn.microsoft.com/en-us/microsoft-teams/botsconversation#receiving-messages
+	message := &SkypeIncomingMessage{}
+	err = json.Unmarshal(body_bytes, message)
+	if err != nil {
+		logger.Printf("JSON unmarshalling failed with %+v\n", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// concurrent requests must not share reply GUID
+	teams_api := &TeamsAPI{GUID: uuid.New().String(), logger: logger}
+	botApi := tp.bot.NewBotAPI(tp, teams_api, tp.account)
+	botApi.UserProfile = &torpedo_registry.UserProfile{ID: message.From.ID, Nick: message.From.Name}
+	// FIXME: Remove hardcode
+	botApi.Me = "torpedobot"
+
+	msg := message.NormalizedText(botApi)
+	logger.Printf("Message: `%s`\n", msg)
+	ev := botApi.NewEvent(message.Conversation.ID, msg)
+	// outgoing webhook has no bot token, only file uploads and public URLs can be downloaded
+	ev.Attachments = message.EventAttachments(nil)
+	if message.Value.Callback != "" {
+		ev.CallbackID, ev.CallbackValue = DecodeCallback(message.Value.Callback)
+	}
+	ev.Raw = message
+	go tp.bot.processChannelEvent(botApi, ev)
+
+	// reply has to be written by this handler, poll for it until deadline
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer ticker.Stop()
+	deadline := time.After(sleepMax * time.Second)
+	for {
+		select {
+		case <-ticker.C:
+			if body, ok := TeamsMessageQueue.Get(teams_api.GUID); ok {
+				w.Write([]byte(body[0]))
+				TeamsMessageQueue.Delete(teams_api.GUID)
+				return
 			}
+		case <-deadline:
+			logger.Println("No reply in time, deleting message")
+			TeamsMessageQueue.Delete(teams_api.GUID)
+			return
 		}
-		ticker.Stop()
-		logger.Println("Ticker stopped, deleting message")
-		TeamsMessageQueue.Delete(teams_api.GUID)
-	})
-	logger.Printf("Starting Teams API listener on %s\n", torpedo_registry.Config.GetConfig()["teamsincomingaddr"])
-	if err := http.ListenAndServe(torpedo_registry.Config.GetConfig()["teamsincomingaddr"], nil); err != nil {
-		logger.Fatal(err)
 	}
-	tb.Stats.ConnectedAccounts -= 1
+}
+
+func (tp *TeamsProtocol) Receive() error {
+	return tp.webhook.Serve()
+}
+
+// Ready - webhook server is listening
+func (tp *TeamsProtocol) Ready() <-chan struct{} {
+	return tp.webhook.Ready()
+}
+
+func (tp *TeamsProtocol) Close() error {
+	if tp.webhook == nil {
+		return nil
+	}
+	return tp.webhook.Close()
 }
@@ -5,12 +5,14 @@ import (
 	"time"
 
 	"flag"
-	"regexp"
+	"strconv"
+	"strings"
 
 	common "github.com/tb0hdan/torpedo_common"
 
 	"fmt"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/tb0hdan/torpedo_registry"
 	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
@@ -26,22 +28,158 @@ func ToTelegramAttachment(rm torpedo_registry.RichMessage, channel int64) (msg t
 	return
 }
 
-func HandleTelegramMessage(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) {
-	switch api := tba.API.(type) {
-	case *tgbotapi.BotAPI:
-		var msg tgbotapi.Chattable
-		var tmp string
-		if len(richmsgs) > 0 && !richmsgs[0].IsEmpty() {
-			msg, tmp = ToTelegramAttachment(richmsgs[0], channel.(int64))
-			api.Send(tgbotapi.NewMessage(channel.(int64), richmsgs[0].Text))
-		} else {
-			msg = tgbotapi.NewMessage(channel.(int64), message)
+type TelegramProtocol struct {
+	bot     *TorpedoBot
+	account *torpedo_registry.Account
+	api     *tgbotapi.BotAPI
+	logger  *log.Logger
+}
+
+func (tb *TorpedoBot) NewTelegramProtocol() Protocol {
+	return &TelegramProtocol{bot: tb}
+}
+
+func (tp *TelegramProtocol) Capabilities() Capabilities {
+	return Capabilities{Images: true, Replies: true, Edits: true, Deletes: true, Cards: true}
+}
+
+// ChannelType - group chat IDs are negative
+func (tp *TelegramProtocol) ChannelType(channel interface{}) string {
+	if id, ok := channel.(int64); ok && id < 0 {
+		return "group"
+	}
+	return "direct"
+}
+
+// ParseChannel - chat IDs are integers
+func (tp *TelegramProtocol) ParseChannel(name string) (interface{}, error) {
+	return strconv.ParseInt(name, 10, 64)
+}
+
+// DirectChannel - private chat ID is user ID
+func (tp *TelegramProtocol) DirectChannel(user_id string) (interface{}, error) {
+	return strconv.ParseInt(user_id, 10, 64)
+}
+
+func (tp *TelegramProtocol) Send(channel interface{}, message string, tba *TorpedoBotAPI, richmsgs []torpedo_registry.RichMessage) (err error) {
+	_, err = tp.SendMessage(&Message{Channel: channel, Text: message, RichMessages: richmsgs}, tba)
+	return
+}
+
+// SendMessage - there are no threads, messages in thread reply to its first message. Reactions are not supported
+func (tp *TelegramProtocol) SendMessage(msg *Message, tba *TorpedoBotAPI) (id string, err error) {
+	chat, ok := msg.Channel.(int64)
+	if !ok {
+		err = fmt.Errorf("Telegram chat ID should be int64, got %T", msg.Channel)
+		return
+	}
+	if msg.Reaction != "" {
+		err = ErrNotSupported
+		return
+	}
+	// message that is deleted, edited or replied to
+	target := msg.ReplyTo
+	if target == "" {
+		target = msg.ThreadID
+	}
+	switch {
+	case msg.Delete != "":
+		target = msg.Delete
+	case msg.Edit != "":
+		target = msg.Edit
+	}
+	target_id := 0
+	if target != "" {
+		if target_id, err = strconv.Atoi(target); err != nil {
+			err = fmt.Errorf("invalid telegram message ID `%s`", target)
+			return
 		}
-		api.Send(msg)
+	}
+	switch {
+	case msg.Delete != "":
+		_, err = tp.api.DeleteMessage(tgbotapi.DeleteMessageConfig{ChatID: chat, MessageID: target_id})
+		return msg.Delete, err
+	case msg.Edit != "":
+		_, err = tp.api.Send(tgbotapi.NewEditMessageText(chat, target_id, msg.Text))
+		return msg.Edit, err
+	}
+
+	if err = validateTelegramCards(msg.Cards); err != nil {
+		return
+	}
+	text := msg.Text
+	var photo tgbotapi.Chattable
+	if len(msg.RichMessages) > 0 && !msg.RichMessages[0].IsEmpty() {
+		var tmp string
+		photo, tmp = ToTelegramAttachment(msg.RichMessages[0], chat)
 		if tmp != "" {
-			os.Remove(tmp)
+			defer os.Remove(tmp)
+		}
+		text = msg.RichMessages[0].Text
+	}
+	var sent tgbotapi.Message
+	if text != "" || (photo == nil && len(msg.Cards) == 0) {
+		config := tgbotapi.NewMessage(chat, text)
+		config.ReplyToMessageID = target_id
+		if sent, err = tp.api.Send(config); err != nil {
+			return
+		}
+	}
+	if photo != nil {
+		if sent, err = tp.api.Send(photo); err != nil {
+			return
+		}
+	}
+	for _, card := range msg.Cards {
+		if sent, err = tp.sendCard(chat, card); err != nil {
+			return
+		}
+	}
+	id = strconv.Itoa(sent.MessageID)
+	return
+}
+
+// validateTelegramCards - callback data of buttons fits Telegram limit, checked before anything is sent
+func validateTelegramCards(cards []Card) error {
+	for _, card := range cards {
+		for _, button := range card.Buttons {
+			if data := EncodeCallback(button); button.URL == "" && len(data) > MaxTelegramCallbackData {
+				return fmt.Errorf("Button `%s` callback data is %d bytes, Telegram allows %d", button.Label, len(data), MaxTelegramCallbackData)
+			}
 		}
 	}
+	return nil
+}
+
+// sendCard - images are sent by URL, followed by text with inline keyboard, one button per row
+func (tp *TelegramProtocol) sendCard(chat int64, card Card) (sent tgbotapi.Message, err error) {
+	for _, image := range card.AllImages() {
+		if sent, err = tp.api.Send(tgbotapi.NewPhotoShare(chat, image)); err != nil {
+			return
+		}
+	}
+	text := card.Summary()
+	if text == "" && len(card.Buttons) == 0 {
+		return
+	}
+	config := tgbotapi.NewMessage(chat, text)
+	if len(card.Buttons) > 0 {
+		rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(card.Buttons))
+		for _, button := range card.Buttons {
+			if button.URL != "" {
+				rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL(button.Label, button.URL)))
+			} else {
+				rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(button.Label, EncodeCallback(button))))
+			}
+		}
+		config.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+		if config.Text == "" {
+			// keyboard can't be sent without text
+			config.Text = "Choose:"
+		}
+	}
+	sent, err = tp.api.Send(config)
+	return
 }
 
 func (tb *TorpedoBot) ConfigureTelegramBot(cfg *torpedo_registry.ConfigStruct) {
@@ -55,69 +193,184 @@ func (tb *TorpedoBot) ParseTelegramBot(cfg *torpedo_registry.ConfigStruct) {
 	}
 }
 
-func (tb *TorpedoBot) RunTelegramBot(apiKey, cmd_prefix string) {
-	account := &torpedo_registry.Account{
-		APIKey:        apiKey,
-		CommandPrefix: cmd_prefix,
-	}
-	torpedo_registry.Accounts.AppendAccounts(account)
-	tb.RunTelegramBotAccount(account)
-}
-
-func (tb *TorpedoBot) RunTelegramBotAccount(account *torpedo_registry.Account) {
-	tb.Stats.ConnectedAccounts += 1
+func (tp *TelegramProtocol) Connect(account *torpedo_registry.Account) (err error) {
+	tp.account = account
 
 	cu := &common.Utils{}
 
-	logger := cu.NewLog("telegram-bot")
+	tp.logger = cu.NewLog("telegram-bot")
 
-	api, err := tgbotapi.NewBotAPI(account.APIKey)
+	tp.api, err = tgbotapi.NewBotAPI(account.APIKey)
 	if err != nil {
-		logger.Panic(err)
+		return
 	}
 
 	if torpedo_registry.Config.GetConfig()["debug"] == "yes" {
 
-		api.Debug = true
+		tp.api.Debug = true
 	}
 
-	logger.Printf("Authorized on account %s", api.Self.UserName)
-	account.Connection.ReconnectCount += 1
-	account.API = api
+	tp.logger.Printf("Authorized on account %s", tp.api.Self.UserName)
+	account.API = tp.api
+	return
+}
 
+func (tp *TelegramProtocol) Close() error {
+	if tp.api != nil {
+		tp.api.StopReceivingUpdates()
+	}
+	return nil
+}
+
+func (tp *TelegramProtocol) Receive() (err error) {
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 
-	updates, err := api.GetUpdatesChan(u)
-
-	tb.RegisteredProtocols["*tgbotapi.BotAPI"] = HandleTelegramMessage
+	updates, err := tp.api.GetUpdatesChan(u)
+	if err != nil {
+		return
+	}
 
-	for update := range updates {
-		if update.Message == nil {
+	ctx := tp.bot.accountContext(tp.account)
+	for {
+		var update tgbotapi.Update
+		select {
+		case <-ctx.Done():
+			return
+		case update = <-updates:
+		}
+		if update.CallbackQuery != nil {
+			tp.processCallbackQuery(update.CallbackQuery)
+			continue
+		}
+		msg, edited := update.Message, false
+		if msg == nil && update.EditedMessage != nil {
+			msg, edited = update.EditedMessage, true
+		}
+		if msg == nil {
 			continue
 		}
 
-		jitter := int64(time.Now().Unix()) - int64(update.Message.Date)
+		date := msg.Date
+		if edited {
+			date = msg.EditDate
+		}
+		jitter := int64(time.Now().Unix()) - int64(date)
 
 		if jitter > 10 {
 			continue
 		}
 
-		// handle multible bot presence
-		r := regexp.MustCompile(`(?i)@(.+)bot`)
-		message := r.ReplaceAllString(update.Message.Text, "")
+		// media messages have caption instead of text
+		text := msg.Text
+		if text == "" {
+			text = msg.Caption
+		}
+		message, mine := tp.normalizeMessage(text)
+		if !mine {
+			continue
+		}
 
-		logger.Printf("[%s] %s\n", update.Message.From.UserName, message)
+		tp.logger.Printf("[%s] %s\n", msg.From.UserName, message)
 
-		botApi := &TorpedoBotAPI{}
-		botApi.API = api
-		botApi.Bot = tb
-		botApi.CommandPrefix = account.CommandPrefix
-		botApi.UserProfile = &torpedo_registry.UserProfile{ID: fmt.Sprintf("%v", update.Message.From.ID), Nick: update.Message.From.UserName}
-		botApi.Me = "torpedobot"
+		botApi := tp.bot.NewBotAPI(tp, tp.api, tp.account)
+		botApi.UserProfile = &torpedo_registry.UserProfile{ID: fmt.Sprintf("%v", msg.From.ID), Nick: msg.From.UserName}
+		botApi.Me = fmt.Sprintf("%v", tp.api.Self.ID)
+		message, botApi.Mentioned = StripMention(message, tp.api.Self.UserName)
+		botApi.Direct = msg.Chat.IsPrivate()
+		botApi.MessageID = fmt.Sprintf("%v", msg.MessageID)
 
-		go tb.processChannelEvent(botApi, update.Message.Chat.ID, message)
+		ev := botApi.NewEvent(msg.Chat.ID, message)
+		if msg.Chat.IsChannel() {
+			ev.Channel.Kind = ChannelPublic
+		}
+		ev.Timestamp = time.Unix(int64(date), 0)
+		ev.Edited = edited
+		ev.Attachments = tp.attachments(msg)
+		ev.Raw = msg
+		if msg.ReplyToMessage != nil {
+			ev.ReplyTo = fmt.Sprintf("%v", msg.ReplyToMessage.MessageID)
+		}
+		go tp.bot.processChannelEvent(botApi, ev)
+
+	}
+}
 
+// processCallbackQuery - inline keyboard button press, answered right away to stop button progress indicator
+func (tp *TelegramProtocol) processCallbackQuery(query *tgbotapi.CallbackQuery) {
+	if _, err := tp.api.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "")); err != nil {
+		tp.logger.Printf("Could not answer callback query: %+v\n", err)
+	}
+	if query.Message == nil || query.From == nil {
+		return
+	}
+	botApi := tp.bot.NewBotAPI(tp, tp.api, tp.account)
+	botApi.UserProfile = &torpedo_registry.UserProfile{ID: fmt.Sprintf("%v", query.From.ID), Nick: query.From.UserName}
+	botApi.Me = fmt.Sprintf("%v", tp.api.Self.ID)
+	botApi.Direct = query.Message.Chat.IsPrivate()
+	botApi.MessageID = fmt.Sprintf("%v", query.Message.MessageID)
+	ev := botApi.NewEvent(query.Message.Chat.ID, "")
+	ev.CallbackID, ev.CallbackValue = DecodeCallback(query.Data)
+	ev.Raw = query
+	go tp.bot.processChannelEvent(botApi, ev)
+}
+
+// attachments - files are referenced by file_id and downloaded through Bot API, largest photo size is used
+func (tp *TelegramProtocol) attachments(msg *tgbotapi.Message) (attachments []Attachment) {
+	if msg.Photo != nil && len(*msg.Photo) > 0 {
+		photo := (*msg.Photo)[len(*msg.Photo)-1]
+		attachments = append(attachments, Attachment{Kind: AttachmentImage, ID: photo.FileID, MimeType: "image/jpeg", Size: photo.FileSize})
+	}
+	if msg.Document != nil {
+		attachments = append(attachments, Attachment{Kind: MimeAttachmentKind(msg.Document.MimeType), ID: msg.Document.FileID,
+			Name: msg.Document.FileName, MimeType: msg.Document.MimeType, Size: msg.Document.FileSize})
+	}
+	if msg.Sticker != nil {
+		attachments = append(attachments, Attachment{Kind: AttachmentSticker, ID: msg.Sticker.FileID,
+			Name: msg.Sticker.Emoji, MimeType: "image/webp", Size: msg.Sticker.FileSize})
+	}
+	if msg.Audio != nil {
+		attachments = append(attachments, Attachment{Kind: AttachmentAudio, ID: msg.Audio.FileID,
+			Name: msg.Audio.Title, MimeType: msg.Audio.MimeType, Size: msg.Audio.FileSize})
 	}
-	tb.Stats.ConnectedAccounts -= 1
+	if msg.Voice != nil {
+		attachments = append(attachments, Attachment{Kind: AttachmentAudio, ID: msg.Voice.FileID, MimeType: msg.Voice.MimeType, Size: msg.Voice.FileSize})
+	}
+	if msg.Video != nil {
+		attachments = append(attachments, Attachment{Kind: AttachmentVideo, ID: msg.Video.FileID, MimeType: msg.Video.MimeType, Size: msg.Video.FileSize})
+	}
+	for idx := range attachments {
+		file_id, size := attachments[idx].ID, attachments[idx].Size
+		attachments[idx].SetDownload(func() (fname string, err error) {
+			// file size is sent with message, don't ask for URL of file that is too large
+			if int64(size) > maxAttachmentBytes() {
+				return "", ErrAttachmentTooLarge
+			}
+			url, err := tp.api.GetFileDirectURL(file_id)
+			if err != nil {
+				return
+			}
+			return downloadURL(url, nil)()
+		})
+	}
+	return
+}
+
+// normalizeMessage - strip bot username from `/command@username`, commands addressed to other bots in group are not mine
+func (tp *TelegramProtocol) normalizeMessage(text string) (message string, mine bool) {
+	message, mine = text, true
+	fields := strings.SplitN(text, " ", 2)
+	idx := strings.Index(fields[0], "@")
+	if !strings.HasPrefix(fields[0], "/") || idx == -1 {
+		return
+	}
+	if !strings.EqualFold(fields[0][idx+1:], tp.api.Self.UserName) {
+		mine = false
+		return
+	}
+	message = fields[0][:idx]
+	if len(fields) > 1 {
+		message += " " + fields[1]
+	}
+	return
 }
@@ -7,6 +7,7 @@ import (
 
 	"fmt"
 
+	"github.com/prometheus/client_golang/prometheus"
 	common "github.com/tb0hdan/torpedo_common"
 	"github.com/tb0hdan/torpedo_registry"
 )
@@ -31,6 +32,8 @@ func (tb *TorpedoBot) ParseTRPE(cfg *torpedo_registry.ConfigStruct) {
 }
 
 func (tb *TorpedoBot) processViaTRPE(channel interface{}, incoming_message, command_prefix, host string) (err error, result string) {
+	timer := prometheus.NewTimer(TRPEDuration)
+	defer timer.ObserveDuration()
 	cu := common.Utils{}
 	response := &TRPEResponse{}
 	err = cu.PostURLFormUnmarshal(host, url.Values{"channel": {fmt.Sprintf("%+v", channel)},
@@ -39,6 +42,7 @@ func (tb *TorpedoBot) processViaTRPE(channel interface{}, incoming_message, comm
 	},
 		response)
 	if err != nil {
+		TRPEErrors.Inc()
 		return
 	}
 	if response.Status == "ok" && response.Message != "" {
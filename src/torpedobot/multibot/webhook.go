@@ -0,0 +1,248 @@
+package multibot
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	common "github.com/tb0hdan/torpedo_common"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+var (
+	WebhookAddr    *string
+	WebhookTLSCert *string
+	WebhookTLSKey  *string
+	WebhookTimeout *int
+)
+
+// WebhookServer - HTTP server shared by webhook based protocols (Skype, Kik, Line, Teams, Facebook)
+type WebhookServer struct {
+	Addr    string
+	bot     *TorpedoBot
+	server  *http.Server
+	routes  map[string]http.Handler
+	lock    sync.RWMutex
+	started bool
+	failed  chan struct{}
+	err     error
+}
+
+// WebhookEndpoint - routes registered by single account on webhook server
+type WebhookEndpoint struct {
+	server *WebhookServer
+	paths  []string
+	done   chan struct{}
+	once   sync.Once
+	ready  chan struct{}
+}
+
+func (tb *TorpedoBot) ConfigureWebhook(cfg *torpedo_registry.ConfigStruct) {
+	WebhookAddr = flag.String("webhook_addr", "0.0.0.0:3978", "Listen on this address for incoming webhook messages (Skype, Kik, Line, Teams, Facebook)")
+	WebhookTLSCert = flag.String("webhook_tls_cert", "", "TLS certificate file for webhook server (plain HTTP if unset)")
+	WebhookTLSKey = flag.String("webhook_tls_key", "", "TLS key file for webhook server")
+	WebhookTimeout = flag.Int("webhook_timeout", 30, "Webhook server request read/write timeout, seconds")
+}
+
+func (tb *TorpedoBot) ParseWebhook(cfg *torpedo_registry.ConfigStruct) {
+	cfg.SetConfig("webhookaddr", *WebhookAddr)
+	if env_addr := common.GetStripEnv("WEBHOOK_ADDR"); env_addr != "" {
+		cfg.SetConfig("webhookaddr", env_addr)
+	}
+	cfg.SetConfig("webhooktlscert", *WebhookTLSCert)
+	cfg.SetConfig("webhooktlskey", *WebhookTLSKey)
+	cfg.SetConfig("webhooktimeout", fmt.Sprintf("%d", *WebhookTimeout))
+}
+
+// GetWebhookServer - get (or create) webhook server listening on addr, empty addr means shared one
+func (tb *TorpedoBot) GetWebhookServer(addr string) (ws *WebhookServer) {
+	if addr == "" {
+		addr = torpedo_registry.Config.GetConfig()["webhookaddr"]
+	}
+	tb.webhooksLock.Lock()
+	defer tb.webhooksLock.Unlock()
+	ws, ok := tb.webhooks[addr]
+	if !ok {
+		ws = &WebhookServer{Addr: addr, bot: tb, routes: make(map[string]http.Handler)}
+		tb.webhooks[addr] = ws
+	}
+	return
+}
+
+// NewWebhookEndpoint - endpoint for single account, addr is protocol specific override (may be empty)
+func (tb *TorpedoBot) NewWebhookEndpoint(addr string) *WebhookEndpoint {
+	return &WebhookEndpoint{server: tb.GetWebhookServer(addr), done: make(chan struct{}), ready: make(chan struct{})}
+}
+
+func (ws *WebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws.lock.RLock()
+	handler, ok := ws.routes[r.URL.Path]
+	ws.lock.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// Handle - add route, replacing existing one (accounts re-register routes on reconnect)
+func (ws *WebhookServer) Handle(path string, handler http.Handler) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	ws.routes[path] = handler
+}
+
+// HandleIfFree - add route unless it's already taken
+func (ws *WebhookServer) HandleIfFree(path string, handler http.Handler) (ok bool) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if _, taken := ws.routes[path]; taken {
+		return
+	}
+	ws.routes[path] = handler
+	ok = true
+	return
+}
+
+func (ws *WebhookServer) Remove(path string) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	delete(ws.routes, path)
+}
+
+// Start - start listening (once), returns channel that is closed if server fails.
+// Address is bound when Start returns
+func (ws *WebhookServer) Start() (failed chan struct{}) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	if ws.started {
+		return ws.failed
+	}
+	cfg := torpedo_registry.Config.GetConfig()
+	timeout := 30 * time.Second
+	if parsed, err := time.ParseDuration(cfg["webhooktimeout"] + "s"); err == nil && parsed > 0 {
+		timeout = parsed
+	}
+	ws.failed = make(chan struct{})
+	listener, err := net.Listen("tcp", ws.Addr)
+	if err != nil {
+		ws.err = err
+		close(ws.failed)
+		return ws.failed
+	}
+	ws.started = true
+	ws.err = nil
+	ws.server = &http.Server{Addr: ws.Addr,
+		Handler:      ws,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		IdleTimeout:  2 * timeout,
+	}
+	go func(server *http.Server, listener net.Listener, failed chan struct{}) {
+		var err error
+		if cfg["webhooktlscert"] != "" && cfg["webhooktlskey"] != "" {
+			ws.bot.logger.Printf("Starting webhook server on https://%s\n", ws.Addr)
+			err = server.ServeTLS(listener, cfg["webhooktlscert"], cfg["webhooktlskey"])
+		} else {
+			ws.bot.logger.Printf("Starting webhook server on http://%s\n", ws.Addr)
+			err = server.Serve(listener)
+		}
+		if err == http.ErrServerClosed {
+			return
+		}
+		ws.lock.Lock()
+		ws.err = err
+		ws.started = false
+		ws.lock.Unlock()
+		close(failed)
+	}(ws.server, listener, ws.failed)
+	return ws.failed
+}
+
+func (ws *WebhookServer) Err() error {
+	ws.lock.RLock()
+	defer ws.lock.RUnlock()
+	return ws.err
+}
+
+// Shutdown - stop server, waiting for in-flight requests
+func (ws *WebhookServer) Shutdown() {
+	ws.lock.Lock()
+	server := ws.server
+	started := ws.started
+	ws.started = false
+	ws.lock.Unlock()
+	if !started {
+		return
+	}
+	ctx, cancel := ws.bot.shutdownContext()
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		ws.bot.logger.Printf("Webhook server %s shutdown failed: %+v\n", ws.Addr, err)
+	}
+}
+
+func (tb *TorpedoBot) stopWebhookServers() {
+	tb.webhooksLock.Lock()
+	defer tb.webhooksLock.Unlock()
+	for _, ws := range tb.webhooks {
+		ws.Shutdown()
+	}
+}
+
+// Handle - add account route
+func (we *WebhookEndpoint) Handle(path string, handler http.Handler) {
+	we.server.Handle(path, handler)
+	we.paths = append(we.paths, path)
+}
+
+// HandleLegacy - add pre-multiaccount route, only first account gets it
+func (we *WebhookEndpoint) HandleLegacy(path string, handler http.Handler) {
+	if we.server.HandleIfFree(path, handler) {
+		we.paths = append(we.paths, path)
+	}
+}
+
+// Serve - make sure server is running and block until endpoint is closed or server fails
+func (we *WebhookEndpoint) Serve() (err error) {
+	failed := we.server.Start()
+	select {
+	case <-failed:
+		return we.server.Err()
+	default:
+	}
+	for _, path := range we.paths {
+		we.server.bot.logger.Printf("Serving webhook on %s%s\n", we.server.Addr, path)
+	}
+	close(we.ready)
+	select {
+	case <-failed:
+		err = we.server.Err()
+	case <-we.done:
+	}
+	return
+}
+
+// Ready - closed once server is listening for endpoint routes
+func (we *WebhookEndpoint) Ready() <-chan struct{} {
+	return we.ready
+}
+
+// Close - remove account routes, server keeps running for other accounts
+func (we *WebhookEndpoint) Close() error {
+	we.once.Do(func() {
+		for _, path := range we.paths {
+			we.server.Remove(path)
+		}
+		close(we.done)
+	})
+	return nil
+}
+
+// WebhookAccountID - short, non-secret account identifier for use in webhook path
+func WebhookAccountID(account *torpedo_registry.Account) string {
+	return common.MD5Hash(account.APIKey)[:8]
+}
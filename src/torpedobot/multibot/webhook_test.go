@@ -0,0 +1,58 @@
+package multibot_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"torpedobot/multibot"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tb0hdan/torpedo_registry"
+)
+
+func teamsRequest(server *multibot.WebhookServer, path, conversation, text string) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"type": "message", "text": %q, "from": {"id": "U91", "name": "alice"},
+		"conversation": {"id": %q}, "recipient": {"name": "torpedobot"}}`, text, conversation)
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return recorder
+}
+
+func TestWebhookAccounts(t *testing.T) {
+	bot := multibot.New()
+	torpedo_registry.Config.SetConfig("teamsincomingaddr", "127.0.0.1:0")
+	bot.RegisterProtocol("teams", bot.NewTeamsProtocol)
+	first := &torpedo_registry.Account{APIKey: "teams-secret-1", CommandPrefix: "!"}
+	second := &torpedo_registry.Account{APIKey: "teams-secret-2", CommandPrefix: "!"}
+	for _, account := range []*torpedo_registry.Account{first, second} {
+		ba := bot.AddAccount("teams", account)
+		defer bot.RemoveAccount(ba.ID)
+		bot.StartAccount("teams", account)
+	}
+	deadline := time.Now().Add(replyTimeout)
+	for testutil.ToFloat64(multibot.AccountsConnected.WithLabelValues("teams")) < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if connected := testutil.ToFloat64(multibot.AccountsConnected.WithLabelValues("teams")); connected != 2 {
+		t.Fatalf("expected 2 connected accounts, got %v", connected)
+	}
+
+	// both accounts are served by one server, each on its own path
+	server := bot.GetWebhookServer("127.0.0.1:0")
+	for idx, account := range []*torpedo_registry.Account{first, second} {
+		path := fmt.Sprintf("/teams/%s/api/messages", multibot.WebhookAccountID(account))
+		recorder := teamsRequest(server, path, fmt.Sprintf("webhook-%d", idx), "!echo hi")
+		reply := &multibot.SkypeOutgoingMessage{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), reply); err != nil || reply.Text != "alice said: !echo hi" {
+			t.Errorf("%s: unexpected reply %q, %+v", path, recorder.Body.String(), err)
+		}
+	}
+	if recorder := teamsRequest(server, "/teams/unknown/api/messages", "webhook-x", "!echo hi"); recorder.Code != http.StatusNotFound {
+		t.Errorf("unknown account path: got %d", recorder.Code)
+	}
+}